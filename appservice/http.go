@@ -216,6 +216,7 @@ func (as *AppService) handleEvents(ctx context.Context, evts []*event.Event, def
 	log := zerolog.Ctx(ctx)
 	for _, evt := range evts {
 		evt.Mautrix.ReceivedAt = time.Now()
+		evt.Mautrix.Context = ctx
 		if defaultTypeClass != event.UnknownEventType {
 			evt.Type.Class = defaultTypeClass
 		} else if evt.StateKey != nil {
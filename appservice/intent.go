@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync/atomic"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
@@ -24,6 +25,9 @@ type IntentAPI struct {
 	UserID    id.UserID
 
 	IsCustomPuppet bool
+
+	// registered caches the result of EnsureRegistered, so that the state store isn't queried on every request.
+	registered atomic.Bool
 }
 
 func (as *AppService) NewIntentAPI(localpart string) *IntentAPI {
@@ -53,7 +57,10 @@ func (intent *IntentAPI) Register() error {
 }
 
 func (intent *IntentAPI) EnsureRegistered() error {
-	if intent.IsCustomPuppet || intent.as.StateStore.IsRegistered(intent.UserID) {
+	if intent.IsCustomPuppet || intent.registered.Load() {
+		return nil
+	} else if intent.as.StateStore.IsRegistered(intent.UserID) {
+		intent.registered.Store(true)
 		return nil
 	}
 
@@ -62,6 +69,7 @@ func (intent *IntentAPI) EnsureRegistered() error {
 		return fmt.Errorf("failed to ensure registered: %w", err)
 	}
 	intent.as.StateStore.MarkRegistered(intent.UserID)
+	intent.registered.Store(true)
 	return nil
 }
 
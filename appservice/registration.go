@@ -98,3 +98,15 @@ func (nsl *NamespaceList) Register(regex *regexp.Regexp, exclusive bool) {
 		*nsl = append(*nsl, ns)
 	}
 }
+
+// MatchString returns true if the given string matches any of the regexes in the namespace list.
+// Invalid regexes are ignored.
+func (nsl NamespaceList) MatchString(str string) bool {
+	for _, ns := range nsl {
+		regex, err := regexp.Compile(ns.Regex)
+		if err == nil && regex.MatchString(str) {
+			return true
+		}
+	}
+	return false
+}
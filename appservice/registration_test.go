@@ -0,0 +1,25 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespaceList_MatchString(t *testing.T) {
+	var nsl NamespaceList
+	nsl.Register(regexp.MustCompile(`^@bot:example\.com$`), true)
+	nsl.Register(regexp.MustCompile(`^@remote_.*:example\.com$`), true)
+	nsl = append(nsl, Namespace{Regex: `[invalid`})
+	assert.True(t, nsl.MatchString("@bot:example.com"))
+	assert.True(t, nsl.MatchString("@remote_1234:example.com"))
+	assert.False(t, nsl.MatchString("@other_1234:example.com"))
+	assert.False(t, nsl.MatchString("@remote_1234:example.org"))
+}
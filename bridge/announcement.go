@@ -0,0 +1,124 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/event"
+)
+
+// AnnouncementOnlyLevel is the events_default power level used for rooms where only admins can send messages.
+const AnnouncementOnlyLevel = 50
+
+var errAnnouncementOnly = errors.New("only admins can send messages in this chat")
+
+// AnnouncementOnlyPortal is an optional interface for portals whose remote chat can be restricted
+// so that only admins can send messages.
+type AnnouncementOnlyPortal interface {
+	Portal
+	// IsAnnouncementOnly returns true if only admins are allowed to send messages in the remote chat.
+	IsAnnouncementOnly() bool
+	// IsRemoteAdmin returns true if the given user is allowed to send messages even if the chat is announcement-only.
+	IsRemoteAdmin(user User) bool
+	// HandleMatrixAnnouncementOnly is called when a Matrix user changes events_default in the room power levels
+	// so that the room switches between announcement-only and normal mode.
+	HandleMatrixAnnouncementOnly(sender User, announcementOnly bool) error
+}
+
+// ApplyAnnouncementOnly updates events_default in the given power levels to match the remote announcement-only setting.
+// It returns true if the power levels were changed.
+func ApplyAnnouncementOnly(levels *event.PowerLevelsEventContent, announcementOnly bool) bool {
+	isAnnouncementOnly := levels.EventsDefault >= AnnouncementOnlyLevel
+	if isAnnouncementOnly == announcementOnly {
+		return false
+	} else if announcementOnly {
+		levels.EventsDefault = AnnouncementOnlyLevel
+	} else {
+		levels.EventsDefault = 0
+	}
+	return true
+}
+
+func (mx *MatrixHandler) HandlePowerLevels(evt *event.Event) {
+	defer mx.TrackEventDuration(evt.Type)()
+	if mx.shouldIgnoreEvent(evt) {
+		return
+	}
+	portal, ok := mx.bridge.Child.GetIPortal(evt.RoomID).(AnnouncementOnlyPortal)
+	if !ok {
+		return
+	}
+	user := mx.bridge.Child.GetIUser(evt.Sender, true)
+	if user == nil {
+		return
+	}
+	levels := evt.Content.AsPowerLevels()
+	announcementOnly := levels.EventsDefault >= AnnouncementOnlyLevel
+	if announcementOnly == portal.IsAnnouncementOnly() {
+		return
+	}
+	log := mx.log.With().
+		Str("room_id", evt.RoomID.String()).
+		Str("sender", evt.Sender.String()).
+		Bool("announcement_only", announcementOnly).
+		Logger()
+	err := portal.HandleMatrixAnnouncementOnly(user, announcementOnly)
+	if err != nil {
+		log.Err(err).Msg("Failed to bridge announcement-only change")
+		_, err = mx.sendNoticeWithMarkdown(evt.RoomID, fmt.Sprintf("⚠ Failed to change who can send messages: %v", err))
+		if err != nil {
+			log.Err(err).Msg("Failed to send announcement-only error notice")
+		}
+	} else {
+		log.Debug().Msg("Bridged announcement-only change")
+	}
+}
+
+func (mx *MatrixHandler) checkAnnouncementOnly(user User, portal Portal) error {
+	aoPortal, ok := portal.(AnnouncementOnlyPortal)
+	if ok && aoPortal.IsAnnouncementOnly() && !aoPortal.IsRemoteAdmin(user) {
+		return errAnnouncementOnly
+	}
+	return nil
+}
+
+// sendMessageRejection sends a permanent failure status for a Matrix event that the bridge refused to handle.
+func (mx *MatrixHandler) sendMessageRejection(ctx context.Context, evt *event.Event, err error, reason event.MessageStatusReason) {
+	mx.bridge.SendMessageErrorCheckpoint(evt, status.MsgStepRemote, err, true, 0)
+
+	if mx.bridge.Config.Bridge.EnableMessageStatusEvents() {
+		statusEvent := &event.BeeperMessageStatusEventContent{
+			RelatesTo: event.RelatesTo{
+				Type:    event.RelReference,
+				EventID: evt.ID,
+			},
+			Status:  event.MessageStatusFail,
+			Reason:  reason,
+			Error:   err.Error(),
+			Message: err.Error(),
+		}
+		_, sendErr := mx.bridge.Bot.SendMessageEvent(evt.RoomID, event.BeeperMessageStatus, statusEvent)
+		if sendErr != nil {
+			zerolog.Ctx(ctx).Error().Err(sendErr).Msg("Failed to send message status event")
+		}
+	}
+	if mx.bridge.Config.Bridge.EnableMessageErrorNotices() {
+		_, sendErr := mx.bridge.Bot.SendMessageEvent(evt.RoomID, event.EventMessage, &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    fmt.Sprintf("⚠ Your message was not bridged: %v.", err),
+		})
+		if sendErr != nil {
+			zerolog.Ctx(ctx).Error().Err(sendErr).Msg("Failed to send message rejection notice")
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// ArchivedChatImportingUser is an optional interface for users whose remote account has archived or old chats
+// that should be bridged on first login without cluttering the chat list.
+type ArchivedChatImportingUser interface {
+	User
+	// CreateArchivedPortals creates portal rooms for archived chats and returns their room IDs.
+	// The portals should be flagged as archived so that backfilling them can be done lazily at a low priority.
+	CreateArchivedPortals(ctx context.Context) ([]id.RoomID, error)
+}
+
+// ImportArchivedChats creates portals for the archived chats of the given user, then tags them as
+// low priority and mutes them using the user's double puppet. It's meant to be called by bridges on first login.
+func (br *Bridge) ImportArchivedChats(ctx context.Context, user ArchivedChatImportingUser) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("action", "import archived chats").
+		Str("user_id", user.GetMXID().String()).
+		Logger()
+	roomIDs, err := user.CreateArchivedPortals(ctx)
+	if err != nil {
+		return err
+	}
+	log.Info().Int("chat_count", len(roomIDs)).Msg("Created portals for archived chats")
+	for _, roomID := range roomIDs {
+		err = br.SetPortalTag(user, roomID, RoomTagLowPriority, true, NoTagOrder)
+		if errors.Is(err, ErrNoDoublePuppet) {
+			log.Debug().Msg("User doesn't have double puppeting enabled, not tagging archived chats")
+			return nil
+		} else if err != nil {
+			log.Warn().Err(err).Str("room_id", roomID.String()).Msg("Failed to tag archived chat as low priority")
+		}
+		err = br.SetPortalMuted(user, roomID, true)
+		if err != nil {
+			log.Warn().Err(err).Str("room_id", roomID.String()).Msg("Failed to mute archived chat")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// AsyncMediaTimeout is how long media conversion may take after the placeholder has been sent.
+const AsyncMediaTimeout = 10 * time.Minute
+
+// RemoteEventQueueingPortal is an optional interface for portals that handle remote events in their own event loop.
+//
+// When SendMediaWithPlaceholder replaces a placeholder, the edit is queued with QueueRemoteEventHandler,
+// so that it's sent in order with other remote events, like an edit or deletion of the same message.
+// Portals that don't implement this get the edit sent in a separate goroutine.
+type RemoteEventQueueingPortal interface {
+	Portal
+	// QueueRemoteEventHandler queues the handler to be called in the portal's event loop,
+	// in order with the remote events of the portal.
+	QueueRemoteEventHandler(handler func())
+}
+
+// MediaConverter downloads remote media and uploads it to Matrix, returning the final message content.
+type MediaConverter func(ctx context.Context) (*event.MessageEventContent, error)
+
+type convertedMedia struct {
+	content *event.MessageEventContent
+	err     error
+}
+
+func (br *Bridge) getAsyncMediaThreshold() time.Duration {
+	if amc, ok := br.Config.Bridge.(bridgeconfig.AsyncMediaBridgeConfig); ok {
+		return amc.GetAsyncMediaThreshold()
+	}
+	return 0
+}
+
+// SendMediaWithPlaceholder sends a remote media message without letting slow media downloads stall bridging.
+//
+// If converting the media takes longer than the threshold in the config, the placeholder (e.g. the caption
+// with a note that the attachment is loading) is sent immediately, and it's edited to the real media content
+// once the conversion finishes. If placeholders are disabled or the media is converted quickly enough,
+// the media is sent directly. The returned event ID is the ID of the first event sent.
+//
+// The conversion doesn't use the given context, as it may continue after this returns. Instead, it gets
+// a context that is canceled after AsyncMediaTimeout or when the bridge is stopping.
+func (br *Bridge) SendMediaWithPlaceholder(ctx context.Context, portal Portal, intent *appservice.IntentAPI, roomID id.RoomID, placeholder *event.MessageEventContent, convert MediaConverter) (id.EventID, error) {
+	threshold := br.getAsyncMediaThreshold()
+	if threshold <= 0 {
+		content, err := convert(ctx)
+		if err != nil {
+			return "", err
+		}
+		return br.sendMediaContent(portal, intent, roomID, content)
+	}
+	log := zerolog.Ctx(ctx).With().Logger()
+	convertCtx, cancel := br.withBackgroundCancel(log.WithContext(context.Background()), AsyncMediaTimeout)
+	resultChan := make(chan convertedMedia, 1)
+	go func() {
+		defer cancel()
+		content, err := convert(convertCtx)
+		resultChan <- convertedMedia{content, err}
+	}()
+	timer := time.NewTimer(threshold)
+	defer timer.Stop()
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			return "", result.err
+		}
+		return br.sendMediaContent(portal, intent, roomID, result.content)
+	case <-timer.C:
+	}
+	eventID, err := br.sendMediaContent(portal, intent, roomID, placeholder)
+	if err != nil {
+		cancel()
+		return "", fmt.Errorf("failed to send placeholder: %w", err)
+	}
+	log = log.With().Str("placeholder_event_id", eventID.String()).Logger()
+	log.Debug().Dur("threshold", threshold).Msg("Sent placeholder for slow media")
+	go func() {
+		result := <-resultChan
+		queueRemoteInPortal(portal, func() {
+			br.replacePlaceholder(log, portal, intent, roomID, eventID, result)
+		})
+	}()
+	return eventID, nil
+}
+
+func queueRemoteInPortal(portal Portal, handler func()) {
+	if qp, ok := portal.(RemoteEventQueueingPortal); ok {
+		qp.QueueRemoteEventHandler(handler)
+	} else {
+		handler()
+	}
+}
+
+func (br *Bridge) replacePlaceholder(log zerolog.Logger, portal Portal, intent *appservice.IntentAPI, roomID id.RoomID, eventID id.EventID, result convertedMedia) {
+	content := result.content
+	if result.err != nil {
+		log.Err(result.err).Msg("Failed to convert media after sending placeholder")
+		content = &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    fmt.Sprintf("Failed to bridge media: %v", result.err),
+		}
+	}
+	content.SetEdit(eventID)
+	_, err := br.sendMediaContent(portal, intent, roomID, content)
+	if err != nil {
+		log.Err(err).Msg("Failed to replace placeholder with media")
+	} else {
+		log.Debug().Msg("Replaced placeholder with media")
+	}
+}
+
+func (br *Bridge) sendMediaContent(portal Portal, intent *appservice.IntentAPI, roomID id.RoomID, content *event.MessageEventContent) (id.EventID, error) {
+	resp, err := br.sendPortalEvent(portal, intent, roomID, event.EventMessage, content)
+	if err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
+}
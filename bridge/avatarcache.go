@@ -0,0 +1,60 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// AvatarDownloader downloads an avatar from the remote network.
+type AvatarDownloader func(ctx context.Context) (data []byte, mimeType string, err error)
+
+// ReuploadAvatar uploads an avatar to Matrix, reusing a previous upload if identical data has already been
+// uploaded for any ghost or portal. This avoids uploading the same file many times for common avatars like
+// network defaults or organization logos.
+//
+// If the remote network provides a stable hash or ID for the avatar, it should be passed as remoteHash,
+// which allows skipping the download entirely when the avatar is already cached.
+func (br *Bridge) ReuploadAvatar(ctx context.Context, remoteHash string, download AvatarDownloader) (id.ContentURIString, error) {
+	log := zerolog.Ctx(ctx)
+	var remoteKey string
+	if remoteHash != "" {
+		remoteKey = "remote:" + remoteHash
+		if mxc := br.BridgeStore.GetCachedMedia(remoteKey); mxc != "" {
+			log.Trace().Str("remote_hash", remoteHash).Msg("Found avatar in cache by remote hash")
+			return mxc, nil
+		}
+	}
+	data, mimeType, err := download(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to download avatar: %w", err)
+	}
+	hash := sha256.Sum256(data)
+	contentKey := "sha256:" + hex.EncodeToString(hash[:])
+	mxc := br.BridgeStore.GetCachedMedia(contentKey)
+	if mxc != "" {
+		log.Trace().Str("content_hash", contentKey).Msg("Found avatar in cache by content hash")
+	} else {
+		resp, err := br.Bot.UploadBytes(data, mimeType)
+		if err != nil {
+			return "", fmt.Errorf("failed to upload avatar: %w", err)
+		}
+		mxc = resp.ContentURI.CUString()
+		br.BridgeStore.SetCachedMedia(contentKey, mxc)
+	}
+	if remoteKey != "" {
+		br.BridgeStore.SetCachedMedia(remoteKey, mxc)
+	}
+	return mxc, nil
+}
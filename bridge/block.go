@@ -0,0 +1,95 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// BlockingUser is an optional interface for users who can block other users on the remote network.
+type BlockingUser interface {
+	User
+	// GetBlockedGhosts returns the ghosts of the remote users this user has blocked, from the bridge's
+	// persistent block list.
+	GetBlockedGhosts() []Ghost
+	// SetGhostBlocked blocks or unblocks the remote user on the remote network and updates the block list.
+	SetGhostBlocked(ctx context.Context, ghost Ghost, blocked bool) error
+}
+
+// HandleMatrixIgnoredUsers bridges a m.ignored_user_list account data change by blocking newly ignored ghosts
+// and unblocking ghosts that are no longer ignored. Bridges that sync the account data of double puppets should
+// call this whenever the ignored user list changes.
+func (br *Bridge) HandleMatrixIgnoredUsers(ctx context.Context, user User, content *event.IgnoredUserListEventContent) {
+	bu, ok := user.(BlockingUser)
+	if !ok {
+		return
+	}
+	log := zerolog.Ctx(ctx)
+	blocked := make(map[id.UserID]Ghost)
+	for _, ghost := range bu.GetBlockedGhosts() {
+		blocked[ghost.GetMXID()] = ghost
+	}
+	for userID := range content.IgnoredUsers {
+		if _, alreadyBlocked := blocked[userID]; alreadyBlocked || !br.Child.IsGhost(userID) {
+			continue
+		}
+		ghost := br.Child.GetIGhost(userID)
+		if ghost == nil {
+			continue
+		}
+		if err := bu.SetGhostBlocked(ctx, ghost, true); err != nil {
+			log.Err(err).Str("ghost_user_id", userID.String()).Msg("Failed to block remote user")
+		}
+	}
+	for userID, ghost := range blocked {
+		if _, stillIgnored := content.IgnoredUsers[userID]; stillIgnored {
+			continue
+		}
+		if err := bu.SetGhostBlocked(ctx, ghost, false); err != nil {
+			log.Err(err).Str("ghost_user_id", userID.String()).Msg("Failed to unblock remote user")
+		}
+	}
+}
+
+// HandleRemoteBlock adds or removes a ghost in the user's Matrix ignore list using their double puppet,
+// so that the messages of users blocked on the remote network are hidden on Matrix too.
+// The bridge is expected to have already updated its persistent block list.
+func (br *Bridge) HandleRemoteBlock(user User, ghost Ghost, blocked bool) error {
+	client, err := getCustomClient(user)
+	if err != nil {
+		return err
+	}
+	var content event.IgnoredUserListEventContent
+	err = client.GetAccountData(event.AccountDataIgnoredUserList.Type, &content)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return fmt.Errorf("failed to get ignored user list: %w", err)
+	}
+	if content.IgnoredUsers == nil {
+		content.IgnoredUsers = make(map[id.UserID]event.IgnoredUser)
+	}
+	_, isIgnored := content.IgnoredUsers[ghost.GetMXID()]
+	if isIgnored == blocked {
+		return nil
+	} else if blocked {
+		content.IgnoredUsers[ghost.GetMXID()] = event.IgnoredUser{}
+	} else {
+		delete(content.IgnoredUsers, ghost.GetMXID())
+	}
+	err = client.SetAccountData(event.AccountDataIgnoredUserList.Type, &content)
+	if err != nil {
+		return fmt.Errorf("failed to update ignored user list: %w", err)
+	}
+	return nil
+}
@@ -12,16 +12,19 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
 	"go.mau.fi/zeroconfig"
 	"gopkg.in/yaml.v3"
 
 	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/util"
 	up "maunium.net/go/mautrix/util/configupgrade"
 	"maunium.net/go/mautrix/util/dbutil"
+	"maunium.net/go/mautrix/util/emojimap"
 )
 
 type HomeserverSoftware string
@@ -187,6 +190,23 @@ type EncryptionConfig struct {
 		Milliseconds int64 `yaml:"milliseconds"`
 		Messages     int   `yaml:"messages"`
 	} `yaml:"rotation"`
+
+	// Pruning configures periodic deletion of old sessions from the crypto store.
+	// Interval is in hours and pruning is disabled if it's zero.
+	Pruning struct {
+		Interval         int  `yaml:"interval"`
+		OlmMaxAgeDays    int  `yaml:"olm_max_age_days"`
+		OlmMaxPerDevice  int  `yaml:"olm_max_per_device"`
+		MegolmMaxAgeDays int  `yaml:"megolm_max_age_days"`
+		Vacuum           bool `yaml:"vacuum"`
+	} `yaml:"pruning"`
+
+	// StoreCache configures an in-memory cache in front of the crypto store. Mode is either empty (disabled),
+	// write_through or write_behind. FlushInterval is in milliseconds and only used in write_behind mode.
+	StoreCache struct {
+		Mode          string `yaml:"mode"`
+		FlushInterval int    `yaml:"flush_interval"`
+	} `yaml:"store_cache"`
 }
 
 type ManagementRoomTexts struct {
@@ -196,6 +216,556 @@ type ManagementRoomTexts struct {
 	AdditionalHelp     string `yaml:"additional_help"`
 }
 
+type DoublePuppetConfig struct {
+	ServerMap      map[string]string `yaml:"double_puppet_server_map"`
+	AllowDiscovery bool              `yaml:"double_puppet_allow_discovery"`
+	// SharedSecretMap contains the login shared secrets per homeserver. The special value "appservice"
+	// logs in using the bridge's own as_token, and values prefixed with "as_token:" are used as
+	// appservice tokens directly without logging in.
+	SharedSecretMap map[string]string `yaml:"login_shared_secret_map"`
+}
+
+// DoublePuppetingBridgeConfig is an optional interface for bridge configs that support
+// automatically setting up double puppeting.
+type DoublePuppetingBridgeConfig interface {
+	BridgeConfig
+	GetDoublePuppetConfig() DoublePuppetConfig
+}
+
+// EmojiMappingBridgeConfig is an optional interface for bridge configs that allow overriding
+// how reactions are translated between the remote network and Matrix.
+type EmojiMappingBridgeConfig interface {
+	BridgeConfig
+	GetEmojiConfig() emojimap.Config
+}
+
+type ContentFilterConfig struct {
+	Keywords     []string `yaml:"keywords"`
+	MaxMediaSize int      `yaml:"max_media_size"`
+	BlockedUsers []string `yaml:"blocked_users"`
+}
+
+// ContentFilteringBridgeConfig is an optional interface for bridge configs that
+// enable the built-in content filters.
+type ContentFilteringBridgeConfig interface {
+	BridgeConfig
+	GetContentFilterConfig() ContentFilterConfig
+}
+
+type PrivacyConfig struct {
+	// HashRemoteIDs enables hashing remote identifiers before they're used in ghost user IDs or bridge info.
+	HashRemoteIDs bool `yaml:"hash_remote_ids"`
+	// Salt is the per-bridge secret used when hashing remote identifiers. Changing it will change all hashed IDs.
+	Salt string `yaml:"salt"`
+}
+
+// PrivacyModeBridgeConfig is an optional interface for bridge configs that support hiding remote identifiers.
+type PrivacyModeBridgeConfig interface {
+	BridgeConfig
+	GetPrivacyConfig() PrivacyConfig
+}
+
+type RemoteMediaConfig struct {
+	// ReferenceURLs enables asking the homeserver to fetch media from stable public URLs instead of reuploading it.
+	ReferenceURLs bool `yaml:"reference_urls"`
+	// AllowedHosts is the list of hostnames whose URLs may be referenced. If empty, all hosts are allowed.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+}
+
+// RemoteMediaBridgeConfig is an optional interface for bridge configs that support referencing
+// remote media by URL.
+type RemoteMediaBridgeConfig interface {
+	BridgeConfig
+	GetRemoteMediaConfig() RemoteMediaConfig
+}
+
+// GalleryBridgeConfig is an optional interface for bridge configs that allow sending
+// multiple media parts of one remote message as a single com.beeper.gallery event.
+type GalleryBridgeConfig interface {
+	BridgeConfig
+	EnableGalleries() bool
+}
+
+type QuoteReplyConfig struct {
+	// Disable turns off the quote fallback, which means replies are bridged as normal messages.
+	Disable bool `yaml:"disable"`
+	// Template is the format of the quote. The {sender} and {excerpt} placeholders are replaced
+	// with the name of the replied-to message's sender and the beginning of its text.
+	Template string `yaml:"template"`
+	// MaxLength is the maximum number of characters of the replied-to message to include.
+	MaxLength int `yaml:"max_length"`
+}
+
+// QuoteReplyBridgeConfig is an optional interface for bridge configs that allow changing how
+// replies are bridged to networks that don't support replies.
+type QuoteReplyBridgeConfig interface {
+	BridgeConfig
+	GetQuoteReplyConfig() QuoteReplyConfig
+}
+
+// IdentityChangeBridgeConfig is an optional interface for bridge configs of networks with end-to-end encryption
+// that allow blocking messages to users whose identity has changed until the change is acknowledged.
+type IdentityChangeBridgeConfig interface {
+	BridgeConfig
+	RequireIdentityAcknowledgement() bool
+}
+
+// AsyncMediaBridgeConfig is an optional interface for bridge configs that allow sending a placeholder
+// for media that takes longer than the threshold to fetch from the remote network.
+type AsyncMediaBridgeConfig interface {
+	BridgeConfig
+	// GetAsyncMediaThreshold returns how long to wait for media before sending a placeholder. Zero disables placeholders.
+	GetAsyncMediaThreshold() time.Duration
+}
+
+type FloodProtectionConfig struct {
+	// MessagesPerMinute is the number of messages a single remote user can send per minute in one portal.
+	// Zero disables flood protection.
+	MessagesPerMinute int `yaml:"messages_per_minute"`
+	// Burst is the number of messages that can be sent at once before rate limiting kicks in.
+	Burst int `yaml:"burst"`
+}
+
+// FloodProtectionBridgeConfig is an optional interface for bridge configs that allow rate limiting
+// remote users to protect portals from spam floods.
+type FloodProtectionBridgeConfig interface {
+	BridgeConfig
+	GetFloodProtectionConfig() FloodProtectionConfig
+}
+
+type RoomType string
+
+const (
+	RoomTypeDM        RoomType = "dm"
+	RoomTypeGroup     RoomType = "group"
+	RoomTypeSpace     RoomType = "space"
+	RoomTypeChannel   RoomType = "channel"
+	RoomTypeBroadcast RoomType = "broadcast"
+)
+
+// RoomDefaults contains the initial settings of new portal rooms. Unset fields keep the bridge's defaults.
+type RoomDefaults struct {
+	Preset            string                  `yaml:"preset"`
+	EventsDefault     *int                    `yaml:"events_default"`
+	Invite            *int                    `yaml:"invite"`
+	JoinRule          event.JoinRule          `yaml:"join_rule"`
+	HistoryVisibility event.HistoryVisibility `yaml:"history_visibility"`
+	GuestAccess       event.GuestAccess       `yaml:"guest_access"`
+	Encrypt           *bool                   `yaml:"encrypt"`
+}
+
+// Merge returns a copy of the defaults with all the fields that are set in the overrides replaced.
+func (rd RoomDefaults) Merge(overrides *RoomDefaults) RoomDefaults {
+	if overrides == nil {
+		return rd
+	}
+	if overrides.Preset != "" {
+		rd.Preset = overrides.Preset
+	}
+	if overrides.EventsDefault != nil {
+		rd.EventsDefault = overrides.EventsDefault
+	}
+	if overrides.Invite != nil {
+		rd.Invite = overrides.Invite
+	}
+	if overrides.JoinRule != "" {
+		rd.JoinRule = overrides.JoinRule
+	}
+	if overrides.HistoryVisibility != "" {
+		rd.HistoryVisibility = overrides.HistoryVisibility
+	}
+	if overrides.GuestAccess != "" {
+		rd.GuestAccess = overrides.GuestAccess
+	}
+	if overrides.Encrypt != nil {
+		rd.Encrypt = overrides.Encrypt
+	}
+	return rd
+}
+
+// RoomDefaultsBridgeConfig is an optional interface for bridge configs that allow changing
+// the initial settings of new portal rooms per room type.
+type RoomDefaultsBridgeConfig interface {
+	BridgeConfig
+	GetRoomDefaults() map[RoomType]RoomDefaults
+}
+
+type RoomDirectoryConfig struct {
+	// PublishPublicChannels enables publishing portals of public remote channels in the room directory.
+	// Portals must also opt in individually.
+	PublishPublicChannels bool `yaml:"publish_public_channels"`
+	// AliasTemplate is the localpart of the canonical alias for published portals, with {{.}} replaced by the channel ID.
+	AliasTemplate string `yaml:"alias_template"`
+}
+
+// RoomDirectoryBridgeConfig is an optional interface for bridge configs that support publishing
+// portals in the room directory.
+type RoomDirectoryBridgeConfig interface {
+	BridgeConfig
+	GetRoomDirectoryConfig() RoomDirectoryConfig
+}
+
+type MemberRepairConfig struct {
+	// Enabled enables the background job that repairs ghost memberships using stored remote member lists.
+	Enabled bool `yaml:"enabled"`
+	// ActionsPerMinute is the maximum number of ghost joins and leaves the job performs per minute.
+	ActionsPerMinute int `yaml:"actions_per_minute"`
+}
+
+// MemberRepairBridgeConfig is an optional interface for bridge configs that support repairing stale
+// ghost memberships in the background.
+type MemberRepairBridgeConfig interface {
+	BridgeConfig
+	GetMemberRepairConfig() MemberRepairConfig
+}
+
+type GhostTemplateConfig struct {
+	// UsernameTemplate is the localpart of ghost user IDs, with {{.}} replaced by the remote user ID.
+	UsernameTemplate string `yaml:"username_template"`
+	// DisplaynameTemplate is the displayname of ghosts. It's executed with the network-provided
+	// profile data, so the available fields depend on the bridge.
+	DisplaynameTemplate string `yaml:"displayname_template"`
+}
+
+// GhostTemplateBridgeConfig is an optional interface for bridge configs whose ghost username and displayname
+// templates can be switched at runtime by reloading the config.
+type GhostTemplateBridgeConfig interface {
+	BridgeConfig
+	GetGhostTemplateConfig() GhostTemplateConfig
+}
+
+type RoomRecreationConfig struct {
+	// Auto enables automatically creating a new Matrix room when a portal's room is found to be deleted.
+	Auto bool `yaml:"auto"`
+	// Backfill enables backfilling recent history into recreated rooms.
+	Backfill bool `yaml:"backfill"`
+}
+
+// RoomRecreationBridgeConfig is an optional interface for bridge configs that allow recreating
+// portal rooms that were deleted on the Matrix side.
+type RoomRecreationBridgeConfig interface {
+	BridgeConfig
+	GetRoomRecreationConfig() RoomRecreationConfig
+}
+
+// CommandPermissionsBridgeConfig is an optional interface for bridge configs that allow overriding
+// permissions of individual bot commands. The map is keyed by command name.
+type CommandPermissionsBridgeConfig interface {
+	BridgeConfig
+	GetCommandPermissions() map[string]CommandPermission
+}
+
+// PermissionRolesBridgeConfig is an optional interface for bridge configs that define custom roles,
+// which can be granted access to individual commands with CommandPermission.Roles.
+type PermissionRolesBridgeConfig interface {
+	BridgeConfig
+	GetPermissionRoles() RoleConfig
+}
+
+type ProfileThrottleConfig struct {
+	// IgnoreAvatarQueryChanges skips avatar updates where only the query string or fragment of the remote URL changed.
+	IgnoreAvatarQueryChanges bool `yaml:"ignore_avatar_query_changes"`
+	// IgnoreNameCaseChanges skips displayname updates where only the case or surrounding whitespace changed.
+	IgnoreNameCaseChanges bool `yaml:"ignore_name_case_changes"`
+	// MinInterval is the minimum number of seconds between profile updates of a single ghost.
+	MinInterval int `yaml:"min_interval"`
+}
+
+// ProfileThrottleBridgeConfig is an optional interface for bridge configs that allow skipping
+// insignificant or too frequent ghost profile updates.
+type ProfileThrottleBridgeConfig interface {
+	BridgeConfig
+	GetProfileThrottleConfig() ProfileThrottleConfig
+}
+
+type TimestampConfig struct {
+	// MaxFutureSkew is the number of seconds remote timestamps can be in the future before being clamped to the current time.
+	MaxFutureSkew int `yaml:"max_future_skew"`
+	// MaxBackdate is the number of seconds live messages can be backdated. Older timestamps are replaced with
+	// the current time. Zero disables the limit. This doesn't apply to backfilling with batch sending.
+	MaxBackdate int `yaml:"max_backdate"`
+	// Monotonic makes sure live message timestamps never go backwards within a portal.
+	Monotonic bool `yaml:"monotonic"`
+}
+
+// TimestampBridgeConfig is an optional interface for bridge configs that allow validating
+// remote message timestamps before they're used for timestamp massaging.
+type TimestampBridgeConfig interface {
+	BridgeConfig
+	GetTimestampConfig() TimestampConfig
+}
+
+type LogRedactionConfig struct {
+	// Fields contains the names of log fields whose values are replaced with a placeholder.
+	Fields []string `yaml:"fields"`
+	// HashFields contains the names of log fields whose values are replaced with a short hash,
+	// which hides the value while still allowing correlating log lines.
+	HashFields []string `yaml:"hash_fields"`
+	// HashSecret is the key used when hashing the values of HashFields. If empty, the appservice token is used.
+	// Changing it will change all hashes, so log lines from before and after the change can't be correlated.
+	HashSecret string `yaml:"hash_secret"`
+	// Patterns contains regular expressions that are redacted from the message and all string fields.
+	Patterns []string `yaml:"patterns"`
+	// ModuleLevels contains minimum log levels for specific components, keyed by the value of the component field.
+	// They can only make logging less verbose than the global minimum level.
+	ModuleLevels map[string]zerolog.Level `yaml:"module_levels"`
+}
+
+// LogRedactionBridgeConfig is an optional interface for bridge configs that allow scrubbing
+// sensitive data from logs.
+type LogRedactionBridgeConfig interface {
+	BridgeConfig
+	GetLogRedactionConfig() LogRedactionConfig
+}
+
+type EditHistoryConfig struct {
+	// Enabled makes the bridge store the previous content of remote messages when they're edited.
+	Enabled bool `yaml:"enabled"`
+	// Notice makes the bridge reply to edited messages with a notice showing what changed.
+	Notice bool `yaml:"notice"`
+	// NoticeInterval is the minimum number of seconds between edit notices for the same message.
+	// Edits that come faster are still stored, but no notice is sent. Defaults to 5 minutes.
+	NoticeInterval int `yaml:"notice_interval"`
+}
+
+// EditHistoryBridgeConfig is an optional interface for bridge configs that allow preserving the edit history of messages.
+type EditHistoryBridgeConfig interface {
+	BridgeConfig
+	GetEditHistoryConfig() EditHistoryConfig
+}
+
+type SystemMessageConfig struct {
+	// Suppress contains the system message types that shouldn't be bridged, e.g. missed_call.
+	Suppress []string `yaml:"suppress"`
+}
+
+// SystemMessageBridgeConfig is an optional interface for bridge configs that allow suppressing remote system messages.
+type SystemMessageBridgeConfig interface {
+	BridgeConfig
+	GetSystemMessageConfig() SystemMessageConfig
+}
+
+type ReactionCapConfig struct {
+	// MaxPerEmoji is the maximum number of individual reactions bridged per emoji on a single message.
+	// Only the newest reactions are bridged, and the full counts are stored in the reaction summary.
+	// Zero means no limit.
+	MaxPerEmoji int `yaml:"max_per_emoji"`
+}
+
+// ReactionCapBridgeConfig is an optional interface for bridge configs that allow limiting
+// the number of reactions bridged per message.
+type ReactionCapBridgeConfig interface {
+	BridgeConfig
+	GetReactionCapConfig() ReactionCapConfig
+}
+
+type WebhookTarget struct {
+	URL string `yaml:"url"`
+	// Secret is used to sign request bodies with HMAC-SHA256. The signature is sent in the X-Mautrix-Signature header.
+	Secret string `yaml:"secret"`
+	// Events contains the event types to send to this URL. If empty, all events are sent.
+	Events []string `yaml:"events"`
+}
+
+type WebhookConfig struct {
+	Targets []WebhookTarget `yaml:"targets"`
+	// MaxRetries is the number of times failed deliveries are retried with exponential backoff.
+	MaxRetries int `yaml:"max_retries"`
+}
+
+// WebhookBridgeConfig is an optional interface for bridge configs that allow sending bridged events to webhooks.
+type WebhookBridgeConfig interface {
+	BridgeConfig
+	GetWebhookConfig() WebhookConfig
+}
+
+type EventInjectionConfig struct {
+	// Enabled enables the HTTP endpoint for injecting synthetic remote events. It should only be used
+	// for testing and integrations, as it allows sending arbitrary messages as any remote user.
+	Enabled bool `yaml:"enabled"`
+	// SharedSecret is the bearer token required to use the endpoint. The endpoint is disabled if this is empty.
+	SharedSecret string `yaml:"shared_secret"`
+}
+
+// EventInjectionBridgeConfig is an optional interface for bridge configs that allow injecting remote events over HTTP.
+type EventInjectionBridgeConfig interface {
+	BridgeConfig
+	GetEventInjectionConfig() EventInjectionConfig
+}
+
+type StartupCheckConfig struct {
+	// Enabled enables checking the bridge state for broken invariants when the bridge starts.
+	Enabled bool `yaml:"enabled"`
+	// Repair makes the startup check fix the problems it finds instead of only logging them.
+	Repair bool `yaml:"repair"`
+}
+
+// StartupCheckBridgeConfig is an optional interface for bridge configs that support validating bridge state at startup.
+type StartupCheckBridgeConfig interface {
+	BridgeConfig
+	GetStartupCheckConfig() StartupCheckConfig
+}
+
+type CachePreloadConfig struct {
+	// Portals is the number of most recently active portals to load into memory at startup, along with their ghosts.
+	// Zero disables preloading.
+	Portals int `yaml:"portals"`
+}
+
+// CachePreloadBridgeConfig is an optional interface for bridge configs that allow preloading caches at startup.
+type CachePreloadBridgeConfig interface {
+	BridgeConfig
+	GetCachePreloadConfig() CachePreloadConfig
+}
+
+type EventTimingConfig struct {
+	// WarnThreshold is the number of milliseconds handling a single event, or a single phase of handling it,
+	// can take before a warning is logged. Zero disables the warnings.
+	WarnThreshold int `yaml:"warn_threshold"`
+	// Thresholds overrides WarnThreshold for specific event types. Matrix events are keyed by the event type,
+	// remote events by the Go type name of the event.
+	Thresholds map[string]int `yaml:"thresholds"`
+}
+
+// EventTimingBridgeConfig is an optional interface for bridge configs that allow logging warnings
+// about events that take too long to handle.
+type EventTimingBridgeConfig interface {
+	BridgeConfig
+	GetEventTimingConfig() EventTimingConfig
+}
+
+type HandlerTimeoutConfig struct {
+	// Default is the number of seconds a portal can spend handling a single event before its context is canceled.
+	// Zero disables the deadline. Matrix events only have a deadline if the portal handles them through
+	// Bridge.RunMatrixEventHandler, remote events if they're handled through Bridge.HandleRemoteEvent.
+	Default int `yaml:"default"`
+	// EventTypes overrides the default deadline for specific event types. Matrix events are keyed by the event type,
+	// remote events by the Go type name of the event.
+	EventTypes map[string]int `yaml:"event_types"`
+	// Skip makes the portal move on to the next event if a handler doesn't return after its deadline,
+	// instead of only logging a warning and waiting for it.
+	Skip bool `yaml:"skip"`
+}
+
+// HandlerTimeoutBridgeConfig is an optional interface for bridge configs that allow limiting how long
+// portals can spend handling a single event.
+type HandlerTimeoutBridgeConfig interface {
+	BridgeConfig
+	GetHandlerTimeoutConfig() HandlerTimeoutConfig
+}
+
+type HomeserverOutageConfig struct {
+	// StoreAndForward enables storing remote events in the database while the homeserver is unreachable
+	// and sending them with their original timestamps once it's back.
+	StoreAndForward bool `yaml:"store_and_forward"`
+	// ProbeInterval is the number of seconds between checks of whether the homeserver is reachable again.
+	ProbeInterval int `yaml:"probe_interval"`
+	// MaxQueued is the maximum number of events stored during an outage. Events beyond the limit fail
+	// like they would without store-and-forward. Zero means no limit.
+	MaxQueued int `yaml:"max_queued"`
+}
+
+// HomeserverOutageBridgeConfig is an optional interface for bridge configs that allow queuing remote events
+// while the homeserver is down.
+type HomeserverOutageBridgeConfig interface {
+	BridgeConfig
+	GetHomeserverOutageConfig() HomeserverOutageConfig
+}
+
+type DisconnectedQueueConfig struct {
+	// Enabled enables holding Matrix messages from users who are temporarily disconnected from the remote network
+	// and sending them once they reconnect, instead of failing them immediately.
+	Enabled bool `yaml:"enabled"`
+	// MaxAge is the number of seconds a message can wait for the user to reconnect before it's failed.
+	// Zero means no limit.
+	MaxAge int `yaml:"max_age"`
+	// MaxCount is the maximum number of messages held per user. Zero means no limit.
+	MaxCount int `yaml:"max_count"`
+}
+
+// DisconnectedQueueBridgeConfig is an optional interface for bridge configs that allow queuing Matrix messages
+// while users are disconnected from the remote network.
+type DisconnectedQueueBridgeConfig interface {
+	BridgeConfig
+	GetDisconnectedQueueConfig() DisconnectedQueueConfig
+}
+
+type ConnectorConcurrencyConfig struct {
+	// MaxPerUser is the maximum number of concurrent calls to the remote network per user, e.g. for sending
+	// Matrix messages or resyncing portals. Zero means no limit.
+	MaxPerUser int `yaml:"max_per_user"`
+}
+
+// ConnectorConcurrencyBridgeConfig is an optional interface for bridge configs that limit how many calls to
+// the remote network can be made concurrently with a single user's connection.
+type ConnectorConcurrencyBridgeConfig interface {
+	BridgeConfig
+	GetConnectorConcurrencyConfig() ConnectorConcurrencyConfig
+}
+
+type EncryptionDefaultMode string
+
+const (
+	EncryptionDefaultAll     EncryptionDefaultMode = "all"
+	EncryptionDefaultDMs     EncryptionDefaultMode = "dms"
+	EncryptionDefaultNone    EncryptionDefaultMode = "none"
+	EncryptionDefaultPerType EncryptionDefaultMode = "per_type"
+)
+
+// EncryptionDefaultsConfig controls which new portals are encrypted by default.
+type EncryptionDefaultsConfig struct {
+	// Mode is the encryption default for new portals. If it's empty, the default field of the encryption
+	// config is used for all portals.
+	Mode EncryptionDefaultMode `yaml:"mode"`
+	// Types contains the encryption default per room type when Mode is per_type.
+	// Room types that aren't listed aren't encrypted.
+	Types map[RoomType]bool `yaml:"types"`
+}
+
+// ShouldEncrypt returns whether new portals of the given type should be encrypted by default.
+// The fallback is used if the mode isn't set.
+func (edc EncryptionDefaultsConfig) ShouldEncrypt(roomType RoomType, fallback bool) bool {
+	switch edc.Mode {
+	case EncryptionDefaultAll:
+		return true
+	case EncryptionDefaultDMs:
+		return roomType == RoomTypeDM
+	case EncryptionDefaultNone:
+		return false
+	case EncryptionDefaultPerType:
+		return edc.Types[roomType]
+	default:
+		return fallback
+	}
+}
+
+// EncryptionDefaultsBridgeConfig is an optional interface for bridge configs that choose the encryption
+// default of new portals based on the room type.
+type EncryptionDefaultsBridgeConfig interface {
+	BridgeConfig
+	GetEncryptionDefaultsConfig() EncryptionDefaultsConfig
+}
+
+type TranslationMode string
+
+const (
+	// TranslationModeAppend appends the translation to the original message before it's sent.
+	TranslationModeAppend TranslationMode = "append"
+	// TranslationModeEdit sends the original message immediately and adds the translation with an edit.
+	TranslationModeEdit TranslationMode = "edit"
+)
+
+type TranslationConfig struct {
+	Mode TranslationMode `yaml:"mode"`
+}
+
+// TranslationBridgeConfig is an optional interface for bridge configs that allow configuring
+// how translations of incoming messages are added.
+type TranslationBridgeConfig interface {
+	BridgeConfig
+	GetTranslationConfig() TranslationConfig
+}
+
 type BaseConfig struct {
 	Homeserver HomeserverConfig  `yaml:"homeserver"`
 	AppService AppserviceConfig  `yaml:"appservice"`
@@ -7,6 +7,8 @@
 package bridgeconfig
 
 import (
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -35,6 +37,39 @@ func RegisterPermissionLevel(name string, level PermissionLevel) {
 	namesToLevels[name] = level
 }
 
+func lookupPermissionLevel(value string) (PermissionLevel, bool) {
+	if level, ok := namesToLevels[strings.ToLower(value)]; ok {
+		return level, true
+	} else if val, err := strconv.Atoi(value); err == nil {
+		return PermissionLevel(val), true
+	}
+	return PermissionLevelBlock, false
+}
+
+// ParsePermissionLevel parses a permission level from a role name (including ones added with
+// RegisterPermissionLevel) or a number. Unknown values are parsed as PermissionLevelBlock,
+// so this must only be used for levels that users have, not for levels that are required.
+func ParsePermissionLevel(value string) PermissionLevel {
+	level, _ := lookupPermissionLevel(value)
+	return level
+}
+
+// UnmarshalYAML parses a permission level. Unlike ParsePermissionLevel, unknown values are rejected,
+// as a typo in a required level would otherwise make something available to everyone.
+func (pl *PermissionLevel) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	err := unmarshal(&value)
+	if err != nil {
+		return err
+	}
+	level, ok := lookupPermissionLevel(value)
+	if !ok {
+		return fmt.Errorf("unknown permission level %q", value)
+	}
+	*pl = level
+	return nil
+}
+
 func (pc *PermissionConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	rawPC := make(map[string]string)
 	err := unmarshal(&rawPC)
@@ -46,14 +81,7 @@ func (pc *PermissionConfig) UnmarshalYAML(unmarshal func(interface{}) error) err
 		*pc = make(map[string]PermissionLevel)
 	}
 	for key, value := range rawPC {
-		level, ok := namesToLevels[strings.ToLower(value)]
-		if ok {
-			(*pc)[key] = level
-		} else if val, err := strconv.Atoi(value); err == nil {
-			(*pc)[key] = PermissionLevel(val)
-		} else {
-			(*pc)[key] = PermissionLevelBlock
-		}
+		(*pc)[key] = ParsePermissionLevel(value)
 	}
 	return nil
 }
@@ -69,3 +97,44 @@ func (pc PermissionConfig) Get(userID id.UserID) PermissionLevel {
 		return PermissionLevelBlock
 	}
 }
+
+// RoleConfig maps custom role names to the users that have the role. Users can be specified the same way as
+// in PermissionConfig, i.e. as user IDs, server names or * for everyone.
+type RoleConfig map[string][]string
+
+// Has checks whether the given user has the given custom role.
+func (rc RoleConfig) Has(userID id.UserID, role string) bool {
+	for _, entry := range rc[role] {
+		if entry == string(userID) || entry == "*" || (len(userID.Homeserver()) > 0 && entry == userID.Homeserver()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns all custom roles the given user has.
+func (rc RoleConfig) Get(userID id.UserID) []string {
+	var roles []string
+	for role := range rc {
+		if rc.Has(userID, role) {
+			roles = append(roles, role)
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// CommandPermission overrides who can use a specific bot command.
+type CommandPermission struct {
+	// Level is the permission level or role required to use the command.
+	// If unset, the command's default requirement is used.
+	Level *PermissionLevel `yaml:"level"`
+	// Rooms contains per-room overrides for Level.
+	Rooms map[id.RoomID]PermissionLevel `yaml:"rooms"`
+	// Roles contains custom roles (see RoleConfig) whose users may use the command regardless of their level.
+	Roles []string `yaml:"roles"`
+	// ManagementRoomOnly limits the command to the user's management room.
+	ManagementRoomOnly bool `yaml:"management_room_only"`
+	// RateLimit is the number of times a single user can use the command per minute. Zero means no limit.
+	RateLimit int `yaml:"rate_limit"`
+}
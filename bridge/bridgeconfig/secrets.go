@@ -0,0 +1,112 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridgeconfig
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var secretReferenceRegex = regexp.MustCompile(`^\$\{(env|file|cmd):(.+)}$`)
+
+// ResolveSecrets replaces secret references in string values of the given config with the actual secrets,
+// which allows deployments to avoid storing plaintext secrets in the config file. The supported references are:
+//
+//   - ${env:NAME} is replaced with the value of the environment variable NAME.
+//   - ${file:/path/to/file} is replaced with the contents of the file, without trailing newlines.
+//   - ${cmd:command} is replaced with the output of the shell command, without trailing newlines.
+//
+// References must be the entire value of a field. The config file itself is never modified,
+// so the references stay in place when the config is upgraded.
+func ResolveSecrets(configData []byte) ([]byte, error) {
+	if !bytes.Contains(configData, []byte("${")) {
+		return configData, nil
+	}
+	var doc yaml.Node
+	err := yaml.Unmarshal(configData, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	changed, err := resolveSecretsInNode(&doc, nil)
+	if err != nil {
+		return nil, err
+	} else if !changed {
+		return configData, nil
+	}
+	return yaml.Marshal(&doc)
+}
+
+func resolveSecretsInNode(node *yaml.Node, path []string) (changed bool, err error) {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			var childChanged bool
+			childChanged, err = resolveSecretsInNode(child, path)
+			if err != nil {
+				return
+			}
+			changed = changed || childChanged
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			var childChanged bool
+			childChanged, err = resolveSecretsInNode(node.Content[i+1], append(path, node.Content[i].Value))
+			if err != nil {
+				return
+			}
+			changed = changed || childChanged
+		}
+	case yaml.ScalarNode:
+		match := secretReferenceRegex.FindStringSubmatch(node.Value)
+		if match == nil || node.Tag != "!!str" {
+			return false, nil
+		}
+		var value string
+		value, err = resolveSecret(match[1], match[2])
+		if err != nil {
+			return false, fmt.Errorf("failed to resolve secret at %s: %w", strings.Join(path, "->"), err)
+		}
+		node.Value = value
+		node.Style = yaml.DoubleQuotedStyle
+		changed = true
+	}
+	return
+}
+
+func resolveSecret(source, ref string) (string, error) {
+	switch source {
+	case "env":
+		value, ok := os.LookupEnv(ref)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", ref)
+		}
+		return value, nil
+	case "file":
+		data, err := os.ReadFile(ref)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case "cmd":
+		var stderr bytes.Buffer
+		cmd := exec.Command("sh", "-c", ref)
+		cmd.Stderr = &stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("secret command failed: %w (%s)", err, strings.TrimSpace(stderr.String()))
+		}
+		return strings.TrimRight(string(output), "\r\n"), nil
+	default:
+		return "", fmt.Errorf("unknown secret source %s", source)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ProtocolInfoBridge is an optional interface for bridges that want to include links to the remote network
+// and its avatar in the protocol section of bridge info state events.
+type ProtocolInfoBridge interface {
+	ChildOverride
+	GetProtocolExternalURL() string
+	GetProtocolAvatarURL() id.ContentURIString
+}
+
+// BridgeInfoExtendingPortal is an optional interface for portals that provide links back to the chat
+// in the native app, as well as network-specific metadata for bridge info state events.
+type BridgeInfoExtendingPortal interface {
+	Portal
+	// GetChannelExternalURL returns a web URL or native app deep link to the remote chat.
+	GetChannelExternalURL() string
+	// GetNetworkExternalURL returns a URL to the group or server the chat is in, if the network has such a concept.
+	GetNetworkExternalURL() string
+	// GetBridgeInfoMetadata returns arbitrary info about the chat. Keys should be namespaced.
+	GetBridgeInfoMetadata() map[string]interface{}
+}
+
+// ExtendBridgeInfo fills the external URLs, protocol avatar and metadata of a bridge info state event
+// using the optional ProtocolInfoBridge and BridgeInfoExtendingPortal interfaces.
+// Fields the bridge or portal doesn't provide are left unchanged.
+//
+// If privacy mode is enabled, remote identifiers are hidden afterwards: the channel and network IDs are
+// passed through OpaqueRemoteID, and external URLs and metadata of the chat are removed.
+func (br *Bridge) ExtendBridgeInfo(portal Portal, content *event.BridgeEventContent) {
+	if pib, ok := br.Child.(ProtocolInfoBridge); ok {
+		if url := pib.GetProtocolExternalURL(); url != "" {
+			content.Protocol.ExternalURL = url
+		}
+		if avatar := pib.GetProtocolAvatarURL(); avatar != "" {
+			content.Protocol.AvatarURL = avatar
+		}
+	}
+	if bip, ok := portal.(BridgeInfoExtendingPortal); ok {
+		if url := bip.GetChannelExternalURL(); url != "" {
+			content.Channel.ExternalURL = url
+		}
+		if url := bip.GetNetworkExternalURL(); url != "" && content.Network != nil {
+			content.Network.ExternalURL = url
+		}
+		if meta := bip.GetBridgeInfoMetadata(); len(meta) > 0 {
+			content.Metadata = meta
+		}
+	}
+	br.applyPrivacyToBridgeInfo(content)
+}
+
+// SendBridgeInfo extends the given bridge info with ExtendBridgeInfo and sends it to the portal room as both
+// m.bridge and uk.half-shot.bridge state events. Nothing is sent if the room already has identical bridge info,
+// so portals can call this whenever any of the info may have changed.
+func (br *Bridge) SendBridgeInfo(portal Portal, roomID id.RoomID, stateKey string, content *event.BridgeEventContent) error {
+	br.ExtendBridgeInfo(portal, content)
+	intent := portal.MainIntent()
+	var existing json.RawMessage
+	err := intent.StateEvent(roomID, event.StateBridge, stateKey, &existing)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		br.ZLog.Warn().Err(err).Str("room_id", roomID.String()).Msg("Failed to get existing bridge info")
+	} else if err == nil {
+		newContent, err := json.Marshal(content)
+		if err == nil && jsonEqual(existing, newContent) {
+			return nil
+		}
+	}
+	_, err = intent.SendStateEvent(roomID, event.StateBridge, stateKey, content)
+	if err != nil {
+		return fmt.Errorf("failed to send m.bridge event: %w", err)
+	}
+	// TODO remove this once https://github.com/matrix-org/matrix-doc/pull/2346 is in spec
+	_, err = intent.SendStateEvent(roomID, event.StateHalfShotBridge, stateKey, content)
+	if err != nil {
+		return fmt.Errorf("failed to send uk.half-shot.bridge event: %w", err)
+	}
+	return nil
+}
+
+func jsonEqual(a, b []byte) bool {
+	var aParsed, bParsed interface{}
+	if json.Unmarshal(a, &aParsed) != nil || json.Unmarshal(b, &bParsed) != nil {
+		return false
+	}
+	aNorm, _ := json.Marshal(aParsed)
+	bNorm, _ := json.Marshal(bParsed)
+	return bytes.Equal(aNorm, bNorm)
+}
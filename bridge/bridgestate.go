@@ -108,6 +108,7 @@ func (bsq *BridgeStateQueue) Send(state status.BridgeState) {
 	}
 
 	state = state.Fill(bsq.user)
+	bsq.bridge.EventBus.Publish(context.Background(), &LoginStateChangedEvent{State: state})
 
 	if len(bsq.ch) >= 8 {
 		bsq.bridge.ZLog.Warn().Msg("Bridge state queue is nearly full, discarding an item")
@@ -0,0 +1,608 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package bridgestore contains database tables that are only used by bridges, like the media cache.
+// They're kept separate from the Matrix state store, which is also used by normal clients.
+package bridgestore
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+//go:embed *.sql
+var rawUpgrades embed.FS
+
+var UpgradeTable dbutil.UpgradeTable
+
+func init() {
+	UpgradeTable.RegisterFS(rawUpgrades)
+}
+
+const VersionTableName = "mx_bridge_version"
+
+// Store is a child database of the bridge with its own version table.
+type Store struct {
+	*dbutil.Database
+}
+
+func NewStore(db *dbutil.Database, log dbutil.DatabaseLogger) *Store {
+	return &Store{
+		Database: db.Child(VersionTableName, UpgradeTable, log),
+	}
+}
+
+// GetCachedMedia returns the content URI of previously uploaded media with the given hash,
+// or an empty string if the hash isn't in the cache.
+func (store *Store) GetCachedMedia(hash string) (mxc id.ContentURIString) {
+	err := store.
+		QueryRow("SELECT mxc FROM mx_media_cache WHERE hash=$1", hash).
+		Scan(&mxc)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		store.Log.Warn("Failed to scan cached media for %s: %v", hash, err)
+	}
+	return
+}
+
+// SetCachedMedia stores the content URI of uploaded media so that it can be reused for identical media.
+func (store *Store) SetCachedMedia(hash string, mxc id.ContentURIString) {
+	_, err := store.Exec(`
+		INSERT INTO mx_media_cache (hash, mxc) VALUES ($1, $2)
+		ON CONFLICT (hash) DO UPDATE SET mxc=excluded.mxc
+	`, hash, mxc)
+	if err != nil {
+		store.Log.Warn("Failed to store cached media for %s: %v", hash, err)
+	}
+}
+
+// SetRemoteMembers replaces the stored remote member list of the given room. It should be called
+// with the full member list after a successful member sync, and marks the room as needing a membership repair check.
+func (store *Store) SetRemoteMembers(roomID id.RoomID, members []id.UserID) error {
+	tx, err := store.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO mx_remote_member_list (room_id, synced_at) VALUES ($1, $2)
+		ON CONFLICT (room_id) DO UPDATE SET synced_at=excluded.synced_at
+	`, roomID, time.Now().UnixMilli())
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to update member list timestamp: %w", err)
+	}
+	_, err = tx.Exec("DELETE FROM mx_remote_member WHERE room_id=$1", roomID)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to delete old members: %w", err)
+	}
+	for _, userID := range members {
+		_, err = tx.Exec("INSERT INTO mx_remote_member (room_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", roomID, userID)
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to insert member %s: %w", userID, err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit changes: %w", err)
+	}
+	return nil
+}
+
+// GetRemoteMembers returns the last stored remote member list of the given room.
+// The boolean is false if no member list has been stored for the room.
+func (store *Store) GetRemoteMembers(roomID id.RoomID) (map[id.UserID]struct{}, bool, error) {
+	var exists bool
+	err := store.
+		QueryRow("SELECT EXISTS(SELECT 1 FROM mx_remote_member_list WHERE room_id=$1)", roomID).
+		Scan(&exists)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+	rows, err := store.Query("SELECT user_id FROM mx_remote_member WHERE room_id=$1", roomID)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	members := make(map[id.UserID]struct{})
+	var userID id.UserID
+	for rows.Next() {
+		err = rows.Scan(&userID)
+		if err != nil {
+			return nil, false, err
+		}
+		members[userID] = struct{}{}
+	}
+	return members, true, rows.Err()
+}
+
+// MemberRepairRoom is a room whose remote member list has changed since the last membership repair.
+type MemberRepairRoom struct {
+	RoomID   id.RoomID
+	SyncedAt int64
+}
+
+// GetRoomsNeedingMemberRepair returns up to limit rooms whose remote member list has changed since
+// the last membership repair, oldest first.
+func (store *Store) GetRoomsNeedingMemberRepair(limit int) ([]MemberRepairRoom, error) {
+	rows, err := store.Query(`
+		SELECT room_id, synced_at FROM mx_remote_member_list WHERE repaired_at < synced_at
+		ORDER BY synced_at ASC LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rooms []MemberRepairRoom
+	for rows.Next() {
+		var room MemberRepairRoom
+		err = rows.Scan(&room.RoomID, &room.SyncedAt)
+		if err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+// MarkMemberRepairDone marks the membership of the given room as repaired against the remote member list
+// that was synced at syncedAt. If the list was synced again during the repair, the room stays in the queue.
+func (store *Store) MarkMemberRepairDone(roomID id.RoomID, syncedAt int64) error {
+	_, err := store.Exec("UPDATE mx_remote_member_list SET repaired_at=$2 WHERE room_id=$1", roomID, syncedAt)
+	return err
+}
+
+// ClearRemoteMembers deletes the stored remote member list of the given room.
+func (store *Store) ClearRemoteMembers(roomID id.RoomID) error {
+	_, err := store.Exec("DELETE FROM mx_remote_member_list WHERE room_id=$1", roomID)
+	return err
+}
+
+// PendingRelation is a relation from a bridged event to a remote message that hadn't been bridged yet.
+type PendingRelation struct {
+	EventID id.EventID
+	RelType string
+}
+
+// AddPendingRelation stores a relation that couldn't be attached to a bridged event because the
+// target remote message wasn't bridged yet.
+func (store *Store) AddPendingRelation(roomID id.RoomID, eventID id.EventID, targetRemoteID, relType string) error {
+	_, err := store.Exec(`
+		INSERT INTO mx_pending_relation (room_id, event_id, target_remote_id, rel_type, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (room_id, event_id) DO UPDATE
+			SET target_remote_id=excluded.target_remote_id, rel_type=excluded.rel_type, created_at=excluded.created_at
+	`, roomID, eventID, targetRemoteID, relType, time.Now().UnixMilli())
+	return err
+}
+
+// GetPendingRelations returns all pending relations that target the given remote message.
+func (store *Store) GetPendingRelations(roomID id.RoomID, targetRemoteID string) ([]PendingRelation, error) {
+	rows, err := store.Query("SELECT event_id, rel_type FROM mx_pending_relation WHERE room_id=$1 AND target_remote_id=$2", roomID, targetRemoteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var relations []PendingRelation
+	for rows.Next() {
+		var rel PendingRelation
+		err = rows.Scan(&rel.EventID, &rel.RelType)
+		if err != nil {
+			return nil, err
+		}
+		relations = append(relations, rel)
+	}
+	return relations, rows.Err()
+}
+
+// DeletePendingRelation deletes a pending relation after it was applied.
+func (store *Store) DeletePendingRelation(roomID id.RoomID, eventID id.EventID) error {
+	_, err := store.Exec("DELETE FROM mx_pending_relation WHERE room_id=$1 AND event_id=$2", roomID, eventID)
+	return err
+}
+
+// EditHistoryEntry is a previous version of an edited message.
+type EditHistoryEntry struct {
+	EditedAt time.Time
+	Content  *event.MessageEventContent
+}
+
+// AddEditHistory stores the content a message had before it was edited at the given time.
+func (store *Store) AddEditHistory(roomID id.RoomID, eventID id.EventID, content *event.MessageEventContent, editedAt time.Time) error {
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	_, err = store.Exec(`
+		INSERT INTO mx_edit_history (room_id, event_id, edited_at, content) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (room_id, event_id, edited_at) DO UPDATE SET content=excluded.content
+	`, roomID, eventID, editedAt.UnixMilli(), contentJSON)
+	return err
+}
+
+// GetEditHistory returns the previous versions of the given message, oldest first.
+func (store *Store) GetEditHistory(roomID id.RoomID, eventID id.EventID) ([]EditHistoryEntry, error) {
+	rows, err := store.Query("SELECT edited_at, content FROM mx_edit_history WHERE room_id=$1 AND event_id=$2 ORDER BY edited_at", roomID, eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []EditHistoryEntry
+	for rows.Next() {
+		var editedAt int64
+		var contentJSON []byte
+		err = rows.Scan(&editedAt, &contentJSON)
+		if err != nil {
+			return nil, err
+		}
+		entry := EditHistoryEntry{EditedAt: time.UnixMilli(editedAt)}
+		err = json.Unmarshal(contentJSON, &entry.Content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse content of version edited at %d: %w", editedAt, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// AddMessageTombstone marks a remote message as deleted and removes data that refers to it: its edit history,
+// reactions bridged to it, relations it was waiting to get and relations other events were waiting for it to be bridged.
+func (store *Store) AddMessageTombstone(roomID id.RoomID, remoteID string, eventID id.EventID) error {
+	tx, err := store.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO mx_message_tombstone (room_id, remote_id, event_id, deleted_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (room_id, remote_id) DO UPDATE SET event_id=excluded.event_id, deleted_at=excluded.deleted_at
+	`, roomID, remoteID, eventID, time.Now().UnixMilli())
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to insert tombstone: %w", err)
+	}
+	_, err = tx.Exec("DELETE FROM mx_edit_history WHERE room_id=$1 AND event_id=$2", roomID, eventID)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to delete edit history: %w", err)
+	}
+	_, err = tx.Exec("DELETE FROM mx_bridged_reaction WHERE room_id=$1 AND target_id=$2", roomID, eventID)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to delete bridged reactions: %w", err)
+	}
+	_, err = tx.Exec("DELETE FROM mx_pending_relation WHERE room_id=$1 AND (event_id=$2 OR target_remote_id=$3)", roomID, eventID, remoteID)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to delete pending relations: %w", err)
+	}
+	return tx.Commit()
+}
+
+// GetMessageTombstone returns the Matrix event ID of a deleted remote message,
+// or an empty string if the message hasn't been deleted.
+func (store *Store) GetMessageTombstone(roomID id.RoomID, remoteID string) (eventID id.EventID, err error) {
+	err = store.QueryRow("SELECT event_id FROM mx_message_tombstone WHERE room_id=$1 AND remote_id=$2", roomID, remoteID).Scan(&eventID)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
+// SetRoomNickname stores the per-room displayname of a user. An empty nickname deletes the stored one.
+func (store *Store) SetRoomNickname(roomID id.RoomID, userID id.UserID, nickname string) error {
+	var err error
+	if nickname == "" {
+		_, err = store.Exec("DELETE FROM mx_room_nickname WHERE room_id=$1 AND user_id=$2", roomID, userID)
+	} else {
+		_, err = store.Exec(`
+			INSERT INTO mx_room_nickname (room_id, user_id, nickname) VALUES ($1, $2, $3)
+			ON CONFLICT (room_id, user_id) DO UPDATE SET nickname=excluded.nickname
+		`, roomID, userID, nickname)
+	}
+	return err
+}
+
+// GetRoomNickname returns the stored per-room displayname of a user, or an empty string if there isn't one.
+func (store *Store) GetRoomNickname(roomID id.RoomID, userID id.UserID) (nickname string, err error) {
+	err = store.QueryRow("SELECT nickname FROM mx_room_nickname WHERE room_id=$1 AND user_id=$2", roomID, userID).Scan(&nickname)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
+// GetRoomNicknames returns all stored per-room displaynames of a user.
+func (store *Store) GetRoomNicknames(userID id.UserID) (map[id.RoomID]string, error) {
+	rows, err := store.Query("SELECT room_id, nickname FROM mx_room_nickname WHERE user_id=$1", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	nicknames := make(map[id.RoomID]string)
+	for rows.Next() {
+		var roomID id.RoomID
+		var nickname string
+		err = rows.Scan(&roomID, &nickname)
+		if err != nil {
+			return nil, err
+		}
+		nicknames[roomID] = nickname
+	}
+	return nicknames, rows.Err()
+}
+
+// BridgedReaction is a remote reaction that was bridged to Matrix as an m.reaction event.
+type BridgedReaction struct {
+	Emoji     string
+	Sender    id.UserID
+	EventID   id.EventID
+	Timestamp time.Time
+}
+
+// GetBridgedReactions returns all reactions bridged to the given target event.
+func (store *Store) GetBridgedReactions(roomID id.RoomID, targetID id.EventID) ([]BridgedReaction, error) {
+	rows, err := store.Query("SELECT emoji, sender, event_id, timestamp FROM mx_bridged_reaction WHERE room_id=$1 AND target_id=$2", roomID, targetID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var reactions []BridgedReaction
+	for rows.Next() {
+		var reaction BridgedReaction
+		var ts int64
+		err = rows.Scan(&reaction.Emoji, &reaction.Sender, &reaction.EventID, &ts)
+		if err != nil {
+			return nil, err
+		}
+		reaction.Timestamp = time.UnixMilli(ts)
+		reactions = append(reactions, reaction)
+	}
+	return reactions, rows.Err()
+}
+
+// AddBridgedReaction stores a reaction that was bridged to the given target event.
+func (store *Store) AddBridgedReaction(roomID id.RoomID, targetID id.EventID, reaction BridgedReaction) error {
+	_, err := store.Exec(`
+		INSERT INTO mx_bridged_reaction (room_id, target_id, emoji, sender, event_id, timestamp) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (room_id, target_id, emoji, sender) DO UPDATE SET event_id=excluded.event_id, timestamp=excluded.timestamp
+	`, roomID, targetID, reaction.Emoji, reaction.Sender, reaction.EventID, reaction.Timestamp.UnixMilli())
+	return err
+}
+
+type bridgedReactionRow struct {
+	roomID   id.RoomID
+	targetID id.EventID
+	BridgedReaction
+}
+
+var bridgedReactionInserter = dbutil.NewMassInsertBuilder(
+	"INSERT INTO mx_bridged_reaction (room_id, target_id, emoji, sender, event_id, timestamp)",
+	"ON CONFLICT (room_id, target_id, emoji, sender) DO UPDATE SET event_id=excluded.event_id, timestamp=excluded.timestamp",
+	6, func(row bridgedReactionRow) []interface{} {
+		return []interface{}{row.roomID, row.targetID, row.Emoji, row.Sender, row.EventID, row.Timestamp.UnixMilli()}
+	},
+)
+
+// AddBridgedReactions stores multiple reactions that were bridged to the given target event using as few queries
+// as possible. The reactions must not contain duplicate emoji and sender pairs.
+func (store *Store) AddBridgedReactions(ctx context.Context, roomID id.RoomID, targetID id.EventID, reactions []BridgedReaction) error {
+	rows := make([]bridgedReactionRow, len(reactions))
+	for i, reaction := range reactions {
+		rows[i] = bridgedReactionRow{roomID: roomID, targetID: targetID, BridgedReaction: reaction}
+	}
+	return bridgedReactionInserter.Exec(ctx, store, rows)
+}
+
+// DeleteBridgedReaction deletes a stored reaction after it was redacted.
+func (store *Store) DeleteBridgedReaction(roomID id.RoomID, targetID id.EventID, emoji string, sender id.UserID) error {
+	_, err := store.Exec("DELETE FROM mx_bridged_reaction WHERE room_id=$1 AND target_id=$2 AND emoji=$3 AND sender=$4", roomID, targetID, emoji, sender)
+	return err
+}
+
+// GetPortalAliasTarget returns the primary key of the portal that the given secondary remote ID belongs to,
+// or an empty string if the ID isn't an alias.
+func (store *Store) GetPortalAliasTarget(aliasKey string) (portalKey string, err error) {
+	err = store.QueryRow("SELECT portal_key FROM mx_portal_alias WHERE alias_key=$1", aliasKey).Scan(&portalKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
+// GetPortalAliases returns all secondary remote IDs of the given portal.
+func (store *Store) GetPortalAliases(portalKey string) ([]string, error) {
+	rows, err := store.Query("SELECT alias_key FROM mx_portal_alias WHERE portal_key=$1", portalKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var aliases []string
+	for rows.Next() {
+		var alias string
+		err = rows.Scan(&alias)
+		if err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, alias)
+	}
+	return aliases, rows.Err()
+}
+
+// SetPortalAlias stores a secondary remote ID for a portal, replacing the portal the ID previously pointed at.
+func (store *Store) SetPortalAlias(aliasKey, portalKey string) error {
+	_, err := store.Exec(`
+		INSERT INTO mx_portal_alias (alias_key, portal_key) VALUES ($1, $2)
+		ON CONFLICT (alias_key) DO UPDATE SET portal_key=excluded.portal_key
+	`, aliasKey, portalKey)
+	return err
+}
+
+// DeletePortalAliases deletes all secondary remote IDs of the given portal.
+func (store *Store) DeletePortalAliases(portalKey string) error {
+	_, err := store.Exec("DELETE FROM mx_portal_alias WHERE portal_key=$1", portalKey)
+	return err
+}
+
+// UserPortal contains the preferences of a Matrix user in a single portal room.
+type UserPortal struct {
+	UserID id.UserID
+	RoomID id.RoomID
+	// Notifications is the notification override of the user in the portal. An empty string means no override.
+	Notifications string
+	// LoginID is the remote login the user prefers to use in the portal, for bridges that support multiple logins.
+	LoginID string
+	// RelayOptOut means the user doesn't want their messages to be sent through the relay bot.
+	RelayOptOut bool
+	LastActive  time.Time
+}
+
+// GetUserPortal returns the preferences of a user in a portal. If nothing is stored, the default preferences are returned.
+func (store *Store) GetUserPortal(userID id.UserID, roomID id.RoomID) (*UserPortal, error) {
+	up := &UserPortal{UserID: userID, RoomID: roomID}
+	var lastActive int64
+	err := store.
+		QueryRow("SELECT notifications, login_id, relay_opt_out, last_active FROM mx_user_portal WHERE user_id=$1 AND room_id=$2", userID, roomID).
+		Scan(&up.Notifications, &up.LoginID, &up.RelayOptOut, &lastActive)
+	if errors.Is(err, sql.ErrNoRows) {
+		return up, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if lastActive != 0 {
+		up.LastActive = time.UnixMilli(lastActive)
+	}
+	return up, nil
+}
+
+// PutUserPortal stores the preferences of a user in a portal, replacing the previously stored ones.
+func (store *Store) PutUserPortal(up *UserPortal) error {
+	var lastActive int64
+	if !up.LastActive.IsZero() {
+		lastActive = up.LastActive.UnixMilli()
+	}
+	_, err := store.Exec(`
+		INSERT INTO mx_user_portal (user_id, room_id, notifications, login_id, relay_opt_out, last_active) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id, room_id) DO UPDATE
+			SET notifications=excluded.notifications, login_id=excluded.login_id,
+			    relay_opt_out=excluded.relay_opt_out, last_active=excluded.last_active
+	`, up.UserID, up.RoomID, up.Notifications, up.LoginID, up.RelayOptOut, lastActive)
+	return err
+}
+
+// SetUserPortalLastActive updates only the last activity time of a user in a portal.
+func (store *Store) SetUserPortalLastActive(userID id.UserID, roomID id.RoomID, ts time.Time) error {
+	_, err := store.Exec(`
+		INSERT INTO mx_user_portal (user_id, room_id, last_active) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, room_id) DO UPDATE SET last_active=excluded.last_active
+	`, userID, roomID, ts.UnixMilli())
+	return err
+}
+
+// DeleteUserPortals deletes the preferences of all users in a portal, e.g. after the portal is deleted.
+func (store *Store) DeleteUserPortals(roomID id.RoomID) error {
+	_, err := store.Exec("DELETE FROM mx_user_portal WHERE room_id=$1", roomID)
+	return err
+}
+
+// OutboxEvent is a converted remote event that couldn't be sent because the homeserver was unreachable.
+type OutboxEvent struct {
+	Seq       int64
+	RoomID    id.RoomID
+	Sender    id.UserID
+	EventType string
+	Content   json.RawMessage
+	Timestamp time.Time
+	RemoteID  string
+}
+
+// AddOutboxEvent stores an event to be sent once the homeserver is reachable again.
+func (store *Store) AddOutboxEvent(evt *OutboxEvent) error {
+	_, err := store.Exec(`
+		INSERT INTO mx_outbox (seq, room_id, sender, event_type, content, timestamp, remote_id) VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, evt.Seq, evt.RoomID, evt.Sender, evt.EventType, []byte(evt.Content), evt.Timestamp.UnixMilli(), evt.RemoteID)
+	return err
+}
+
+// GetOutboxEvents returns the oldest queued events in the order they were queued.
+func (store *Store) GetOutboxEvents(limit int) ([]*OutboxEvent, error) {
+	rows, err := store.Query(`
+		SELECT seq, room_id, sender, event_type, content, timestamp, remote_id FROM mx_outbox ORDER BY seq LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []*OutboxEvent
+	for rows.Next() {
+		var evt OutboxEvent
+		var content []byte
+		var ts int64
+		err = rows.Scan(&evt.Seq, &evt.RoomID, &evt.Sender, &evt.EventType, &content, &ts, &evt.RemoteID)
+		if err != nil {
+			return nil, err
+		}
+		evt.Content = content
+		evt.Timestamp = time.UnixMilli(ts)
+		events = append(events, &evt)
+	}
+	return events, rows.Err()
+}
+
+// DeleteOutboxEvent deletes a queued event after it was sent or dropped.
+func (store *Store) DeleteOutboxEvent(seq int64) error {
+	_, err := store.Exec("DELETE FROM mx_outbox WHERE seq=$1", seq)
+	return err
+}
+
+// CountOutboxEvents returns the number of queued events.
+func (store *Store) CountOutboxEvents() (count int, err error) {
+	err = store.QueryRow("SELECT COUNT(*) FROM mx_outbox").Scan(&count)
+	return
+}
+
+// DeleteOldPendingRelations deletes pending relations that were queued before the given time,
+// as their targets are unlikely to ever be bridged. It returns the number of deleted relations.
+func (store *Store) DeleteOldPendingRelations(before time.Time) (int64, error) {
+	res, err := store.Exec("DELETE FROM mx_pending_relation WHERE created_at<$1", before.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// CountOldPendingRelations returns the number of pending relations that were queued before the given time.
+func (store *Store) CountOldPendingRelations(before time.Time) (count int, err error) {
+	err = store.QueryRow("SELECT COUNT(*) FROM mx_pending_relation WHERE created_at<$1", before.UnixMilli()).Scan(&count)
+	return
+}
+
+// PutOpaqueRemoteID stores the remote identifier that the given hashed identifier was generated from.
+func (store *Store) PutOpaqueRemoteID(opaqueID, remoteID string) error {
+	_, err := store.Exec(`
+		INSERT INTO mx_opaque_remote_id (opaque_id, remote_id) VALUES ($1, $2)
+		ON CONFLICT (opaque_id) DO NOTHING
+	`, opaqueID, remoteID)
+	return err
+}
+
+// GetRemoteIDByOpaque returns the remote identifier that the given hashed identifier was generated from,
+// or an empty string if the hashed identifier is unknown.
+func (store *Store) GetRemoteIDByOpaque(opaqueID string) (remoteID string, err error) {
+	err = store.QueryRow("SELECT remote_id FROM mx_opaque_remote_id WHERE opaque_id=$1", opaqueID).Scan(&remoteID)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
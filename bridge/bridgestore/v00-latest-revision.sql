@@ -0,0 +1,102 @@
+-- v0 -> v11: Latest revision
+
+CREATE TABLE mx_media_cache (
+	hash TEXT PRIMARY KEY,
+	mxc  TEXT NOT NULL
+);
+
+CREATE TABLE mx_remote_member_list (
+	room_id     TEXT   PRIMARY KEY,
+	synced_at   BIGINT NOT NULL,
+	repaired_at BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE mx_remote_member (
+	room_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+
+	PRIMARY KEY (room_id, user_id),
+	CONSTRAINT mx_remote_member_list_fkey FOREIGN KEY (room_id) REFERENCES mx_remote_member_list (room_id) ON DELETE CASCADE
+);
+
+CREATE TABLE mx_pending_relation (
+	room_id          TEXT   NOT NULL,
+	event_id         TEXT   NOT NULL,
+	target_remote_id TEXT   NOT NULL,
+	rel_type         TEXT   NOT NULL,
+	created_at       BIGINT NOT NULL,
+
+	PRIMARY KEY (room_id, event_id)
+);
+
+CREATE INDEX mx_pending_relation_target_idx ON mx_pending_relation (room_id, target_remote_id);
+
+CREATE TABLE mx_edit_history (
+	room_id   TEXT   NOT NULL,
+	event_id  TEXT   NOT NULL,
+	edited_at BIGINT NOT NULL,
+	content   jsonb  NOT NULL,
+
+	PRIMARY KEY (room_id, event_id, edited_at)
+);
+
+CREATE TABLE mx_message_tombstone (
+	room_id    TEXT   NOT NULL,
+	remote_id  TEXT   NOT NULL,
+	event_id   TEXT   NOT NULL,
+	deleted_at BIGINT NOT NULL,
+
+	PRIMARY KEY (room_id, remote_id)
+);
+
+CREATE TABLE mx_room_nickname (
+	room_id  TEXT NOT NULL,
+	user_id  TEXT NOT NULL,
+	nickname TEXT NOT NULL,
+
+	PRIMARY KEY (room_id, user_id)
+);
+
+CREATE TABLE mx_bridged_reaction (
+	room_id   TEXT   NOT NULL,
+	target_id TEXT   NOT NULL,
+	emoji     TEXT   NOT NULL,
+	sender    TEXT   NOT NULL,
+	event_id  TEXT   NOT NULL,
+	timestamp BIGINT NOT NULL,
+
+	PRIMARY KEY (room_id, target_id, emoji, sender)
+);
+
+CREATE TABLE mx_portal_alias (
+	alias_key  TEXT PRIMARY KEY,
+	portal_key TEXT NOT NULL
+);
+
+CREATE INDEX mx_portal_alias_portal_key_idx ON mx_portal_alias (portal_key);
+
+CREATE TABLE mx_user_portal (
+	user_id       TEXT    NOT NULL,
+	room_id       TEXT    NOT NULL,
+	notifications TEXT    NOT NULL DEFAULT '',
+	login_id      TEXT    NOT NULL DEFAULT '',
+	relay_opt_out BOOLEAN NOT NULL DEFAULT false,
+	last_active   BIGINT  NOT NULL DEFAULT 0,
+
+	PRIMARY KEY (user_id, room_id)
+);
+
+CREATE TABLE mx_outbox (
+	seq        BIGINT PRIMARY KEY,
+	room_id    TEXT   NOT NULL,
+	sender     TEXT   NOT NULL,
+	event_type TEXT   NOT NULL,
+	content    jsonb  NOT NULL,
+	timestamp  BIGINT NOT NULL,
+	remote_id  TEXT   NOT NULL
+);
+
+CREATE TABLE mx_opaque_remote_id (
+	opaque_id TEXT PRIMARY KEY,
+	remote_id TEXT NOT NULL
+);
@@ -0,0 +1,14 @@
+-- v2: Add table for remote member lists used to repair ghost memberships
+CREATE TABLE mx_remote_member_list (
+	room_id     TEXT   PRIMARY KEY,
+	synced_at   BIGINT NOT NULL,
+	repaired_at BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE mx_remote_member (
+	room_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+
+	PRIMARY KEY (room_id, user_id),
+	CONSTRAINT mx_remote_member_list_fkey FOREIGN KEY (room_id) REFERENCES mx_remote_member_list (room_id) ON DELETE CASCADE
+);
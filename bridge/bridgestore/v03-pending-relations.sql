@@ -0,0 +1,12 @@
+-- v3: Add table for relations to remote messages that haven't been bridged yet
+CREATE TABLE mx_pending_relation (
+	room_id          TEXT   NOT NULL,
+	event_id         TEXT   NOT NULL,
+	target_remote_id TEXT   NOT NULL,
+	rel_type         TEXT   NOT NULL,
+	created_at       BIGINT NOT NULL,
+
+	PRIMARY KEY (room_id, event_id)
+);
+
+CREATE INDEX mx_pending_relation_target_idx ON mx_pending_relation (room_id, target_remote_id);
@@ -0,0 +1,9 @@
+-- v4: Add table for previous versions of edited messages
+CREATE TABLE mx_edit_history (
+	room_id   TEXT   NOT NULL,
+	event_id  TEXT   NOT NULL,
+	edited_at BIGINT NOT NULL,
+	content   jsonb  NOT NULL,
+
+	PRIMARY KEY (room_id, event_id, edited_at)
+);
@@ -0,0 +1,9 @@
+-- v5: Add table for tombstones of deleted messages
+CREATE TABLE mx_message_tombstone (
+	room_id    TEXT   NOT NULL,
+	remote_id  TEXT   NOT NULL,
+	event_id   TEXT   NOT NULL,
+	deleted_at BIGINT NOT NULL,
+
+	PRIMARY KEY (room_id, remote_id)
+);
@@ -0,0 +1,8 @@
+-- v6: Add table for per-room displaynames of ghosts
+CREATE TABLE mx_room_nickname (
+	room_id  TEXT NOT NULL,
+	user_id  TEXT NOT NULL,
+	nickname TEXT NOT NULL,
+
+	PRIMARY KEY (room_id, user_id)
+);
@@ -0,0 +1,11 @@
+-- v7: Add table for reactions bridged with a per-emoji cap
+CREATE TABLE mx_bridged_reaction (
+	room_id   TEXT   NOT NULL,
+	target_id TEXT   NOT NULL,
+	emoji     TEXT   NOT NULL,
+	sender    TEXT   NOT NULL,
+	event_id  TEXT   NOT NULL,
+	timestamp BIGINT NOT NULL,
+
+	PRIMARY KEY (room_id, target_id, emoji, sender)
+);
@@ -0,0 +1,7 @@
+-- v8: Add table for secondary remote IDs of portals
+CREATE TABLE mx_portal_alias (
+	alias_key  TEXT PRIMARY KEY,
+	portal_key TEXT NOT NULL
+);
+
+CREATE INDEX mx_portal_alias_portal_key_idx ON mx_portal_alias (portal_key);
@@ -0,0 +1,11 @@
+-- v9: Add table for per-user preferences in portals
+CREATE TABLE mx_user_portal (
+	user_id       TEXT    NOT NULL,
+	room_id       TEXT    NOT NULL,
+	notifications TEXT    NOT NULL DEFAULT '',
+	login_id      TEXT    NOT NULL DEFAULT '',
+	relay_opt_out BOOLEAN NOT NULL DEFAULT false,
+	last_active   BIGINT  NOT NULL DEFAULT 0,
+
+	PRIMARY KEY (user_id, room_id)
+);
@@ -0,0 +1,10 @@
+-- v10: Add table for remote events queued while the homeserver is unreachable
+CREATE TABLE mx_outbox (
+	seq        BIGINT PRIMARY KEY,
+	room_id    TEXT   NOT NULL,
+	sender     TEXT   NOT NULL,
+	event_type TEXT   NOT NULL,
+	content    jsonb  NOT NULL,
+	timestamp  BIGINT NOT NULL,
+	remote_id  TEXT   NOT NULL
+);
@@ -0,0 +1,5 @@
+-- v11: Add lookup table for hashed remote identifiers
+CREATE TABLE mx_opaque_remote_id (
+	opaque_id TEXT PRIMARY KEY,
+	remote_id TEXT NOT NULL
+);
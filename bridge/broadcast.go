@@ -0,0 +1,119 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// BroadcastRecipient is a single recipient of a broadcast list.
+type BroadcastRecipient struct {
+	// ID is the remote ID of the recipient.
+	ID string
+	// Ghost is the ghost of the recipient, used to report which users the message was delivered to.
+	Ghost Ghost
+	// Name is the displayname of the recipient, used in delivery failure notices.
+	Name string
+}
+
+// BroadcastPortal is an optional interface for portals of one-to-many chats like broadcast lists, where messages
+// sent by the user are delivered to each recipient individually on the remote network.
+//
+// Matrix messages in broadcast portals are fanned out with SendBroadcastMessage instead of ReceiveMatrixEvent.
+// Replies from recipients should be bridged into the individual DM portals, as that's where they arrive
+// on the remote network too. Reactions, redactions and other events are still passed to ReceiveMatrixEvent.
+type BroadcastPortal interface {
+	Portal
+	// IsBroadcast returns true if the portal is a broadcast list.
+	IsBroadcast() bool
+	// GetBroadcastRecipients returns the current recipients of the broadcast list.
+	GetBroadcastRecipients(ctx context.Context) ([]BroadcastRecipient, error)
+	// SendBroadcastMessage sends the Matrix message to a single recipient of the broadcast list.
+	SendBroadcastMessage(ctx context.Context, sender User, evt *event.Event, recipient BroadcastRecipient) error
+}
+
+func isBroadcastable(evt *event.Event) bool {
+	if evt.Type != event.EventMessage && evt.Type != event.EventSticker {
+		return false
+	}
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	return ok && content.NewContent == nil
+}
+
+func (mx *MatrixHandler) handleBroadcast(ctx context.Context, user User, portal BroadcastPortal, evt *event.Event) {
+	log := zerolog.Ctx(ctx)
+	recipients, err := portal.GetBroadcastRecipients(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to get broadcast recipients")
+		mx.sendMessageRejection(ctx, evt, fmt.Errorf("failed to get broadcast recipients: %w", err), event.MessageStatusNetworkError)
+		return
+	} else if len(recipients) == 0 {
+		mx.sendMessageRejection(ctx, evt, fmt.Errorf("broadcast list has no recipients"), event.MessageStatusGenericError)
+		return
+	}
+	deliveredTo := make([]id.UserID, 0, len(recipients))
+	var failed []string
+	var lastErr error
+	for _, recipient := range recipients {
+		err = portal.SendBroadcastMessage(ctx, user, evt, recipient)
+		if err != nil {
+			log.Err(err).Str("recipient_id", recipient.ID).Msg("Failed to send broadcast message to recipient")
+			name := recipient.Name
+			if name == "" {
+				name = recipient.ID
+			}
+			failed = append(failed, name)
+			lastErr = err
+		} else if recipient.Ghost != nil {
+			deliveredTo = append(deliveredTo, recipient.Ghost.GetMXID())
+		}
+	}
+	log.Debug().
+		Int("recipient_count", len(recipients)).
+		Int("failed_count", len(failed)).
+		Msg("Sent broadcast message")
+	if len(failed) == len(recipients) {
+		mx.sendMessageRejection(ctx, evt, fmt.Errorf("failed to deliver to any recipient: %w", lastErr), event.MessageStatusNetworkError)
+		return
+	}
+	mx.bridge.SendMessageSuccessCheckpoint(evt, status.MsgStepRemote, 0)
+	if mx.bridge.Config.Bridge.EnableMessageStatusEvents() {
+		statusEvent := &event.BeeperMessageStatusEventContent{
+			RelatesTo: event.RelatesTo{
+				Type:    event.RelReference,
+				EventID: evt.ID,
+			},
+			Status:           event.MessageStatusSuccess,
+			DeliveredToUsers: &deliveredTo,
+		}
+		if len(failed) > 0 {
+			statusEvent.Message = fmt.Sprintf("Delivered to %d of %d recipients", len(recipients)-len(failed), len(recipients))
+		}
+		_, err = mx.bridge.Bot.SendMessageEvent(evt.RoomID, event.BeeperMessageStatus, statusEvent)
+		if err != nil {
+			log.Err(err).Msg("Failed to send message status event")
+		}
+	}
+	if len(failed) > 0 && mx.bridge.Config.Bridge.EnableMessageErrorNotices() {
+		_, err = mx.bridge.Bot.SendMessageEvent(evt.RoomID, event.EventMessage, &event.MessageEventContent{
+			MsgType:   event.MsgNotice,
+			Body:      fmt.Sprintf("⚠ Your message was not delivered to %s.", strings.Join(failed, ", ")),
+			RelatesTo: (&event.RelatesTo{}).SetReplyTo(evt.ID),
+		})
+		if err != nil {
+			log.Err(err).Msg("Failed to send broadcast failure notice")
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrCaptionEditsNotSupported = errors.New("editing media captions is not supported")
+	ErrMediaEditsNotSupported   = errors.New("replacing media in edits is not supported")
+)
+
+// MediaEditCapabilities describes which kinds of edits to media messages a portal can bridge.
+type MediaEditCapabilities struct {
+	// Caption means the caption of a media message can be edited while keeping the same media.
+	Caption bool
+	// Replace means an edit can replace the media itself, or change a text message into a media message.
+	Replace bool
+}
+
+// MediaEditingPortal is an optional interface for portals that distinguish caption-only edits from edits
+// that replace the content of a message.
+//
+// Edits that the portal doesn't support are rejected with an appropriate error before reaching the portal.
+// Caption-only edits are passed to HandleMatrixCaptionEdit, while other edits go to ReceiveMatrixEvent as usual.
+// The edits are checked and passed to HandleMatrixCaptionEdit in the portal's event loop if the portal
+// implements MatrixEventQueueingPortal, see RunMatrixEventHandler for the deadline and connector slot.
+type MediaEditingPortal interface {
+	Portal
+	GetMediaEditCapabilities() MediaEditCapabilities
+	// HandleMatrixCaptionEdit bridges an edit that only changes the caption of a media message.
+	// The original content is the edited event, which has the same media as the new content.
+	HandleMatrixCaptionEdit(sender User, evt *event.Event, original *event.MessageEventContent)
+}
+
+// FetchEvent gets a single event from the homeserver using the bridge bot, decrypting it if necessary.
+func (br *Bridge) FetchEvent(roomID id.RoomID, eventID id.EventID) (*event.Event, error) {
+	evt, err := br.Bot.GetEvent(roomID, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get event: %w", err)
+	}
+	err = evt.Content.ParseRaw(evt.Type)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse event: %w", err)
+	}
+	if evt.Type == event.EventEncrypted {
+		if br.Crypto == nil {
+			return nil, fmt.Errorf("event is encrypted, but encryption is not enabled")
+		}
+		evt, err = br.Crypto.Decrypt(evt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt event: %w", err)
+		}
+	}
+	return evt, nil
+}
+
+func getMediaURL(content *event.MessageEventContent) id.ContentURIString {
+	if content.File != nil {
+		return content.File.URL
+	}
+	return content.URL
+}
+
+// isMediaEdit returns true if the event is an edit whose new content is a media message.
+func isMediaEdit(evt *event.Event) bool {
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	return ok && content.NewContent != nil && isMediaMessage(evt.Type, content.NewContent) &&
+		content.RelatesTo.GetReplaceID() != ""
+}
+
+// handleMediaEdit checks edits to media messages against the portal's capabilities.
+// It returns true if the event was fully handled and shouldn't be passed to ReceiveMatrixEvent.
+func (mx *MatrixHandler) handleMediaEdit(ctx context.Context, user User, portal MediaEditingPortal, evt *event.Event) bool {
+	content := evt.Content.AsMessage()
+	editTarget := content.RelatesTo.GetReplaceID()
+	log := zerolog.Ctx(ctx).With().Str("edit_target_id", editTarget.String()).Logger()
+	origEvt, err := mx.bridge.FetchEvent(evt.RoomID, editTarget)
+	if err != nil {
+		log.Err(err).Msg("Failed to fetch edit target")
+		mx.sendMessageRejection(ctx, evt, err, event.MessageStatusGenericError)
+		return true
+	}
+	original, ok := origEvt.Content.Parsed.(*event.MessageEventContent)
+	caps := portal.GetMediaEditCapabilities()
+	if ok && isMediaMessage(origEvt.Type, original) && getMediaURL(original) == getMediaURL(content.NewContent) {
+		if !caps.Caption {
+			mx.sendMessageRejection(ctx, evt, ErrCaptionEditsNotSupported, event.MessageStatusUnsupported)
+		} else {
+			log.Debug().Msg("Passing caption-only edit to portal")
+			portal.HandleMatrixCaptionEdit(user, evt, original)
+		}
+		return true
+	} else if !caps.Replace {
+		mx.sendMessageRejection(ctx, evt, ErrMediaEditsNotSupported, event.MessageStatusUnsupported)
+		return true
+	}
+	return false
+}
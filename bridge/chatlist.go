@@ -0,0 +1,67 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"math"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ChatListInfo contains the user-specific chat list flags of a remote chat.
+type ChatListInfo struct {
+	// Favorite is true if the chat is pinned or favorited on the remote network.
+	Favorite bool
+	// Order is the position of the chat among favorites, between 0 and 1. Use NoTagOrder if the network doesn't have ordering.
+	Order float64
+	// Archived is true if the chat is archived on the remote network.
+	Archived bool
+}
+
+// ChatListInfoFromTags converts Matrix room tags into a ChatListInfo.
+func ChatListInfoFromTags(tags event.Tags) ChatListInfo {
+	info := ChatListInfo{Order: NoTagOrder}
+	if fav, ok := tags[RoomTagFavourite]; ok {
+		info.Favorite = true
+		if order, err := fav.Order.Float64(); err == nil {
+			info.Order = order
+		}
+	}
+	_, info.Archived = tags[RoomTagLowPriority]
+	return info
+}
+
+// ChatListSyncingPortal is an optional interface for portals that can bridge chat list changes from Matrix
+// (like favoriting or archiving a room) to the remote network.
+type ChatListSyncingPortal interface {
+	Portal
+	HandleMatrixChatListUpdate(user User, info ChatListInfo)
+}
+
+// SyncChatListInfo applies remote chat list flags to Matrix room tags using the user's double puppet.
+func (br *Bridge) SyncChatListInfo(user User, roomID id.RoomID, info ChatListInfo) error {
+	order := info.Order
+	if !math.IsNaN(order) {
+		order = math.Max(0, math.Min(1, order))
+	}
+	err := br.SetPortalTag(user, roomID, RoomTagFavourite, info.Favorite, order)
+	if err != nil {
+		return err
+	}
+	return br.SetPortalTag(user, roomID, RoomTagLowPriority, info.Archived, NoTagOrder)
+}
+
+// HandleMatrixRoomTags bridges a m.tag room account data change to the portal. Bridges that sync the account data
+// of double puppets should call this whenever the tags of a portal room change.
+func (br *Bridge) HandleMatrixRoomTags(user User, roomID id.RoomID, content *event.TagEventContent) {
+	portal, ok := br.Child.GetIPortal(roomID).(ChatListSyncingPortal)
+	if !ok {
+		return
+	}
+	portal.HandleMatrixChatListUpdate(user, ChatListInfoFromTags(content.Tags))
+}
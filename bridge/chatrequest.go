@@ -0,0 +1,72 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// RoomTagChatRequest is the room tag added to portals of pending chat requests.
+const RoomTagChatRequest = "fi.mau.chat_request"
+
+var ErrChatRequestPending = errors.New("the chat request must be accepted before sending messages")
+
+// ChatRequestPortal is an optional interface for portals of chats that may be pending "message requests"
+// on the remote network. Matrix events in pending portals are rejected until the request is accepted.
+type ChatRequestPortal interface {
+	Portal
+	IsPendingChatRequest() bool
+	// AcceptChatRequest accepts the request on the remote network, after which normal bridging starts.
+	AcceptChatRequest(ctx context.Context, user User) error
+	// DeclineChatRequest declines the request on the remote network. The portal is responsible for cleaning up the room.
+	DeclineChatRequest(ctx context.Context, user User) error
+}
+
+// HandleRemoteChatRequest should be called after creating the portal room for a remote chat request.
+// It tags the room so clients can show it separately (if the user has double puppeting enabled)
+// and sends a notice explaining how to accept or decline the request.
+func (br *Bridge) HandleRemoteChatRequest(ctx context.Context, user User, portal ChatRequestPortal, roomID id.RoomID) error {
+	err := br.SetPortalTag(user, roomID, RoomTagChatRequest, true, NoTagOrder)
+	if err != nil && !errors.Is(err, ErrNoDoublePuppet) {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to tag chat request room")
+	}
+	prefix := br.Config.Bridge.GetCommandPrefix()
+	_, err = br.sendPortalEvent(portal, portal.MainIntent(), roomID, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body: fmt.Sprintf("This is a message request. The sender won't know you've seen their messages until you accept it. "+
+			"Use `%s accept-request` to accept or `%s decline-request` to decline.", prefix, prefix),
+	})
+	return err
+}
+
+// FinishChatRequest removes the chat request tag from the portal room after the request was accepted.
+func (br *Bridge) FinishChatRequest(user User, roomID id.RoomID) error {
+	err := br.SetPortalTag(user, roomID, RoomTagChatRequest, false, NoTagOrder)
+	if errors.Is(err, ErrNoDoublePuppet) {
+		return nil
+	}
+	return err
+}
+
+func (mx *MatrixHandler) chatRequestMiddleware(next MatrixEventHandler) MatrixEventHandler {
+	return func(user User, portal Portal, evt *event.Event) {
+		if crp, ok := portal.(ChatRequestPortal); ok && crp.IsPendingChatRequest() {
+			log := mx.log.With().Str("event_id", evt.ID.String()).Logger()
+			log.Debug().Msg("Rejecting event in pending chat request")
+			go mx.sendMessageRejection(log.WithContext(EventContext(evt)), evt, ErrChatRequestPending, event.MessageStatusNoPermission)
+			return
+		}
+		next(user, portal, evt)
+	}
+}
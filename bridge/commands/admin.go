@@ -7,8 +7,10 @@
 package commands
 
 import (
+	"context"
 	"strconv"
 
+	"maunium.net/go/mautrix/bridge"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -75,3 +77,41 @@ var CommandSetPowerLevel = &FullHandler{
 	RequiresAdmin:  true,
 	RequiresPortal: true,
 }
+
+func fnMigrateGhosts(ce *Event) {
+	migrator, ok := ce.Bridge.Child.(bridge.GhostMigratingBridge)
+	if !ok {
+		ce.Reply("This bridge does not support migrating ghosts")
+		return
+	}
+	migrations := migrator.GetGhostMigrations()
+	if len(migrations) == 0 {
+		ce.Reply("No ghosts need to be migrated")
+		return
+	}
+	ce.Reply("Migrating %d ghosts to new user IDs...", len(migrations))
+	ctx := ce.ZLog.WithContext(context.Background())
+	var rooms, failed int
+	for oldMXID, ghost := range migrations {
+		migratedRooms, err := ce.Bridge.MigrateGhost(ctx, oldMXID, ghost)
+		rooms += migratedRooms
+		if err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		ce.Reply("Migrated ghosts in %d rooms, but %d ghosts had errors. Check the logs for more info.", rooms, failed)
+	} else {
+		ce.Reply("Successfully migrated %d ghosts in %d rooms", len(migrations), rooms)
+	}
+}
+
+var CommandMigrateGhosts = &FullHandler{
+	Func: fnMigrateGhosts,
+	Name: "migrate-ghosts",
+	Help: HelpMeta{
+		Section:     HelpSectionAdmin,
+		Description: "Move ghosts to new user IDs after changing the username template.",
+	},
+	RequiresAdmin: true,
+}
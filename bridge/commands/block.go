@@ -0,0 +1,71 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"context"
+	"errors"
+
+	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/id"
+)
+
+var CommandBlock = &FullHandler{
+	Func: fnBlock,
+	Name: "block",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "Block a remote user.",
+		Args:        "<_Matrix user ID_>",
+	},
+	RequiresLogin: true,
+}
+
+var CommandUnblock = &FullHandler{
+	Func: fnBlock,
+	Name: "unblock",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "Unblock a remote user.",
+		Args:        "<_Matrix user ID_>",
+	},
+	RequiresLogin: true,
+}
+
+func fnBlock(ce *Event) {
+	bu, ok := ce.User.(bridge.BlockingUser)
+	if !ok {
+		ce.Reply("This bridge doesn't support blocking users")
+		return
+	} else if len(ce.Args) != 1 {
+		ce.Reply("**Usage:** `$cmdprefix %s <Matrix user ID>`", ce.Command)
+		return
+	}
+	userID := id.UserID(ce.Args[0])
+	if !ce.Bridge.Child.IsGhost(userID) {
+		ce.Reply("%s is not a remote user", userID)
+		return
+	}
+	ghost := ce.Bridge.Child.GetIGhost(userID)
+	if ghost == nil {
+		ce.Reply("User %s not found", userID)
+		return
+	}
+	blocked := ce.Command == "block"
+	ctx := ce.ZLog.WithContext(context.Background())
+	err := bu.SetGhostBlocked(ctx, ghost, blocked)
+	if err != nil {
+		ce.ZLog.Err(err).Str("ghost_user_id", userID.String()).Bool("blocked", blocked).Msg("Failed to change block status")
+		ce.Reply("Failed to %s user: %v", ce.Command, err)
+		return
+	}
+	err = ce.Bridge.HandleRemoteBlock(ce.User, ghost, blocked)
+	if err != nil && !errors.Is(err, bridge.ErrNoDoublePuppet) {
+		ce.ZLog.Warn().Err(err).Msg("Failed to update Matrix ignore list after changing block status")
+	}
+	ce.React("✅")
+}
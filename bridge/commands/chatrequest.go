@@ -0,0 +1,79 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"context"
+
+	"maunium.net/go/mautrix/bridge"
+)
+
+var CommandAcceptRequest = &FullHandler{
+	Func: fnAcceptRequest,
+	Name: "accept-request",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "Accept the message request in the current portal.",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+var CommandDeclineRequest = &FullHandler{
+	Func: fnDeclineRequest,
+	Name: "decline-request",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "Decline the message request in the current portal.",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func (ce *Event) getPendingChatRequest() bridge.ChatRequestPortal {
+	portal, ok := ce.Portal.(bridge.ChatRequestPortal)
+	if !ok {
+		ce.Reply("This bridge doesn't support message requests")
+		return nil
+	} else if !portal.IsPendingChatRequest() {
+		ce.Reply("This chat is not a pending message request")
+		return nil
+	}
+	return portal
+}
+
+func fnAcceptRequest(ce *Event) {
+	portal := ce.getPendingChatRequest()
+	if portal == nil {
+		return
+	}
+	ctx := ce.ZLog.WithContext(context.Background())
+	err := portal.AcceptChatRequest(ctx, ce.User)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to accept chat request")
+		ce.Reply("Failed to accept message request: %v", err)
+		return
+	}
+	err = ce.Bridge.FinishChatRequest(ce.User, ce.RoomID)
+	if err != nil {
+		ce.ZLog.Warn().Err(err).Msg("Failed to remove chat request tag")
+	}
+	ce.Reply("Message request accepted")
+}
+
+func fnDeclineRequest(ce *Event) {
+	portal := ce.getPendingChatRequest()
+	if portal == nil {
+		return
+	}
+	ctx := ce.ZLog.WithContext(context.Background())
+	err := portal.DeclineChatRequest(ctx, ce.User)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to decline chat request")
+		ce.Reply("Failed to decline message request: %v", err)
+	}
+}
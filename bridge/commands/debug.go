@@ -0,0 +1,161 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/id"
+)
+
+var CommandTrace = &FullHandler{
+	Func: fnTrace,
+	Name: "trace",
+	Help: HelpMeta{
+		Section:     HelpSectionAdmin,
+		Description: "Show the database mapping and status of a message.",
+		Args:        "<_event ID or remote ID_>",
+	},
+	RequiresAdmin: true,
+}
+
+func fnTrace(ce *Event) {
+	tracer, ok := ce.Bridge.Child.(bridge.MessageTracingBridge)
+	if !ok {
+		ce.Reply("This bridge doesn't support tracing messages")
+		return
+	} else if len(ce.Args) != 1 {
+		ce.Reply("**Usage:** `$cmdprefix trace <event ID or remote ID>`")
+		return
+	}
+	ctx := ce.ZLog.WithContext(context.Background())
+	traces, err := tracer.TraceMessage(ctx, ce.Args[0])
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to trace message")
+		ce.Reply("Failed to trace message: %v", err)
+		return
+	} else if len(traces) == 0 {
+		ce.Reply("No messages found matching `%s`", ce.Args[0])
+		return
+	}
+	var out strings.Builder
+	_, _ = fmt.Fprintf(&out, "Found %d message parts:\n\n", len(traces))
+	for i, trace := range traces {
+		if i > 0 {
+			out.WriteString("\n")
+		}
+		formatMessageTrace(&out, trace)
+	}
+	ce.Reply(out.String())
+}
+
+func formatMessageTrace(out *strings.Builder, trace *bridge.MessageTrace) {
+	_, _ = fmt.Fprintf(out, "* Matrix: `%s` in `%s`\n", trace.MXID, trace.RoomID)
+	_, _ = fmt.Fprintf(out, "  * Remote ID: `%s`", trace.RemoteID)
+	if trace.PartID != "" {
+		_, _ = fmt.Fprintf(out, " (part `%s`)", trace.PartID)
+	}
+	out.WriteString("\n")
+	if trace.Sender != "" {
+		_, _ = fmt.Fprintf(out, "  * Sender: `%s`\n", trace.Sender)
+	}
+	if !trace.Timestamp.IsZero() {
+		_, _ = fmt.Fprintf(out, "  * Remote timestamp: %s\n", trace.Timestamp.UTC().Format(time.RFC3339Nano))
+	}
+	_, _ = fmt.Fprintf(out, "  * Edits: %d\n", trace.EditCount)
+	if len(trace.Reactions) > 0 {
+		_, _ = fmt.Fprintf(out, "  * Reactions: %d\n", len(trace.Reactions))
+		for _, reaction := range trace.Reactions {
+			_, _ = fmt.Fprintf(out, "    * %s by `%s` (`%s`)\n", reaction.Key, reaction.Sender, reaction.MXID)
+		}
+	}
+	if trace.MatrixStatus != "" {
+		_, _ = fmt.Fprintf(out, "  * Matrix → remote status: %s\n", trace.MatrixStatus)
+	}
+	if trace.RemoteStatus != "" {
+		_, _ = fmt.Fprintf(out, "  * Remote → Matrix status: %s\n", trace.RemoteStatus)
+	}
+}
+
+var CommandDoctor = &FullHandler{
+	Func: fnDoctor,
+	Name: "doctor",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "Check the health of the bridge and your connection to it.",
+	},
+}
+
+func fnDoctor(ce *Event) {
+	ctx := ce.ZLog.WithContext(context.Background())
+	var roomID id.RoomID
+	if ce.RoomID != ce.User.GetManagementRoomID() {
+		roomID = ce.RoomID
+	}
+	results := ce.Bridge.RunDiagnostics(ctx, ce.User, roomID)
+	var out strings.Builder
+	failed := 0
+	for _, res := range results {
+		icon := "✅"
+		if !res.OK {
+			icon = "❌"
+			failed++
+		}
+		_, _ = fmt.Fprintf(&out, "* %s **%s**: %s\n", icon, res.Name, res.Message)
+		if res.Hint != "" {
+			_, _ = fmt.Fprintf(&out, "  * Hint: %s\n", res.Hint)
+		}
+	}
+	if failed == 0 {
+		out.WriteString("\nNo problems found")
+	} else {
+		_, _ = fmt.Fprintf(&out, "\n%d checks failed", failed)
+	}
+	ce.Reply(out.String())
+}
+
+var CommandTimings = &FullHandler{
+	Func: fnTimings,
+	Name: "timings",
+	Help: HelpMeta{
+		Section:     HelpSectionAdmin,
+		Description: "Show how long handling recent events in this portal took.",
+	},
+	RequiresAdmin:  true,
+	RequiresPortal: true,
+}
+
+func fnTimings(ce *Event) {
+	stats := ce.Bridge.GetEventTimingStats(ce.Portal)
+	if len(stats) == 0 {
+		ce.Reply("No events have been handled in this portal since the bridge was started")
+		return
+	}
+	var out strings.Builder
+	for _, typeStats := range stats {
+		_, _ = fmt.Fprintf(&out, "* `%s`: %d events, average %s, max %s\n",
+			typeStats.EventType, typeStats.Count, formatTiming(typeStats.Average), formatTiming(typeStats.Max))
+		phases := make([]string, 0, len(typeStats.Phases))
+		for phase := range typeStats.Phases {
+			phases = append(phases, phase)
+		}
+		sort.Strings(phases)
+		for _, phase := range phases {
+			_, _ = fmt.Fprintf(&out, "  * %s: average %s\n", phase, formatTiming(typeStats.Phases[phase]))
+		}
+	}
+	ce.Reply(out.String())
+}
+
+func formatTiming(duration time.Duration) string {
+	return duration.Round(100 * time.Microsecond).String()
+}
@@ -12,13 +12,25 @@ var CommandLoginMatrix = &FullHandler{
 	Help: HelpMeta{
 		Section:     HelpSectionAuth,
 		Description: "Enable double puppeting.",
-		Args:        "<_access token_>",
+		Args:        "[_access token_]",
 	},
 	RequiresLogin: true,
 }
 
 func fnLoginMatrix(ce *Event) {
-	if len(ce.Args) == 0 {
+	var accessToken string
+	if len(ce.Args) > 0 {
+		accessToken = ce.Args[0]
+	} else if ce.Bridge.DoublePuppet.CanAutoSetup(ce.User.GetMXID()) {
+		var err error
+		_, accessToken, err = ce.Bridge.DoublePuppet.Setup(ce.User.GetMXID(), "", true)
+		if err != nil {
+			ce.ZLog.Warn().Err(err).Msg("Failed to automatically set up double puppeting")
+			ce.Reply("Failed to automatically enable double puppeting: %v\n\n"+
+				"You can still log in manually with `$cmdprefix login-matrix <access token>`", err)
+			return
+		}
+	} else {
 		ce.Reply("**Usage:** `login-matrix <access token>`")
 		return
 	}
@@ -30,7 +42,7 @@ func fnLoginMatrix(ce *Event) {
 			return
 		}
 	}
-	err := puppet.SwitchCustomMXID(ce.Args[0], ce.User.GetMXID())
+	err := puppet.SwitchCustomMXID(accessToken, ce.User.GetMXID())
 	if err != nil {
 		ce.Reply("Failed to enable double puppeting: %v", err)
 	} else {
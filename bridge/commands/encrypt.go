@@ -0,0 +1,41 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"context"
+	"errors"
+
+	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/event"
+)
+
+var CommandEncrypt = &FullHandler{
+	Func: fnEncrypt,
+	Name: "encrypt",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "Enable end-to-bridge encryption in the current portal.",
+	},
+	RequiresPortal:     true,
+	RequiresEventLevel: event.StateEncryption,
+}
+
+func fnEncrypt(ce *Event) {
+	ctx := ce.ZLog.WithContext(context.Background())
+	err := ce.Bridge.EnablePortalEncryption(ctx, ce.Portal, ce.RoomID)
+	if errors.Is(err, bridge.ErrEncryptionNotAvailable) {
+		ce.Reply("This bridge instance doesn't have end-to-bridge encryption enabled")
+	} else if errors.Is(err, bridge.ErrPortalAlreadyEncrypted) {
+		ce.Reply("This portal is already encrypted")
+	} else if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to enable encryption in portal")
+		ce.Reply("Failed to enable encryption: %v", err)
+	} else {
+		ce.Reply("Successfully enabled encryption in this portal")
+	}
+}
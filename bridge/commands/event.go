@@ -71,6 +71,11 @@ func (ce *Event) ReplyAdvanced(msg string, allowMarkdown, allowHTML bool) {
 	}
 }
 
+// getRepliedEvent fetches the event the command is replying to, decrypting it if necessary.
+func (ce *Event) getRepliedEvent() (*event.Event, error) {
+	return ce.Bridge.FetchEvent(ce.RoomID, ce.ReplyTo)
+}
+
 // React sends a reaction to the command.
 func (ce *Event) React(key string) {
 	_, err := ce.MainIntent().SendReaction(ce.RoomID, ce.EventID, key)
@@ -0,0 +1,187 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/jsontime"
+)
+
+var CommandExportData = &FullHandler{
+	Func: fnExportData,
+	Name: "export-data",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "Export your logins, portals and message mappings to move them to another bridge instance.",
+		Args:        "[--include-secrets]",
+	},
+	RequiresLogin: true,
+}
+
+func fnExportData(ce *Event) {
+	exporter, ok := ce.User.(bridge.DataExportingUser)
+	if !ok {
+		ce.Reply("This bridge doesn't support exporting user data")
+		return
+	}
+	includeSecrets := len(ce.Args) > 0 && ce.Args[0] == "--include-secrets"
+	if includeSecrets && ce.RoomID != ce.User.GetManagementRoomID() {
+		ce.Reply("Exports including secrets can only be created in your management room")
+		return
+	} else if includeSecrets && (ce.Bridge.Crypto == nil || !ce.Bridge.StateStore.IsEncrypted(ce.RoomID)) {
+		ce.Reply("Exports including secrets can only be created in an encrypted management room")
+		return
+	}
+	export, err := exporter.ExportData(includeSecrets)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to export user data")
+		ce.Reply("Failed to export data: %v", err)
+		return
+	}
+	export.Version = bridge.UserDataExportVersion
+	export.Bridge = ce.Bridge.Name
+	export.UserID = ce.User.GetMXID()
+	export.ExportedAt = jsontime.UnixMilliNow()
+	export.IncludeSecrets = includeSecrets
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		ce.Reply("Failed to marshal export: %v", err)
+		return
+	}
+	fileName := fmt.Sprintf("%s-export-%s.json", ce.Bridge.Name, time.Now().Format("2006-01-02"))
+	size := len(data)
+	uploadMime := "application/json"
+	var file *attachment.EncryptedFile
+	if includeSecrets {
+		// Secrets must never be uploaded in plaintext, as media can't be deleted and anyone with the mxc URI can download it.
+		file = attachment.NewEncryptedFile()
+		file.EncryptInPlace(data)
+		uploadMime = "application/octet-stream"
+	}
+	resp, err := ce.Bot.UploadBytesWithName(data, uploadMime, fileName)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to upload user data export")
+		ce.Reply("Failed to upload export: %v", err)
+		return
+	}
+	content := &event.MessageEventContent{
+		MsgType: event.MsgFile,
+		Body:    fileName,
+		Info: &event.FileInfo{
+			MimeType: "application/json",
+			Size:     size,
+		},
+	}
+	if file != nil {
+		content.File = &event.EncryptedFileInfo{
+			EncryptedFile: *file,
+			URL:           resp.ContentURI.CUString(),
+		}
+	} else {
+		content.URL = resp.ContentURI.CUString()
+	}
+	wrapped := &event.Content{Parsed: content}
+	evtType := event.EventMessage
+	if includeSecrets {
+		err = ce.Bridge.Crypto.Encrypt(ce.RoomID, evtType, wrapped)
+		if err != nil {
+			ce.ZLog.Err(err).Msg("Failed to encrypt user data export event")
+			ce.Reply("Failed to encrypt export: %v", err)
+			return
+		}
+		evtType = event.EventEncrypted
+	}
+	_, err = ce.MainIntent().SendMessageEvent(ce.RoomID, evtType, wrapped)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to send user data export")
+		ce.Reply("Failed to send export: %v", err)
+		return
+	}
+	if includeSecrets {
+		ce.Reply("The export contains your login secrets, make sure to delete it after importing")
+	}
+}
+
+var CommandImportData = &FullHandler{
+	Func: fnImportData,
+	Name: "import-data",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "Import data exported from another bridge instance. Must be sent as a reply to the export file.",
+	},
+}
+
+func fnImportData(ce *Event) {
+	importer, ok := ce.User.(bridge.DataExportingUser)
+	if !ok {
+		ce.Reply("This bridge doesn't support importing user data")
+		return
+	} else if ce.ReplyTo == "" {
+		ce.Reply("**Usage:** reply to an export file with `$cmdprefix import-data`")
+		return
+	}
+	data, err := ce.downloadRepliedFile()
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to download user data export")
+		ce.Reply("Failed to download export: %v", err)
+		return
+	}
+	export, err := bridge.ParseUserDataExport(data, ce.Bridge.Name)
+	if err != nil {
+		ce.Reply("Invalid export: %v", err)
+		return
+	}
+	err = importer.ImportData(export)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to import user data")
+		ce.Reply("Failed to import data: %v", err)
+		return
+	}
+	ce.ZLog.Info().
+		Str("exported_by", export.UserID.String()).
+		Int("portal_count", len(export.Portals)).
+		Msg("Imported user data")
+	ce.Reply("Successfully imported %d portals exported by %s", len(export.Portals), export.UserID)
+}
+
+func (ce *Event) downloadRepliedFile() ([]byte, error) {
+	evt, err := ce.getRepliedEvent()
+	if err != nil {
+		return nil, err
+	}
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok || content.MsgType != event.MsgFile {
+		return nil, fmt.Errorf("replied event is not a file")
+	}
+	var mxc id.ContentURI
+	if content.File != nil {
+		mxc, err = content.File.URL.Parse()
+	} else {
+		mxc, err = content.URL.Parse()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid file URL: %w", err)
+	}
+	data, err := ce.Bot.DownloadBytes(mxc)
+	if err != nil {
+		return nil, err
+	}
+	if content.File != nil {
+		err = content.File.DecryptInPlace(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt file: %w", err)
+		}
+	}
+	return data, nil
+}
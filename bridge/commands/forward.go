@@ -0,0 +1,58 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"context"
+	"strings"
+
+	"maunium.net/go/mautrix/id"
+)
+
+var CommandForward = &FullHandler{
+	Func: fnForward,
+	Name: "forward",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "Forward a message to another portal. Must be sent as a reply to the message.",
+		Args:        "<_room ID or alias_>",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnForward(ce *Event) {
+	if len(ce.Args) == 0 || ce.ReplyTo == "" {
+		ce.Reply("**Usage:** reply to a message with `$cmdprefix forward <room ID or alias>`")
+		return
+	}
+	targetRoomID := id.RoomID(ce.Args[0])
+	if strings.HasPrefix(ce.Args[0], "#") {
+		resp, err := ce.Bot.ResolveAlias(id.RoomAlias(ce.Args[0]))
+		if err != nil {
+			ce.Reply("Failed to resolve alias: %v", err)
+			return
+		}
+		targetRoomID = resp.RoomID
+	} else if !strings.HasPrefix(ce.Args[0], "!") {
+		ce.Reply("That doesn't look like a room ID or alias")
+		return
+	}
+	evt, err := ce.getRepliedEvent()
+	if err != nil {
+		ce.Reply("Failed to get message: %v", err)
+		return
+	}
+	ctx := ce.ZLog.WithContext(context.Background())
+	_, err = ce.Bridge.ForwardMessage(ctx, ce.User, evt, targetRoomID)
+	if err != nil {
+		ce.ZLog.Err(err).Str("target_room_id", targetRoomID.String()).Msg("Failed to forward message")
+		ce.Reply("Failed to forward message: %v", err)
+	} else {
+		ce.React("✅")
+	}
+}
@@ -72,7 +72,7 @@ func (fh *FullHandler) GetAliases() []string {
 }
 
 func (fh *FullHandler) ShowInHelp(ce *Event) bool {
-	return !fh.RequiresAdmin || ce.User.GetPermissionLevel() >= bridgeconfig.PermissionLevelAdmin
+	return ce.Processor.CheckPermission(ce.User, ce.RoomID, fh.Name) == nil
 }
 
 func (fh *FullHandler) userHasRoomPermission(ce *Event) bool {
@@ -86,8 +86,8 @@ func (fh *FullHandler) userHasRoomPermission(ce *Event) bool {
 }
 
 func (fh *FullHandler) Run(ce *Event) {
-	if fh.RequiresAdmin && ce.User.GetPermissionLevel() < bridgeconfig.PermissionLevelAdmin {
-		ce.Reply("That command is limited to bridge administrators.")
+	if err := ce.Processor.CheckPermission(ce.User, ce.RoomID, fh.Name); err != nil {
+		ce.Reply("%s.", capitalizeFirst(err.Error()))
 	} else if fh.RequiresEventLevel.Type != "" && ce.User.GetPermissionLevel() < bridgeconfig.PermissionLevelAdmin && !fh.userHasRoomPermission(ce) {
 		ce.Reply("That command requires room admin rights.")
 	} else if fh.RequiresPortal && ce.Portal == nil {
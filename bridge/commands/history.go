@@ -0,0 +1,60 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var CommandHistory = &FullHandler{
+	Func: fnHistory,
+	Name: "history",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "List previous versions of an edited message. Must be sent as a reply to the message or with its event ID.",
+		Args:        "[_event ID_]",
+	},
+	RequiresPortal: true,
+}
+
+func fnHistory(ce *Event) {
+	eventID := ce.ReplyTo
+	if len(ce.Args) > 0 {
+		eventID = id.EventID(ce.Args[0])
+	}
+	if eventID == "" || !strings.HasPrefix(eventID.String(), "$") {
+		ce.Reply("**Usage:** reply to a message with `$cmdprefix history` or use `$cmdprefix history <event ID>`")
+		return
+	}
+	history, err := ce.Bridge.BridgeStore.GetEditHistory(ce.RoomID, eventID)
+	if err != nil {
+		ce.ZLog.Err(err).Str("event_id", eventID.String()).Msg("Failed to get edit history")
+		ce.Reply("Failed to get edit history: %v", err)
+		return
+	} else if len(history) == 0 {
+		ce.Reply("No edit history stored for that message")
+		return
+	}
+	lines := make([]string, len(history))
+	for i, entry := range history {
+		lines[i] = formatHistoryVersion(i+1, entry.EditedAt, entry.Content)
+	}
+	ce.Reply("Previous versions of the message:\n\n%s", strings.Join(lines, "\n"))
+}
+
+func formatHistoryVersion(index int, editedAt time.Time, content *event.MessageEventContent) string {
+	body := ""
+	if content != nil {
+		body = strings.ReplaceAll(content.Body, "\n", " ")
+	}
+	return fmt.Sprintf("%d. Replaced at %s: %s", index, editedAt.UTC().Format(time.RFC3339), body)
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"maunium.net/go/mautrix/bridge"
+)
+
+var CommandConfirmIdentity = &FullHandler{
+	Func: fnConfirmIdentity,
+	Name: "confirm-identity",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "Confirm identity changes of users in the current portal to allow sending messages again.",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnConfirmIdentity(ce *Event) {
+	portal, ok := ce.Portal.(bridge.IdentityGatedPortal)
+	if !ok {
+		ce.Reply("This bridge doesn't track identity changes")
+		return
+	}
+	count, err := bridge.AcknowledgeIdentityChanges(portal)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to acknowledge identity changes")
+		ce.Reply("Failed to confirm identity changes: %v", err)
+	} else if count == 0 {
+		ce.Reply("There are no unconfirmed identity changes in this chat")
+	} else {
+		ce.ZLog.Info().Int("ghost_count", count).Msg("Acknowledged identity changes")
+		ce.React("✅")
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"context"
+	"errors"
+
+	"maunium.net/go/mautrix/bridge"
+)
+
+var CommandRefreshMedia = &FullHandler{
+	Func: fnRefreshMedia,
+	Name: "refresh-media",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "Download expired media again. Must be sent as a reply to the media message.",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnRefreshMedia(ce *Event) {
+	portal, ok := ce.Portal.(bridge.MediaRefreshingPortal)
+	if !ok {
+		ce.Reply("This bridge doesn't support refreshing media")
+		return
+	} else if ce.ReplyTo == "" {
+		ce.Reply("**Usage:** reply to a media message with `$cmdprefix refresh-media`")
+		return
+	}
+	evt, err := ce.getRepliedEvent()
+	if err != nil {
+		ce.Reply("Failed to get message: %v", err)
+		return
+	}
+	ctx := ce.ZLog.WithContext(context.Background())
+	err = ce.Bridge.RefreshMedia(ctx, ce.User, portal, evt)
+	if errors.Is(err, bridge.ErrMediaNotRefreshable) {
+		ce.Reply("That message doesn't have refreshable media")
+	} else if err != nil {
+		ce.ZLog.Err(err).Str("target_event_id", evt.ID.String()).Msg("Failed to refresh media")
+		ce.Reply("Failed to refresh media: %v", err)
+	} else {
+		ce.React("✅")
+	}
+}
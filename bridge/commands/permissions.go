@@ -0,0 +1,148 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrCommandNotPermitted       = errors.New("you don't have permission to use that command")
+	ErrCommandAdminOnly          = errors.New("that command is limited to bridge administrators")
+	ErrCommandManagementRoomOnly = errors.New("that command can only be used in your management room")
+	ErrCommandRateLimited        = errors.New("you're using that command too often, please try again later")
+)
+
+type commandRateLimitKey struct {
+	UserID  id.UserID
+	Command string
+}
+
+func (proc *Processor) getCommandPermission(command string) (bridgeconfig.CommandPermission, bool) {
+	cpc, ok := proc.bridge.Config.Bridge.(bridgeconfig.CommandPermissionsBridgeConfig)
+	if !ok {
+		return bridgeconfig.CommandPermission{}, false
+	}
+	perm, ok := cpc.GetCommandPermissions()[command]
+	return perm, ok
+}
+
+func (proc *Processor) getPermissionRoles() bridgeconfig.RoleConfig {
+	prc, ok := proc.bridge.Config.Bridge.(bridgeconfig.PermissionRolesBridgeConfig)
+	if !ok {
+		return nil
+	}
+	return prc.GetPermissionRoles()
+}
+
+// GetUserRoles returns the custom roles that the given user has.
+func (proc *Processor) GetUserRoles(userID id.UserID) []string {
+	return proc.getPermissionRoles().Get(userID)
+}
+
+// GetRequiredLevel returns the permission level required to use the given command in the given room,
+// taking per-command and per-room overrides in the config into account.
+func (proc *Processor) GetRequiredLevel(roomID id.RoomID, command string) bridgeconfig.PermissionLevel {
+	if realCommand, ok := proc.aliases[command]; ok {
+		command = realCommand
+	}
+	if perm, ok := proc.getCommandPermission(command); ok {
+		if level, ok := perm.Rooms[roomID]; ok {
+			return level
+		} else if perm.Level != nil {
+			return *perm.Level
+		}
+	}
+	if fh, ok := proc.handlers[command].(*FullHandler); ok && fh.RequiresAdmin {
+		return bridgeconfig.PermissionLevelAdmin
+	}
+	return bridgeconfig.PermissionLevelBlock
+}
+
+// CheckPermission checks whether the user is allowed to use the given command in the given room.
+// This doesn't count towards the command's rate limit.
+func (proc *Processor) CheckPermission(user bridge.User, roomID id.RoomID, command string) error {
+	if realCommand, ok := proc.aliases[command]; ok {
+		command = realCommand
+	}
+	perm, hasPerm := proc.getCommandPermission(command)
+	required := proc.GetRequiredLevel(roomID, command)
+	if user.GetPermissionLevel() < required && !proc.hasAnyRole(user.GetMXID(), perm.Roles) {
+		if required >= bridgeconfig.PermissionLevelAdmin {
+			return ErrCommandAdminOnly
+		}
+		return ErrCommandNotPermitted
+	}
+	if hasPerm && perm.ManagementRoomOnly && user.GetManagementRoomID() != roomID {
+		return ErrCommandManagementRoomOnly
+	}
+	return nil
+}
+
+func (proc *Processor) hasAnyRole(userID id.UserID, roles []string) bool {
+	if len(roles) == 0 {
+		return false
+	}
+	roleConfig := proc.getPermissionRoles()
+	for _, role := range roles {
+		if roleConfig.Has(userID, role) {
+			return true
+		}
+	}
+	return false
+}
+
+func (proc *Processor) checkRateLimit(user bridge.User, command string) error {
+	perm, ok := proc.getCommandPermission(command)
+	if !ok || perm.RateLimit <= 0 || user.GetPermissionLevel() >= bridgeconfig.PermissionLevelAdmin {
+		return nil
+	}
+	key := commandRateLimitKey{UserID: user.GetMXID(), Command: command}
+	now := time.Now()
+	cutoff := now.Add(-time.Minute)
+	proc.rateLimitLock.Lock()
+	defer proc.rateLimitLock.Unlock()
+	if now.Sub(proc.rateLimitsPruned) > time.Minute {
+		proc.pruneRateLimits(cutoff)
+		proc.rateLimitsPruned = now
+	}
+	recent := proc.rateLimits[key][:0]
+	for _, ts := range proc.rateLimits[key] {
+		if ts.After(cutoff) {
+			recent = append(recent, ts)
+		}
+	}
+	if len(recent) >= perm.RateLimit {
+		proc.rateLimits[key] = recent
+		return ErrCommandRateLimited
+	}
+	proc.rateLimits[key] = append(recent, now)
+	return nil
+}
+
+// pruneRateLimits deletes the rate limit entries of users who haven't used the command since the cutoff.
+// The rate limit lock must be held.
+func (proc *Processor) pruneRateLimits(cutoff time.Time) {
+	for key, timestamps := range proc.rateLimits {
+		if len(timestamps) == 0 || !timestamps[len(timestamps)-1].After(cutoff) {
+			delete(proc.rateLimits, key)
+		}
+	}
+}
+
+func capitalizeFirst(msg string) string {
+	if msg == "" {
+		return msg
+	}
+	return strings.ToUpper(msg[:1]) + msg[1:]
+}
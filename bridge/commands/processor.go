@@ -9,6 +9,8 @@ package commands
 import (
 	"runtime/debug"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog"
 	"maunium.net/go/maulogger/v2/maulogadapt"
@@ -23,6 +25,10 @@ type Processor struct {
 
 	handlers map[string]Handler
 	aliases  map[string]string
+
+	rateLimits       map[commandRateLimitKey][]time.Time
+	rateLimitsPruned time.Time
+	rateLimitLock    sync.Mutex
 }
 
 // NewProcessor creates a Processor
@@ -33,11 +39,19 @@ func NewProcessor(bridge *bridge.Bridge) *Processor {
 
 		handlers: make(map[string]Handler),
 		aliases:  make(map[string]string),
+
+		rateLimits: make(map[commandRateLimitKey][]time.Time),
 	}
 	proc.AddHandlers(
 		CommandHelp, CommandVersion, CommandCancel,
 		CommandLoginMatrix, CommandLogoutMatrix, CommandPingMatrix,
-		CommandDiscardMegolmSession, CommandSetPowerLevel)
+		CommandDiscardMegolmSession, CommandSetPowerLevel, CommandMigrateGhosts,
+		CommandExportData, CommandImportData, CommandRefreshMedia, CommandForward,
+		CommandSync, CommandTrace, CommandDoctor, CommandSubscribe, CommandUnsubscribe,
+		CommandTranslate, CommandConfirmIdentity, CommandReport,
+		CommandBlock, CommandUnblock, CommandAcceptRequest, CommandDeclineRequest,
+		CommandRecreateRoom, CommandReloadConfig, CommandHistory,
+		CommandUnbridge, CommandBridge, CommandTimings, CommandEncrypt)
 	return proc
 }
 
@@ -119,6 +133,10 @@ func (proc *Processor) Handle(roomID id.RoomID, eventID id.EventID, user bridge.
 		} else {
 			ce.Reply("Unknown command, use the `help` command for help.")
 		}
+	} else if err := proc.CheckPermission(ce.User, ce.RoomID, realCommand); err != nil {
+		ce.Reply("%s.", capitalizeFirst(err.Error()))
+	} else if err = proc.checkRateLimit(ce.User, realCommand); err != nil {
+		ce.Reply("%s.", capitalizeFirst(err.Error()))
 	} else {
 		ce.Handler = handler
 		handler.Run(ce)
@@ -0,0 +1,50 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"context"
+	"strings"
+
+	"maunium.net/go/mautrix/bridge"
+)
+
+var CommandRecreateRoom = &FullHandler{
+	Func: fnRecreateRoom,
+	Name: "recreate-room",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "Replace the Matrix room of the current portal with a new one.",
+		Args:        "[--no-backfill]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnRecreateRoom(ce *Event) {
+	portal, ok := ce.Portal.(bridge.RecreatablePortal)
+	if !ok {
+		ce.Reply("This bridge doesn't support recreating portal rooms")
+		return
+	}
+	backfill := true
+	if len(ce.Args) > 0 {
+		if strings.ToLower(ce.Args[0]) != "--no-backfill" {
+			ce.Reply("**Usage:** `$cmdprefix recreate-room [--no-backfill]`")
+			return
+		}
+		backfill = false
+	}
+	ctx := ce.ZLog.WithContext(context.Background())
+	newRoomID, err := ce.Bridge.RecreatePortalRoom(ctx, portal, ce.RoomID, ce.User, backfill)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to recreate portal room")
+		ce.Reply("Failed to recreate room: %v", err)
+		return
+	}
+	ce.ZLog.Debug().Str("new_room_id", newRoomID.String()).Msg("Recreated portal room via command")
+}
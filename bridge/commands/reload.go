@@ -0,0 +1,32 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"context"
+)
+
+var CommandReloadConfig = &FullHandler{
+	Func: fnReloadConfig,
+	Name: "reload-config",
+	Help: HelpMeta{
+		Section:     HelpSectionAdmin,
+		Description: "Reload settings that are safe to change at runtime from the config file.",
+	},
+	RequiresAdmin: true,
+}
+
+func fnReloadConfig(ce *Event) {
+	ctx := ce.ZLog.WithContext(context.Background())
+	err := ce.Bridge.ReloadConfig(ctx)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to reload config")
+		ce.Reply("Failed to reload config: %v", err)
+	} else {
+		ce.Reply("Config reloaded")
+	}
+}
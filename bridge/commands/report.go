@@ -0,0 +1,45 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"context"
+
+	"maunium.net/go/mautrix/bridge"
+)
+
+var CommandReport = &FullHandler{
+	Func: fnReport,
+	Name: "report",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "Report a message as spam or abuse to the remote network. Must be sent as a reply to the message.",
+		Args:        "[_reason_]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnReport(ce *Event) {
+	portal, ok := ce.Portal.(bridge.ReportHandlingPortal)
+	if !ok {
+		ce.Reply("This bridge doesn't support reporting messages")
+		return
+	} else if ce.ReplyTo == "" {
+		ce.Reply("**Usage:** reply to a message with `$cmdprefix report [reason]`")
+		return
+	}
+	ctx := ce.ZLog.WithContext(context.Background())
+	err := portal.HandleMatrixReport(ctx, ce.User, ce.ReplyTo, ce.RawArgs)
+	if err != nil {
+		ce.ZLog.Err(err).Str("reported_event_id", ce.ReplyTo.String()).Msg("Failed to report message")
+		ce.Reply("Failed to report message: %v", err)
+	} else {
+		ce.ZLog.Info().Str("reported_event_id", ce.ReplyTo.String()).Msg("Reported message")
+		ce.React("✅")
+	}
+}
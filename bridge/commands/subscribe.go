@@ -0,0 +1,95 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"context"
+	"errors"
+
+	"maunium.net/go/mautrix/bridge"
+)
+
+var CommandSubscribe = &FullHandler{
+	Func: fnSubscribe,
+	Name: "subscribe",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "Bridge a public channel from the remote network into the current room.",
+		Args:        "<_channel_>",
+	},
+}
+
+var CommandUnsubscribe = &FullHandler{
+	Func: fnUnsubscribe,
+	Name: "unsubscribe",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "Stop bridging a public channel into the current room.",
+	},
+}
+
+func (ce *Event) getPublicChannelBridge() bridge.PublicChannelBridge {
+	pcb, ok := ce.Bridge.Child.(bridge.PublicChannelBridge)
+	if !ok {
+		ce.Reply("This bridge doesn't support public channel subscriptions")
+		return nil
+	} else if ce.RoomID == ce.User.GetManagementRoomID() {
+		ce.Reply("Public channels can't be bridged into your management room")
+		return nil
+	} else if canManage, err := ce.Bridge.CanManageSubscription(ce.User, ce.RoomID); err != nil {
+		ce.ZLog.Err(err).Msg("Failed to check room power levels")
+		ce.Reply("Failed to check your permissions in this room: %v", err)
+		return nil
+	} else if !canManage {
+		ce.Reply("You don't have sufficient permissions in this room to manage subscriptions")
+		return nil
+	}
+	return pcb
+}
+
+func fnSubscribe(ce *Event) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage:** `$cmdprefix subscribe <channel>`")
+		return
+	} else if ce.Portal != nil {
+		ce.Reply("This room is already a portal")
+		return
+	}
+	pcb := ce.getPublicChannelBridge()
+	if pcb == nil {
+		return
+	}
+	ctx := ce.ZLog.WithContext(context.Background())
+	name, err := pcb.SubscribePublicChannel(ctx, ce.User, ce.RoomID, ce.Args[0])
+	if errors.Is(err, bridge.ErrPublicChannelNotFound) || errors.Is(err, bridge.ErrRoomAlreadySubscribed) {
+		ce.Reply("Failed to subscribe: %v", err)
+	} else if err != nil {
+		ce.ZLog.Err(err).Str("channel", ce.Args[0]).Msg("Failed to subscribe room to public channel")
+		ce.Reply("Failed to subscribe: %v", err)
+	} else {
+		ce.ZLog.Info().Str("channel", ce.Args[0]).Msg("Subscribed room to public channel")
+		ce.Reply("Subscribed this room to %s", name)
+	}
+}
+
+func fnUnsubscribe(ce *Event) {
+	pcb := ce.getPublicChannelBridge()
+	if pcb == nil {
+		return
+	}
+	ctx := ce.ZLog.WithContext(context.Background())
+	err := pcb.UnsubscribePublicChannel(ctx, ce.RoomID)
+	if errors.Is(err, bridge.ErrRoomNotSubscribed) {
+		ce.Reply("This room isn't subscribed to any channel")
+	} else if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to unsubscribe room from public channel")
+		ce.Reply("Failed to unsubscribe: %v", err)
+	} else {
+		ce.ZLog.Info().Msg("Unsubscribed room from public channel")
+		ce.React("✅")
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"context"
+	"strings"
+
+	"maunium.net/go/mautrix/bridge"
+)
+
+var CommandSync = &FullHandler{
+	Func: fnSync,
+	Name: "sync",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "Resync the info of the current portal from the remote network.",
+		Args:        "[--members] [--avatar] [--powers] [--full]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnSync(ce *Event) {
+	portal, ok := ce.Portal.(bridge.ResyncablePortal)
+	if !ok {
+		ce.Reply("This bridge doesn't support resyncing portals")
+		return
+	}
+	var flags bridge.ResyncFlags
+	for _, arg := range ce.Args {
+		switch strings.ToLower(arg) {
+		case "--members":
+			flags.Members = true
+		case "--avatar":
+			flags.Avatar = true
+		case "--powers":
+			flags.PowerLevels = true
+		case "--full":
+			flags = bridge.ResyncFlagsFull
+		default:
+			ce.Reply("**Usage:** `$cmdprefix sync [--members] [--avatar] [--powers] [--full]`")
+			return
+		}
+	}
+	ctx := ce.ZLog.WithContext(context.Background())
+	var changes []string
+	err := ce.Bridge.WithConnectorSlot(ctx, ce.User.GetMXID(), ce.RoomID, func(ctx context.Context) (err error) {
+		changes, err = portal.Resync(ctx, ce.User, flags)
+		return
+	})
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to resync portal")
+		ce.Reply("Failed to resync portal: %v", err)
+		return
+	}
+	ce.Portal.UpdateBridgeInfo()
+	if len(changes) == 0 {
+		ce.Reply("Portal resynced, nothing changed")
+	} else {
+		ce.Reply("Portal resynced, changes:\n\n* %s", strings.Join(changes, "\n* "))
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"strings"
+
+	"maunium.net/go/mautrix/bridge"
+)
+
+var CommandTranslate = &FullHandler{
+	Func: fnTranslate,
+	Name: "translate",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "Enable or disable translation of incoming messages in the current portal.",
+		Args:        "<on|off|_language_>",
+	},
+	RequiresPortal: true,
+}
+
+func fnTranslate(ce *Event) {
+	portal, ok := ce.Portal.(bridge.TranslatingPortal)
+	if !ok || ce.Bridge.Translator == nil {
+		ce.Reply("This bridge doesn't support translating messages")
+		return
+	} else if len(ce.Args) != 1 {
+		status := "Translation is disabled in this portal"
+		if lang := portal.GetTranslationLanguage(); lang != "" {
+			status = "Incoming messages are translated to `" + lang + "`"
+		}
+		ce.Reply("%s\n\n**Usage:** `$cmdprefix translate <on|off|language>`", status)
+		return
+	}
+	var lang string
+	switch strings.ToLower(ce.Args[0]) {
+	case "off", "disable":
+		lang = ""
+	case "on", "enable":
+		if tlu, ok := ce.User.(bridge.TranslationLanguageUser); ok {
+			lang = tlu.GetPreferredLanguage()
+		}
+		if lang == "" {
+			ce.Reply("You don't have a preferred language set, please specify the language explicitly")
+			return
+		}
+	default:
+		lang = ce.Args[0]
+	}
+	err := portal.SetTranslationLanguage(lang)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to set portal translation language")
+		ce.Reply("Failed to change translation settings: %v", err)
+	} else if lang == "" {
+		ce.Reply("Disabled translation in this portal")
+	} else {
+		ce.Reply("Incoming messages will now be translated to `%s`", lang)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package commands
+
+import (
+	"context"
+	"strings"
+
+	"maunium.net/go/mautrix/bridge"
+)
+
+var CommandUnbridge = &FullHandler{
+	Func: fnUnbridge,
+	Name: "unbridge",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "Remove the bridge from the current room without deleting the room.",
+	},
+	RequiresPortal: true,
+	RequiresAdmin:  true,
+}
+
+func fnUnbridge(ce *Event) {
+	portal, ok := ce.Portal.(bridge.UnbridgeablePortal)
+	if !ok {
+		ce.Reply("This bridge doesn't support unbridging rooms")
+		return
+	}
+	ce.Reply("Unbridging room. The room and its history will be kept, but messages will no longer be bridged.")
+	ctx := ce.ZLog.WithContext(context.Background())
+	err := ce.Bridge.UnbridgeRoom(ctx, portal, ce.RoomID)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to unbridge room")
+		ce.Reply("Failed to unbridge room: %v", err)
+	}
+}
+
+var CommandBridge = &FullHandler{
+	Func: fnBridge,
+	Name: "bridge",
+	Help: HelpMeta{
+		Section:     HelpSectionGeneral,
+		Description: "Bridge the current room to a remote chat.",
+		Args:        "[--relay] <_remote chat ID_>",
+	},
+	RequiresLogin: true,
+	RequiresAdmin: true,
+}
+
+func fnBridge(ce *Event) {
+	var opts bridge.PlumbOptions
+	args := ce.Args
+	if len(args) > 0 && strings.ToLower(args[0]) == "--relay" {
+		opts.SetRelay = true
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		ce.Reply("**Usage:** `$cmdprefix bridge [--relay] <remote chat ID>`")
+		return
+	} else if ce.Portal != nil {
+		ce.Reply("This room is already a portal")
+		return
+	}
+	ctx := ce.ZLog.WithContext(context.Background())
+	result, err := ce.Bridge.BridgeExistingRoom(ctx, ce.User, ce.RoomID, args[0], opts)
+	if err != nil {
+		ce.ZLog.Err(err).Str("remote_chat_id", args[0]).Msg("Failed to bridge room")
+		ce.Reply("Failed to bridge room: %v", err)
+		return
+	}
+	if len(result.Warnings) > 0 {
+		ce.Reply("Successfully bridged room, but there were some problems:\n\n* %s", strings.Join(result.Warnings, "\n* "))
+	} else {
+		ce.Reply("Successfully bridged room")
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+)
+
+// ConfigReloadingBridge is an optional interface for bridges that support reloading bridge-specific settings
+// that are safe to change at runtime, like relay templates, rate limits, backfill limits and permissions.
+type ConfigReloadingBridge interface {
+	ChildOverride
+	// ReloadConfig parses the given config file data and applies the safe-to-change settings.
+	// The new config must be fully validated before anything is applied, so that an invalid config
+	// leaves the old settings in place.
+	ReloadConfig(ctx context.Context, configData []byte) error
+}
+
+// ConfigReloadHook is called with the raw config file data when the config is reloaded.
+// Hooks should parse and validate only the section they're interested in, and return a function that applies it.
+// The apply functions are only called if every hook and the bridge accepted the new config, so an invalid config
+// in one section doesn't leave the other sections half-applied.
+type ConfigReloadHook func(ctx context.Context, configData []byte) (apply func(), err error)
+
+// OnConfigReload registers a hook that is called when the config is reloaded,
+// which allows components to reload their own config sections.
+func (br *Bridge) OnConfigReload(hook ConfigReloadHook) {
+	br.configReloadLock.Lock()
+	defer br.configReloadLock.Unlock()
+	br.configReloadHooks = append(br.configReloadHooks, hook)
+}
+
+// ReloadConfig re-reads the config file and applies settings that are safe to change at runtime.
+// Settings that require a restart, like the homeserver and appservice sections, are ignored with a warning.
+//
+// The whole config is validated before anything is applied: first the reload hooks, then the bridge itself
+// (see ConfigReloadingBridge), and only then are the hooks applied. Concurrent reloads are serialized.
+//
+// The logging level can be raised at runtime, but it can't be lowered below the level the bridge was started with.
+func (br *Bridge) ReloadConfig(ctx context.Context) error {
+	br.configReloadLock.Lock()
+	defer br.configReloadLock.Unlock()
+	log := zerolog.Ctx(ctx)
+	configData, err := os.ReadFile(br.ConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+	configData, err = bridgeconfig.ResolveSecrets(configData)
+	if err != nil {
+		return err
+	}
+	var newBase bridgeconfig.BaseConfig
+	err = yaml.Unmarshal(configData, &newBase)
+	if err != nil {
+		return fmt.Errorf("failed to parse config: %w", err)
+	}
+	if newBase.Homeserver != br.Config.Homeserver {
+		log.Warn().Msg("Homeserver config changed, restart the bridge to apply the changes")
+	}
+	applyFuncs := make([]func(), 0, len(br.configReloadHooks))
+	for _, hook := range br.configReloadHooks {
+		apply, err := hook(ctx, configData)
+		if err != nil {
+			return err
+		} else if apply != nil {
+			applyFuncs = append(applyFuncs, apply)
+		}
+	}
+	// The bridge validates its whole config before applying anything, so it's called last
+	// and nothing else has been applied if it fails.
+	if crb, ok := br.Child.(ConfigReloadingBridge); ok {
+		err = crb.ReloadConfig(ctx, configData)
+		if err != nil {
+			return fmt.Errorf("failed to reload bridge config: %w", err)
+		}
+	}
+	for _, apply := range applyFuncs {
+		apply()
+	}
+	if newBase.Logging.MinLevel != nil {
+		zerolog.SetGlobalLevel(*newBase.Logging.MinLevel)
+		br.Config.Logging.MinLevel = newBase.Logging.MinLevel
+	}
+	log.Info().Msg("Reloaded config")
+	return nil
+}
+
+func (br *Bridge) reloadConfigOnSIGHUP() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		log := br.ZLog.With().Str("action", "reload config").Logger()
+		log.Info().Msg("SIGHUP received, reloading config")
+		err := br.ReloadConfig(log.WithContext(context.Background()))
+		if err != nil {
+			log.Err(err).Msg("Failed to reload config")
+		}
+	}
+}
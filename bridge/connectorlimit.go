@@ -0,0 +1,82 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util"
+)
+
+type connectorLimiters struct {
+	lock     sync.Mutex
+	limiters map[id.UserID]*util.FairSemaphore[id.RoomID]
+}
+
+func (br *Bridge) getConnectorLimiter(userID id.UserID) *util.FairSemaphore[id.RoomID] {
+	clc, ok := br.Config.Bridge.(bridgeconfig.ConnectorConcurrencyBridgeConfig)
+	if !ok {
+		return nil
+	}
+	limit := clc.GetConnectorConcurrencyConfig().MaxPerUser
+	if limit <= 0 {
+		return nil
+	}
+	br.connectorLimiters.lock.Lock()
+	defer br.connectorLimiters.lock.Unlock()
+	limiter, ok := br.connectorLimiters.limiters[userID]
+	if !ok {
+		limiter = util.NewFairSemaphore[id.RoomID](limit)
+		br.connectorLimiters.limiters[userID] = limiter
+	}
+	return limiter
+}
+
+// AcquireConnectorSlot waits until the user has a free slot for calling the remote network on behalf of
+// the given room. The returned function must be called to free the slot after the call is done.
+//
+// The number of concurrent calls per user is limited by the connector concurrency config. Waiting calls are
+// served round-robin by room, so mass operations in one room don't block the user's other rooms. Matrix events
+// handled through RunMatrixEventHandler take a slot. Bridges should also use this for other calls that are made
+// with the user's connection, like fetching chat info or backfilling.
+//
+// This blocks until a slot is free, so it must not be called from the Matrix event dispatcher (i.e. directly
+// in ReceiveMatrixEvent), as that would stop events from being dispatched to all other portals.
+func (br *Bridge) AcquireConnectorSlot(ctx context.Context, userID id.UserID, roomID id.RoomID) (release func(), err error) {
+	limiter := br.getConnectorLimiter(userID)
+	if limiter == nil {
+		return func() {}, nil
+	}
+	defer TimeEventPhase(ctx, EventPhaseConnectorWait)()
+	err = limiter.Acquire(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wait for connector slot: %w", err)
+	}
+	return limiter.Release, nil
+}
+
+// WithConnectorSlot runs the given function while holding a connector slot, see AcquireConnectorSlot.
+func (br *Bridge) WithConnectorSlot(ctx context.Context, userID id.UserID, roomID id.RoomID, fn func(ctx context.Context) error) error {
+	release, err := br.AcquireConnectorSlot(ctx, userID, roomID)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return fn(ctx)
+}
+
+// ForgetConnectorLimiter drops the concurrency limiter of the given user. Bridges can call this after the user
+// logs out. Calls that are already holding or waiting for a slot aren't affected.
+func (br *Bridge) ForgetConnectorLimiter(userID id.UserID) {
+	br.connectorLimiters.lock.Lock()
+	delete(br.connectorLimiters.limiters, userID)
+	br.connectorLimiters.lock.Unlock()
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+)
+
+// FilterDirection is the direction a message is being bridged in.
+type FilterDirection int
+
+const (
+	FilterMatrixToRemote FilterDirection = iota
+	FilterRemoteToMatrix
+)
+
+var (
+	ErrMessageFiltered   = errors.New("message was blocked by a content filter")
+	ErrMediaTooLarge     = fmt.Errorf("%w: media is too large", ErrMessageFiltered)
+	ErrBlockedKeyword    = fmt.Errorf("%w: message contains a blocked keyword", ErrMessageFiltered)
+	ErrSenderBlocklisted = fmt.Errorf("%w: sender is blocked", ErrMessageFiltered)
+)
+
+// ContentFilter is a moderation hook that is invoked for messages before they're bridged.
+type ContentFilter interface {
+	// FilterMessage can modify the content in place to change what is bridged, or return an error to reject
+	// the message entirely. The sender is a Matrix user ID for Matrix->remote messages and
+	// a remote user ID for remote->Matrix messages.
+	FilterMessage(ctx context.Context, direction FilterDirection, sender string, content *event.MessageEventContent) error
+}
+
+// AddContentFilter registers a content filter. Filters are called in the order they were added.
+//
+// Matrix->remote messages are filtered automatically. Bridges must call FilterRemoteMessage
+// for converted remote messages before sending them to Matrix.
+func (br *Bridge) AddContentFilter(filters ...ContentFilter) {
+	br.contentFilters = append(br.contentFilters, filters...)
+}
+
+// filterMessage runs the filters on the content. For edits (m.replace), the new content is filtered too,
+// as that's what is actually shown and bridged, while the top-level content is only a fallback.
+func (br *Bridge) filterMessage(ctx context.Context, direction FilterDirection, sender string, content *event.MessageEventContent) error {
+	for _, filter := range br.contentFilters {
+		if err := filter.FilterMessage(ctx, direction, sender, content); err != nil {
+			return err
+		}
+		if content.NewContent != nil {
+			if err := filter.FilterMessage(ctx, direction, sender, content.NewContent); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// FilterRemoteMessage runs the registered content filters on a remote message that has been converted to Matrix.
+// If an error is returned, the message should not be bridged. For edits, the new content is filtered as well.
+func (br *Bridge) FilterRemoteMessage(ctx context.Context, sender string, content *event.MessageEventContent) error {
+	return br.filterMessage(ctx, FilterRemoteToMatrix, sender, content)
+}
+
+func (br *Bridge) initContentFilters() {
+	cfc, ok := br.Config.Bridge.(bridgeconfig.ContentFilteringBridgeConfig)
+	if !ok {
+		return
+	}
+	cfg := cfc.GetContentFilterConfig()
+	if len(cfg.Keywords) > 0 {
+		br.AddContentFilter(KeywordFilter(cfg.Keywords))
+	}
+	if cfg.MaxMediaSize > 0 {
+		br.AddContentFilter(MaxMediaSizeFilter(cfg.MaxMediaSize))
+	}
+	if len(cfg.BlockedUsers) > 0 {
+		br.AddContentFilter(NewBlocklistFilter(cfg.BlockedUsers))
+	}
+}
+
+func (mx *MatrixHandler) contentFilterMiddleware(next MatrixEventHandler) MatrixEventHandler {
+	return func(user User, portal Portal, evt *event.Event) {
+		content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+		if ok && len(mx.bridge.contentFilters) > 0 {
+			log := mx.log.With().Str("event_id", evt.ID.String()).Logger()
+			ctx := log.WithContext(EventContext(evt))
+			err := mx.bridge.filterMessage(ctx, FilterMatrixToRemote, evt.Sender.String(), content)
+			if err != nil {
+				log.Debug().Err(err).Msg("Message rejected by content filter")
+				go mx.sendMessageRejection(ctx, evt, err, event.MessageStatusNoPermission)
+				return
+			}
+		}
+		next(user, portal, evt)
+	}
+}
+
+// KeywordFilter rejects messages whose body contains any of the given keywords (case-insensitively).
+type KeywordFilter []string
+
+func (kf KeywordFilter) FilterMessage(ctx context.Context, _ FilterDirection, _ string, content *event.MessageEventContent) error {
+	body := strings.ToLower(content.Body)
+	for _, keyword := range kf {
+		if strings.Contains(body, strings.ToLower(keyword)) {
+			zerolog.Ctx(ctx).Debug().Str("keyword", keyword).Msg("Message contains blocked keyword")
+			return ErrBlockedKeyword
+		}
+	}
+	return nil
+}
+
+// MaxMediaSizeFilter rejects media messages that are larger than the given number of bytes.
+type MaxMediaSizeFilter int
+
+func (mmsf MaxMediaSizeFilter) FilterMessage(_ context.Context, _ FilterDirection, _ string, content *event.MessageEventContent) error {
+	if content.Info != nil && content.Info.Size > int(mmsf) {
+		return ErrMediaTooLarge
+	}
+	return nil
+}
+
+// BlocklistFilter rejects messages from the given senders.
+type BlocklistFilter map[string]struct{}
+
+func NewBlocklistFilter(senders []string) BlocklistFilter {
+	bf := make(BlocklistFilter, len(senders))
+	for _, sender := range senders {
+		bf[sender] = struct{}{}
+	}
+	return bf
+}
+
+func (bf BlocklistFilter) FilterMessage(_ context.Context, _ FilterDirection, sender string, _ *event.MessageEventContent) error {
+	if _, blocked := bf[sender]; blocked {
+		return ErrSenderBlocklisted
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"html"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// CrossPortalReplyKey is the key in the content of messages that reply to or quote a message in another portal.
+const CrossPortalReplyKey = "fi.mau.cross_portal_reply"
+
+// CrossPortalReply is a reference to a message in another portal room.
+//
+// Matrix replies can't point to events in other rooms, so cross-portal replies are rendered as a link
+// to the target event with an excerpt of its text instead.
+type CrossPortalReply struct {
+	RoomID  id.RoomID  `json:"room_id"`
+	EventID id.EventID `json:"event_id"`
+
+	SenderName string `json:"-"`
+	Text       string `json:"-"`
+}
+
+// CrossPortalMessageBridge is an optional interface for bridges that can find bridged messages by remote ID
+// without knowing which portal they're in, e.g. when a discussion group quotes a post from a linked channel.
+type CrossPortalMessageBridge interface {
+	ChildOverride
+	// GetMessageByRemoteID finds the Matrix room and event ID of a bridged remote message.
+	// The portal key is the remote chat the message is in, which is not necessarily the portal being bridged to.
+	// Both returned IDs should be empty if the message isn't known.
+	GetMessageByRemoteID(remotePortalKey, remoteMessageID string) (id.RoomID, id.EventID, error)
+}
+
+// FindCrossPortalReply looks up a remote message in another portal and returns a reference to it,
+// or nil if the bridge doesn't support cross-portal lookups or the message hasn't been bridged.
+//
+// The sender name and text of the reference are filled from the target event if possible.
+func (br *Bridge) FindCrossPortalReply(ctx context.Context, remotePortalKey, remoteMessageID string) *CrossPortalReply {
+	cpb, ok := br.Child.(CrossPortalMessageBridge)
+	if !ok {
+		return nil
+	}
+	log := zerolog.Ctx(ctx).With().
+		Str("target_portal_key", remotePortalKey).
+		Str("target_message_id", remoteMessageID).
+		Logger()
+	roomID, eventID, err := cpb.GetMessageByRemoteID(remotePortalKey, remoteMessageID)
+	if err != nil {
+		log.Err(err).Msg("Failed to find cross-portal reply target")
+		return nil
+	} else if roomID == "" || eventID == "" {
+		log.Debug().Msg("Cross-portal reply target not found")
+		return nil
+	}
+	reply := &CrossPortalReply{RoomID: roomID, EventID: eventID}
+	target, err := br.FetchEvent(roomID, eventID)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to fetch cross-portal reply target")
+		return reply
+	}
+	reply.SenderName = target.Sender.String()
+	if member := br.StateStore.GetMember(roomID, target.Sender); member != nil && member.Displayname != "" {
+		reply.SenderName = member.Displayname
+	}
+	if content, ok := target.Content.Parsed.(*event.MessageEventContent); ok {
+		content.RemoveReplyFallback()
+		reply.Text = content.Body
+	}
+	return reply
+}
+
+// AddCrossPortalReply prepends a link to the replied-to message in another portal to the given content.
+// The returned raw content should be merged into the event content to let clients find the original message.
+func (br *Bridge) AddCrossPortalReply(content *event.MessageEventContent, reply *CrossPortalReply) map[string]interface{} {
+	if reply == nil {
+		return nil
+	}
+	link := reply.RoomID.EventURI(reply.EventID, br.AS.HomeserverDomain).MatrixToURL()
+	maxLength := br.getQuoteReplyConfig().MaxLength
+	var plainQuote, htmlQuote string
+	if reply.Text != "" {
+		excerpt := makeExcerpt(reply.Text, maxLength)
+		sender := makeExcerpt(reply.SenderName, maxLength)
+		plainQuote = fmt.Sprintf("> %s: %s\n> %s", sender, excerpt, link)
+		htmlQuote = fmt.Sprintf(
+			`<blockquote><a href="%s">In reply to</a> %s<br/>%s</blockquote>`,
+			html.EscapeString(link), html.EscapeString(sender), event.TextToHTML(excerpt),
+		)
+	} else {
+		plainQuote = fmt.Sprintf("> In reply to %s", link)
+		htmlQuote = fmt.Sprintf(`<blockquote><a href="%s">In reply to a message in another chat</a></blockquote>`, html.EscapeString(link))
+	}
+	if !isMediaMessage(event.EventMessage, content) {
+		if content.Format != event.FormatHTML {
+			content.Format = event.FormatHTML
+			content.FormattedBody = event.TextToHTML(content.Body)
+		}
+		content.FormattedBody = htmlQuote + content.FormattedBody
+		content.Body = plainQuote + "\n\n" + content.Body
+	}
+	return map[string]interface{}{
+		CrossPortalReplyKey: reply,
+	}
+}
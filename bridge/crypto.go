@@ -40,6 +40,7 @@ type CryptoHelper struct {
 	client *mautrix.Client
 	mach   *crypto.OlmMachine
 	store  *SQLCryptoStore
+	cache  *crypto.WriteBehindStore
 	log    *zerolog.Logger
 
 	lock       sync.RWMutex
@@ -65,19 +66,9 @@ func (helper *CryptoHelper) Init() error {
 	}
 	helper.log.Debug().Msg("Initializing end-to-bridge encryption...")
 
-	helper.store = NewSQLCryptoStore(
-		helper.bridge.DB,
-		dbutil.ZeroLogger(helper.bridge.ZLog.With().Str("db_section", "crypto").Logger()),
-		helper.bridge.AS.BotMXID(),
-		fmt.Sprintf("@%s:%s", helper.bridge.Config.Bridge.FormatUsername("%"), helper.bridge.AS.HomeserverDomain),
-		helper.bridge.CryptoPickleKey,
-	)
-
-	err := helper.store.DB.Upgrade()
-	if err != nil {
-		helper.bridge.LogDBUpgradeErrorAndExit("crypto", err)
-	}
+	helper.initStore()
 
+	var err error
 	var isExistingDevice bool
 	helper.client, isExistingDevice, err = helper.loginBot()
 	if err != nil {
@@ -88,7 +79,7 @@ func (helper *CryptoHelper) Init() error {
 		Str("device_id", helper.client.DeviceID.String()).
 		Msg("Logged in as bridge bot")
 	stateStore := &cryptoStateStore{helper.bridge}
-	helper.mach = crypto.NewOlmMachine(helper.client, helper.log, helper.store, stateStore)
+	helper.mach = crypto.NewOlmMachine(helper.client, helper.log, helper.initCache(), stateStore)
 	helper.mach.AllowKeyShare = helper.allowKeyShare
 	helper.mach.SendKeysMinTrust = helper.bridge.Config.Bridge.GetEncryptionConfig().VerificationLevels.Receive
 	helper.mach.PlaintextMentions = helper.bridge.Config.Bridge.GetEncryptionConfig().PlaintextMentions
@@ -106,6 +97,47 @@ func (helper *CryptoHelper) Init() error {
 	return nil
 }
 
+// initStore creates the crypto store and upgrades its schema without logging in, which is also used by
+// maintenance commands that need all database tables to exist.
+func (helper *CryptoHelper) initStore() {
+	helper.store = NewSQLCryptoStore(
+		helper.bridge.DB,
+		dbutil.ZeroLogger(helper.bridge.ZLog.With().Str("db_section", "crypto").Logger()),
+		helper.bridge.AS.BotMXID(),
+		fmt.Sprintf("@%s:%s", helper.bridge.Config.Bridge.FormatUsername("%"), helper.bridge.AS.HomeserverDomain),
+		helper.bridge.CryptoPickleKey,
+	)
+
+	err := helper.store.DB.Upgrade()
+	if err != nil {
+		helper.bridge.LogDBUpgradeErrorAndExit("crypto", err)
+	}
+}
+
+// initCache wraps the crypto store in an in-memory cache if it's enabled in the config.
+func (helper *CryptoHelper) initCache() crypto.Store {
+	cfg := helper.bridge.Config.Bridge.GetEncryptionConfig().StoreCache
+	mode := crypto.StoreConsistency(cfg.Mode)
+	switch mode {
+	case "":
+		return helper.store
+	case crypto.ConsistencyWriteThrough, crypto.ConsistencyWriteBehind:
+	default:
+		helper.log.Warn().Str("mode", cfg.Mode).Msg("Unknown crypto store cache mode, not using cache")
+		return helper.store
+	}
+	helper.cache = crypto.NewWriteBehindStore(
+		helper.store,
+		helper.log.With().Str("db_section", "crypto_cache").Logger(),
+		crypto.WriteBehindStoreOptions{
+			Consistency:   mode,
+			FlushInterval: time.Duration(cfg.FlushInterval) * time.Millisecond,
+		},
+	)
+	helper.log.Debug().Str("mode", cfg.Mode).Msg("Using in-memory crypto store cache")
+	return helper.cache
+}
+
 func (helper *CryptoHelper) allowKeyShare(ctx context.Context, device *id.Device, info event.RequestedKeyInfo) *crypto.KeyShareRejection {
 	cfg := helper.bridge.Config.Bridge.GetEncryptionConfig()
 	if !cfg.AllowKeySharing {
@@ -183,6 +215,7 @@ func (helper *CryptoHelper) verifyKeysAreOnServer() {
 }
 
 func (helper *CryptoHelper) Start() {
+	go helper.pruneSessionsLoop()
 	if helper.bridge.Config.Bridge.GetEncryptionConfig().Appservice {
 		helper.log.Debug().Msg("End-to-bridge encryption is in appservice mode, registering event listeners and not starting syncer")
 		helper.bridge.AS.Registration.EphemeralEvents = true
@@ -203,6 +236,55 @@ func (helper *CryptoHelper) Start() {
 	}
 }
 
+func (helper *CryptoHelper) pruneSessionsLoop() {
+	cfg := helper.bridge.Config.Bridge.GetEncryptionConfig().Pruning
+	if cfg.Interval <= 0 {
+		return
+	}
+	log := helper.log.With().Str("action", "prune crypto sessions").Logger()
+	ctx := log.WithContext(helper.bridge.BackgroundCtx)
+	opts := crypto.SessionPruneOptions{
+		OlmMaxAge:       time.Duration(cfg.OlmMaxAgeDays) * 24 * time.Hour,
+		OlmMaxPerDevice: cfg.OlmMaxPerDevice,
+		MegolmMaxAge:    time.Duration(cfg.MegolmMaxAgeDays) * 24 * time.Hour,
+		Vacuum:          cfg.Vacuum,
+	}
+	ticker := time.NewTicker(time.Duration(cfg.Interval) * time.Hour)
+	defer ticker.Stop()
+	for {
+		if helper.cache != nil {
+			err := helper.cache.Flush()
+			if err != nil {
+				log.Err(err).Msg("Failed to flush crypto store cache before pruning")
+			}
+		}
+		result, err := helper.store.PruneSessions(ctx, opts)
+		if helper.cache != nil {
+			// The cache may still contain pruned sessions, so drop everything and reload from the database.
+			_ = helper.cache.Invalidate()
+		}
+		if err != nil {
+			log.Err(err).Msg("Failed to prune crypto sessions")
+		} else if stats, err := helper.store.GetStats(ctx); err != nil {
+			log.Err(err).Msg("Failed to get crypto store stats")
+		} else {
+			log.Info().
+				Int64("pruned_olm_sessions", result.OlmSessions).
+				Int64("pruned_megolm_sessions", result.MegolmSessions).
+				Int64("pruned_message_indexes", result.MessageIndexes).
+				Int("olm_sessions", stats.OlmSessions).
+				Int("megolm_inbound_sessions", stats.MegolmInboundSessions).
+				Int("message_indexes", stats.MessageIndexes).
+				Msg("Pruned crypto sessions")
+		}
+		select {
+		case <-ticker.C:
+		case <-helper.bridge.BackgroundCtx.Done():
+			return
+		}
+	}
+}
+
 func (helper *CryptoHelper) Stop() {
 	helper.log.Debug().Msg("CryptoHelper.Stop() called, stopping bridge bot sync")
 	helper.client.StopSync()
@@ -210,6 +292,12 @@ func (helper *CryptoHelper) Stop() {
 		helper.cancelSync()
 	}
 	helper.syncDone.Wait()
+	if helper.cache != nil {
+		err := helper.cache.Close()
+		if err != nil {
+			helper.log.Err(err).Msg("Failed to flush crypto store cache")
+		}
+	}
 }
 
 func (helper *CryptoHelper) clearDatabase() {
@@ -245,6 +333,7 @@ func (helper *CryptoHelper) Reset(startAfterReset bool) {
 	}
 	helper.client = nil
 	helper.store = nil
+	helper.cache = nil
 	helper.mach = nil
 	err = helper.Init()
 	if err != nil {
@@ -262,7 +351,7 @@ func (helper *CryptoHelper) Client() *mautrix.Client {
 }
 
 func (helper *CryptoHelper) Decrypt(evt *event.Event) (*event.Event, error) {
-	return helper.mach.DecryptMegolmEvent(context.TODO(), evt)
+	return helper.mach.DecryptMegolmEvent(EventContext(evt), evt)
 }
 
 func (helper *CryptoHelper) Encrypt(roomID id.RoomID, evtType event.Type, content *event.Content) (err error) {
@@ -336,6 +425,23 @@ func (helper *CryptoHelper) ResetSession(roomID id.RoomID) {
 	}
 }
 
+// ShareSession creates an outbound group session for the room and shares it with all current members,
+// establishing Olm sessions with their devices as necessary. If a valid session has already been shared,
+// this does nothing.
+func (helper *CryptoHelper) ShareSession(roomID id.RoomID) error {
+	helper.lock.RLock()
+	defer helper.lock.RUnlock()
+	users, err := helper.store.GetRoomJoinedOrInvitedMembers(roomID)
+	if err != nil {
+		return fmt.Errorf("failed to get room member list: %w", err)
+	}
+	err = helper.mach.ShareGroupSession(context.TODO(), roomID, users)
+	if err != nil && err != crypto.AlreadyShared {
+		return fmt.Errorf("failed to share group session: %w", err)
+	}
+	return nil
+}
+
 func (helper *CryptoHelper) HandleMemberEvent(evt *event.Event) {
 	helper.lock.RLock()
 	defer helper.lock.RUnlock()
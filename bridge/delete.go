@@ -0,0 +1,217 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrDeleteTooOld            = errors.New("the message is too old to be deleted for everyone")
+	ErrDeleteForMeUnsupported  = errors.New("deleting messages only for yourself is not supported")
+	ErrHidingNeedsDoublePuppet = errors.New("hiding messages requires double puppeting")
+)
+
+// DeleteScopeKey is the key in the content of redactions that specifies who the message should be deleted for.
+// Redactions without the key are treated as DeleteForEveryone.
+const DeleteScopeKey = "fi.mau.delete_scope"
+
+// HiddenEventsAccountDataType is the room account data type that lists events hidden for a specific user,
+// which is used for messages that were deleted only for that user on the remote network.
+const HiddenEventsAccountDataType = "fi.mau.hidden_events"
+
+type DeleteScope string
+
+const (
+	DeleteForEveryone DeleteScope = "for_everyone"
+	DeleteForMe       DeleteScope = "for_me"
+)
+
+// DeleteCapabilities describes which kinds of deletes a portal can bridge to the remote network.
+type DeleteCapabilities struct {
+	// ForEveryoneTimeLimit is how long after sending a message can be deleted for everyone. Zero means no limit.
+	ForEveryoneTimeLimit time.Duration
+	// ForMe means messages can be deleted only for the user who deleted them.
+	ForMe bool
+}
+
+// MatrixMessageRemove contains info about a Matrix redaction that should be bridged as a message delete.
+type MatrixMessageRemove struct {
+	Event    *event.Event
+	TargetID id.EventID
+	Reason   string
+	Scope    DeleteScope
+}
+
+// MessageRemovingPortal is an optional interface for portals that want the reason and scope of Matrix redactions.
+//
+// Redactions are passed to HandleMatrixMessageRemove instead of ReceiveMatrixEvent. Deletes that exceed the
+// portal's capabilities are rejected before reaching the portal.
+type MessageRemovingPortal interface {
+	Portal
+	GetDeleteCapabilities() DeleteCapabilities
+	HandleMatrixMessageRemove(ctx context.Context, sender User, msg *MatrixMessageRemove) error
+}
+
+func (mx *MatrixHandler) handleMessageRemove(ctx context.Context, user User, portal MessageRemovingPortal, evt *event.Event) {
+	log := zerolog.Ctx(ctx)
+	msg := &MatrixMessageRemove{
+		Event:    evt,
+		TargetID: evt.Redacts,
+		Scope:    DeleteForEveryone,
+	}
+	if content, ok := evt.Content.Parsed.(*event.RedactionEventContent); ok {
+		msg.Reason = content.Reason
+	}
+	if scope, ok := evt.Content.Raw[DeleteScopeKey].(string); ok && DeleteScope(scope) == DeleteForMe {
+		msg.Scope = DeleteForMe
+	}
+	caps := portal.GetDeleteCapabilities()
+	if msg.Scope == DeleteForMe && !caps.ForMe {
+		mx.sendMessageRejection(ctx, evt, ErrDeleteForMeUnsupported, event.MessageStatusUnsupported)
+		return
+	} else if msg.Scope == DeleteForEveryone && caps.ForEveryoneTimeLimit > 0 {
+		target, err := mx.bridge.FetchEvent(evt.RoomID, msg.TargetID)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to fetch redaction target to check delete time limit")
+		} else if time.Since(time.UnixMilli(target.Timestamp)) > caps.ForEveryoneTimeLimit {
+			mx.sendMessageRejection(ctx, evt, ErrDeleteTooOld, event.MessageStatusUnsupported)
+			return
+		}
+	}
+	err := portal.HandleMatrixMessageRemove(ctx, user, msg)
+	if err != nil {
+		log.Err(err).Msg("Failed to bridge message delete")
+		mx.sendMessageRejection(ctx, evt, err, event.MessageStatusGenericError)
+	} else if msg.Scope == DeleteForEveryone {
+		mx.bridge.CleanupDeletedMessage(ctx, portal, evt.RoomID, msg.TargetID)
+	}
+}
+
+// DeletedMessageCleaningPortal is an optional interface for portals that delete their database rows of messages
+// after they're deleted. The bridge calls it after a delete was bridged successfully in either direction.
+type DeletedMessageCleaningPortal interface {
+	Portal
+	// DeleteMessageRows deletes the database rows of the message or reaction with the given Matrix event ID
+	// and returns its remote ID, or an empty string if the event isn't a known message.
+	DeleteMessageRows(ctx context.Context, eventID id.EventID) (remoteID string, err error)
+}
+
+// MessageReferenceCleaningPortal is an optional interface for portals that store references between messages,
+// like the reply target or thread root of a message, in their database.
+type MessageReferenceCleaningPortal interface {
+	DeletedMessageCleaningPortal
+	// ClearMessageReferences removes references to the deleted message with the given Matrix event ID
+	// from other messages, e.g. by clearing their reply target or thread root.
+	ClearMessageReferences(ctx context.Context, eventID id.EventID) error
+}
+
+// CleanupDeletedMessage removes the database rows of a deleted message and leaves a tombstone in their place.
+// References to the message from other messages are also removed (see MessageReferenceCleaningPortal),
+// as are bridge-level rows like its edit history and bridged reactions.
+//
+// Portals should use IsMessageDeleted to check the tombstones when remote events like edits or replies
+// refer to a message that isn't in the database anymore.
+//
+// This is called automatically after Matrix redactions are bridged: for MessageRemovingPortals when
+// HandleMatrixMessageRemove succeeds, and for other portals when they send a successful remote message
+// checkpoint for the redaction. Bridges must call it themselves for deletes from the remote network.
+func (br *Bridge) CleanupDeletedMessage(ctx context.Context, portal Portal, roomID id.RoomID, eventID id.EventID) {
+	cleaner, ok := portal.(DeletedMessageCleaningPortal)
+	if !ok {
+		return
+	}
+	log := zerolog.Ctx(ctx).With().Str("deleted_event_id", eventID.String()).Logger()
+	if refCleaner, ok := cleaner.(MessageReferenceCleaningPortal); ok {
+		err := refCleaner.ClearMessageReferences(ctx, eventID)
+		if err != nil {
+			log.Err(err).Msg("Failed to clear references to deleted message")
+		}
+	}
+	remoteID, err := cleaner.DeleteMessageRows(ctx, eventID)
+	if err != nil {
+		log.Err(err).Msg("Failed to delete database rows of deleted message")
+		return
+	} else if remoteID == "" {
+		return
+	}
+	err = br.BridgeStore.AddMessageTombstone(roomID, remoteID, eventID)
+	if err != nil {
+		log.Err(err).Str("deleted_remote_id", remoteID).Msg("Failed to save tombstone of deleted message")
+	} else {
+		log.Debug().Str("deleted_remote_id", remoteID).Msg("Cleaned up deleted message")
+	}
+}
+
+// cleanupAfterRedactionCheckpoint cleans up the target of a Matrix redaction that a portal without
+// MessageRemovingPortal reported as successfully bridged.
+func (br *Bridge) cleanupAfterRedactionCheckpoint(evt *event.Event) {
+	if evt.Redacts == "" {
+		return
+	}
+	portal := br.Child.GetIPortal(evt.RoomID)
+	if portal == nil {
+		return
+	} else if _, ok := portal.(MessageRemovingPortal); ok {
+		// Already cleaned up in handleMessageRemove
+		return
+	}
+	log := br.ZLog.With().
+		Str("action", "cleanup redacted message").
+		Str("redaction_event_id", evt.ID.String()).
+		Logger()
+	br.CleanupDeletedMessage(log.WithContext(context.Background()), portal, evt.RoomID, evt.Redacts)
+}
+
+// IsMessageDeleted checks if the remote message with the given ID was deleted after being bridged.
+func (br *Bridge) IsMessageDeleted(roomID id.RoomID, remoteID string) bool {
+	eventID, err := br.BridgeStore.GetMessageTombstone(roomID, remoteID)
+	if err != nil {
+		br.ZLog.Err(err).Str("room_id", roomID.String()).Str("remote_id", remoteID).Msg("Failed to get message tombstone")
+	}
+	return eventID != ""
+}
+
+type hiddenEventsContent struct {
+	EventIDs []id.EventID `json:"event_ids"`
+}
+
+// HideEventForUser hides a message only for the given user, which is used for remote deletes that only apply
+// to one user. Matrix has no per-user redactions, so the event ID is added to room account data of the user's
+// double puppet, which clients that support it use to hide the event.
+func (br *Bridge) HideEventForUser(user User, roomID id.RoomID, eventID id.EventID) error {
+	puppet := user.GetIDoublePuppet()
+	if puppet == nil || puppet.CustomIntent() == nil {
+		return ErrHidingNeedsDoublePuppet
+	}
+	client := puppet.CustomIntent().Client
+	var content hiddenEventsContent
+	err := client.GetRoomAccountData(roomID, HiddenEventsAccountDataType, &content)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return fmt.Errorf("failed to get hidden events: %w", err)
+	}
+	for _, hidden := range content.EventIDs {
+		if hidden == eventID {
+			return nil
+		}
+	}
+	content.EventIDs = append(content.EventIDs, eventID)
+	err = client.SetRoomAccountData(roomID, HiddenEventsAccountDataType, &content)
+	if err != nil {
+		return fmt.Errorf("failed to save hidden events: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/id"
+)
+
+// SupportsDeterministicEventIDs returns true if the homeserver allows the bridge to choose event IDs
+// when batch sending. Bridges must only use deterministic event IDs for events sent with batch sending
+// when this returns true.
+func (br *Bridge) SupportsDeterministicEventIDs() bool {
+	return br.Config.Homeserver.Software == bridgeconfig.SoftwareHungry
+}
+
+func (br *Bridge) makeDeterministicEventID(roomID id.RoomID, parts ...string) id.EventID {
+	data := fmt.Sprintf("%s/%s/%s", roomID, br.Name, strings.Join(parts, "/"))
+	sum := sha256.Sum256([]byte(data))
+	return id.EventID(fmt.Sprintf("$%s:%s", base64.RawURLEncoding.EncodeToString(sum[:]), br.AS.HomeserverDomain))
+}
+
+// DeterministicEventID generates the Matrix event ID for a part of a remote message. The part ID should be empty
+// for single-part messages. The same inputs always produce the same event ID, which means that replies, threads
+// and reactions can reference messages that haven't been bridged yet, and the references will resolve
+// once the messages arrive.
+func (br *Bridge) DeterministicEventID(roomID id.RoomID, remoteMessageID, partID string) id.EventID {
+	if partID == "" {
+		return br.makeDeterministicEventID(roomID, remoteMessageID)
+	}
+	return br.makeDeterministicEventID(roomID, remoteMessageID, partID)
+}
+
+// DeterministicReactionID generates the Matrix event ID for a remote reaction. The emoji ID should be
+// the remote identifier of the reaction, which may be the emoji itself.
+func (br *Bridge) DeterministicReactionID(roomID id.RoomID, remoteMessageID, partID, sender, emojiID string) id.EventID {
+	return br.makeDeterministicEventID(roomID, remoteMessageID, partID, "reaction", sender, emojiID)
+}
+
+// ResolveTargetEventID returns the event ID to use when referencing a remote message, e.g. as a reply or
+// reaction target. If the message has been bridged, the known event ID is returned. Otherwise, the deterministic
+// event ID is returned if the homeserver supports them, or an empty string if it doesn't.
+func (br *Bridge) ResolveTargetEventID(roomID id.RoomID, known id.EventID, remoteMessageID, partID string) id.EventID {
+	if known != "" {
+		return known
+	} else if !br.SupportsDeterministicEventIDs() {
+		return ""
+	}
+	return br.DeterministicEventID(roomID, remoteMessageID, partID)
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/id"
+)
+
+// SlowDatabaseThreshold is the database round-trip time above which the diagnostics report a warning.
+const SlowDatabaseThreshold = 100 * time.Millisecond
+
+// DiagnosticResult is the result of a single self-diagnostic check.
+type DiagnosticResult struct {
+	Name    string
+	OK      bool
+	Message string
+	// Hint is an actionable suggestion for fixing the problem if the check failed.
+	Hint string
+}
+
+// BackfillQueueBridge is an optional interface for bridges that have a backfill queue whose backlog
+// should be included in the self-diagnostics.
+type BackfillQueueBridge interface {
+	ChildOverride
+	GetBackfillQueueLength(user User) int
+}
+
+// RemoteStateUser is an optional interface for users whose remote network connection state
+// should be included in the self-diagnostics.
+type RemoteStateUser interface {
+	User
+	GetRemoteState() status.BridgeState
+}
+
+// RunDiagnostics checks the health of the bridge from the point of view of the given user.
+// If roomID is not empty, the encryption state of that room is checked too.
+func (br *Bridge) RunDiagnostics(ctx context.Context, user User, roomID id.RoomID) []DiagnosticResult {
+	results := []DiagnosticResult{
+		br.checkAppserviceConnectivity(),
+		br.checkDatabaseLatency(ctx),
+	}
+	if user != nil {
+		results = append(results, br.checkDoublePuppet(user))
+		if rsu, ok := user.(RemoteStateUser); ok {
+			results = append(results, checkRemoteState(rsu))
+		}
+		if bqb, ok := br.Child.(BackfillQueueBridge); ok {
+			queueLength := bqb.GetBackfillQueueLength(user)
+			results = append(results, DiagnosticResult{
+				Name:    "Backfill queue",
+				OK:      true,
+				Message: fmt.Sprintf("%d items waiting", queueLength),
+			})
+		}
+	}
+	if roomID != "" {
+		results = append(results, br.checkRoomEncryption(roomID))
+	}
+	return results
+}
+
+func (br *Bridge) checkAppserviceConnectivity() DiagnosticResult {
+	res := DiagnosticResult{Name: "Homeserver connection"}
+	start := time.Now()
+	resp, err := br.Bot.Whoami()
+	if err != nil {
+		res.Message = fmt.Sprintf("Failed to call /whoami as the bridge bot: %v", err)
+		res.Hint = "Check that the homeserver is running and that the registration file is installed correctly"
+	} else if resp.UserID != br.Bot.UserID {
+		res.Message = fmt.Sprintf("The as_token belongs to %s instead of the bridge bot", resp.UserID)
+		res.Hint = "Regenerate the registration file and make sure the homeserver uses the same one"
+	} else {
+		res.OK = true
+		res.Message = fmt.Sprintf("OK (%s)", time.Since(start).Round(time.Millisecond))
+	}
+	return res
+}
+
+func (br *Bridge) checkDatabaseLatency(ctx context.Context) DiagnosticResult {
+	res := DiagnosticResult{Name: "Database"}
+	start := time.Now()
+	err := br.DB.RawDB.PingContext(ctx)
+	latency := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		res.Message = fmt.Sprintf("Failed to ping database: %v", err)
+		res.Hint = "Check that the database server is running and reachable"
+	} else if latency > SlowDatabaseThreshold {
+		res.Message = fmt.Sprintf("Slow round-trip time: %s", latency)
+		res.Hint = "Check the load on the database server and the network latency between it and the bridge"
+	} else {
+		res.OK = true
+		res.Message = fmt.Sprintf("OK (%s)", latency)
+	}
+	return res
+}
+
+func (br *Bridge) checkDoublePuppet(user User) DiagnosticResult {
+	res := DiagnosticResult{Name: "Double puppeting"}
+	puppet := user.GetIDoublePuppet()
+	if puppet == nil || puppet.CustomIntent() == nil {
+		res.OK = true
+		res.Message = "Not enabled"
+		return res
+	}
+	resp, err := puppet.CustomIntent().Whoami()
+	if err != nil {
+		res.Message = fmt.Sprintf("Failed to validate access token: %v", err)
+		res.Hint = "Log in again with `$cmdprefix login-matrix`"
+	} else if resp.UserID != user.GetMXID() {
+		res.Message = fmt.Sprintf("Access token belongs to %s", resp.UserID)
+		res.Hint = "Log out with `$cmdprefix logout-matrix` and log in again with the correct account"
+	} else {
+		res.OK = true
+		res.Message = "OK"
+	}
+	return res
+}
+
+func checkRemoteState(user RemoteStateUser) DiagnosticResult {
+	res := DiagnosticResult{Name: "Remote network connection"}
+	state := user.GetRemoteState()
+	switch state.StateEvent {
+	case status.StateConnected, status.StateBackfilling:
+		res.OK = true
+		res.Message = string(state.StateEvent)
+	case "":
+		res.Message = "Unknown"
+	default:
+		res.Message = string(state.StateEvent)
+		if state.Message != "" {
+			res.Message = fmt.Sprintf("%s: %s", state.StateEvent, state.Message)
+		}
+		if state.StateEvent == status.StateBadCredentials || state.StateEvent == status.StateLoggedOut {
+			res.Hint = "Log in again"
+		} else {
+			res.Hint = "Check the bridge logs for connection errors"
+		}
+	}
+	return res
+}
+
+func (br *Bridge) checkRoomEncryption(roomID id.RoomID) DiagnosticResult {
+	res := DiagnosticResult{Name: "Room encryption"}
+	roomEncrypted := br.StateStore.IsEncrypted(roomID)
+	portal := br.Child.GetIPortal(roomID)
+	switch {
+	case roomEncrypted && br.Crypto == nil:
+		res.Message = "Room is encrypted, but encryption is not enabled in the bridge"
+		res.Hint = "Enable encryption in the bridge config or create a new unencrypted room"
+	case portal != nil && portal.IsEncrypted() != roomEncrypted:
+		res.Message = fmt.Sprintf("Portal encryption flag (%t) doesn't match room state (%t)", portal.IsEncrypted(), roomEncrypted)
+		res.Hint = "Resync the portal or re-enable encryption in the room"
+	case roomEncrypted:
+		res.OK = true
+		res.Message = "Encrypted"
+	default:
+		res.OK = true
+		res.Message = "Not encrypted"
+	}
+	return res
+}
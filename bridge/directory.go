@@ -0,0 +1,108 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ErrAliasInUse is returned by PublishPortal if the alias of the portal already points to another room.
+var ErrAliasInUse = errors.New("alias is already used by another room")
+
+// DirectoryPublishablePortal is an optional interface for portals of public remote channels that can be
+// published in the homeserver's room directory. Publishing must be enabled in the config as well.
+type DirectoryPublishablePortal interface {
+	Portal
+	// ShouldPublishToDirectory returns true if the portal has opted in to being listed in the room directory.
+	ShouldPublishToDirectory() bool
+}
+
+func (br *Bridge) getDirectoryAlias(channelID string) (id.RoomAlias, bool) {
+	rdc, ok := br.Config.Bridge.(bridgeconfig.RoomDirectoryBridgeConfig)
+	if !ok {
+		return "", false
+	}
+	cfg := rdc.GetRoomDirectoryConfig()
+	if !cfg.PublishPublicChannels || cfg.AliasTemplate == "" {
+		return "", false
+	}
+	// The channel ID comes from the remote network, so it's escaped like user ID localparts to make sure
+	// it can't contain characters that aren't allowed in aliases (like :) or change the rest of the template.
+	localpart := strings.ReplaceAll(cfg.AliasTemplate, "{{.}}", id.EncodeUserLocalpart(channelID))
+	return id.NewRoomAlias(localpart, br.AS.HomeserverDomain), true
+}
+
+// PublishPortal publishes the portal room of a public remote channel in the room directory with a canonical alias.
+// The topic should be the remote channel's description, which is shown in the directory.
+// It does nothing if publishing is disabled in the config or the portal hasn't opted in.
+//
+// If the alias already exists and points to another room, ErrAliasInUse is returned and the room isn't published.
+func (br *Bridge) PublishPortal(ctx context.Context, portal DirectoryPublishablePortal, roomID id.RoomID, channelID, topic string) error {
+	alias, enabled := br.getDirectoryAlias(channelID)
+	if !enabled || !portal.ShouldPublishToDirectory() {
+		return nil
+	}
+	log := zerolog.Ctx(ctx).With().Str("room_alias", alias.String()).Logger()
+	intent := portal.MainIntent()
+	_, err := br.Bot.CreateAlias(alias, roomID)
+	if errors.Is(err, mautrix.MRoomInUse) {
+		resp, resolveErr := br.Bot.ResolveAlias(alias)
+		if resolveErr != nil {
+			return fmt.Errorf("failed to resolve existing alias: %w", resolveErr)
+		} else if resp.RoomID != roomID {
+			log.Warn().Str("alias_room_id", resp.RoomID.String()).Msg("Alias of portal is used by another room, not publishing")
+			return fmt.Errorf("%w: %s points to %s", ErrAliasInUse, alias, resp.RoomID)
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to create alias: %w", err)
+	}
+	_, err = intent.SendStateEvent(roomID, event.StateCanonicalAlias, "", &event.CanonicalAliasEventContent{Alias: alias})
+	if err != nil {
+		return fmt.Errorf("failed to set canonical alias: %w", err)
+	}
+	if topic != "" {
+		_, err = intent.SetRoomTopic(roomID, topic)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to set topic of published portal")
+		}
+	}
+	err = br.Bot.SetRoomDirectoryVisibility(roomID, mautrix.RoomDirectoryVisibilityPublic)
+	if err != nil {
+		return fmt.Errorf("failed to publish room: %w", err)
+	}
+	log.Info().Msg("Published portal in room directory")
+	return nil
+}
+
+// UnpublishPortal removes a portal room from the room directory and deletes its alias.
+// Bridges should call this when a public remote channel becomes private or when the portal is deleted.
+func (br *Bridge) UnpublishPortal(ctx context.Context, roomID id.RoomID, channelID string) error {
+	alias, enabled := br.getDirectoryAlias(channelID)
+	if !enabled {
+		return nil
+	}
+	err := br.Bot.SetRoomDirectoryVisibility(roomID, mautrix.RoomDirectoryVisibilityPrivate)
+	if err != nil {
+		return fmt.Errorf("failed to unpublish room: %w", err)
+	}
+	_, err = br.Bot.DeleteAlias(alias)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return fmt.Errorf("failed to delete alias: %w", err)
+	}
+	zerolog.Ctx(ctx).Info().Str("room_alias", alias.String()).Msg("Unpublished portal from room directory")
+	return nil
+}
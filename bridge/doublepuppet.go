@@ -0,0 +1,333 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrMismatchingMXID = errors.New("whoami result does not match custom mxid")
+	ErrNoAccessToken   = errors.New("no access token provided")
+	ErrNoMXID          = errors.New("no mxid provided")
+)
+
+const (
+	// UseConfigASToken is stored instead of an access token when the double puppet uses an appservice token from the config.
+	UseConfigASToken  = "appservice-config"
+	asTokenModePrefix = "as_token:"
+	appserviceLogin   = "appservice"
+	msc4190Feature    = "io.element.msc4190"
+)
+
+// DoublePuppetUtil contains helpers for setting up and maintaining double puppeting.
+//
+// Automatic double puppeting goes through a chain of methods: first the shared secret map in the config
+// (an appservice token with the as_token: prefix, the bridge's own appservice token or a login shared secret),
+// then an appservice-scoped device using the bridge's own appservice token if the homeserver supports MSC4190
+// and the user is in the bridge's namespace, and finally asking the user to log in manually with the
+// login-matrix command.
+type DoublePuppetUtil struct {
+	br  *Bridge
+	log zerolog.Logger
+}
+
+func (dp *DoublePuppetUtil) getConfig() bridgeconfig.DoublePuppetConfig {
+	dpc, ok := dp.br.Config.Bridge.(bridgeconfig.DoublePuppetingBridgeConfig)
+	if !ok {
+		return bridgeconfig.DoublePuppetConfig{}
+	}
+	return dpc.GetDoublePuppetConfig()
+}
+
+func (dp *DoublePuppetUtil) newClient(mxid id.UserID, accessToken string) (*mautrix.Client, error) {
+	_, homeserver, err := mxid.Parse()
+	if err != nil {
+		return nil, err
+	}
+	cfg := dp.getConfig()
+	homeserverURL, found := cfg.ServerMap[homeserver]
+	if !found {
+		if homeserver == dp.br.AS.HomeserverDomain {
+			homeserverURL = ""
+		} else if cfg.AllowDiscovery {
+			resp, err := mautrix.DiscoverClientAPI(homeserver)
+			if err != nil {
+				return nil, fmt.Errorf("failed to find homeserver URL for %s: %w", homeserver, err)
+			} else if resp == nil {
+				return nil, fmt.Errorf("no .well-known found for %s", homeserver)
+			}
+			homeserverURL = resp.Homeserver.BaseURL
+			dp.log.Debug().
+				Str("homeserver", homeserver).
+				Str("url", homeserverURL).
+				Msg("Discovered URL to enable double puppeting")
+		} else {
+			return nil, fmt.Errorf("double puppeting from %s is not allowed", homeserver)
+		}
+	}
+	return dp.br.AS.NewExternalMautrixClient(mxid, accessToken, homeserverURL)
+}
+
+func (dp *DoublePuppetUtil) newIntent(mxid id.UserID, accessToken string) (*appservice.IntentAPI, error) {
+	client, err := dp.newClient(mxid, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	ia := dp.br.AS.NewIntentAPI("custom")
+	ia.Client = client
+	ia.Localpart, _, _ = mxid.Parse()
+	ia.UserID = mxid
+	ia.IsCustomPuppet = true
+	return ia, nil
+}
+
+func (dp *DoublePuppetUtil) autoLogin(mxid id.UserID, loginSecret string) (string, error) {
+	dp.log.Debug().Str("user_id", mxid.String()).Msg("Logging into user account with shared secret")
+	client, err := dp.newClient(mxid, "")
+	if err != nil {
+		return "", fmt.Errorf("failed to create mautrix client to log in: %w", err)
+	}
+	bridgeName := fmt.Sprintf("%s Bridge", dp.br.ProtocolName)
+	req := mautrix.ReqLogin{
+		Identifier:               mautrix.UserIdentifier{Type: mautrix.IdentifierTypeUser, User: string(mxid)},
+		DeviceID:                 id.DeviceID(bridgeName),
+		InitialDeviceDisplayName: bridgeName,
+	}
+	if loginSecret == appserviceLogin {
+		client.AccessToken = dp.br.AS.Registration.AppToken
+		req.Type = mautrix.AuthTypeAppservice
+	} else {
+		mac := hmac.New(sha512.New, []byte(loginSecret))
+		mac.Write([]byte(mxid))
+		req.Password = hex.EncodeToString(mac.Sum(nil))
+		req.Type = mautrix.AuthTypePassword
+	}
+	resp, err := client.Login(&req)
+	if err != nil {
+		return "", err
+	}
+	return resp.AccessToken, nil
+}
+
+// canUseMSC4190 returns true if the bridge can create an appservice-scoped device for the given user.
+func (dp *DoublePuppetUtil) canUseMSC4190(mxid id.UserID) bool {
+	_, homeserver, err := mxid.Parse()
+	return err == nil &&
+		homeserver == dp.br.AS.HomeserverDomain &&
+		dp.br.SpecVersions.UnstableFeatures[msc4190Feature] &&
+		dp.br.AS.Registration.Namespaces.UserIDs.MatchString(string(mxid))
+}
+
+// setupMSC4190 creates a double puppet intent that uses the bridge's own appservice token to act as the user,
+// and makes sure the bridge's device exists for the user (MSC4190).
+func (dp *DoublePuppetUtil) setupMSC4190(mxid id.UserID) (*appservice.IntentAPI, error) {
+	dp.log.Debug().Str("user_id", mxid.String()).Msg("Setting up double puppet with appservice-scoped device")
+	intent, err := dp.newIntent(mxid, dp.br.AS.Registration.AppToken)
+	if err != nil {
+		return nil, err
+	}
+	intent.SetAppServiceUserID = true
+	bridgeName := fmt.Sprintf("%s Bridge", dp.br.ProtocolName)
+	err = intent.SetDeviceInfo(id.DeviceID(bridgeName), &mautrix.ReqDeviceInfo{DisplayName: bridgeName})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create appservice device: %w", err)
+	}
+	resp, err := intent.Whoami()
+	if err != nil {
+		return nil, err
+	} else if resp.UserID != mxid {
+		return nil, ErrMismatchingMXID
+	}
+	return intent, nil
+}
+
+// CanAutoSetup returns true if the shared secret map contains a login method for the homeserver of the given user,
+// or if the bridge can create an appservice-scoped device for the user using MSC4190.
+func (dp *DoublePuppetUtil) CanAutoSetup(mxid id.UserID) bool {
+	_, homeserver, err := mxid.Parse()
+	if err != nil {
+		return false
+	}
+	_, hasSecret := dp.getConfig().SharedSecretMap[homeserver]
+	return hasSecret || dp.canUseMSC4190(mxid)
+}
+
+// Setup creates a double puppet intent for the given user ID.
+//
+// If the saved access token is empty or no longer valid and reloginOnFail is true, the shared secret map
+// in the config is used to get a new token, falling back to MSC4190 if there's no secret for the homeserver.
+// The returned access token should be saved in the database.
+func (dp *DoublePuppetUtil) Setup(mxid id.UserID, savedAccessToken string, reloginOnFail bool) (intent *appservice.IntentAPI, newAccessToken string, err error) {
+	if len(mxid) == 0 {
+		err = ErrNoMXID
+		return
+	}
+	_, homeserver, _ := mxid.Parse()
+	loginSecret, hasSecret := dp.getConfig().SharedSecretMap[homeserver]
+	// Special case as_token: prefix to not log in and use it as an appservice token directly.
+	if hasSecret && strings.HasPrefix(loginSecret, asTokenModePrefix) {
+		intent, err = dp.newIntent(mxid, strings.TrimPrefix(loginSecret, asTokenModePrefix))
+		if err != nil {
+			return
+		}
+		intent.SetAppServiceUserID = true
+		if savedAccessToken != UseConfigASToken {
+			var resp *mautrix.RespWhoami
+			resp, err = intent.Whoami()
+			if err == nil && resp.UserID != mxid {
+				err = ErrMismatchingMXID
+			}
+		}
+		return intent, UseConfigASToken, err
+	}
+	if savedAccessToken == "" || savedAccessToken == UseConfigASToken {
+		if reloginOnFail && hasSecret {
+			savedAccessToken, err = dp.autoLogin(mxid, loginSecret)
+		} else if (reloginOnFail || savedAccessToken == UseConfigASToken) && dp.canUseMSC4190(mxid) {
+			intent, err = dp.setupMSC4190(mxid)
+			return intent, UseConfigASToken, err
+		} else {
+			err = ErrNoAccessToken
+		}
+		if err != nil {
+			return
+		}
+	}
+	intent, err = dp.newIntent(mxid, savedAccessToken)
+	if err != nil {
+		return
+	}
+	var resp *mautrix.RespWhoami
+	resp, err = intent.Whoami()
+	if err != nil {
+		if reloginOnFail && hasSecret && errors.Is(err, mautrix.MUnknownToken) {
+			intent.AccessToken, err = dp.autoLogin(mxid, loginSecret)
+			if err == nil {
+				newAccessToken = intent.AccessToken
+			}
+		} else if reloginOnFail && errors.Is(err, mautrix.MUnknownToken) && dp.canUseMSC4190(mxid) {
+			intent, err = dp.setupMSC4190(mxid)
+			newAccessToken = UseConfigASToken
+		}
+	} else if resp.UserID != mxid {
+		err = ErrMismatchingMXID
+	} else {
+		newAccessToken = savedAccessToken
+	}
+	return
+}
+
+// EnsureDoublePuppet enables double puppeting for the user if it isn't enabled yet, or revalidates the existing
+// double puppet. If no automatic method works, the user is asked to log in manually in their management room.
+//
+// Bridges should call this after a user successfully logs into the remote network.
+func (dp *DoublePuppetUtil) EnsureDoublePuppet(ctx context.Context, user User) error {
+	puppet := user.GetIDoublePuppet()
+	if puppet != nil && puppet.CustomIntent() != nil {
+		return dp.Revalidate(ctx, user)
+	}
+	log := zerolog.Ctx(ctx).With().Str("user_id", user.GetMXID().String()).Logger()
+	if puppet == nil {
+		puppet = user.GetIGhost()
+		if puppet == nil {
+			return fmt.Errorf("user doesn't have a ghost to use as double puppet")
+		}
+	}
+	if dp.CanAutoSetup(user.GetMXID()) {
+		_, accessToken, err := dp.Setup(user.GetMXID(), "", true)
+		if err == nil {
+			err = puppet.SwitchCustomMXID(accessToken, user.GetMXID())
+		}
+		if err == nil {
+			log.Info().Msg("Automatically enabled double puppeting")
+			return nil
+		}
+		log.Warn().Err(err).Msg("Failed to automatically enable double puppeting")
+	}
+	dp.promptLogin(ctx, user, "Double puppeting couldn't be enabled automatically.")
+	return nil
+}
+
+// Revalidate checks that the double puppet of the given user still works.
+//
+// If the access token has stopped working, a new one is fetched using the automatic methods (see DoublePuppetUtil),
+// and if that isn't possible, double puppeting is disabled and the user is asked to log in again in their
+// management room. Network errors are returned without touching the double puppet.
+func (dp *DoublePuppetUtil) Revalidate(ctx context.Context, user User) error {
+	puppet := user.GetIDoublePuppet()
+	if puppet == nil || puppet.CustomIntent() == nil {
+		return nil
+	}
+	log := zerolog.Ctx(ctx).With().Str("user_id", user.GetMXID().String()).Logger()
+	resp, err := puppet.CustomIntent().Whoami()
+	if err == nil && resp.UserID == user.GetMXID() {
+		return nil
+	} else if err != nil && !errors.Is(err, mautrix.MUnknownToken) {
+		return fmt.Errorf("failed to validate double puppet: %w", err)
+	}
+	log.Warn().Err(err).Msg("Double puppet access token is no longer valid, trying to repair")
+	_, newAccessToken, err := dp.Setup(user.GetMXID(), "", true)
+	if err == nil {
+		err = puppet.SwitchCustomMXID(newAccessToken, user.GetMXID())
+	}
+	if err == nil {
+		log.Info().Msg("Repaired double puppet")
+		return nil
+	}
+	log.Warn().Err(err).Msg("Failed to repair double puppet, disabling it")
+	err = puppet.SwitchCustomMXID("", "")
+	if err != nil {
+		log.Err(err).Msg("Failed to disable broken double puppet")
+	}
+	dp.promptLogin(ctx, user, "Your Matrix access token used for double puppeting is no longer valid.")
+	return nil
+}
+
+func (dp *DoublePuppetUtil) promptLogin(ctx context.Context, user User, reason string) {
+	prefix := dp.br.Config.Bridge.GetCommandPrefix()
+	err := dp.br.SendManagementNotice(ctx, user, fmt.Sprintf(
+		"%s Use `%s login-matrix <access token>` to enable double puppeting.", reason, prefix,
+	))
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).
+			Str("user_id", user.GetMXID().String()).
+			Msg("Failed to send double puppet login prompt to management room")
+	}
+}
+
+// revalidateAll revalidates the double puppets of all users at startup, so that expired tokens are
+// repaired or reported before they cause messages to be sent without double puppeting.
+func (dp *DoublePuppetUtil) revalidateAll(ctx context.Context) {
+	ulb, ok := dp.br.Child.(UserListingBridge)
+	if !ok {
+		return
+	}
+	ctx = dp.log.WithContext(ctx)
+	for _, user := range ulb.GetAllIUsers() {
+		if ctx.Err() != nil {
+			return
+		}
+		err := dp.Revalidate(ctx, user)
+		if err != nil {
+			dp.log.Warn().Err(err).Str("user_id", user.GetMXID().String()).Msg("Failed to revalidate double puppet")
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// EditHistoryKey is the key in the content of bridged edits that contains info about the stored edit history.
+const EditHistoryKey = "fi.mau.edit_history"
+
+// DefaultEditNoticeInterval is the minimum time between edit notices for the same message
+// if it's not set in the config.
+const DefaultEditNoticeInterval = 5 * time.Minute
+
+// maxEditDiffWords is the maximum number of changed words in the old and new text that are diffed.
+// The diff takes quadratic memory, so longer changes are shown without a diff.
+const maxEditDiffWords = 500
+
+// EditHistoryInfo is the content of the EditHistoryKey field.
+type EditHistoryInfo struct {
+	PreviousVersions int `json:"previous_versions"`
+}
+
+func (br *Bridge) getEditHistoryConfig() bridgeconfig.EditHistoryConfig {
+	if ehc, ok := br.Config.Bridge.(bridgeconfig.EditHistoryBridgeConfig); ok {
+		return ehc.GetEditHistoryConfig()
+	}
+	return bridgeconfig.EditHistoryConfig{}
+}
+
+// RecordEdit stores the previous content of a remote message that is being edited, if edit history is enabled
+// in the config. Portals should call it before sending the edit, with the content the message had before the edit.
+//
+// If the edit history notice is enabled, a notice replying to the message is sent with a diff of the change.
+// The returned raw content should be merged into the edit event. It's nil if edit history is disabled.
+func (br *Bridge) RecordEdit(ctx context.Context, portal Portal, roomID id.RoomID, eventID id.EventID, prevContent, newContent *event.MessageEventContent, editedAt time.Time) map[string]interface{} {
+	cfg := br.getEditHistoryConfig()
+	if !cfg.Enabled || prevContent == nil {
+		return nil
+	}
+	log := zerolog.Ctx(ctx).With().Str("edit_target_event_id", eventID.String()).Logger()
+	err := br.BridgeStore.AddEditHistory(roomID, eventID, prevContent, editedAt)
+	if err != nil {
+		log.Err(err).Msg("Failed to store previous version of edited message")
+		return nil
+	}
+	history, err := br.BridgeStore.GetEditHistory(roomID, eventID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get edit history")
+		return nil
+	}
+	noticeInterval := DefaultEditNoticeInterval
+	if cfg.NoticeInterval > 0 {
+		noticeInterval = time.Duration(cfg.NoticeInterval) * time.Second
+	}
+	// The history is sorted by edit time, so the second to last entry is the previous edit.
+	recentlyNotified := len(history) >= 2 && editedAt.Sub(history[len(history)-2].EditedAt) < noticeInterval
+	if cfg.Notice && newContent != nil && !recentlyNotified {
+		notice := &event.MessageEventContent{
+			MsgType:   event.MsgNotice,
+			Body:      "Edited (the changes are too long to show)",
+			RelatesTo: (&event.RelatesTo{}).SetReplyTo(eventID),
+		}
+		if plainDiff, htmlDiff, ok := renderWordDiff(prevContent.Body, newContent.Body); ok {
+			notice.Body = "Edited: " + plainDiff
+			notice.Format = event.FormatHTML
+			notice.FormattedBody = "Edited: " + htmlDiff
+		}
+		_, err = br.sendPortalEvent(portal, portal.MainIntent(), roomID, event.EventMessage, notice)
+		if err != nil {
+			log.Err(err).Msg("Failed to send edit history notice")
+		}
+	}
+	return map[string]interface{}{
+		EditHistoryKey: &EditHistoryInfo{PreviousVersions: len(history)},
+	}
+}
+
+// renderWordDiff renders the word-level difference between two texts, both as plain text
+// (with [-removed-] and {+added+} markers) and as HTML (with <del> and <ins> tags).
+//
+// Common words at the start and end are skipped before diffing. If the remaining parts are longer than
+// maxEditDiffWords, no diff is rendered and ok is false.
+func renderWordDiff(oldText, newText string) (plainDiff, htmlDiff string, ok bool) {
+	oldWords := strings.Fields(oldText)
+	newWords := strings.Fields(newText)
+	prefixLen := 0
+	for prefixLen < len(oldWords) && prefixLen < len(newWords) && oldWords[prefixLen] == newWords[prefixLen] {
+		prefixLen++
+	}
+	suffixLen := 0
+	for suffixLen < len(oldWords)-prefixLen && suffixLen < len(newWords)-prefixLen &&
+		oldWords[len(oldWords)-1-suffixLen] == newWords[len(newWords)-1-suffixLen] {
+		suffixLen++
+	}
+	oldChanged := oldWords[prefixLen : len(oldWords)-suffixLen]
+	newChanged := newWords[prefixLen : len(newWords)-suffixLen]
+	if len(oldChanged) > maxEditDiffWords || len(newChanged) > maxEditDiffWords {
+		return "", "", false
+	}
+	// lcs[i][j] is the length of the longest common subsequence of oldChanged[i:] and newChanged[j:]
+	lcs := make([][]int, len(oldChanged)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(newChanged)+1)
+	}
+	for i := len(oldChanged) - 1; i >= 0; i-- {
+		for j := len(newChanged) - 1; j >= 0; j-- {
+			if oldChanged[i] == newChanged[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var plain, formatted []string
+	addUnchanged := func(words []string) {
+		for _, word := range words {
+			plain = append(plain, word)
+			formatted = append(formatted, html.EscapeString(word))
+		}
+	}
+	addUnchanged(oldWords[:prefixLen])
+	i, j := 0, 0
+	for i < len(oldChanged) || j < len(newChanged) {
+		switch {
+		case i < len(oldChanged) && j < len(newChanged) && oldChanged[i] == newChanged[j]:
+			addUnchanged(oldChanged[i : i+1])
+			i++
+			j++
+		case i < len(oldChanged) && (j == len(newChanged) || lcs[i+1][j] >= lcs[i][j+1]):
+			plain = append(plain, "[-"+oldChanged[i]+"-]")
+			formatted = append(formatted, "<del>"+html.EscapeString(oldChanged[i])+"</del>")
+			i++
+		default:
+			plain = append(plain, "{+"+newChanged[j]+"+}")
+			formatted = append(formatted, "<ins>"+html.EscapeString(newChanged[j])+"</ins>")
+			j++
+		}
+	}
+	addUnchanged(oldWords[len(oldWords)-suffixLen:])
+	return strings.Join(plain, " "), strings.Join(formatted, " "), true
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"maunium.net/go/mautrix/event"
+)
+
+// MessageEffectPortal is an optional interface for portals that can send messages with effects to the remote network.
+//
+// Remote messages with effects should be bridged by setting the BeeperEffect field in the message content,
+// and the MessageEffects flag should be set in the room features (see Bridge.SendRoomFeatures).
+type MessageEffectPortal interface {
+	Portal
+	// SupportsMessageEffect returns true if the given effect ID can be sent to the remote chat.
+	SupportsMessageEffect(effectID string) bool
+}
+
+// messageEffectMiddleware removes message effects from Matrix messages unless the portal can send the effect,
+// so that portals only need to check whether the BeeperEffect field is set.
+func (mx *MatrixHandler) messageEffectMiddleware(next MatrixEventHandler) MatrixEventHandler {
+	return func(user User, portal Portal, evt *event.Event) {
+		content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+		if ok && content.BeeperEffect != nil {
+			mep, supportsEffects := portal.(MessageEffectPortal)
+			if !supportsEffects || !mep.SupportsMessageEffect(content.BeeperEffect.ID) {
+				mx.log.Debug().
+					Str("event_id", evt.ID.String()).
+					Str("effect_id", content.BeeperEffect.ID).
+					Msg("Dropping unsupported message effect")
+				content.BeeperEffect = nil
+			}
+		}
+		next(user, portal, evt)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrEncryptionNotAvailable = errors.New("encryption is not enabled on this bridge")
+	ErrPortalAlreadyEncrypted = errors.New("the portal is already encrypted")
+)
+
+// EncryptionEventContent returns the m.room.encryption content for portal rooms,
+// including custom session rotation settings if they're enabled in the config.
+func (br *Bridge) EncryptionEventContent() *event.EncryptionEventContent {
+	content := &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1}
+	if rot := br.Config.Bridge.GetEncryptionConfig().Rotation; rot.EnableCustom {
+		content.RotationPeriodMillis = rot.Milliseconds
+		content.RotationPeriodMessages = rot.Messages
+	}
+	return content
+}
+
+// EnablePortalEncryption enables encryption in an existing unencrypted portal room.
+//
+// The encryption state event is sent using the portal's main intent and the portal is marked as encrypted.
+// After that, all ghosts in the room are joined again to make sure the state store knows about them and
+// the current outbound Megolm session is discarded, so that the next message creates a session that's
+// shared with everyone in the room.
+func (br *Bridge) EnablePortalEncryption(ctx context.Context, portal Portal, roomID id.RoomID) error {
+	log := zerolog.Ctx(ctx).With().Str("action", "enable portal encryption").Logger()
+	if br.Crypto == nil {
+		return ErrEncryptionNotAvailable
+	} else if portal.IsEncrypted() {
+		return ErrPortalAlreadyEncrypted
+	}
+	intent := portal.MainIntent()
+	_, err := intent.SendStateEvent(roomID, event.StateEncryption, "", br.EncryptionEventContent())
+	if err != nil {
+		return fmt.Errorf("failed to send encryption event: %w", err)
+	}
+	portal.MarkEncrypted()
+	if portal.IsPrivateChat() {
+		err = br.Bot.EnsureJoined(roomID, appservice.EnsureJoinedParams{BotOverride: intent.Client})
+		if err != nil {
+			return fmt.Errorf("failed to join bridge bot to room: %w", err)
+		}
+	}
+	members, err := br.Bot.JoinedMembers(roomID)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get joined members to rotate in ghosts")
+	} else {
+		for userID := range members.Joined {
+			if !br.Child.IsGhost(userID) {
+				continue
+			}
+			ghost := br.Child.GetIGhost(userID)
+			if ghost == nil {
+				continue
+			}
+			err = ghost.DefaultIntent().EnsureJoined(roomID)
+			if err != nil {
+				log.Warn().Err(err).Str("ghost_user_id", userID.String()).Msg("Failed to ensure ghost is joined")
+			}
+		}
+	}
+	br.Crypto.ResetSession(roomID)
+	portal.UpdateBridgeInfo()
+	log.Info().Msg("Enabled encryption in portal")
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"runtime/debug"
+	"sync"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type BusEventType string
+
+const (
+	BusEventPortalCreated     BusEventType = "portal_created"
+	BusEventMessageBridged    BusEventType = "message_bridged"
+	BusEventLoginStateChanged BusEventType = "login_state_changed"
+	BusEventBackfillFinished  BusEventType = "backfill_finished"
+	BusEventMembershipChanged BusEventType = "membership_changed"
+)
+
+// BusEvent is an event published on the EventBus.
+type BusEvent interface {
+	GetBusEventType() BusEventType
+}
+
+// PortalCreatedEvent is published by bridges after creating the Matrix room for a portal.
+type PortalCreatedEvent struct {
+	Portal Portal
+	RoomID id.RoomID
+}
+
+// MessageBridgedEvent is published by bridges after bridging a message in either direction.
+type MessageBridgedEvent struct {
+	Portal     Portal
+	RoomID     id.RoomID
+	EventID    id.EventID
+	RemoteID   string
+	FromMatrix bool
+}
+
+// LoginStateChangedEvent is published automatically when a new bridge state is queued with BridgeStateQueue.Send.
+type LoginStateChangedEvent struct {
+	State status.BridgeState
+}
+
+// BackfillFinishedEvent is published by bridges after finishing a backfill batch in a portal.
+type BackfillFinishedEvent struct {
+	Portal       Portal
+	RoomID       id.RoomID
+	MessageCount int
+}
+
+// MembershipChangedEvent is published automatically when a membership change is applied with Bridge.ApplyMemberChange.
+type MembershipChangedEvent struct {
+	RoomID     id.RoomID
+	UserID     id.UserID
+	Membership event.Membership
+}
+
+func (evt *PortalCreatedEvent) GetBusEventType() BusEventType     { return BusEventPortalCreated }
+func (evt *MessageBridgedEvent) GetBusEventType() BusEventType    { return BusEventMessageBridged }
+func (evt *LoginStateChangedEvent) GetBusEventType() BusEventType { return BusEventLoginStateChanged }
+func (evt *BackfillFinishedEvent) GetBusEventType() BusEventType  { return BusEventBackfillFinished }
+func (evt *MembershipChangedEvent) GetBusEventType() BusEventType { return BusEventMembershipChanged }
+
+// BusEventHandler is a function that receives events from the EventBus.
+type BusEventHandler func(ctx context.Context, evt BusEvent)
+
+type busSubscription struct {
+	handler BusEventHandler
+}
+
+// EventBus is a publish/subscribe bus for events inside the bridge. It allows components like commands,
+// provisioning APIs and metrics to react to things happening in portals without the portal code knowing about them.
+type EventBus struct {
+	log         zerolog.Logger
+	subscribers map[BusEventType][]*busSubscription
+	lock        sync.RWMutex
+}
+
+func newEventBus(br *Bridge) *EventBus {
+	return &EventBus{
+		log:         br.ZLog.With().Str("component", "event bus").Logger(),
+		subscribers: make(map[BusEventType][]*busSubscription),
+	}
+}
+
+// Subscribe registers a handler for the given event type. The returned function removes the subscription.
+//
+// Handlers are called synchronously in the goroutine that publishes the event,
+// so they must not block for long. Slow work should be done in a separate goroutine.
+func (eb *EventBus) Subscribe(evtType BusEventType, handler BusEventHandler) (unsubscribe func()) {
+	sub := &busSubscription{handler: handler}
+	eb.lock.Lock()
+	eb.subscribers[evtType] = append(eb.subscribers[evtType], sub)
+	eb.lock.Unlock()
+	return func() {
+		eb.lock.Lock()
+		defer eb.lock.Unlock()
+		subs := eb.subscribers[evtType]
+		for i, existing := range subs {
+			if existing == sub {
+				eb.subscribers[evtType] = append(subs[:i:i], subs[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Publish sends the event to all handlers subscribed to its type.
+func (eb *EventBus) Publish(ctx context.Context, evt BusEvent) {
+	if eb == nil {
+		return
+	}
+	eb.lock.RLock()
+	subs := eb.subscribers[evt.GetBusEventType()]
+	eb.lock.RUnlock()
+	for _, sub := range subs {
+		eb.callHandler(ctx, sub.handler, evt)
+	}
+}
+
+func (eb *EventBus) callHandler(ctx context.Context, handler BusEventHandler, evt BusEvent) {
+	defer func() {
+		err := recover()
+		if err != nil {
+			eb.log.Error().
+				Str(zerolog.ErrorStackFieldName, string(debug.Stack())).
+				Interface(zerolog.ErrorFieldName, err).
+				Str("bus_event_type", string(evt.GetBusEventType())).
+				Msg("Panic in event bus handler")
+		}
+	}()
+	handler(ctx, evt)
+}
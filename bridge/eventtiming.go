@@ -0,0 +1,205 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+)
+
+// Standard phase names for TimeEventPhase. Bridges can use other names too, but using these ones
+// makes it easy to tell whether time was spent in the remote network, the homeserver or the database.
+const (
+	EventPhaseConvert       = "convert"
+	EventPhaseRemoteSend    = "remote_send"
+	EventPhaseMatrixSend    = "matrix_send"
+	EventPhaseDatabase      = "database"
+	EventPhaseConnectorWait = "connector_wait"
+)
+
+// eventTimingHistorySize is the number of recent events per portal that are included in timing stats.
+const eventTimingHistorySize = 200
+
+type eventTimingContextKey struct{}
+
+type eventTiming struct {
+	lock   sync.Mutex
+	phases map[string]time.Duration
+}
+
+// TimeEventPhase starts timing a phase of handling an event and returns a function that must be called
+// when the phase ends. The context must be the one passed to the handler in HandleRemoteEvent or
+// RunMatrixEventHandler. If the same phase is timed multiple times for one event, the durations are added up.
+//
+//	defer bridge.TimeEventPhase(ctx, bridge.EventPhaseRemoteSend)()
+func TimeEventPhase(ctx context.Context, phase string) func() {
+	timing, ok := ctx.Value(eventTimingContextKey{}).(*eventTiming)
+	if !ok {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		timing.lock.Lock()
+		// The phases are cleared when the event is finished, which can happen first if the handler was skipped.
+		if timing.phases != nil {
+			timing.phases[phase] += time.Since(start)
+		}
+		timing.lock.Unlock()
+	}
+}
+
+type timedEvent struct {
+	eventType string
+	total     time.Duration
+	phases    map[string]time.Duration
+}
+
+type portalEventTimings struct {
+	events []timedEvent
+	next   int
+}
+
+type eventTimingTracker struct {
+	lock    sync.Mutex
+	portals map[Portal]*portalEventTimings
+}
+
+// EventTypeTimingStats contains timing stats of one event type in a portal.
+type EventTypeTimingStats struct {
+	EventType string
+	Count     int
+	Average   time.Duration
+	Max       time.Duration
+	// Phases contains the average duration of each phase that was timed with TimeEventPhase.
+	Phases map[string]time.Duration
+}
+
+func (br *Bridge) getEventTimingThreshold(eventType string) time.Duration {
+	etc, ok := br.Config.Bridge.(bridgeconfig.EventTimingBridgeConfig)
+	if !ok {
+		return 0
+	}
+	cfg := etc.GetEventTimingConfig()
+	if threshold, ok := cfg.Thresholds[eventType]; ok {
+		return time.Duration(threshold) * time.Millisecond
+	}
+	return time.Duration(cfg.WarnThreshold) * time.Millisecond
+}
+
+func startEventTiming(ctx context.Context) (context.Context, *eventTiming) {
+	timing := &eventTiming{phases: make(map[string]time.Duration)}
+	return context.WithValue(ctx, eventTimingContextKey{}, timing), timing
+}
+
+func remoteEventTypeName(evt interface{}) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", evt), "*")
+}
+
+func matrixEventTypeName(evt *event.Event) string {
+	return evt.Type.Type
+}
+
+func (br *Bridge) finishEventTiming(log *zerolog.Logger, portal Portal, eventType string, start time.Time, timing *eventTiming) {
+	total := time.Since(start)
+	timing.lock.Lock()
+	phases := timing.phases
+	timing.phases = nil
+	timing.lock.Unlock()
+
+	if threshold := br.getEventTimingThreshold(eventType); threshold > 0 {
+		for phase, duration := range phases {
+			if duration > threshold {
+				log.Warn().
+					Str("event_type", eventType).
+					Str("phase", phase).
+					Dur("duration", duration).
+					Msgf("%s took %s", phase, duration.Round(time.Millisecond))
+			}
+		}
+		if total > threshold {
+			log.Warn().
+				Str("event_type", eventType).
+				Dur("duration", total).
+				Interface("phases", phases).
+				Msgf("Handling %s took %s", eventType, total.Round(time.Millisecond))
+		}
+	}
+
+	br.eventTimings.lock.Lock()
+	defer br.eventTimings.lock.Unlock()
+	pt, ok := br.eventTimings.portals[portal]
+	if !ok {
+		pt = &portalEventTimings{}
+		br.eventTimings.portals[portal] = pt
+	}
+	evt := timedEvent{eventType: eventType, total: total, phases: phases}
+	if len(pt.events) < eventTimingHistorySize {
+		pt.events = append(pt.events, evt)
+	} else {
+		pt.events[pt.next] = evt
+	}
+	pt.next = (pt.next + 1) % eventTimingHistorySize
+}
+
+// GetEventTimingStats returns timing stats of the most recent events handled in the given portal,
+// grouped by event type and sorted by the total time spent on each type.
+func (br *Bridge) GetEventTimingStats(portal Portal) []EventTypeTimingStats {
+	br.eventTimings.lock.Lock()
+	defer br.eventTimings.lock.Unlock()
+	pt, ok := br.eventTimings.portals[portal]
+	if !ok {
+		return nil
+	}
+	byType := make(map[string]*EventTypeTimingStats)
+	totals := make(map[string]time.Duration)
+	phaseTotals := make(map[string]map[string]time.Duration)
+	for _, evt := range pt.events {
+		stats, ok := byType[evt.eventType]
+		if !ok {
+			stats = &EventTypeTimingStats{EventType: evt.eventType}
+			byType[evt.eventType] = stats
+			phaseTotals[evt.eventType] = make(map[string]time.Duration)
+		}
+		stats.Count++
+		totals[evt.eventType] += evt.total
+		if evt.total > stats.Max {
+			stats.Max = evt.total
+		}
+		for phase, duration := range evt.phases {
+			phaseTotals[evt.eventType][phase] += duration
+		}
+	}
+	output := make([]EventTypeTimingStats, 0, len(byType))
+	for eventType, stats := range byType {
+		stats.Average = totals[eventType] / time.Duration(stats.Count)
+		stats.Phases = make(map[string]time.Duration, len(phaseTotals[eventType]))
+		for phase, total := range phaseTotals[eventType] {
+			stats.Phases[phase] = total / time.Duration(stats.Count)
+		}
+		output = append(output, *stats)
+	}
+	sort.Slice(output, func(i, j int) bool {
+		return totals[output[i].EventType] > totals[output[j].EventType]
+	})
+	return output
+}
+
+// ForgetEventTimings removes the timing stats of a portal. Bridges should call this when deleting portals.
+func (br *Bridge) ForgetEventTimings(portal Portal) {
+	br.eventTimings.lock.Lock()
+	delete(br.eventTimings.portals, portal)
+	br.eventTimings.lock.Unlock()
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	floodSummaryDelay  = 1 * time.Minute
+	floodSweepInterval = 10 * time.Minute
+)
+
+type floodKey struct {
+	RoomID id.RoomID
+	Sender string
+}
+
+type floodBucket struct {
+	tokens  float64
+	updated time.Time
+	dropped int
+	timer   *time.Timer
+}
+
+// FloodProtector rate limits remote users per portal using a token bucket. Messages over the limit are dropped,
+// and a single notice summarizing the dropped messages is sent once the flood is over.
+// This protects encrypted portals from spam floods, which would otherwise generate a lot of expensive Megolm traffic.
+type FloodProtector struct {
+	br      *Bridge
+	log     zerolog.Logger
+	buckets map[floodKey]*floodBucket
+	lock    sync.Mutex
+
+	lastSweep time.Time
+}
+
+func newFloodProtector(br *Bridge) *FloodProtector {
+	return &FloodProtector{
+		br:      br,
+		log:     br.ZLog.With().Str("component", "flood protection").Logger(),
+		buckets: make(map[floodKey]*floodBucket),
+	}
+}
+
+func (fp *FloodProtector) getConfig() (cfg bridgeconfig.FloodProtectionConfig) {
+	if fpc, ok := fp.br.Config.Bridge.(bridgeconfig.FloodProtectionBridgeConfig); ok {
+		cfg = fpc.GetFloodProtectionConfig()
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = cfg.MessagesPerMinute
+	}
+	return
+}
+
+// Allow checks whether a message from the given remote user should be bridged to the portal.
+// If it returns false, the message should be dropped. The sender name is used in the summary notice.
+func (fp *FloodProtector) Allow(portal Portal, roomID id.RoomID, sender, senderName string) bool {
+	cfg := fp.getConfig()
+	if cfg.MessagesPerMinute <= 0 {
+		return true
+	}
+	now := time.Now()
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	fp.sweep(now, cfg)
+	key := floodKey{RoomID: roomID, Sender: sender}
+	bucket, ok := fp.buckets[key]
+	if !ok {
+		bucket = &floodBucket{tokens: float64(cfg.Burst), updated: now}
+		fp.buckets[key] = bucket
+	} else {
+		bucket.tokens += now.Sub(bucket.updated).Minutes() * float64(cfg.MessagesPerMinute)
+		if bucket.tokens > float64(cfg.Burst) {
+			bucket.tokens = float64(cfg.Burst)
+		}
+		bucket.updated = now
+	}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true
+	}
+	bucket.dropped++
+	if bucket.timer == nil {
+		fp.log.Warn().
+			Str("room_id", roomID.String()).
+			Str("sender", sender).
+			Msg("Remote user is flooding portal, dropping messages")
+		bucket.timer = time.AfterFunc(floodSummaryDelay, func() {
+			fp.sendSummary(portal, key, senderName)
+		})
+	} else {
+		bucket.timer.Reset(floodSummaryDelay)
+	}
+	return false
+}
+
+func (fp *FloodProtector) sweep(now time.Time, cfg bridgeconfig.FloodProtectionConfig) {
+	if now.Sub(fp.lastSweep) < floodSweepInterval {
+		return
+	}
+	fp.lastSweep = now
+	refillTime := time.Duration(float64(cfg.Burst) / float64(cfg.MessagesPerMinute) * float64(time.Minute))
+	for key, bucket := range fp.buckets {
+		if bucket.timer == nil && now.Sub(bucket.updated) > refillTime {
+			delete(fp.buckets, key)
+		}
+	}
+}
+
+func (fp *FloodProtector) sendSummary(portal Portal, key floodKey, senderName string) {
+	fp.lock.Lock()
+	bucket, ok := fp.buckets[key]
+	var dropped int
+	if ok {
+		dropped = bucket.dropped
+		bucket.dropped = 0
+		bucket.timer = nil
+	}
+	fp.lock.Unlock()
+	if dropped == 0 {
+		return
+	}
+	log := fp.log.With().Str("room_id", key.RoomID.String()).Str("sender", key.Sender).Logger()
+	log.Info().Int("dropped_count", dropped).Msg("Flood ended, sending summary notice")
+	body := fmt.Sprintf("%s sent too many messages too quickly, %d messages were not bridged", senderName, dropped)
+	if dropped == 1 {
+		body = fmt.Sprintf("%s sent too many messages too quickly, 1 message was not bridged", senderName)
+	}
+	_, err := fp.br.sendPortalEvent(portal, portal.MainIntent(), key.RoomID, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    body,
+	})
+	if err != nil {
+		log.Err(err).Msg("Failed to send flood summary notice")
+	}
+}
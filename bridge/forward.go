@@ -0,0 +1,149 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrForwardTargetNotPortal   = errors.New("target room is not a portal")
+	ErrForwardNotInTarget       = errors.New("you're not in the target room")
+	ErrForwardNeedsDoublePuppet = errors.New("forwarding messages requires double puppeting")
+	ErrForwardUnsupportedEvent  = errors.New("only messages and stickers can be forwarded")
+)
+
+// ForwardedFromKey is the key in the content of forwarded messages that contains info about the original message.
+const ForwardedFromKey = "fi.mau.forwarded_from"
+
+// ForwardedFrom contains attribution info for forwarded messages.
+type ForwardedFrom struct {
+	RoomID  id.RoomID  `json:"room_id"`
+	EventID id.EventID `json:"event_id"`
+	Sender  id.UserID  `json:"sender"`
+}
+
+// ForwardMessage forwards a bridged message to another portal as the given user.
+//
+// The message is sent to the target room with the user's double puppet, which means it goes through the normal
+// Matrix->remote flow of the target portal. Media is re-uploaded so that it can be decrypted in the target room.
+func (br *Bridge) ForwardMessage(ctx context.Context, user User, evt *event.Event, targetRoomID id.RoomID) (id.EventID, error) {
+	if evt.Type != event.EventMessage && evt.Type != event.EventSticker {
+		return "", ErrForwardUnsupportedEvent
+	}
+	origContent, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok {
+		return "", ErrForwardUnsupportedEvent
+	}
+	target := br.Child.GetIPortal(targetRoomID)
+	if target == nil {
+		return "", ErrForwardTargetNotPortal
+	} else if !br.StateStore.IsInRoom(targetRoomID, user.GetMXID()) {
+		return "", ErrForwardNotInTarget
+	}
+	puppet := user.GetIDoublePuppet()
+	if puppet == nil || puppet.CustomIntent() == nil {
+		return "", ErrForwardNeedsDoublePuppet
+	}
+	content := &event.MessageEventContent{
+		MsgType:       origContent.MsgType,
+		Body:          origContent.Body,
+		Format:        origContent.Format,
+		FormattedBody: origContent.FormattedBody,
+		GeoURI:        origContent.GeoURI,
+		Info:          origContent.Info,
+	}
+	if origContent.URL != "" || origContent.File != nil {
+		err := br.reuploadForwardedMedia(origContent, content, target.IsEncrypted())
+		if err != nil {
+			return "", err
+		}
+	}
+	wrapped := &event.Content{
+		Parsed: content,
+		Raw: map[string]interface{}{
+			ForwardedFromKey: &ForwardedFrom{
+				RoomID:  evt.RoomID,
+				EventID: evt.ID,
+				Sender:  evt.Sender,
+			},
+		},
+	}
+	evtType := evt.Type
+	if target.IsEncrypted() && br.Crypto != nil {
+		err := br.Crypto.Encrypt(targetRoomID, evtType, wrapped)
+		if err != nil {
+			return "", fmt.Errorf("failed to encrypt forwarded message: %w", err)
+		}
+		evtType = event.EventEncrypted
+	}
+	// The double puppet value is intentionally not added (by using the raw client instead of the intent),
+	// so that the event is bridged to the remote network like a normal message from the user.
+	resp, err := puppet.CustomIntent().Client.SendMessageEvent(targetRoomID, evtType, wrapped)
+	if err != nil {
+		return "", fmt.Errorf("failed to send forwarded message: %w", err)
+	}
+	zerolog.Ctx(ctx).Debug().
+		Str("source_event_id", evt.ID.String()).
+		Str("target_room_id", targetRoomID.String()).
+		Str("target_event_id", resp.EventID.String()).
+		Msg("Forwarded message")
+	return resp.EventID, nil
+}
+
+func (br *Bridge) reuploadForwardedMedia(orig, content *event.MessageEventContent, encrypt bool) error {
+	var mxc id.ContentURI
+	var err error
+	if orig.File != nil {
+		mxc, err = orig.File.URL.Parse()
+	} else {
+		mxc, err = orig.URL.Parse()
+	}
+	if err != nil {
+		return fmt.Errorf("invalid media URL: %w", err)
+	}
+	data, err := br.Bot.DownloadBytes(mxc)
+	if err != nil {
+		return fmt.Errorf("failed to download media: %w", err)
+	}
+	if orig.File != nil {
+		err = orig.File.DecryptInPlace(data)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt media: %w", err)
+		}
+	}
+	mimeType := "application/octet-stream"
+	if orig.Info != nil && orig.Info.MimeType != "" && !encrypt {
+		mimeType = orig.Info.MimeType
+	}
+	var file *attachment.EncryptedFile
+	if encrypt {
+		file = attachment.NewEncryptedFile()
+		file.EncryptInPlace(data)
+	}
+	resp, err := br.Bot.UploadBytesWithName(data, mimeType, orig.Body)
+	if err != nil {
+		return fmt.Errorf("failed to upload media: %w", err)
+	}
+	if file != nil {
+		content.File = &event.EncryptedFileInfo{
+			EncryptedFile: *file,
+			URL:           resp.ContentURI.CUString(),
+		}
+	} else {
+		content.URL = resp.ContentURI.CUString()
+	}
+	return nil
+}
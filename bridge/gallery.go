@@ -0,0 +1,79 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"fmt"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+)
+
+// GalleriesEnabled returns true if the bridge config allows sending galleries.
+func (br *Bridge) GalleriesEnabled() bool {
+	gbc, ok := br.Config.Bridge.(bridgeconfig.GalleryBridgeConfig)
+	return ok && gbc.EnableGalleries()
+}
+
+// GroupMediaParts converts the media parts of a single remote message into Matrix message contents.
+//
+// If galleries are enabled and there's more than one image or video, the parts are merged into a single
+// com.beeper.gallery message. Otherwise, the parts are returned as-is, with the caption as a separate text part.
+// The caption may be nil if the message doesn't have one.
+func (br *Bridge) GroupMediaParts(parts []*event.MessageEventContent, caption *event.MessageEventContent) []*event.MessageEventContent {
+	if len(parts) < 2 || !br.GalleriesEnabled() || !canBeInGallery(parts) {
+		if caption != nil {
+			return append(parts, caption)
+		}
+		return parts
+	}
+	gallery := &event.MessageEventContent{
+		MsgType:             event.MsgBeeperGallery,
+		Body:                fmt.Sprintf("Sent a gallery with %d items", len(parts)),
+		BeeperGalleryImages: parts,
+	}
+	if caption != nil {
+		gallery.Body = caption.Body
+		gallery.BeeperGalleryCaption = caption.Body
+		if caption.Format == event.FormatHTML {
+			gallery.BeeperGalleryCaptionHTML = caption.FormattedBody
+		}
+		gallery.Mentions = caption.Mentions
+	}
+	return []*event.MessageEventContent{gallery}
+}
+
+func canBeInGallery(parts []*event.MessageEventContent) bool {
+	for _, part := range parts {
+		if part.MsgType != event.MsgImage && part.MsgType != event.MsgVideo {
+			return false
+		}
+	}
+	return true
+}
+
+// SplitGallery splits an outgoing com.beeper.gallery message into the individual media parts and the caption
+// for remote networks that don't support sending multiple media items in one message. The caption is nil
+// if the gallery doesn't have one. Non-gallery messages are returned as the only part.
+func SplitGallery(content *event.MessageEventContent) (parts []*event.MessageEventContent, caption *event.MessageEventContent) {
+	if content.MsgType != event.MsgBeeperGallery {
+		return []*event.MessageEventContent{content}, nil
+	}
+	parts = content.BeeperGalleryImages
+	if content.BeeperGalleryCaption != "" {
+		caption = &event.MessageEventContent{
+			MsgType:  event.MsgText,
+			Body:     content.BeeperGalleryCaption,
+			Mentions: content.Mentions,
+		}
+		if content.BeeperGalleryCaptionHTML != "" {
+			caption.Format = event.FormatHTML
+			caption.FormattedBody = content.BeeperGalleryCaptionHTML
+		}
+	}
+	return
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
+)
+
+// GhostMigratingBridge is an optional interface for bridges that support changing the ghost username template
+// after ghosts have already been created.
+type GhostMigratingBridge interface {
+	ChildOverride
+	// GetGhostMigrations returns the ghosts whose Matrix user ID has changed,
+	// mapped from the previous user ID to the ghost with the new user ID.
+	GetGhostMigrations() map[id.UserID]Ghost
+}
+
+// MigrateGhost moves a ghost from an old Matrix user ID to the user ID of the given ghost.
+//
+// The new ghost is registered and gets the profile of the ghost, then joins all portal rooms the old ghost is in,
+// inheriting its power level. Finally, the old ghost leaves those rooms. The number of migrated rooms is returned
+// along with the first error, if any.
+func (br *Bridge) MigrateGhost(ctx context.Context, oldMXID id.UserID, ghost Ghost) (int, error) {
+	log := zerolog.Ctx(ctx).With().
+		Str("old_user_id", oldMXID.String()).
+		Str("new_user_id", ghost.GetMXID().String()).
+		Logger()
+	if oldMXID == ghost.GetMXID() {
+		return 0, nil
+	}
+	newIntent := ghost.DefaultIntent()
+	err := newIntent.EnsureRegistered()
+	if err != nil {
+		return 0, err
+	}
+	if profilefulGhost, ok := ghost.(GhostWithProfile); ok {
+		err = newIntent.SetDisplayName(profilefulGhost.GetDisplayname())
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to set displayname of migrated ghost")
+		}
+		if avatarURL := profilefulGhost.GetAvatarURL(); !avatarURL.IsEmpty() {
+			err = newIntent.SetAvatarURL(avatarURL)
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to set avatar of migrated ghost")
+			}
+		}
+	}
+	oldIntent := br.AS.Intent(oldMXID)
+	if oldIntent == nil {
+		return 0, fmt.Errorf("invalid old user ID %s", oldMXID)
+	}
+	var migrated int
+	var firstErr error
+	for _, roomID := range br.StateStore.FindJoinedRooms(oldMXID) {
+		if br.Child.GetIPortal(roomID) == nil {
+			continue
+		}
+		err = br.migrateGhostInRoom(roomID, oldIntent, newIntent)
+		if err != nil {
+			log.Err(err).Str("room_id", roomID.String()).Msg("Failed to migrate ghost in room")
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			migrated++
+		}
+	}
+	log.Info().Int("room_count", migrated).Msg("Migrated ghost to new user ID")
+	return migrated, firstErr
+}
+
+func (br *Bridge) migrateGhostInRoom(roomID id.RoomID, oldIntent, newIntent *appservice.IntentAPI) error {
+	err := newIntent.EnsureJoined(roomID, appservice.EnsureJoinedParams{BotOverride: oldIntent.Client})
+	if err != nil {
+		return fmt.Errorf("failed to join new ghost: %w", err)
+	}
+	levels, err := oldIntent.PowerLevels(roomID)
+	if err != nil {
+		return fmt.Errorf("failed to get power levels: %w", err)
+	}
+	if oldLevel := levels.GetUserLevel(oldIntent.UserID); oldLevel != levels.UsersDefault {
+		levels.SetUserLevel(newIntent.UserID, oldLevel)
+		levels.SetUserLevel(oldIntent.UserID, levels.UsersDefault)
+		_, err = oldIntent.SetPowerLevels(roomID, levels)
+		if err != nil {
+			return fmt.Errorf("failed to transfer power level: %w", err)
+		}
+	}
+	_, err = oldIntent.LeaveRoom(roomID, &mautrix.ReqLeave{Reason: "User ID changed"})
+	if err != nil {
+		return fmt.Errorf("failed to leave old ghost: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util"
+)
+
+// GhostTemplates contains the parsed username and displayname templates for ghosts.
+//
+// If the bridge config implements bridgeconfig.GhostTemplateBridgeConfig, the templates are loaded at startup
+// and switched when the config is reloaded. Changing the username template changes the user IDs of ghosts,
+// so existing ghosts need to be moved with the migrate-ghosts command afterwards (see GhostMigratingBridge).
+type GhostTemplates struct {
+	lock           sync.RWMutex
+	usernameSource string
+	username       *template.Template
+	usernameRegex  *regexp.Regexp
+	displayname    *template.Template
+}
+
+func parseGhostTemplates(cfg bridgeconfig.GhostTemplateConfig) (username, displayname *template.Template, usernameRegex *regexp.Regexp, err error) {
+	username, err = template.New("username").Parse(cfg.UsernameTemplate)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to parse username template: %w", err)
+	}
+	displayname, err = template.New("displayname").Parse(cfg.DisplaynameTemplate)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to parse displayname template: %w", err)
+	}
+	placeholder := strings.ToLower(util.RandomString(16))
+	var buf strings.Builder
+	err = username.Execute(&buf, placeholder)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to execute username template: %w", err)
+	} else if !strings.Contains(buf.String(), placeholder) {
+		return nil, nil, nil, fmt.Errorf("username template doesn't contain the remote user ID")
+	}
+	quoted := regexp.QuoteMeta(buf.String())
+	usernameRegex = regexp.MustCompile(fmt.Sprintf("^%s$", strings.Replace(quoted, placeholder, "(.+)", 1)))
+	return
+}
+
+// FormatUsername returns the localpart of the ghost user ID for the given remote user ID.
+func (gt *GhostTemplates) FormatUsername(remoteID string) string {
+	gt.lock.RLock()
+	defer gt.lock.RUnlock()
+	var buf strings.Builder
+	_ = gt.username.Execute(&buf, remoteID)
+	return buf.String()
+}
+
+// ParseUsername returns the remote user ID from a ghost user ID localpart generated with the current template.
+func (gt *GhostTemplates) ParseUsername(localpart string) (string, bool) {
+	gt.lock.RLock()
+	defer gt.lock.RUnlock()
+	match := gt.usernameRegex.FindStringSubmatch(localpart)
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+// FormatDisplayname returns the displayname of a ghost using the given network-provided profile data.
+func (gt *GhostTemplates) FormatDisplayname(data interface{}) (string, error) {
+	gt.lock.RLock()
+	defer gt.lock.RUnlock()
+	var buf strings.Builder
+	err := gt.displayname.Execute(&buf, data)
+	return buf.String(), err
+}
+
+func (br *Bridge) initGhostTemplates() error {
+	gtc, ok := br.Config.Bridge.(bridgeconfig.GhostTemplateBridgeConfig)
+	if !ok {
+		return nil
+	}
+	cfg := gtc.GetGhostTemplateConfig()
+	username, displayname, usernameRegex, err := parseGhostTemplates(cfg)
+	if err != nil {
+		return err
+	}
+	br.GhostTemplates = &GhostTemplates{
+		usernameSource: cfg.UsernameTemplate,
+		username:       username,
+		usernameRegex:  usernameRegex,
+		displayname:    displayname,
+	}
+	br.OnConfigReload(br.reloadGhostTemplates)
+	return nil
+}
+
+func (br *Bridge) reloadGhostTemplates(ctx context.Context, configData []byte) (func(), error) {
+	var parsed struct {
+		Bridge bridgeconfig.GhostTemplateConfig `yaml:"bridge"`
+	}
+	err := yaml.Unmarshal(configData, &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ghost templates: %w", err)
+	}
+	username, displayname, usernameRegex, err := parseGhostTemplates(parsed.Bridge)
+	if err != nil {
+		return nil, err
+	}
+	var buf strings.Builder
+	_ = username.Execute(&buf, strings.ToLower(util.RandomString(16)))
+	exampleGhostID := id.NewUserID(buf.String(), br.Config.Homeserver.Domain)
+	if br.AS.Registration != nil && len(br.AS.Registration.Namespaces.UserIDs) > 0 &&
+		!br.AS.Registration.Namespaces.UserIDs.MatchString(string(exampleGhostID)) {
+		return nil, fmt.Errorf("ghost user IDs generated with the new username template (e.g. %s) don't match the user namespace in the registration", exampleGhostID)
+	}
+	return func() {
+		gt := br.GhostTemplates
+		gt.lock.Lock()
+		usernameChanged := gt.usernameSource != parsed.Bridge.UsernameTemplate
+		gt.usernameSource = parsed.Bridge.UsernameTemplate
+		gt.username, gt.usernameRegex, gt.displayname = username, usernameRegex, displayname
+		gt.lock.Unlock()
+		if usernameChanged {
+			zerolog.Ctx(ctx).Warn().Msg("Ghost username template changed, use the migrate-ghosts command to move existing ghosts")
+		}
+	}, nil
+}
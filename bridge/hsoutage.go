@@ -0,0 +1,269 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/bridge/bridgestore"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrQueuedForHomeserver = errors.New("the homeserver is unreachable, the event will be sent when it's back")
+	ErrOutboxFull          = errors.New("the homeserver is unreachable and too many events are already queued")
+)
+
+const (
+	defaultOutageProbeInterval = 30 * time.Second
+	outboxReplayBatchSize      = 100
+)
+
+// QueuedEventSendingPortal is an optional interface for portals that want to know when an event that was queued
+// during a homeserver outage is finally sent, e.g. to store the Matrix event ID in the message table.
+type QueuedEventSendingPortal interface {
+	Portal
+	HandleQueuedEventSent(ctx context.Context, remoteID string, eventID id.EventID)
+}
+
+type homeserverOutage struct {
+	lock    sync.Mutex
+	down    bool
+	lastSeq int64
+}
+
+func (br *Bridge) getHomeserverOutageConfig() (bridgeconfig.HomeserverOutageConfig, bool) {
+	hoc, ok := br.Config.Bridge.(bridgeconfig.HomeserverOutageBridgeConfig)
+	if !ok {
+		return bridgeconfig.HomeserverOutageConfig{}, false
+	}
+	cfg := hoc.GetHomeserverOutageConfig()
+	return cfg, cfg.StoreAndForward
+}
+
+func isHomeserverUnreachable(err error) bool {
+	var httpErr mautrix.HTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	} else if httpErr.Response == nil {
+		// Requests that were sent but didn't get any response failed due to a network error.
+		return httpErr.Request != nil && httpErr.WrappedError != nil
+	}
+	switch httpErr.Response.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsHomeserverDown returns true if the bridge has detected that the homeserver is unreachable
+// and is storing remote events until it's back.
+func (br *Bridge) IsHomeserverDown() bool {
+	br.hsOutage.lock.Lock()
+	defer br.hsOutage.lock.Unlock()
+	return br.hsOutage.down
+}
+
+// SendRemoteEvent sends a converted remote event to a portal room with the original timestamp of the remote event.
+//
+// If store-and-forward is enabled in the config and the homeserver is unreachable, the event is stored in the
+// database instead and ErrQueuedForHomeserver is returned. Queued events are sent in order once the homeserver is
+// reachable again, after which QueuedEventSendingPortal is notified. Events from double puppets can't be queued,
+// as their intents can't be recreated later.
+func (br *Bridge) SendRemoteEvent(ctx context.Context, portal Portal, intent *appservice.IntentAPI, roomID id.RoomID, evtType event.Type, content interface{}, ts time.Time, remoteID string) (*mautrix.RespSendEvent, error) {
+	cfg, enabled := br.getHomeserverOutageConfig()
+	if !enabled || intent.IsCustomPuppet {
+		return br.sendPortalEventWithTS(portal, intent, roomID, evtType, content, ts.UnixMilli())
+	}
+	// The content has to be serialized before sending, as encryption replaces it in place.
+	plaintext, err := json.Marshal(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event content: %w", err)
+	}
+	outboxEvt := &bridgestore.OutboxEvent{
+		RoomID:    roomID,
+		Sender:    intent.UserID,
+		EventType: evtType.Type,
+		Content:   plaintext,
+		Timestamp: ts,
+		RemoteID:  remoteID,
+	}
+	if br.IsHomeserverDown() {
+		return nil, br.queueOutboxEvent(ctx, cfg, outboxEvt, nil)
+	}
+	resp, err := br.sendPortalEventWithTS(portal, intent, roomID, evtType, content, ts.UnixMilli())
+	if err != nil && isHomeserverUnreachable(err) {
+		br.markHomeserverDown(cfg, err)
+		return nil, br.queueOutboxEvent(ctx, cfg, outboxEvt, err)
+	}
+	return resp, err
+}
+
+func (br *Bridge) queueOutboxEvent(ctx context.Context, cfg bridgeconfig.HomeserverOutageConfig, evt *bridgestore.OutboxEvent, sendErr error) error {
+	br.hsOutage.lock.Lock()
+	defer br.hsOutage.lock.Unlock()
+	if cfg.MaxQueued > 0 {
+		count, err := br.BridgeStore.CountOutboxEvents()
+		if err != nil {
+			return fmt.Errorf("failed to count queued events: %w", err)
+		} else if count >= cfg.MaxQueued {
+			if sendErr != nil {
+				return fmt.Errorf("%w: %v", ErrOutboxFull, sendErr)
+			}
+			return ErrOutboxFull
+		}
+	}
+	// Sequence numbers are based on the current time, but must be unique and increasing to keep the order.
+	evt.Seq = time.Now().UnixNano()
+	if evt.Seq <= br.hsOutage.lastSeq {
+		evt.Seq = br.hsOutage.lastSeq + 1
+	}
+	br.hsOutage.lastSeq = evt.Seq
+	err := br.BridgeStore.AddOutboxEvent(evt)
+	if err != nil {
+		return fmt.Errorf("failed to queue event: %w", err)
+	}
+	zerolog.Ctx(ctx).Debug().
+		Str("remote_id", evt.RemoteID).
+		Str("room_id", evt.RoomID.String()).
+		Msg("Queued event until the homeserver is reachable again")
+	return ErrQueuedForHomeserver
+}
+
+func (br *Bridge) markHomeserverDown(cfg bridgeconfig.HomeserverOutageConfig, err error) {
+	br.hsOutage.lock.Lock()
+	alreadyDown := br.hsOutage.down
+	br.hsOutage.down = true
+	br.hsOutage.lock.Unlock()
+	if !alreadyDown {
+		br.ZLog.Warn().Err(err).Msg("Homeserver is unreachable, storing remote events until it's back")
+		go br.probeHomeserver(cfg)
+	}
+}
+
+// resumeOutbox is called at startup to continue sending events that were queued before the bridge was restarted.
+func (br *Bridge) resumeOutbox() {
+	cfg, enabled := br.getHomeserverOutageConfig()
+	if !enabled {
+		return
+	}
+	count, err := br.BridgeStore.CountOutboxEvents()
+	if err != nil {
+		br.ZLog.Err(err).Msg("Failed to count queued events")
+	} else if count > 0 {
+		br.ZLog.Info().Int("event_count", count).Msg("Found events queued during a homeserver outage")
+		br.markHomeserverDown(cfg, nil)
+	}
+}
+
+func (br *Bridge) probeHomeserver(cfg bridgeconfig.HomeserverOutageConfig) {
+	interval := time.Duration(cfg.ProbeInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultOutageProbeInterval
+	}
+	log := br.ZLog.With().Str("action", "homeserver outage probe").Logger()
+	ctx := log.WithContext(br.BackgroundCtx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		_, err := br.Bot.Whoami()
+		if err == nil && br.replayOutbox(ctx) {
+			return
+		} else if err != nil && !isHomeserverUnreachable(err) {
+			log.Warn().Err(err).Msg("Unexpected error checking if homeserver is reachable")
+		}
+		select {
+		case <-ticker.C:
+		case <-br.BackgroundCtx.Done():
+			return
+		}
+	}
+}
+
+// replayOutbox sends all queued events in order. It returns false if the homeserver went down again.
+func (br *Bridge) replayOutbox(ctx context.Context) bool {
+	log := zerolog.Ctx(ctx)
+	log.Info().Msg("Homeserver is reachable again, sending queued events")
+	sent := 0
+	for {
+		events, err := br.BridgeStore.GetOutboxEvents(outboxReplayBatchSize)
+		if err != nil {
+			log.Err(err).Msg("Failed to get queued events")
+			return false
+		} else if len(events) == 0 {
+			br.hsOutage.lock.Lock()
+			// Events may have been queued after the last batch was fetched, so check again while holding the lock.
+			count, err := br.BridgeStore.CountOutboxEvents()
+			if err == nil && count == 0 {
+				br.hsOutage.down = false
+			}
+			br.hsOutage.lock.Unlock()
+			if err != nil {
+				log.Err(err).Msg("Failed to count queued events")
+				return false
+			} else if count > 0 {
+				continue
+			}
+			log.Info().Int("event_count", sent).Msg("Finished sending queued events")
+			return true
+		}
+		for _, evt := range events {
+			err = br.sendOutboxEvent(ctx, evt)
+			if isHomeserverUnreachable(err) {
+				log.Warn().Err(err).Msg("Homeserver went down again while sending queued events")
+				return false
+			} else if err != nil {
+				log.Err(err).
+					Int64("seq", evt.Seq).
+					Str("remote_id", evt.RemoteID).
+					Str("room_id", evt.RoomID.String()).
+					Msg("Failed to send queued event, dropping it")
+			} else {
+				sent++
+			}
+			err = br.BridgeStore.DeleteOutboxEvent(evt.Seq)
+			if err != nil {
+				log.Err(err).Int64("seq", evt.Seq).Msg("Failed to delete queued event")
+				return false
+			}
+		}
+	}
+}
+
+func (br *Bridge) sendOutboxEvent(ctx context.Context, evt *bridgestore.OutboxEvent) error {
+	portal := br.Child.GetIPortal(evt.RoomID)
+	if portal == nil {
+		return fmt.Errorf("portal not found")
+	}
+	intent := br.Bot
+	if evt.Sender != br.Bot.UserID {
+		intent = br.AS.Intent(evt.Sender)
+	}
+	content := &event.Content{VeryRaw: evt.Content}
+	evtType := event.Type{Type: evt.EventType, Class: event.MessageEventType}
+	resp, err := br.sendPortalEventWithTS(portal, intent, evt.RoomID, evtType, content, evt.Timestamp.UnixMilli())
+	if err != nil {
+		return err
+	}
+	if qesp, ok := portal.(QueuedEventSendingPortal); ok {
+		qesp.HandleQueuedEventSent(ctx, evt.RemoteID, resp.EventID)
+	}
+	return nil
+}
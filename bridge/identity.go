@@ -0,0 +1,138 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// IdentityChangeKey is the key in the content of identity change notices that contains info about the change.
+const IdentityChangeKey = "fi.mau.identity_change"
+
+var ErrIdentityNotAcknowledged = errors.New("the identity of a user in this chat has changed and must be confirmed before sending messages")
+
+// IdentityChange contains info about a remote user's identity key changing.
+type IdentityChange struct {
+	UserID id.UserID `json:"user_id"`
+	// RequiresAcknowledgement is true if messages won't be bridged until the change is acknowledged.
+	RequiresAcknowledgement bool `json:"requires_acknowledgement"`
+}
+
+// IdentityGhost is an optional interface for ghosts on end-to-end encrypted networks whose identity key
+// (e.g. a Signal safety number or WhatsApp identity key) is tracked by the bridge.
+type IdentityGhost interface {
+	GhostWithProfile
+	GetIdentityKey() string
+	IsIdentityAcknowledged() bool
+	// SetIdentityKey persists the identity key of the ghost and whether the latest change has been acknowledged.
+	SetIdentityKey(key string, acknowledged bool) error
+}
+
+// IdentityGatedPortal is an optional interface for portals that can stop bridging messages from Matrix
+// while the identity change of one of the remote users hasn't been acknowledged.
+type IdentityGatedPortal interface {
+	Portal
+	// GetIdentityGhosts returns the ghosts of the other participants in the chat whose identity is tracked.
+	GetIdentityGhosts() []IdentityGhost
+}
+
+func (br *Bridge) requireIdentityAcknowledgement() bool {
+	icc, ok := br.Config.Bridge.(bridgeconfig.IdentityChangeBridgeConfig)
+	return ok && icc.RequireIdentityAcknowledgement()
+}
+
+// HandleRemoteIdentityChange stores the new identity key of a ghost, and if the identity changed from a previously
+// known one, posts a warning notice in the portal. If acknowledgements are required in the config, messages from
+// Matrix will be rejected until a user confirms the change with the confirm-identity command.
+func (br *Bridge) HandleRemoteIdentityChange(ctx context.Context, portal Portal, roomID id.RoomID, ghost IdentityGhost, newKey string) error {
+	oldKey := ghost.GetIdentityKey()
+	if oldKey == newKey {
+		return nil
+	}
+	changed := oldKey != ""
+	requireAck := changed && br.requireIdentityAcknowledgement()
+	err := ghost.SetIdentityKey(newKey, !requireAck)
+	if err != nil {
+		return fmt.Errorf("failed to save identity key: %w", err)
+	} else if !changed {
+		return nil
+	}
+	zerolog.Ctx(ctx).Info().
+		Str("ghost_user_id", ghost.GetMXID().String()).
+		Bool("requires_ack", requireAck).
+		Msg("Remote user's identity changed")
+	body := fmt.Sprintf("⚠️ The identity key of %s has changed. "+
+		"This may mean they reinstalled the app or changed devices, or that someone is intercepting your messages.",
+		ghost.GetDisplayname())
+	if requireAck {
+		body += fmt.Sprintf(" Messages won't be sent until you verify the change and confirm it with `%s confirm-identity`.",
+			br.Config.Bridge.GetCommandPrefix())
+	}
+	content := &event.Content{
+		Parsed: &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    body,
+		},
+		Raw: map[string]interface{}{
+			IdentityChangeKey: &IdentityChange{
+				UserID:                  ghost.GetMXID(),
+				RequiresAcknowledgement: requireAck,
+			},
+		},
+	}
+	_, err = br.sendPortalEvent(portal, portal.MainIntent(), roomID, event.EventMessage, content)
+	if err != nil {
+		return fmt.Errorf("failed to send identity change notice: %w", err)
+	}
+	return nil
+}
+
+// AcknowledgeIdentityChanges marks all unacknowledged identity changes in the portal as acknowledged.
+// It returns the number of ghosts whose changes were acknowledged.
+func AcknowledgeIdentityChanges(portal IdentityGatedPortal) (int, error) {
+	var count int
+	for _, ghost := range portal.GetIdentityGhosts() {
+		if ghost.IsIdentityAcknowledged() {
+			continue
+		}
+		err := ghost.SetIdentityKey(ghost.GetIdentityKey(), true)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (mx *MatrixHandler) identityGateMiddleware(next MatrixEventHandler) MatrixEventHandler {
+	return func(user User, portal Portal, evt *event.Event) {
+		// The config is checked for every event, so that disabling acknowledgements (e.g. with a config reload)
+		// also unblocks chats that have changes which were left unacknowledged while it was enabled.
+		if igp, ok := portal.(IdentityGatedPortal); ok && evt.Type != event.EventRedaction && mx.bridge.requireIdentityAcknowledgement() {
+			for _, ghost := range igp.GetIdentityGhosts() {
+				if !ghost.IsIdentityAcknowledged() {
+					log := mx.log.With().
+						Str("event_id", evt.ID.String()).
+						Str("ghost_user_id", ghost.GetMXID().String()).
+						Logger()
+					log.Debug().Msg("Rejecting event due to unacknowledged identity change")
+					go mx.sendMessageRejection(log.WithContext(EventContext(evt)), evt, ErrIdentityNotAcknowledged, event.MessageStatusNoPermission)
+					return
+				}
+			}
+		}
+		next(user, portal, evt)
+	}
+}
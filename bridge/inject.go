@@ -0,0 +1,144 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+)
+
+// InjectEventPath is the path of the HTTP endpoint for injecting remote events.
+const InjectEventPath = "/_matrix/mau/inject"
+
+var ErrUnknownInjectedPortal = errors.New("unknown portal")
+
+type InjectedEventType string
+
+const (
+	InjectedMessage  InjectedEventType = "message"
+	InjectedReaction InjectedEventType = "reaction"
+	InjectedChatInfo InjectedEventType = "chat_info"
+)
+
+// InjectedEvent is a synthetic remote event received through the event injection endpoint.
+type InjectedEvent struct {
+	Type InjectedEventType `json:"type"`
+	// PortalKey identifies the remote chat the event is in.
+	PortalKey string `json:"portal_key"`
+	// Sender is the remote ID of the user who sent the event.
+	Sender string `json:"sender,omitempty"`
+	// ID is the remote ID of the message. For reactions, it's the ID of the reaction if the network has one.
+	ID        string `json:"id,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+
+	// Text is the plaintext body of messages.
+	Text string `json:"text,omitempty"`
+	// HTML is the optional formatted body of messages.
+	HTML string `json:"html,omitempty"`
+	// TargetID is the remote ID of the message being reacted or replied to.
+	TargetID string `json:"target_id,omitempty"`
+	// Emoji is the reaction key.
+	Emoji string `json:"emoji,omitempty"`
+
+	// Name, Topic and AvatarURL are the new chat info for chat_info events.
+	Name      *string `json:"name,omitempty"`
+	Topic     *string `json:"topic,omitempty"`
+	AvatarURL *string `json:"avatar_url,omitempty"`
+}
+
+// EventInjectionBridge is an optional interface for bridges that accept synthetic remote events over HTTP,
+// which is useful for integration tests and simple connectors written in other languages.
+type EventInjectionBridge interface {
+	ChildOverride
+	// InjectRemoteEvent queues the event in the portal like a real remote event, so that it goes through
+	// the normal portal event loop and HandleRemoteEvent. ErrUnknownInjectedPortal should be returned
+	// if the portal key doesn't match any portal.
+	InjectRemoteEvent(evt *InjectedEvent) error
+}
+
+func (br *Bridge) initEventInjection() {
+	eib, ok := br.Child.(EventInjectionBridge)
+	if !ok {
+		return
+	}
+	eic, ok := br.Config.Bridge.(bridgeconfig.EventInjectionBridgeConfig)
+	if !ok {
+		return
+	}
+	cfg := eic.GetEventInjectionConfig()
+	if !cfg.Enabled || cfg.SharedSecret == "" {
+		return
+	}
+	br.ZLog.Warn().Msg("Remote event injection endpoint is enabled, it should only be used for testing and integrations")
+	br.AS.Router.HandleFunc(InjectEventPath, func(w http.ResponseWriter, r *http.Request) {
+		br.handleInjectEvent(eib, cfg.SharedSecret, w, r)
+	}).Methods(http.MethodPost)
+}
+
+func (br *Bridge) handleInjectEvent(eib EventInjectionBridge, secret string, w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		appservice.Error{
+			ErrorCode:  appservice.ErrUnknownToken,
+			HTTPStatus: http.StatusForbidden,
+			Message:    "Invalid or missing access token",
+		}.Write(w)
+		return
+	}
+	var evt InjectedEvent
+	err := json.NewDecoder(r.Body).Decode(&evt)
+	if err != nil {
+		appservice.Error{
+			ErrorCode:  appservice.ErrNotJSON,
+			HTTPStatus: http.StatusBadRequest,
+			Message:    "Failed to parse request body",
+		}.Write(w)
+		return
+	}
+	switch {
+	case evt.PortalKey == "":
+		err = errors.New("missing portal key")
+	case evt.Type == InjectedMessage && evt.Text == "":
+		err = errors.New("missing text")
+	case evt.Type == InjectedReaction && (evt.TargetID == "" || evt.Emoji == ""):
+		err = errors.New("missing target ID or emoji")
+	case evt.Type != InjectedMessage && evt.Type != InjectedReaction && evt.Type != InjectedChatInfo:
+		err = errors.New("unknown event type")
+	}
+	if err != nil {
+		appservice.Error{
+			ErrorCode:  appservice.ErrBadJSON,
+			HTTPStatus: http.StatusBadRequest,
+			Message:    err.Error(),
+		}.Write(w)
+		return
+	}
+	err = eib.InjectRemoteEvent(&evt)
+	if errors.Is(err, ErrUnknownInjectedPortal) {
+		appservice.Error{
+			ErrorCode:  "M_NOT_FOUND",
+			HTTPStatus: http.StatusNotFound,
+			Message:    err.Error(),
+		}.Write(w)
+		return
+	} else if err != nil {
+		br.ZLog.Err(err).Str("portal_key", evt.PortalKey).Msg("Failed to inject remote event")
+		appservice.Error{
+			ErrorCode:  appservice.ErrUnknown,
+			HTTPStatus: http.StatusInternalServerError,
+			Message:    err.Error(),
+		}.Write(w)
+		return
+	}
+	appservice.WriteBlankOK(w)
+}
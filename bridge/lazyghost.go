@@ -0,0 +1,59 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// LazyGhostBridge is an optional interface for bridges that create ghost database rows lazily
+// instead of ensuring the row exists every time a message is bridged.
+type LazyGhostBridge interface {
+	ChildOverride
+	// CreateGhost creates the database row for a ghost that didn't exist yet. The Matrix user is registered
+	// automatically the first time its intent is used, so this shouldn't make any Matrix requests.
+	CreateGhost(ctx context.Context, remoteID string, mxid id.UserID) (Ghost, error)
+}
+
+// GhostMXID returns the Matrix user ID reserved for the ghost of the given remote user.
+// The ID is deterministic, so it can be used in e.g. mentions without the ghost existing yet.
+func (br *Bridge) GhostMXID(remoteID string) id.UserID {
+	return id.NewUserID(br.Config.Bridge.FormatUsername(remoteID), br.AS.HomeserverDomain)
+}
+
+// GetOrCreateGhost returns the ghost of the given remote user, creating its database row on first use.
+//
+// Concurrent calls for the same user only look it up once, so bridges can call this for every message without
+// racing to create the same ghost. Ghosts are looked up with GetIGhost, so the bridge's own ghost cache is used
+// and only lookups that are in progress are tracked here. The ghost is only registered on the homeserver when
+// its intent is first used to send something.
+func (br *Bridge) GetOrCreateGhost(ctx context.Context, remoteID string) Ghost {
+	lgb, ok := br.Child.(LazyGhostBridge)
+	mxid := br.GhostMXID(remoteID)
+	ghost, _ := br.lazyGhostLoads.GetOrLoad(mxid, func(mxid id.UserID) (Ghost, bool) {
+		// Calls that are already waiting get the result of this load, later ones go through GetIGhost again.
+		defer br.lazyGhostLoads.Delete(mxid)
+		ghost := br.Child.GetIGhost(mxid)
+		if ghost != nil || !ok {
+			return ghost, ghost != nil
+		}
+		ghost, err := lgb.CreateGhost(ctx, remoteID, mxid)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).
+				Str("remote_user_id", remoteID).
+				Str("ghost_user_id", mxid.String()).
+				Msg("Failed to create ghost")
+			return nil, false
+		}
+		return ghost, ghost != nil
+	})
+	return ghost
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+
+	"github.com/rs/zerolog"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"go.mau.fi/zeroconfig"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+)
+
+const redactedPlaceholder = "<redacted>"
+
+// redactingWriter is a log writer that scrubs sensitive data from JSON log lines before passing them on.
+type redactingWriter struct {
+	next         zerolog.LevelWriter
+	fields       []string
+	hashFields   []string
+	hashSecret   []byte
+	patterns     []*regexp.Regexp
+	moduleLevels map[string]zerolog.Level
+}
+
+func newRedactingWriter(next io.Writer, cfg bridgeconfig.LogRedactionConfig) (*redactingWriter, error) {
+	lw, ok := next.(zerolog.LevelWriter)
+	if !ok {
+		lw = levelWriterAdapter{next}
+	}
+	rw := &redactingWriter{
+		next:         lw,
+		fields:       cfg.Fields,
+		hashFields:   cfg.HashFields,
+		hashSecret:   []byte(cfg.HashSecret),
+		moduleLevels: cfg.ModuleLevels,
+	}
+	for _, pattern := range cfg.Patterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %w", pattern, err)
+		}
+		rw.patterns = append(rw.patterns, compiled)
+	}
+	return rw, nil
+}
+
+type levelWriterAdapter struct {
+	io.Writer
+}
+
+func (lwa levelWriterAdapter) WriteLevel(_ zerolog.Level, p []byte) (int, error) {
+	return lwa.Write(p)
+}
+
+func (rw *redactingWriter) Write(p []byte) (int, error) {
+	return rw.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (rw *redactingWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	if len(rw.moduleLevels) > 0 && level != zerolog.NoLevel {
+		component := gjson.GetBytes(p, "component").Str
+		if minLevel, ok := rw.moduleLevels[component]; ok && component != "" && level < minLevel {
+			return len(p), nil
+		}
+	}
+	_, err := rw.next.WriteLevel(level, rw.redact(p))
+	// Always report the original length, as the redacted line may be shorter or longer.
+	return len(p), err
+}
+
+func (rw *redactingWriter) redact(p []byte) []byte {
+	var err error
+	for _, field := range rw.fields {
+		if gjson.GetBytes(p, field).Exists() {
+			p, err = sjson.SetBytes(p, field, redactedPlaceholder)
+			if err != nil {
+				return p
+			}
+		}
+	}
+	for _, field := range rw.hashFields {
+		if val := gjson.GetBytes(p, field); val.Exists() {
+			p, err = sjson.SetBytes(p, field, rw.hash(val.String()))
+			if err != nil {
+				return p
+			}
+		}
+	}
+	if len(rw.patterns) > 0 {
+		p = rw.redactAllPatterns(p)
+	}
+	return p
+}
+
+// hash returns a keyed hash of the value, so that values can't be recovered by hashing guesses
+// without knowing the secret.
+func (rw *redactingWriter) hash(val string) string {
+	mac := hmac.New(sha256.New, rw.hashSecret)
+	mac.Write([]byte(val))
+	return "hash:" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+type logReplacement struct {
+	start, end int
+	value      []byte
+}
+
+// redactAllPatterns applies the patterns to all string values in the log line, including ones inside nested
+// objects and arrays. The values are replaced in place, so the order of fields is preserved.
+func (rw *redactingWriter) redactAllPatterns(p []byte) []byte {
+	replacements := rw.collectPatternReplacements(p, gjson.ParseBytes(p), nil)
+	if len(replacements) == 0 {
+		return p
+	}
+	out := make([]byte, 0, len(p))
+	prevEnd := 0
+	for _, repl := range replacements {
+		out = append(out, p[prevEnd:repl.start]...)
+		out = append(out, repl.value...)
+		prevEnd = repl.end
+	}
+	return append(out, p[prevEnd:]...)
+}
+
+func (rw *redactingWriter) collectPatternReplacements(p []byte, val gjson.Result, replacements []logReplacement) []logReplacement {
+	switch {
+	case val.Type == gjson.String:
+		start, end := val.Index, val.Index+len(val.Raw)
+		// gjson only knows the position of values it found by iterating, so make sure it matches before replacing.
+		if end > len(p) || string(p[start:end]) != val.Raw {
+			return replacements
+		}
+		if redacted := rw.redactPatterns(val.Str); redacted != val.Str {
+			replacements = append(replacements, logReplacement{start: start, end: end, value: marshalLogString(redacted)})
+		}
+	case val.IsObject(), val.IsArray():
+		val.ForEach(func(_, child gjson.Result) bool {
+			replacements = rw.collectPatternReplacements(p, child, replacements)
+			return true
+		})
+	}
+	return replacements
+}
+
+func marshalLogString(val string) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(val)
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'})
+}
+
+func (rw *redactingWriter) redactPatterns(val string) string {
+	for _, pattern := range rw.patterns {
+		val = pattern.ReplaceAllString(val, redactedPlaceholder)
+	}
+	return val
+}
+
+func (br *Bridge) getLogRedactionConfig() (bridgeconfig.LogRedactionConfig, bool) {
+	lrc, ok := br.Config.Bridge.(bridgeconfig.LogRedactionBridgeConfig)
+	if !ok {
+		return bridgeconfig.LogRedactionConfig{}, false
+	}
+	cfg := lrc.GetLogRedactionConfig()
+	enabled := len(cfg.Fields) > 0 || len(cfg.HashFields) > 0 || len(cfg.Patterns) > 0 || len(cfg.ModuleLevels) > 0
+	if cfg.HashSecret == "" {
+		cfg.HashSecret = br.Config.AppService.ASToken
+	}
+	return cfg, enabled
+}
+
+// compileLogger creates the bridge logger from the logging config. If log redaction is enabled,
+// the redacting writer is placed in front of the configured writers, which are only opened once.
+func (br *Bridge) compileLogger() (*zerolog.Logger, error) {
+	cfg, enabled := br.getLogRedactionConfig()
+	logCfg := br.Config.Logging
+	if !enabled || len(logCfg.Writers) == 0 {
+		return logCfg.Compile()
+	}
+	writers := make([]io.Writer, len(logCfg.Writers))
+	for i, wc := range logCfg.Writers {
+		writer, err := wc.Compile()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse config for writer #%d: %w", i+1, err)
+		}
+		writers[i] = writer
+	}
+	var realWriter io.Writer = writers[0]
+	if len(writers) > 1 {
+		realWriter = zerolog.MultiLevelWriter(writers...)
+	}
+	rw, err := newRedactingWriter(realWriter, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize log redaction: %w", err)
+	}
+	// Compile the rest of the config (timestamp, caller, metadata and level) with a placeholder writer
+	// that doesn't open anything, then swap in the redacting writer.
+	logCfg.Writers = []zeroconfig.WriterConfig{{Type: zeroconfig.WriterTypeStdout}}
+	log, err := logCfg.Compile()
+	if err != nil {
+		return nil, err
+	}
+	redactedLog := log.Output(rw)
+	return &redactedLog, nil
+}
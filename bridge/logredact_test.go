@@ -0,0 +1,82 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+)
+
+func newTestRedactingWriter(t *testing.T, cfg bridgeconfig.LogRedactionConfig) (*redactingWriter, *bytes.Buffer) {
+	var buf bytes.Buffer
+	rw, err := newRedactingWriter(&buf, cfg)
+	require.NoError(t, err)
+	return rw, &buf
+}
+
+func TestRedactingWriter_Fields(t *testing.T) {
+	rw, _ := newTestRedactingWriter(t, bridgeconfig.LogRedactionConfig{
+		Fields: []string{"phone", "login.token"},
+	})
+	out := rw.redact([]byte(`{"level":"info","phone":"+123456","login":{"token":"meow","user":"foo"},"message":"hi"}`))
+	assert.Equal(t, `{"level":"info","phone":"<redacted>","login":{"token":"<redacted>","user":"foo"},"message":"hi"}`, string(out))
+}
+
+func TestRedactingWriter_HashFields(t *testing.T) {
+	rw, _ := newTestRedactingWriter(t, bridgeconfig.LogRedactionConfig{
+		HashFields: []string{"remote_id"},
+		HashSecret: "secret1",
+	})
+	line := []byte(`{"remote_id":"12345"}`)
+	first := gjson.GetBytes(rw.redact(line), "remote_id").Str
+	assert.True(t, strings.HasPrefix(first, "hash:"))
+	assert.NotContains(t, first, "12345")
+	assert.Equal(t, first, gjson.GetBytes(rw.redact(line), "remote_id").Str, "hash should be stable")
+
+	otherRW, _ := newTestRedactingWriter(t, bridgeconfig.LogRedactionConfig{
+		HashFields: []string{"remote_id"},
+		HashSecret: "secret2",
+	})
+	assert.NotEqual(t, first, gjson.GetBytes(otherRW.redact(line), "remote_id").Str, "hash should depend on the secret")
+}
+
+func TestRedactingWriter_NestedPatterns(t *testing.T) {
+	rw, _ := newTestRedactingWriter(t, bridgeconfig.LogRedactionConfig{
+		Patterns: []string{`\+[0-9]{6,}`},
+	})
+	out := rw.redact([]byte(`{"message":"call +1234567","req":{"to":"+7654321","tags":["ok","+1111111 <3"]},"count":1234567}` + "\n"))
+	assert.Equal(t, `{"message":"call <redacted>","req":{"to":"<redacted>","tags":["ok","<redacted> <3"]},"count":1234567}`+"\n", string(out))
+}
+
+func TestRedactingWriter_EscapedStrings(t *testing.T) {
+	rw, _ := newTestRedactingWriter(t, bridgeconfig.LogRedactionConfig{
+		Patterns: []string{`secret`},
+	})
+	out := rw.redact([]byte(`{"message":"\"secret\"\nline","other":"ä"}`))
+	assert.Equal(t, `{"message":"\"<redacted>\"\nline","other":"ä"}`, string(out))
+}
+
+func TestRedactingWriter_ModuleLevels(t *testing.T) {
+	rw, buf := newTestRedactingWriter(t, bridgeconfig.LogRedactionConfig{
+		ModuleLevels: map[string]zerolog.Level{"noisy": zerolog.WarnLevel},
+	})
+	log := zerolog.New(rw)
+	log.Info().Str("component", "noisy").Msg("dropped")
+	log.Warn().Str("component", "noisy").Msg("kept")
+	log.Info().Str("component", "other").Msg("kept too")
+	assert.NotContains(t, buf.String(), "dropped")
+	assert.Contains(t, buf.String(), `"message":"kept"`)
+	assert.Contains(t, buf.String(), `"message":"kept too"`)
+}
@@ -0,0 +1,337 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+var (
+	ErrUnknownMaintenanceCommand = errors.New("unknown command")
+	ErrMaintenanceUsage          = errors.New("invalid arguments")
+)
+
+// MaintenanceCommand is an offline maintenance task that can be run with `<bridge> <command> [args...]`
+// instead of starting the bridge. The config is loaded before the command runs, and the bridge is
+// initialized (but not started) if NeedsInit is set.
+type MaintenanceCommand struct {
+	Name        string
+	Args        string
+	Description string
+	NeedsInit   bool
+	Func        func(ctx context.Context, br *Bridge, args []string) error
+}
+
+// MaintenanceCommandBridge is an optional interface for bridges that have network-specific maintenance commands.
+type MaintenanceCommandBridge interface {
+	ChildOverride
+	GetMaintenanceCommands() []*MaintenanceCommand
+}
+
+// UserListingBridge is an optional interface for bridges that can list all users in the database.
+// It's required for the list-logins maintenance command.
+type UserListingBridge interface {
+	ChildOverride
+	GetAllIUsers() []User
+}
+
+// GhostListingBridge is an optional interface for bridges that can list all ghosts in the database.
+// It's required for the fix-ghost-profiles maintenance command.
+type GhostListingBridge interface {
+	ChildOverride
+	GetAllIGhosts() []Ghost
+}
+
+// PortalExportingPortal is an optional interface for portals that include their remote ID and message
+// mappings in the output of the export-portal maintenance command.
+type PortalExportingPortal interface {
+	Portal
+	ExportPortal(ctx context.Context) (*ExportedPortal, error)
+}
+
+// OfflinePortalExport is the output of the export-portal maintenance command.
+type OfflinePortalExport struct {
+	*ExportedPortal
+	Encrypted   bool        `json:"encrypted"`
+	PrivateChat bool        `json:"private_chat"`
+	Members     []id.UserID `json:"members"`
+}
+
+var builtinMaintenanceCommands = []*MaintenanceCommand{{
+	Name:        "verify-config",
+	Description: "Check that the config and registration are valid",
+	Func:        fnVerifyConfig,
+}, {
+	Name:        "migrate-db",
+	Description: "Upgrade the database schema to the latest version",
+	NeedsInit:   true,
+	Func:        fnMigrateDB,
+}, {
+	Name:        "copy-db",
+	Args:        "<type> <uri>",
+	Description: "Copy the database to another database, e.g. to switch from SQLite to Postgres",
+	NeedsInit:   true,
+	Func:        fnCopyDB,
+}, {
+	Name:        "export-portal",
+	Args:        "<room ID> [output file]",
+	Description: "Export the data of a portal as JSON",
+	NeedsInit:   true,
+	Func:        fnExportPortal,
+}, {
+	Name:        "list-logins",
+	Description: "List bridge users and whether they're logged in",
+	NeedsInit:   true,
+	Func:        fnListLogins,
+}, {
+	Name:        "fix-ghost-profiles",
+	Description: "Reset the Matrix profiles of ghosts to match the bridge database (supports --dry-run)",
+	NeedsInit:   true,
+	Func:        fnFixGhostProfiles,
+}}
+
+func (br *Bridge) getMaintenanceCommands() []*MaintenanceCommand {
+	cmds := builtinMaintenanceCommands
+	if mcb, ok := br.Child.(MaintenanceCommandBridge); ok {
+		cmds = append(cmds[:len(cmds):len(cmds)], mcb.GetMaintenanceCommands()...)
+	}
+	return cmds
+}
+
+func (br *Bridge) printMaintenanceCommands() {
+	_, _ = fmt.Fprintln(os.Stderr, "Available commands:")
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, cmd := range br.getMaintenanceCommands() {
+		_, _ = fmt.Fprintf(w, "  %s %s\t%s\n", cmd.Name, cmd.Args, cmd.Description)
+	}
+	_ = w.Flush()
+}
+
+// RunMaintenanceCommand runs the given offline maintenance command and returns the exit code for the process.
+// It's called by Main if there are any non-flag arguments.
+func (br *Bridge) RunMaintenanceCommand(args []string) int {
+	var cmd *MaintenanceCommand
+	for _, maybeCmd := range br.getMaintenanceCommands() {
+		if maybeCmd.Name == args[0] {
+			cmd = maybeCmd
+			break
+		}
+	}
+	if cmd == nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v %s\n", ErrUnknownMaintenanceCommand, args[0])
+		br.printMaintenanceCommands()
+		return 1
+	}
+	if cmd.NeedsInit {
+		br.init()
+	}
+	ctx := context.Background()
+	if br.ZLog != nil {
+		ctx = br.ZLog.With().Str("maintenance_command", cmd.Name).Logger().WithContext(ctx)
+	}
+	err := cmd.Func(ctx, br, args[1:])
+	if errors.Is(err, ErrMaintenanceUsage) {
+		_, _ = fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n", br.Name, cmd.Name, cmd.Args)
+		return 1
+	} else if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s failed: %v\n", cmd.Name, err)
+		return 23
+	}
+	return 0
+}
+
+func fnVerifyConfig(_ context.Context, br *Bridge, args []string) error {
+	if len(args) > 0 {
+		return ErrMaintenanceUsage
+	}
+	err := br.validateConfig()
+	if err != nil {
+		return err
+	}
+	err = br.validateRegistrationNamespace()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Config is valid")
+	return nil
+}
+
+func fnMigrateDB(_ context.Context, br *Bridge, args []string) error {
+	if len(args) > 0 {
+		return ErrMaintenanceUsage
+	}
+	err := br.DB.Upgrade()
+	if err != nil {
+		return fmt.Errorf("failed to upgrade main database: %w", err)
+	}
+	err = br.StateStore.Upgrade()
+	if err != nil {
+		return fmt.Errorf("failed to upgrade state store: %w", err)
+	}
+	err = br.BridgeStore.Upgrade()
+	if err != nil {
+		return fmt.Errorf("failed to upgrade bridge store: %w", err)
+	}
+	fmt.Println("Database is up to date")
+	return nil
+}
+
+func fnCopyDB(ctx context.Context, br *Bridge, args []string) error {
+	if len(args) != 2 {
+		return ErrMaintenanceUsage
+	}
+	err := fnMigrateDB(ctx, br, nil)
+	if err != nil {
+		return err
+	}
+	if cs, ok := br.Crypto.(interface{ initStore() }); ok {
+		cs.initStore()
+	}
+	target, err := dbutil.NewFromConfig(br.Name, dbutil.Config{Type: args[0], URI: args[1]}, dbutil.ZeroLogger(br.ZLog.With().Str("db_section", "copy_target").Logger()))
+	if err != nil {
+		return fmt.Errorf("failed to open target database: %w", err)
+	}
+	defer target.RawDB.Close()
+	err = br.DB.PrepareCopyTarget(target)
+	if err != nil {
+		return err
+	}
+	results, err := dbutil.CopyDatabase(ctx, br.DB, target, dbutil.CopyOptions{Verify: true})
+	for _, result := range results {
+		fmt.Printf("Copied %d rows from %s\n", result.Rows, result.Table)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("Database copied successfully, update the database section in the config to switch to it")
+	return nil
+}
+
+func fnExportPortal(ctx context.Context, br *Bridge, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return ErrMaintenanceUsage
+	}
+	roomID := id.RoomID(args[0])
+	portal := br.Child.GetIPortal(roomID)
+	if portal == nil {
+		return fmt.Errorf("%s is not a portal", roomID)
+	}
+	export := &OfflinePortalExport{
+		ExportedPortal: &ExportedPortal{RoomID: roomID},
+		Encrypted:      portal.IsEncrypted(),
+		PrivateChat:    portal.IsPrivateChat(),
+	}
+	if exporter, ok := portal.(PortalExportingPortal); ok {
+		exported, err := exporter.ExportPortal(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to export portal: %w", err)
+		}
+		export.ExportedPortal = exported
+		export.RoomID = roomID
+	}
+	var err error
+	export.Members, err = br.StateStore.GetRoomJoinedOrInvitedMembers(roomID)
+	if err != nil {
+		return fmt.Errorf("failed to get portal members: %w", err)
+	}
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal export: %w", err)
+	}
+	if len(args) < 2 || args[1] == "-" {
+		fmt.Println(string(data))
+		return nil
+	}
+	return os.WriteFile(args[1], data, 0600)
+}
+
+func fnListLogins(_ context.Context, br *Bridge, args []string) error {
+	if len(args) > 0 {
+		return ErrMaintenanceUsage
+	}
+	ulb, ok := br.Child.(UserListingBridge)
+	if !ok {
+		return fmt.Errorf("this bridge doesn't support listing users")
+	}
+	users := ulb.GetAllIUsers()
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].GetMXID() < users[j].GetMXID()
+	})
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "USER ID\tLOGGED IN\tPERMISSIONS\tMANAGEMENT ROOM")
+	for _, user := range users {
+		_, _ = fmt.Fprintf(w, "%s\t%t\t%d\t%s\n", user.GetMXID(), user.IsLoggedIn(), user.GetPermissionLevel(), user.GetManagementRoomID())
+	}
+	return w.Flush()
+}
+
+func fnFixGhostProfiles(ctx context.Context, br *Bridge, args []string) error {
+	if len(args) > 0 {
+		return ErrMaintenanceUsage
+	}
+	dryRun := *maintenanceDryRun
+	glb, ok := br.Child.(GhostListingBridge)
+	if !ok {
+		return fmt.Errorf("this bridge doesn't support listing ghosts")
+	}
+	log := zerolog.Ctx(ctx)
+	var fixed, failed int
+	for _, ghost := range glb.GetAllIGhosts() {
+		profilefulGhost, ok := ghost.(GhostWithProfile)
+		if !ok {
+			continue
+		}
+		ghostLog := log.With().Str("ghost_user_id", ghost.GetMXID().String()).Logger()
+		current, err := br.Bot.GetProfile(ghost.GetMXID())
+		if err != nil {
+			ghostLog.Warn().Err(err).Msg("Failed to get current profile of ghost")
+			current = &mautrix.RespUserProfile{}
+		}
+		wantName := profilefulGhost.GetDisplayname()
+		wantAvatar := profilefulGhost.GetAvatarURL()
+		if current.DisplayName == wantName && current.AvatarURL == wantAvatar {
+			continue
+		}
+		fmt.Printf("%s: %q -> %q\n", ghost.GetMXID(), current.DisplayName, wantName)
+		if dryRun {
+			fixed++
+			continue
+		}
+		intent := ghost.DefaultIntent()
+		err = intent.SetDisplayName(wantName)
+		if err == nil && !wantAvatar.IsEmpty() {
+			err = intent.SetAvatarURL(wantAvatar)
+		}
+		if err != nil {
+			ghostLog.Err(err).Msg("Failed to fix ghost profile")
+			failed++
+		} else {
+			fixed++
+		}
+	}
+	if dryRun {
+		fmt.Printf("%d ghost profiles would be fixed\n", fixed)
+	} else {
+		fmt.Printf("Fixed %d ghost profiles\n", fixed)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to fix %d ghost profiles", failed)
+	}
+	return nil
+}
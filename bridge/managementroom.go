@@ -0,0 +1,172 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+var ErrNotAllowedManagementRoom = errors.New("user isn't allowed to use the bridge")
+
+// LegacyNoticeRoomUser is an optional interface for users of bridges that used to send bridge notices to a
+// separate notice room. If the user doesn't have a usable management room, the notice room is migrated to be
+// the management room instead of creating a new room.
+type LegacyNoticeRoomUser interface {
+	User
+	GetNoticeRoomID() id.RoomID
+	// ClearNoticeRoom removes the notice room from the user. It's called after the notice room has been
+	// migrated or found to be unusable.
+	ClearNoticeRoom()
+}
+
+// isManagementRoomUsable checks from the state store that both the bridge bot and the user are still in the room.
+func (br *Bridge) isManagementRoomUsable(user User, roomID id.RoomID) bool {
+	return roomID != "" &&
+		br.StateStore.IsInRoom(roomID, br.Bot.UserID) &&
+		br.StateStore.IsInvited(roomID, user.GetMXID())
+}
+
+// GetOrCreateManagementRoom returns the management room of the user, repairing it if necessary.
+//
+// If the current management room is gone (e.g. the user or bot left), the legacy notice room is migrated
+// (if the user implements LegacyNoticeRoomUser), or a new direct chat with the bridge bot is created.
+// The new room is saved with User.SetManagementRoom.
+func (br *Bridge) GetOrCreateManagementRoom(ctx context.Context, user User) (id.RoomID, error) {
+	br.managementRoomLock.Lock()
+	defer br.managementRoomLock.Unlock()
+	log := zerolog.Ctx(ctx).With().Str("user_id", user.GetMXID().String()).Logger()
+	current := user.GetManagementRoomID()
+	if br.isManagementRoomUsable(user, current) {
+		return current, nil
+	} else if current != "" {
+		log.Info().Str("old_room_id", current.String()).Msg("Management room is no longer usable, forgetting it")
+		user.SetManagementRoom("")
+	}
+	if roomID := br.migrateNoticeRoom(log, user); roomID != "" {
+		return roomID, nil
+	}
+	if user.GetPermissionLevel() < bridgeconfig.PermissionLevelUser {
+		return "", ErrNotAllowedManagementRoom
+	}
+	return br.createManagementRoom(log, user)
+}
+
+func (br *Bridge) migrateNoticeRoom(log zerolog.Logger, user User) id.RoomID {
+	lnr, ok := user.(LegacyNoticeRoomUser)
+	if !ok {
+		return ""
+	}
+	noticeRoom := lnr.GetNoticeRoomID()
+	if noticeRoom == "" {
+		return ""
+	}
+	lnr.ClearNoticeRoom()
+	log = log.With().Str("notice_room_id", noticeRoom.String()).Logger()
+	if !br.isManagementRoomUsable(user, noticeRoom) {
+		log.Debug().Msg("Legacy notice room is no longer usable, not migrating it")
+		return ""
+	}
+	user.SetManagementRoom(noticeRoom)
+	log.Info().Msg("Migrated legacy notice room to management room")
+	_, err := br.Bot.SendNotice(noticeRoom, "This room has been registered as your bridge management/status room.")
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to send notice about migrated management room")
+	}
+	return noticeRoom
+}
+
+func (br *Bridge) createManagementRoom(log zerolog.Logger, user User) (id.RoomID, error) {
+	resp, err := br.Bot.CreateRoom(&mautrix.ReqCreateRoom{
+		Preset:   "private_chat",
+		IsDirect: true,
+		Invite:   []id.UserID{user.GetMXID()},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create management room: %w", err)
+	}
+	user.SetManagementRoom(resp.RoomID)
+	log.Info().Str("room_id", resp.RoomID.String()).Msg("Created new management room")
+	texts := br.Config.Bridge.GetManagementRoomTexts()
+	_, _ = br.sendBotNoticeWithMarkdown(resp.RoomID, texts.Welcome)
+	br.sendManagementRoomWelcome(user, resp.RoomID)
+	return resp.RoomID, nil
+}
+
+func (br *Bridge) sendBotNoticeWithMarkdown(roomID id.RoomID, message string) (*mautrix.RespSendEvent, error) {
+	content := format.RenderMarkdown(message, true, false)
+	content.MsgType = event.MsgNotice
+	return br.Bot.SendMessageEvent(roomID, event.EventMessage, &content)
+}
+
+// sendManagementRoomWelcome sends the login status specific welcome texts and the additional help to a management room.
+func (br *Bridge) sendManagementRoomWelcome(user User, roomID id.RoomID) {
+	texts := br.Config.Bridge.GetManagementRoomTexts()
+	if user.IsLoggedIn() {
+		_, _ = br.sendBotNoticeWithMarkdown(roomID, texts.WelcomeConnected)
+	} else {
+		_, _ = br.sendBotNoticeWithMarkdown(roomID, texts.WelcomeUnconnected)
+	}
+	if len(texts.AdditionalHelp) > 0 {
+		_, _ = br.sendBotNoticeWithMarkdown(roomID, texts.AdditionalHelp)
+	}
+}
+
+// SendManagementNotice sends a markdown notice to the user's management room, creating the room if the user
+// doesn't have one. If sending fails because the room is gone, the room is forgotten and sending is retried
+// once in a new room.
+func (br *Bridge) SendManagementNotice(ctx context.Context, user User, message string) error {
+	roomID, err := br.GetOrCreateManagementRoom(ctx, user)
+	if err != nil {
+		return err
+	}
+	_, err = br.sendBotNoticeWithMarkdown(roomID, message)
+	if !IsRoomGoneError(err) {
+		return err
+	}
+	zerolog.Ctx(ctx).Warn().Err(err).
+		Str("user_id", user.GetMXID().String()).
+		Str("room_id", roomID.String()).
+		Msg("Failed to send to management room, recreating it")
+	br.forgetManagementRoom(user, roomID)
+	roomID, err = br.GetOrCreateManagementRoom(ctx, user)
+	if err != nil {
+		return err
+	}
+	_, err = br.sendBotNoticeWithMarkdown(roomID, message)
+	return err
+}
+
+// forgetManagementRoom unsets the management room of the user if it's still the given room,
+// so that a new one is created the next time it's needed.
+func (br *Bridge) forgetManagementRoom(user User, roomID id.RoomID) {
+	br.managementRoomLock.Lock()
+	defer br.managementRoomLock.Unlock()
+	if user.GetManagementRoomID() == roomID {
+		user.SetManagementRoom("")
+	}
+}
+
+// handleManagementRoomLeave is called when the user leaves their management room. The room is forgotten and the
+// bridge bot leaves it too, as it can't be used for anything anymore.
+func (br *Bridge) handleManagementRoomLeave(ctx context.Context, user User, roomID id.RoomID) {
+	br.forgetManagementRoom(user, roomID)
+	zerolog.Ctx(ctx).Debug().Msg("User left management room, forgetting it")
+	_, err := br.Bot.LeaveRoom(roomID)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to leave old management room")
+	}
+}
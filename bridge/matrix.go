@@ -11,6 +11,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -20,7 +21,6 @@ import (
 	"maunium.net/go/mautrix/bridge/bridgeconfig"
 	"maunium.net/go/mautrix/bridge/status"
 	"maunium.net/go/mautrix/event"
-	"maunium.net/go/mautrix/format"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -34,6 +34,27 @@ type MatrixHandler struct {
 	log    *zerolog.Logger
 
 	TrackEventDuration func(event.Type) func()
+	// MetaDebounceDelay is how long to wait for more room metadata changes before passing them
+	// to portals that implement BatchedMetaHandlingPortal.
+	MetaDebounceDelay time.Duration
+	// ReceiptDebounceDelay is how long to wait for newer read receipts from the same user before passing
+	// the newest one to portals. Zero disables coalescing, so every receipt is passed to the portal immediately.
+	ReceiptDebounceDelay time.Duration
+
+	pendingMeta     map[id.RoomID]*pendingMetaBatch
+	pendingMetaLock sync.Mutex
+
+	pendingReceipts     map[receiptKey]*pendingReceipt
+	pendingReceiptsLock sync.Mutex
+
+	slowModeUntil  map[id.RoomID]map[id.UserID]time.Time
+	slowModePruned time.Time
+	slowModeLock   sync.Mutex
+
+	disconnectedQueues     map[id.UserID]*disconnectedQueue
+	disconnectedQueuesLock sync.Mutex
+
+	middleware []MatrixEventMiddleware
 }
 
 func noop() {}
@@ -49,10 +70,26 @@ func NewMatrixHandler(br *Bridge) *MatrixHandler {
 		log:    br.ZLog,
 
 		TrackEventDuration: noopTrack,
+		MetaDebounceDelay:  DefaultMetaDebounceDelay,
+
+		pendingMeta:     make(map[id.RoomID]*pendingMetaBatch),
+		pendingReceipts: make(map[receiptKey]*pendingReceipt),
+		slowModeUntil:   make(map[id.RoomID]map[id.UserID]time.Time),
+
+		disconnectedQueues: make(map[id.UserID]*disconnectedQueue),
 	}
 	for evtType := range status.CheckpointTypes {
 		br.EventProcessor.On(evtType, handler.sendBridgeCheckpoint)
 	}
+	handler.UseMatrixMiddleware(
+		handler.secretChatMiddleware,
+		handler.chatRequestMiddleware,
+		handler.identityGateMiddleware,
+		handler.contentFilterMiddleware,
+		handler.messageEffectMiddleware,
+		handler.quoteReplyMiddleware,
+		handler.disconnectedQueueMiddleware,
+	)
 	br.EventProcessor.On(event.EventMessage, handler.HandleMessage)
 	br.EventProcessor.On(event.EventEncrypted, handler.HandleEncrypted)
 	br.EventProcessor.On(event.EventSticker, handler.HandleMessage)
@@ -63,6 +100,7 @@ func NewMatrixHandler(br *Bridge) *MatrixHandler {
 	br.EventProcessor.On(event.StateRoomAvatar, handler.HandleRoomMetadata)
 	br.EventProcessor.On(event.StateTopic, handler.HandleRoomMetadata)
 	br.EventProcessor.On(event.StateEncryption, handler.HandleEncryption)
+	br.EventProcessor.On(event.StatePowerLevels, handler.HandlePowerLevels)
 	br.EventProcessor.On(event.EphemeralEventReceipt, handler.HandleReceipt)
 	br.EventProcessor.On(event.EphemeralEventTyping, handler.HandleTyping)
 	return handler
@@ -121,10 +159,7 @@ func (mx *MatrixHandler) joinAndCheckMembers(ctx context.Context, evt *event.Eve
 }
 
 func (mx *MatrixHandler) sendNoticeWithMarkdown(roomID id.RoomID, message string) (*mautrix.RespSendEvent, error) {
-	intent := mx.as.BotIntent()
-	content := format.RenderMarkdown(message, true, false)
-	content.MsgType = event.MsgNotice
-	return intent.SendMessageEvent(roomID, event.EventMessage, content)
+	return mx.bridge.sendBotNoticeWithMarkdown(roomID, message)
 }
 
 func (mx *MatrixHandler) HandleBotInvite(ctx context.Context, evt *event.Event) {
@@ -157,16 +192,7 @@ func (mx *MatrixHandler) HandleBotInvite(ctx context.Context, evt *event.Event)
 	}
 
 	if evt.RoomID == user.GetManagementRoomID() {
-		if user.IsLoggedIn() {
-			_, _ = mx.sendNoticeWithMarkdown(evt.RoomID, texts.WelcomeConnected)
-		} else {
-			_, _ = mx.sendNoticeWithMarkdown(evt.RoomID, texts.WelcomeUnconnected)
-		}
-
-		additionalHelp := texts.AdditionalHelp
-		if len(additionalHelp) > 0 {
-			_, _ = mx.sendNoticeWithMarkdown(evt.RoomID, additionalHelp)
-		}
+		mx.bridge.sendManagementRoomWelcome(user, evt.RoomID)
 	}
 }
 
@@ -242,7 +268,7 @@ func (mx *MatrixHandler) HandleMembership(evt *event.Event) {
 		mx.bridge.Crypto.HandleMemberEvent(evt)
 	}
 
-	ctx := context.Background()
+	ctx := EventContext(evt)
 	log := mx.log.With().
 		Str("sender", evt.Sender.String()).
 		Str("target", evt.GetStateKey()).
@@ -270,6 +296,9 @@ func (mx *MatrixHandler) HandleMembership(evt *event.Event) {
 	if portal == nil {
 		if ghost != nil && content.Membership == event.MembershipInvite {
 			mx.HandleGhostInvite(ctx, evt, user, ghost)
+		} else if isSelf && evt.RoomID == user.GetManagementRoomID() &&
+			(content.Membership == event.MembershipLeave || content.Membership == event.MembershipBan) {
+			mx.bridge.handleManagementRoomLeave(ctx, user, evt.RoomID)
 		}
 		return
 	} else if user.GetPermissionLevel() < bridgeconfig.PermissionLevelUser || !user.IsLoggedIn() {
@@ -316,6 +345,11 @@ func (mx *MatrixHandler) HandleRoomMetadata(evt *event.Event) {
 		return
 	}
 
+	if batchedPortal, ok := portal.(BatchedMetaHandlingPortal); ok {
+		mx.queueBatchedMeta(batchedPortal, user, evt)
+		return
+	}
+
 	metaPortal, ok := portal.(MetaHandlingPortal)
 	if !ok {
 		return
@@ -450,6 +484,7 @@ func (mx *MatrixHandler) postDecrypt(ctx context.Context, original, decrypted *e
 		return
 	}
 	copySomeKeys(original, decrypted)
+	decrypted.Mautrix.Context = original.Mautrix.Context
 
 	mx.bridge.SendMessageSuccessCheckpoint(decrypted, status.MsgStepDecrypted, retryCount)
 	decrypted.Mautrix.CheckpointSent = true
@@ -462,11 +497,12 @@ func (mx *MatrixHandler) postDecrypt(ctx context.Context, original, decrypted *e
 
 func (mx *MatrixHandler) HandleEncrypted(evt *event.Event) {
 	defer mx.TrackEventDuration(evt.Type)()
+	defer mx.startEventSpan(evt, "bridge.handle_matrix_encrypted").End()
 	if mx.shouldIgnoreEvent(evt) || mx.bridge.Crypto == nil {
 		return
 	}
 	content := evt.Content.AsEncrypted()
-	ctx := context.Background()
+	ctx := EventContext(evt)
 	log := mx.log.With().
 		Str("event_id", evt.ID.String()).
 		Str("session_id", content.SessionID.String()).
@@ -529,12 +565,13 @@ func (mx *MatrixHandler) waitLongerForSession(ctx context.Context, evt *event.Ev
 
 func (mx *MatrixHandler) HandleMessage(evt *event.Event) {
 	defer mx.TrackEventDuration(evt.Type)()
+	defer mx.startEventSpan(evt, "bridge.handle_matrix_message").End()
 	if mx.shouldIgnoreEvent(evt) {
 		return
 	} else if !evt.Mautrix.WasEncrypted && mx.bridge.Config.Bridge.GetEncryptionConfig().Require {
 		log := mx.log.With().Str("event_id", evt.ID.String()).Logger()
 		log.Warn().Msg("Dropping unencrypted event")
-		ctx := log.WithContext(context.Background())
+		ctx := log.WithContext(EventContext(evt))
 		mx.sendCryptoStatusError(ctx, evt, "", errMessageNotEncrypted, 0, true)
 		return
 	}
@@ -561,12 +598,24 @@ func (mx *MatrixHandler) HandleMessage(evt *event.Event) {
 
 	portal := mx.bridge.Child.GetIPortal(evt.RoomID)
 	if portal != nil {
-		portal.ReceiveMatrixEvent(user, evt)
+		if isPublicChannel(portal) {
+			log := mx.log.With().Str("event_id", evt.ID.String()).Logger()
+			log.Debug().Msg("Rejecting message in public channel room")
+			go mx.sendMessageRejection(log.WithContext(EventContext(evt)), evt, ErrPublicChannelReadOnly, event.MessageStatusUnsupported)
+			return
+		} else if err := mx.checkAnnouncementOnly(user, portal); err != nil {
+			log := mx.log.With().Str("event_id", evt.ID.String()).Logger()
+			log.Debug().Err(err).Msg("Rejecting message in announcement-only room")
+			go mx.sendMessageRejection(log.WithContext(EventContext(evt)), evt, err, event.MessageStatusNoPermission)
+			return
+		}
+		mx.dispatchToPortal(user, portal, evt)
 	}
 }
 
 func (mx *MatrixHandler) HandleReaction(evt *event.Event) {
 	defer mx.TrackEventDuration(evt.Type)()
+	defer mx.startEventSpan(evt, "bridge.handle_matrix_reaction").End()
 	if mx.shouldIgnoreEvent(evt) {
 		return
 	}
@@ -578,12 +627,13 @@ func (mx *MatrixHandler) HandleReaction(evt *event.Event) {
 
 	portal := mx.bridge.Child.GetIPortal(evt.RoomID)
 	if portal != nil {
-		portal.ReceiveMatrixEvent(user, evt)
+		mx.dispatchToPortal(user, portal, evt)
 	}
 }
 
 func (mx *MatrixHandler) HandleRedaction(evt *event.Event) {
 	defer mx.TrackEventDuration(evt.Type)()
+	defer mx.startEventSpan(evt, "bridge.handle_matrix_redaction").End()
 	if mx.shouldIgnoreEvent(evt) {
 		return
 	}
@@ -595,7 +645,7 @@ func (mx *MatrixHandler) HandleRedaction(evt *event.Event) {
 
 	portal := mx.bridge.Child.GetIPortal(evt.RoomID)
 	if portal != nil {
-		portal.ReceiveMatrixEvent(user, evt)
+		mx.dispatchToPortal(user, portal, evt)
 	}
 }
 
@@ -626,6 +676,8 @@ func (mx *MatrixHandler) HandleReceipt(evt *event.Event) {
 				if ok {
 					dp.ScheduleDisappearing()
 				}
+			} else if mx.ReceiptDebounceDelay > 0 {
+				mx.queueReadReceipt(rrPortal, user, evt.RoomID, eventID, receipt)
 			} else {
 				rrPortal.HandleMatrixReadReceipt(user, eventID, receipt)
 			}
@@ -638,9 +690,14 @@ func (mx *MatrixHandler) HandleTyping(evt *event.Event) {
 	if portal == nil {
 		return
 	}
+	content := evt.Content.AsTyping()
+	if extendedPortal, ok := portal.(ExtendedTypingPortal); ok {
+		extendedPortal.HandleMatrixTypingWithTypes(content.UserIDs, content.Types)
+		return
+	}
 	typingPortal, ok := portal.(TypingPortal)
 	if !ok {
 		return
 	}
-	typingPortal.HandleMatrixTyping(evt.Content.AsTyping().UserIDs)
+	typingPortal.HandleMatrixTyping(content.UserIDs)
 }
@@ -0,0 +1,128 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var ErrMediaNotRefreshable = errors.New("this message doesn't have refreshable media")
+
+// MediaRefreshingPortal is an optional interface for portals on networks where media URLs expire
+// (e.g. Signal attachments or Telegram files), which means media may not have been bridged successfully.
+type MediaRefreshingPortal interface {
+	Portal
+	// RefetchMedia downloads the media of the given Matrix event from the remote network again.
+	// Portals should look up the message metadata by event ID and return ErrMediaNotRefreshable
+	// if the event isn't a bridged media message.
+	RefetchMedia(ctx context.Context, user User, eventID id.EventID) (data []byte, mimeType string, err error)
+}
+
+// sendPortalEvent sends a message event to the given portal, encrypting it if the portal is encrypted.
+func (br *Bridge) sendPortalEvent(portal Portal, intent *appservice.IntentAPI, roomID id.RoomID, evtType event.Type, content interface{}) (*mautrix.RespSendEvent, error) {
+	return br.sendPortalEventWithTS(portal, intent, roomID, evtType, content, 0)
+}
+
+// sendPortalEventWithTS is like sendPortalEvent, but also sets the timestamp of the event.
+// The timestamp is only applied for appservice users, and zero means the current time is used.
+func (br *Bridge) sendPortalEventWithTS(portal Portal, intent *appservice.IntentAPI, roomID id.RoomID, evtType event.Type, content interface{}, ts int64) (*mautrix.RespSendEvent, error) {
+	wrapped, ok := content.(*event.Content)
+	if !ok {
+		wrapped = &event.Content{Parsed: content}
+	}
+	if portal.IsEncrypted() && br.Crypto != nil {
+		err := br.Crypto.Encrypt(roomID, evtType, wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt event: %w", err)
+		}
+		evtType = event.EventEncrypted
+	}
+	return intent.SendMassagedMessageEvent(roomID, evtType, wrapped, ts)
+}
+
+func isMediaMessage(evtType event.Type, content *event.MessageEventContent) bool {
+	if evtType == event.EventSticker {
+		return true
+	}
+	switch content.MsgType {
+	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
+		return true
+	default:
+		return false
+	}
+}
+
+// RefreshMedia re-fetches the media of the given bridged message from the remote network,
+// re-uploads it and edits the Matrix event to point at the new file.
+func (br *Bridge) RefreshMedia(ctx context.Context, user User, portal MediaRefreshingPortal, evt *event.Event) error {
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok || !isMediaMessage(evt.Type, content) {
+		return ErrMediaNotRefreshable
+	}
+	ghost := br.Child.GetIGhost(evt.Sender)
+	if ghost == nil {
+		return fmt.Errorf("message wasn't sent by a ghost")
+	}
+	intent := ghost.DefaultIntent()
+	release, err := br.AcquireConnectorSlot(ctx, user.GetMXID(), evt.RoomID)
+	if err != nil {
+		return err
+	}
+	data, mimeType, err := portal.RefetchMedia(ctx, user, evt.ID)
+	release()
+	if err != nil {
+		return err
+	}
+	var file *attachment.EncryptedFile
+	uploadMime := mimeType
+	if portal.IsEncrypted() {
+		file = attachment.NewEncryptedFile()
+		file.EncryptInPlace(data)
+		uploadMime = "application/octet-stream"
+	}
+	resp, err := intent.UploadBytesWithName(data, uploadMime, content.Body)
+	if err != nil {
+		return fmt.Errorf("failed to upload refreshed media: %w", err)
+	}
+	newContent := &event.MessageEventContent{
+		MsgType: content.MsgType,
+		Body:    content.Body,
+		Info:    content.Info,
+	}
+	if newContent.Info != nil {
+		newContent.Info.MimeType = mimeType
+		newContent.Info.Size = len(data)
+	}
+	if file != nil {
+		newContent.File = &event.EncryptedFileInfo{
+			EncryptedFile: *file,
+			URL:           resp.ContentURI.CUString(),
+		}
+	} else {
+		newContent.URL = resp.ContentURI.CUString()
+	}
+	newContent.SetEdit(evt.ID)
+	_, err = br.sendPortalEvent(portal, intent, evt.RoomID, evt.Type, newContent)
+	if err != nil {
+		return fmt.Errorf("failed to send edit: %w", err)
+	}
+	zerolog.Ctx(ctx).Debug().
+		Str("event_id", evt.ID.String()).
+		Str("new_mxc", resp.ContentURI.String()).
+		Msg("Refreshed expired media")
+	return nil
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/bridge/bridgestore"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	memberRepairBatchSize        = 20
+	memberRepairIdleInterval     = 10 * time.Minute
+	defaultMemberRepairRateLimit = 30
+)
+
+// MemberSyncLockingPortal is an interface for portals that allow the member repair job to lock out
+// member syncs. The repair job only touches portals that implement this, as it would otherwise race
+// with member syncs and undo their changes.
+type MemberSyncLockingPortal interface {
+	Portal
+	// LockMemberSync blocks until no member sync is running in the portal and prevents new ones from
+	// starting until the returned function is called.
+	LockMemberSync() (unlock func())
+}
+
+// StoreRemoteMembers stores the full remote member list of a portal after a successful member sync.
+//
+// If the member repair job is enabled, it will later compare the list against the Matrix room and
+// make ghosts join or leave as necessary, which fixes memberships left behind by failed or partial syncs.
+// Only ghosts are touched by the repair job, so the list may safely contain other users too.
+func (br *Bridge) StoreRemoteMembers(roomID id.RoomID, members []id.UserID) error {
+	return br.BridgeStore.SetRemoteMembers(roomID, members)
+}
+
+func (br *Bridge) startMemberRepair() {
+	mrc, ok := br.Config.Bridge.(bridgeconfig.MemberRepairBridgeConfig)
+	if !ok {
+		return
+	}
+	cfg := mrc.GetMemberRepairConfig()
+	if !cfg.Enabled {
+		return
+	}
+	if cfg.ActionsPerMinute <= 0 {
+		cfg.ActionsPerMinute = defaultMemberRepairRateLimit
+	}
+	go br.runMemberRepair(br.BackgroundCtx, time.Minute/time.Duration(cfg.ActionsPerMinute))
+}
+
+// sleepCtx sleeps for the given duration and returns false if the context was canceled before that.
+func sleepCtx(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// runMemberRepair processes rooms whose remote member list changed since the last repair until the context
+// is canceled. Progress is stored in the database after each room, so the job continues where it left off
+// after a restart.
+func (br *Bridge) runMemberRepair(ctx context.Context, actionDelay time.Duration) {
+	log := br.ZLog.With().Str("component", "member repair").Logger()
+	for {
+		rooms, err := br.BridgeStore.GetRoomsNeedingMemberRepair(memberRepairBatchSize)
+		if err != nil {
+			log.Err(err).Msg("Failed to get rooms needing member repair")
+		}
+		if len(rooms) == 0 {
+			if !sleepCtx(ctx, memberRepairIdleInterval) {
+				return
+			}
+			continue
+		}
+		for _, room := range rooms {
+			roomLog := log.With().Str("room_id", room.RoomID.String()).Logger()
+			if !br.repairRoomMembers(ctx, roomLog, room, actionDelay) {
+				return
+			}
+			err = br.BridgeStore.MarkMemberRepairDone(room.RoomID, room.SyncedAt)
+			if err != nil {
+				roomLog.Err(err).Msg("Failed to mark member repair as done")
+			}
+		}
+	}
+}
+
+// repairRoomMembers repairs the ghost memberships of a single room. It returns false if the context was
+// canceled before the room was fully repaired.
+func (br *Bridge) repairRoomMembers(ctx context.Context, log zerolog.Logger, room bridgestore.MemberRepairRoom, actionDelay time.Duration) bool {
+	roomID := room.RoomID
+	basePortal := br.Child.GetIPortal(roomID)
+	if basePortal == nil {
+		log.Debug().Msg("Room is no longer a portal, dropping remote member list")
+		err := br.BridgeStore.ClearRemoteMembers(roomID)
+		if err != nil {
+			log.Err(err).Msg("Failed to clear remote member list")
+		}
+		return true
+	}
+	portal, ok := basePortal.(MemberSyncLockingPortal)
+	if !ok {
+		log.Debug().Msg("Portal doesn't support locking member syncs, skipping member repair")
+		return true
+	}
+	unlock := portal.LockMemberSync()
+	defer unlock()
+	// The list is read after locking, so it may be newer than room.SyncedAt. In that case the room
+	// is just repaired again later, which is harmless.
+	remoteMembers, ok, err := br.BridgeStore.GetRemoteMembers(roomID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get remote member list")
+		return true
+	} else if !ok {
+		return true
+	}
+	matrixMembers := br.StateStore.GetRoomMembers(roomID, event.MembershipJoin, event.MembershipInvite)
+	mainIntentMXID := portal.MainIntent().UserID
+	var removed, added int
+	defer func() {
+		if removed > 0 || added > 0 {
+			log.Info().Int("removed", removed).Int("added", added).Msg("Repaired ghost memberships")
+		}
+	}()
+	for userID := range matrixMembers {
+		if _, isRemoteMember := remoteMembers[userID]; isRemoteMember || userID == mainIntentMXID || !br.Child.IsGhost(userID) {
+			continue
+		}
+		ghost := br.Child.GetIGhost(userID)
+		if ghost == nil {
+			continue
+		}
+		_, err = ghost.DefaultIntent().LeaveRoom(roomID)
+		if err != nil {
+			log.Err(err).Str("user_id", userID.String()).Msg("Failed to remove stale ghost from room")
+		} else {
+			removed++
+		}
+		if !sleepCtx(ctx, actionDelay) {
+			return false
+		}
+	}
+	for userID := range remoteMembers {
+		if _, isMatrixMember := matrixMembers[userID]; isMatrixMember || !br.Child.IsGhost(userID) {
+			continue
+		}
+		ghost := br.Child.GetIGhost(userID)
+		if ghost == nil {
+			continue
+		}
+		err = ghost.DefaultIntent().EnsureJoined(roomID)
+		if err != nil {
+			log.Err(err).Str("user_id", userID.String()).Msg("Failed to add missing ghost to room")
+		} else {
+			added++
+		}
+		if !sleepCtx(ctx, actionDelay) {
+			return false
+		}
+	}
+	return true
+}
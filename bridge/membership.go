@@ -0,0 +1,101 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// MemberChange is a membership change of a single user in a portal, along with who did it and why.
+type MemberChange struct {
+	Target     id.UserID
+	Membership event.Membership
+	// Actor is the intent of the user who made the change. If nil, the change is made by the bridge bot.
+	Actor *appservice.IntentAPI
+	// ActorName is used to attribute the change in the reason if the actor can't make the change
+	// and the bridge bot has to do it instead.
+	ActorName string
+	Reason    string
+}
+
+func (mc *MemberChange) send(roomID id.RoomID, intent *appservice.IntentAPI, reason string) error {
+	var err error
+	switch {
+	case mc.Target == intent.UserID && mc.Membership == event.MembershipLeave:
+		_, err = intent.LeaveRoom(roomID, &mautrix.ReqLeave{Reason: reason})
+	case mc.Target == intent.UserID && mc.Membership == event.MembershipJoin:
+		_, err = intent.SendCustomMembershipEvent(roomID, mc.Target, event.MembershipJoin, reason)
+	case mc.Membership == event.MembershipInvite:
+		_, err = intent.InviteUser(roomID, &mautrix.ReqInviteUser{UserID: mc.Target, Reason: reason})
+	case mc.Membership == event.MembershipLeave:
+		_, err = intent.KickUser(roomID, &mautrix.ReqKickUser{UserID: mc.Target, Reason: reason})
+	case mc.Membership == event.MembershipBan:
+		_, err = intent.BanUser(roomID, &mautrix.ReqBanUser{UserID: mc.Target, Reason: reason})
+	default:
+		err = fmt.Errorf("%s can't change the membership of %s to %s", intent.UserID, mc.Target, mc.Membership)
+	}
+	return err
+}
+
+// ApplyMemberChange applies a membership change to a portal room using the actor's intent, so that the Matrix
+// timeline shows who made the change. If the actor isn't allowed to make the change, the bridge bot does it
+// instead and the actor's name is included in the reason.
+func (br *Bridge) ApplyMemberChange(ctx context.Context, roomID id.RoomID, change MemberChange) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("target_user_id", change.Target.String()).
+		Str("membership", string(change.Membership)).
+		Logger()
+	isRemoval := change.Membership == event.MembershipLeave || change.Membership == event.MembershipBan
+	if isRemoval && (change.Actor == nil || change.Actor.UserID != change.Target) && !br.Child.IsGhost(change.Target) && br.isPlumbed(roomID) {
+		return ErrWontKickPlumbedMember
+	}
+	if change.Actor != nil {
+		err := change.Actor.EnsureJoined(roomID)
+		if err == nil {
+			err = change.send(roomID, change.Actor, change.Reason)
+		}
+		if err == nil {
+			br.publishMemberChange(ctx, roomID, change)
+			return nil
+		} else if !errors.Is(err, mautrix.MForbidden) {
+			return err
+		}
+		log.Debug().Err(err).
+			Str("actor_user_id", change.Actor.UserID.String()).
+			Msg("Actor can't change membership, falling back to bridge bot")
+	}
+	reason := change.Reason
+	if change.ActorName != "" {
+		if reason != "" {
+			reason = fmt.Sprintf("%s: %s", change.ActorName, reason)
+		} else {
+			reason = change.ActorName
+		}
+	}
+	err := change.send(roomID, br.Bot, reason)
+	if err == nil {
+		br.publishMemberChange(ctx, roomID, change)
+	}
+	return err
+}
+
+func (br *Bridge) publishMemberChange(ctx context.Context, roomID id.RoomID, change MemberChange) {
+	br.EventBus.Publish(ctx, &MembershipChangedEvent{
+		RoomID:     roomID,
+		UserID:     change.Target,
+		Membership: change.Membership,
+	})
+}
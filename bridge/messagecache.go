@@ -0,0 +1,137 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"sync"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util"
+)
+
+// MessagePartKey identifies a message part by its remote IDs.
+type MessagePartKey struct {
+	PortalKey string
+	RemoteID  string
+	PartID    string
+}
+
+// CachedMessagePart is a row of a bridge's message table that can be stored in a MessagePartCache.
+type CachedMessagePart interface {
+	GetMXID() id.EventID
+	GetPartKey() MessagePartKey
+}
+
+// MessagePartCache is a read-through cache that bridges can put in front of their message table.
+//
+// Message parts are looked up by Matrix event ID for every reply, reaction, receipt and redaction, so caching
+// the most recently used ones avoids most database queries in busy rooms. Parts can be found both by event ID
+// and by remote ID. Bridges must call Invalidate or InvalidatePortal whenever they update or delete rows.
+type MessagePartCache struct {
+	lock     sync.Mutex
+	byMXID   *util.LRUCache[id.EventID, CachedMessagePart]
+	byRemote map[MessagePartKey]id.EventID
+	// generation is incremented on every invalidation to avoid caching parts that were loaded before it.
+	generation uint64
+}
+
+// NewMessagePartCache creates a new cache that holds up to the given number of message parts.
+func NewMessagePartCache(size int) *MessagePartCache {
+	mpc := &MessagePartCache{byRemote: make(map[MessagePartKey]id.EventID, size)}
+	mpc.byMXID = util.NewLRUCache[id.EventID, CachedMessagePart](size, func(_ id.EventID, part CachedMessagePart) {
+		delete(mpc.byRemote, part.GetPartKey())
+	})
+	return mpc
+}
+
+// GetByMXID returns the message part with the given Matrix event ID from the cache, or loads it using the given
+// function. Parts that aren't found, i.e. when the function returns nil, aren't cached.
+func (mpc *MessagePartCache) GetByMXID(mxid id.EventID, load func(id.EventID) (CachedMessagePart, error)) (CachedMessagePart, error) {
+	mpc.lock.Lock()
+	part, ok := mpc.byMXID.Get(mxid)
+	generation := mpc.generation
+	mpc.lock.Unlock()
+	if ok {
+		return part, nil
+	}
+	part, err := load(mxid)
+	if err != nil || part == nil {
+		return part, err
+	}
+	mpc.put(part, generation)
+	return part, nil
+}
+
+// GetByRemoteID returns the message part with the given remote IDs from the cache, or loads it using the given
+// function. Parts that aren't found, i.e. when the function returns nil, aren't cached.
+func (mpc *MessagePartCache) GetByRemoteID(key MessagePartKey, load func(MessagePartKey) (CachedMessagePart, error)) (CachedMessagePart, error) {
+	mpc.lock.Lock()
+	var part CachedMessagePart
+	mxid, ok := mpc.byRemote[key]
+	if ok {
+		part, ok = mpc.byMXID.Get(mxid)
+	}
+	generation := mpc.generation
+	mpc.lock.Unlock()
+	if ok {
+		return part, nil
+	}
+	part, err := load(key)
+	if err != nil || part == nil {
+		return part, err
+	}
+	mpc.put(part, generation)
+	return part, nil
+}
+
+// Put adds a message part to the cache. Bridges should call this after inserting new message parts,
+// as they're likely to be looked up soon.
+func (mpc *MessagePartCache) Put(part CachedMessagePart) {
+	mpc.lock.Lock()
+	mpc.putLocked(part)
+	mpc.lock.Unlock()
+}
+
+func (mpc *MessagePartCache) put(part CachedMessagePart, generation uint64) {
+	mpc.lock.Lock()
+	defer mpc.lock.Unlock()
+	if mpc.generation == generation {
+		mpc.putLocked(part)
+	}
+}
+
+func (mpc *MessagePartCache) putLocked(part CachedMessagePart) {
+	mxid := part.GetMXID()
+	if old, ok := mpc.byMXID.Get(mxid); ok {
+		delete(mpc.byRemote, old.GetPartKey())
+	}
+	mpc.byMXID.Put(mxid, part)
+	mpc.byRemote[part.GetPartKey()] = mxid
+}
+
+// Invalidate removes the message part with the given Matrix event ID from the cache.
+func (mpc *MessagePartCache) Invalidate(mxid id.EventID) {
+	mpc.lock.Lock()
+	defer mpc.lock.Unlock()
+	mpc.generation++
+	if part, ok := mpc.byMXID.Remove(mxid); ok {
+		delete(mpc.byRemote, part.GetPartKey())
+	}
+}
+
+// InvalidatePortal removes all message parts of the given portal from the cache, e.g. after the portal is deleted.
+func (mpc *MessagePartCache) InvalidatePortal(portalKey string) {
+	mpc.lock.Lock()
+	defer mpc.lock.Unlock()
+	mpc.generation++
+	for key, mxid := range mpc.byRemote {
+		if key.PortalKey == portalKey {
+			delete(mpc.byRemote, key)
+			mpc.byMXID.Remove(mxid)
+		}
+	}
+}
@@ -30,7 +30,11 @@ func (br *Bridge) SendMessageCheckpoint(evt *event.Event, step status.MessageChe
 	if err != nil {
 		checkpoint.Info = err.Error()
 	}
+	traceCheckpoint(evt, step, s, err)
 	go br.SendRawMessageCheckpoint(checkpoint)
+	if evt.Type == event.EventRedaction && step == status.MsgStepRemote && s == status.MsgStatusSuccess {
+		go br.cleanupAfterRedactionCheckpoint(evt)
+	}
 }
 
 func (br *Bridge) SendRawMessageCheckpoint(cp *status.MessageCheckpoint) {
@@ -0,0 +1,113 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// MessagePart is a single part of a remote message that is bridged as multiple Matrix events,
+// such as a text message with several media attachments.
+type MessagePart struct {
+	// ID is the stable ID of the part within the remote message. It's used for mapping replies to specific parts.
+	ID string
+	// SortKey determines the order of the parts. Parts with a lower sort key are shown first.
+	SortKey int
+	// EventID is the Matrix event that currently contains the part. It's empty for parts that haven't been sent yet.
+	EventID id.EventID
+	// Content is the Matrix content of the part.
+	Content *event.MessageEventContent
+}
+
+// SortMessageParts sorts the given parts by their sort key. Parts with equal sort keys keep their relative order.
+func SortMessageParts(parts []*MessagePart) {
+	sort.SliceStable(parts, func(i, j int) bool {
+		return parts[i].SortKey < parts[j].SortKey
+	})
+}
+
+// InsertMessagePart adds a late-arriving part to an already bridged multi-part message.
+//
+// Matrix events can't be reordered, so if the new part belongs before some already sent parts, the events from
+// that point onward are edited to contain the contents shifted by one, and the last part is sent as a new event.
+// The existing parts must be in their current order and must include their content.
+//
+// The returned slice contains all parts in the correct order with updated event IDs, which the bridge must
+// store to keep mapping replies and edits to the right parts.
+func (br *Bridge) InsertMessagePart(ctx context.Context, portal Portal, intent *appservice.IntentAPI, roomID id.RoomID, existing []*MessagePart, newPart *MessagePart) ([]*MessagePart, error) {
+	log := zerolog.Ctx(ctx).With().Str("part_id", newPart.ID).Logger()
+	eventIDs := make([]id.EventID, len(existing))
+	for i, part := range existing {
+		eventIDs[i] = part.EventID
+	}
+	parts := make([]*MessagePart, len(existing), len(existing)+1)
+	copy(parts, existing)
+	parts = append(parts, newPart)
+	SortMessageParts(parts)
+	firstChanged := len(parts) - 1
+	for i := range existing {
+		if parts[i] != existing[i] {
+			firstChanged = i
+			break
+		}
+	}
+	if firstChanged < len(existing) {
+		log.Debug().
+			Int("position", firstChanged).
+			Int("shifted_parts", len(existing)-firstChanged).
+			Msg("Inserting late message part by editing subsequent parts")
+	}
+	for i := firstChanged; i < len(existing); i++ {
+		editContent := *parts[i].Content
+		editContent.SetEdit(eventIDs[i])
+		_, err := br.sendPortalEvent(portal, intent, roomID, event.EventMessage, &editContent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to edit part %d: %w", i, err)
+		}
+		parts[i].EventID = eventIDs[i]
+	}
+	last := parts[len(parts)-1]
+	resp, err := br.sendPortalEvent(portal, intent, roomID, event.EventMessage, last.Content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send last part: %w", err)
+	}
+	last.EventID = resp.EventID
+	return parts, nil
+}
+
+// FindMessagePartEvent returns the Matrix event that contains the part with the given ID, which is used to
+// map remote replies targeting a specific part. If the part isn't found, the first part's event is returned.
+func FindMessagePartEvent(parts []*MessagePart, partID string) id.EventID {
+	if len(parts) == 0 {
+		return ""
+	}
+	for _, part := range parts {
+		if part.ID == partID {
+			return part.EventID
+		}
+	}
+	return parts[0].EventID
+}
+
+// FindMessagePartByEvent returns the part contained in the given Matrix event, which is used to map
+// Matrix replies to a specific part on the remote network. It returns nil if the event isn't one of the parts.
+func FindMessagePartByEvent(parts []*MessagePart, eventID id.EventID) *MessagePart {
+	for _, part := range parts {
+		if part.EventID == eventID {
+			return part
+		}
+	}
+	return nil
+}
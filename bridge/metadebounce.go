@@ -0,0 +1,115 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// DefaultMetaDebounceDelay is the default value for MatrixHandler.MetaDebounceDelay.
+const DefaultMetaDebounceDelay = 1 * time.Second
+
+// BatchedMetaHandlingPortal is an optional interface for portals that want room metadata changes
+// (name, topic, avatar) from Matrix to be coalesced into a single call.
+//
+// When a portal implements this, the events are collected until no new changes have arrived in
+// MatrixHandler.MetaDebounceDelay, and only the latest event of each type is passed to the portal.
+// HandleMatrixMeta is not called for portals that implement this interface.
+type BatchedMetaHandlingPortal interface {
+	Portal
+	HandleMatrixMetaBatch(sender User, evts []*event.Event)
+}
+
+type pendingMetaBatch struct {
+	portal BatchedMetaHandlingPortal
+	sender User
+	events []*event.Event
+	timer  *time.Timer
+}
+
+func (batch *pendingMetaBatch) add(evt *event.Event) {
+	for i, existing := range batch.events {
+		if existing.Type == evt.Type {
+			batch.events = append(batch.events[:i], batch.events[i+1:]...)
+			break
+		}
+	}
+	batch.events = append(batch.events, evt)
+}
+
+func (mx *MatrixHandler) queueBatchedMeta(portal BatchedMetaHandlingPortal, sender User, evt *event.Event) {
+	mx.pendingMetaLock.Lock()
+	defer mx.pendingMetaLock.Unlock()
+	batch, ok := mx.pendingMeta[evt.RoomID]
+	if ok && batch.sender.GetMXID() != sender.GetMXID() {
+		// Changes from different users are never merged, so flush the old batch right away.
+		batch.timer.Stop()
+		delete(mx.pendingMeta, evt.RoomID)
+		go batch.portal.HandleMatrixMetaBatch(batch.sender, batch.events)
+		ok = false
+	}
+	if !ok {
+		batch = &pendingMetaBatch{portal: portal, sender: sender}
+		roomID := evt.RoomID
+		batch.timer = time.AfterFunc(mx.MetaDebounceDelay, func() {
+			mx.flushBatchedMeta(roomID, batch)
+		})
+		mx.pendingMeta[roomID] = batch
+	} else {
+		batch.timer.Reset(mx.MetaDebounceDelay)
+	}
+	batch.add(evt)
+}
+
+func (mx *MatrixHandler) flushBatchedMeta(roomID id.RoomID, batch *pendingMetaBatch) {
+	mx.pendingMetaLock.Lock()
+	if mx.pendingMeta[roomID] != batch {
+		mx.pendingMetaLock.Unlock()
+		return
+	}
+	delete(mx.pendingMeta, roomID)
+	mx.pendingMetaLock.Unlock()
+	if len(batch.events) > 0 {
+		batch.portal.HandleMatrixMetaBatch(batch.sender, batch.events)
+	}
+}
+
+// DiscardPendingMatrixMeta drops queued Matrix metadata changes of the given type in the given room.
+//
+// Portals should call this when the remote network reports a new value for the metadata while a Matrix change
+// is still being debounced, so that the remote value wins instead of being overwritten by the older Matrix change.
+// If no event types are given, all pending changes in the room are dropped.
+func (mx *MatrixHandler) DiscardPendingMatrixMeta(roomID id.RoomID, evtTypes ...event.Type) {
+	mx.pendingMetaLock.Lock()
+	defer mx.pendingMetaLock.Unlock()
+	batch, ok := mx.pendingMeta[roomID]
+	if !ok {
+		return
+	}
+	if len(evtTypes) == 0 {
+		batch.events = nil
+	} else {
+		filtered := batch.events[:0]
+	Outer:
+		for _, evt := range batch.events {
+			for _, evtType := range evtTypes {
+				if evt.Type == evtType {
+					continue Outer
+				}
+			}
+			filtered = append(filtered, evt)
+		}
+		batch.events = filtered
+	}
+	if len(batch.events) == 0 {
+		batch.timer.Stop()
+		delete(mx.pendingMeta, roomID)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// MatrixEventHandler handles a Matrix event that is being passed to a portal.
+type MatrixEventHandler func(user User, portal Portal, evt *event.Event)
+
+// MatrixEventMiddleware wraps a MatrixEventHandler. Middleware can inspect or modify the event before calling next,
+// skip calling next to drop the event entirely, or do something after next returns.
+type MatrixEventMiddleware func(next MatrixEventHandler) MatrixEventHandler
+
+// RemoteEventHandler handles an event from the remote network in a portal.
+// The type of the event depends on the network.
+type RemoteEventHandler func(ctx context.Context, portal Portal, evt interface{})
+
+// RemoteEventMiddleware wraps a RemoteEventHandler, see MatrixEventMiddleware.
+type RemoteEventMiddleware func(next RemoteEventHandler) RemoteEventHandler
+
+// UseMatrixMiddleware adds middleware around the handler that passes Matrix messages, reactions and redactions
+// to portals. Middleware is applied in the order it was added, i.e. the first one added is the outermost.
+//
+// This must be called before the bridge starts receiving events.
+func (mx *MatrixHandler) UseMatrixMiddleware(middleware ...MatrixEventMiddleware) {
+	mx.middleware = append(mx.middleware, middleware...)
+}
+
+func (mx *MatrixHandler) dispatchToPortal(user User, portal Portal, evt *event.Event) {
+	defer mx.startEventSpan(evt, "bridge.dispatch_to_portal").End()
+	mx.bridge.markUserPortalActive(evt.Sender, evt.RoomID)
+	log := addTraceID(evt.Mautrix.Context, mx.log.With()).
+		Str("event_id", evt.ID.String()).
+		Str("room_id", evt.RoomID.String()).
+		Str("sender", evt.Sender.String()).
+		Logger()
+	// The context stored in the event must not be cancelable, as portals may handle the event after this returns.
+	// Deadlines are applied where the event is actually handled, see RunMatrixEventHandler.
+	evt.Mautrix.Context = log.WithContext(evt.Mautrix.Context)
+	handler := mx.receiveMatrixEvent
+	for i := len(mx.middleware) - 1; i >= 0; i-- {
+		handler = mx.middleware[i](handler)
+	}
+	handler(user, portal, evt)
+}
+
+// MatrixEventQueueingPortal is an optional interface for portals that handle Matrix events in their own event loop.
+//
+// The built-in handling of broadcast messages, new threads, media edits and message removals is queued with
+// QueueMatrixEventHandler, so that it runs in order with the other events of the portal and doesn't block
+// the dispatcher. Portals that don't implement this get those events handled in a separate goroutine.
+type MatrixEventQueueingPortal interface {
+	Portal
+	// QueueMatrixEventHandler queues the handler to be called in the portal's event loop,
+	// in order with the events passed to ReceiveMatrixEvent.
+	QueueMatrixEventHandler(handler func())
+}
+
+func queueInPortal(portal Portal, handler func()) {
+	if qp, ok := portal.(MatrixEventQueueingPortal); ok {
+		qp.QueueMatrixEventHandler(handler)
+	} else {
+		go handler()
+	}
+}
+
+func (mx *MatrixHandler) receiveMatrixEvent(user User, portal Portal, evt *event.Event) {
+	// Slow mode is checked after all middleware, so that messages rejected by middleware don't count.
+	if err := mx.checkSlowMode(user, portal, evt); err != nil {
+		zerolog.Ctx(evt.Mautrix.Context).Debug().Err(err).Msg("Rejecting message due to slow mode")
+		go mx.sendMessageRejection(EventContext(evt), evt, err, event.MessageStatusNoPermission)
+		return
+	}
+	if bcPortal, ok := portal.(BroadcastPortal); ok && bcPortal.IsBroadcast() && isBroadcastable(evt) {
+		queueInPortal(portal, func() {
+			mx.bridge.RunMatrixEventHandler(user, portal, evt, func(ctx context.Context) {
+				mx.handleBroadcast(ctx, user, bcPortal, evt)
+			})
+		})
+		return
+	} else if tfPortal, ok := portal.(ThreadFirstPortal); ok && isThreadless(evt) {
+		queueInPortal(portal, func() {
+			mx.bridge.RunMatrixEventHandler(user, portal, evt, func(ctx context.Context) {
+				mx.handleNewThread(ctx, user, tfPortal, evt)
+			})
+		})
+		return
+	} else if mePortal, ok := portal.(MediaEditingPortal); ok && isMediaEdit(evt) {
+		queueInPortal(portal, func() {
+			var passThrough atomic.Bool
+			mx.bridge.RunMatrixEventHandler(user, portal, evt, func(ctx context.Context) {
+				passThrough.Store(!mx.handleMediaEdit(ctx, user, mePortal, evt))
+			})
+			// This is done after the connector slot is released, as the portal may handle the event immediately.
+			if passThrough.Load() {
+				portal.ReceiveMatrixEvent(user, evt)
+			}
+		})
+		return
+	} else if mrPortal, ok := portal.(MessageRemovingPortal); ok && evt.Type == event.EventRedaction {
+		queueInPortal(portal, func() {
+			mx.bridge.RunMatrixEventHandler(user, portal, evt, func(ctx context.Context) {
+				log := zerolog.Ctx(ctx).With().Str("redacts", evt.Redacts.String()).Logger()
+				mx.handleMessageRemove(log.WithContext(ctx), user, mrPortal, evt)
+			})
+		})
+		return
+	}
+	portal.ReceiveMatrixEvent(user, evt)
+}
+
+// UseRemoteMiddleware adds middleware around remote event handling done through HandleRemoteEvent.
+// Middleware is applied in the order it was added, i.e. the first one added is the outermost.
+//
+// This must be called before the bridge starts receiving events.
+func (br *Bridge) UseRemoteMiddleware(middleware ...RemoteEventMiddleware) {
+	br.remoteMiddleware = append(br.remoteMiddleware, middleware...)
+}
+
+// HandleRemoteEvent runs the given handler for a remote event through the registered remote event middleware.
+//
+// Bridges should route their remote event handling through this method in the portal event loop to allow
+// cross-cutting features like spam filtering, metrics or audit logging to be implemented as middleware.
+func (br *Bridge) HandleRemoteEvent(ctx context.Context, portal Portal, evt interface{}, handler RemoteEventHandler) {
+	ctx, span := StartSpan(ctx, "bridge.handle_remote_event")
+	defer span.End()
+	log := addTraceID(ctx, zerolog.Ctx(ctx).With()).Logger()
+	ctx, timing := startEventTiming(log.WithContext(ctx))
+	start := time.Now()
+	for i := len(br.remoteMiddleware) - 1; i >= 0; i-- {
+		handler = br.remoteMiddleware[i](handler)
+	}
+	eventType := remoteEventTypeName(evt)
+	br.runWithWatchdog(ctx, &log, eventType, func(ctx context.Context) {
+		handler(ctx, portal, evt)
+	})
+	br.finishEventTiming(&log, portal, eventType, start, timing)
+}
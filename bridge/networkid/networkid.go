@@ -0,0 +1,150 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package networkid contains utilities for canonicalizing and validating remote network identifiers.
+//
+// Bridges should pass every remote user and chat ID through the same Normalizer before using it as a database key
+// or in a Matrix user ID, so that differently formatted versions of the same ID don't create duplicate portals
+// or ghosts.
+package networkid
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var (
+	ErrEmptyID      = errors.New("identifier is empty")
+	ErrInvalidID    = errors.New("identifier is invalid")
+	ErrInvalidPhone = errors.New("invalid phone number")
+)
+
+// Normalizer converts an identifier into its canonical form, or returns an error if the identifier is invalid.
+type Normalizer func(id string) (string, error)
+
+// Normalize runs the normalizer and also rejects empty results.
+func (n Normalizer) Normalize(id string) (string, error) {
+	normalized, err := n(id)
+	if err != nil {
+		return "", err
+	} else if normalized == "" {
+		return "", ErrEmptyID
+	}
+	return normalized, nil
+}
+
+// MustNormalize is like Normalize, but panics if the identifier is invalid.
+// It's meant for hardcoded IDs, like the IDs of built-in chats.
+func (n Normalizer) MustNormalize(id string) string {
+	normalized, err := n.Normalize(id)
+	if err != nil {
+		panic(fmt.Errorf("failed to normalize %q: %w", id, err))
+	}
+	return normalized
+}
+
+// Chain returns a normalizer that runs all the given normalizers in order.
+func Chain(normalizers ...Normalizer) Normalizer {
+	return func(id string) (string, error) {
+		var err error
+		for _, normalizer := range normalizers {
+			id, err = normalizer(id)
+			if err != nil {
+				return "", err
+			}
+		}
+		return id, nil
+	}
+}
+
+// TrimSpace removes leading and trailing whitespace.
+func TrimSpace(id string) (string, error) {
+	return strings.TrimSpace(id), nil
+}
+
+// CaseFold converts the identifier to a case-insensitive form. Unlike strings.ToLower, this also maps
+// characters like the Kelvin sign or the long s that only have an uppercase form in common with ASCII letters.
+func CaseFold(id string) (string, error) {
+	return strings.Map(func(r rune) rune {
+		return unicode.ToLower(unicode.ToUpper(r))
+	}, id), nil
+}
+
+// Unicode returns a normalizer that applies the given Unicode normalization form. This package doesn't depend on
+// golang.org/x/text itself, so bridges that need it should pass norm.NFC.String from that module.
+func Unicode(form func(string) string) Normalizer {
+	return func(id string) (string, error) {
+		return form(id), nil
+	}
+}
+
+// Pattern returns a normalizer that rejects identifiers that don't fully match the given regex.
+func Pattern(pattern *regexp.Regexp) Normalizer {
+	return func(id string) (string, error) {
+		if match := pattern.FindString(id); match != id {
+			return "", fmt.Errorf("%w: %q doesn't match %s", ErrInvalidID, id, pattern)
+		}
+		return id, nil
+	}
+}
+
+// MaxLength returns a normalizer that rejects identifiers longer than the given number of bytes.
+func MaxLength(length int) Normalizer {
+	return func(id string) (string, error) {
+		if len(id) > length {
+			return "", fmt.Errorf("%w: longer than %d bytes", ErrInvalidID, length)
+		}
+		return id, nil
+	}
+}
+
+const (
+	minPhoneDigits = 7
+	maxPhoneDigits = 15
+)
+
+// E164 returns a normalizer that converts phone numbers into the E.164 format, i.e. a plus sign followed by
+// the country code and the subscriber number without any separators.
+//
+// Spaces, dashes, dots, slashes and parentheses are removed, and the international call prefix 00 is treated
+// like a plus sign. Numbers without either are assumed to be national numbers: if defaultCountryCode is set,
+// a single trunk prefix 0 is removed and the country code is added, otherwise they're rejected.
+func E164(defaultCountryCode string) Normalizer {
+	defaultCountryCode = strings.TrimPrefix(defaultCountryCode, "+")
+	return func(phone string) (string, error) {
+		phone = strings.Map(func(r rune) rune {
+			switch r {
+			case ' ', '\u00a0', '-', '.', '/', '(', ')':
+				return -1
+			}
+			return r
+		}, strings.TrimSpace(phone))
+		switch {
+		case strings.HasPrefix(phone, "+"):
+			phone = phone[1:]
+		case strings.HasPrefix(phone, "00"):
+			phone = phone[2:]
+		case defaultCountryCode != "":
+			phone = defaultCountryCode + strings.TrimPrefix(phone, "0")
+		default:
+			return "", fmt.Errorf("%w: missing country code", ErrInvalidPhone)
+		}
+		if len(phone) < minPhoneDigits || len(phone) > maxPhoneDigits {
+			return "", fmt.Errorf("%w: must have %d to %d digits", ErrInvalidPhone, minPhoneDigits, maxPhoneDigits)
+		} else if phone[0] == '0' {
+			return "", fmt.Errorf("%w: country code can't start with 0", ErrInvalidPhone)
+		}
+		for _, r := range phone {
+			if r < '0' || r > '9' {
+				return "", fmt.Errorf("%w: unexpected character %q", ErrInvalidPhone, r)
+			}
+		}
+		return "+" + phone, nil
+	}
+}
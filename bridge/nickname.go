@@ -0,0 +1,105 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// SetRoomNickname sets the displayname of a ghost in a single portal room, e.g. for nicknames in group chats,
+// without changing the ghost's global profile. An empty nickname removes the nickname and restores the global
+// displayname in the room.
+//
+// Nicknames are stored in the database, so that they can be restored with ReapplyRoomNicknames after the global
+// displayname changes, since homeservers overwrite the displayname in all rooms when the global one is changed.
+func (br *Bridge) SetRoomNickname(ctx context.Context, ghost Ghost, roomID id.RoomID, nickname string) error {
+	userID := ghost.GetMXID()
+	oldNickname, err := br.BridgeStore.GetRoomNickname(roomID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to get previous nickname: %w", err)
+	}
+	if nickname == "" && oldNickname == "" {
+		return nil
+	}
+	displayname := nickname
+	if nickname == "" {
+		displayname, err = br.getGlobalDisplayname(ghost)
+		if err != nil {
+			return err
+		}
+	}
+	member := br.StateStore.GetMember(roomID, userID)
+	if oldNickname == nickname && member.Membership == event.MembershipJoin && member.Displayname == displayname {
+		return nil
+	}
+	err = br.sendRoomDisplayname(ghost, roomID, displayname)
+	if err != nil {
+		return err
+	}
+	err = br.BridgeStore.SetRoomNickname(roomID, userID, nickname)
+	if err != nil {
+		return fmt.Errorf("failed to save nickname: %w", err)
+	}
+	zerolog.Ctx(ctx).Debug().
+		Str("ghost_user_id", userID.String()).
+		Str("room_id", roomID.String()).
+		Str("nickname", nickname).
+		Msg("Updated per-room ghost displayname")
+	return nil
+}
+
+// ReapplyRoomNicknames restores the per-room displaynames of a ghost. Bridges should call this after changing
+// the global displayname of a ghost.
+func (br *Bridge) ReapplyRoomNicknames(ctx context.Context, ghost Ghost) {
+	log := zerolog.Ctx(ctx).With().Str("ghost_user_id", ghost.GetMXID().String()).Logger()
+	nicknames, err := br.BridgeStore.GetRoomNicknames(ghost.GetMXID())
+	if err != nil {
+		log.Err(err).Msg("Failed to get per-room nicknames")
+		return
+	}
+	for roomID, nickname := range nicknames {
+		err = br.sendRoomDisplayname(ghost, roomID, nickname)
+		if err != nil {
+			log.Err(err).Str("room_id", roomID.String()).Msg("Failed to reapply per-room nickname")
+		}
+	}
+}
+
+func (br *Bridge) getGlobalDisplayname(ghost Ghost) (string, error) {
+	if gwp, ok := ghost.(GhostWithProfile); ok {
+		return gwp.GetDisplayname(), nil
+	}
+	resp, err := ghost.DefaultIntent().Client.GetOwnDisplayName()
+	if err != nil {
+		return "", fmt.Errorf("failed to get global displayname: %w", err)
+	}
+	return resp.DisplayName, nil
+}
+
+func (br *Bridge) sendRoomDisplayname(ghost Ghost, roomID id.RoomID, displayname string) error {
+	userID := ghost.GetMXID()
+	content := *br.StateStore.GetMember(roomID, userID)
+	content.Membership = event.MembershipJoin
+	content.Reason = ""
+	content.Displayname = displayname
+	intent := ghost.DefaultIntent()
+	err := intent.EnsureJoined(roomID)
+	if err != nil {
+		return fmt.Errorf("failed to ensure ghost is joined: %w", err)
+	}
+	_, err = intent.SendStateEvent(roomID, event.StateMember, userID.String(), &content)
+	if err != nil {
+		return fmt.Errorf("failed to send member event: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type PendingRelationType string
+
+const (
+	PendingRelationReply  PendingRelationType = "reply"
+	PendingRelationThread PendingRelationType = "thread"
+)
+
+// QueuePendingRelation remembers that a bridged event should have been a reply to or in the thread of a remote
+// message that isn't in the database yet, e.g. because it's still being backfilled. Once the target is bridged,
+// ResolvePendingRelations resends the event with the relation.
+//
+// If the homeserver supports deterministic event IDs, portals should use ResolveTargetEventID when converting
+// the message instead, so that the relation is included when the event is first sent.
+func (br *Bridge) QueuePendingRelation(roomID id.RoomID, eventID id.EventID, targetRemoteID string, relType PendingRelationType) error {
+	return br.BridgeStore.AddPendingRelation(roomID, eventID, targetRemoteID, string(relType))
+}
+
+// ResolvePendingRelations applies queued relations that target the given remote message, which has just been
+// bridged as targetEventID.
+//
+// Matrix doesn't allow adding relations to existing events, so each event is sent again by its original sender
+// with the relation included, and the old event is redacted. The replaced callback is called with the old and new
+// event IDs so that the portal can update its database. Relations are only removed from the queue after the new
+// event was sent, so failed ones are retried the next time the target is bridged.
+func (br *Bridge) ResolvePendingRelations(ctx context.Context, portal Portal, roomID id.RoomID, targetRemoteID string, targetEventID id.EventID, replaced func(oldID, newID id.EventID)) {
+	log := zerolog.Ctx(ctx).With().
+		Str("target_remote_id", targetRemoteID).
+		Str("target_event_id", targetEventID.String()).
+		Logger()
+	relations, err := br.BridgeStore.GetPendingRelations(roomID, targetRemoteID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get pending relations")
+		return
+	}
+	for _, rel := range relations {
+		relLog := log.With().Str("event_id", rel.EventID.String()).Logger()
+		newEventID, err := br.resendWithRelation(relLog, portal, roomID, rel.EventID, PendingRelationType(rel.RelType), targetEventID)
+		if err != nil {
+			relLog.Err(err).Msg("Failed to apply pending relation")
+			continue
+		}
+		err = br.BridgeStore.DeletePendingRelation(roomID, rel.EventID)
+		if err != nil {
+			relLog.Err(err).Msg("Failed to delete applied pending relation")
+		}
+		relLog.Debug().Str("new_event_id", newEventID.String()).Msg("Applied pending relation")
+		if replaced != nil {
+			replaced(rel.EventID, newEventID)
+		}
+	}
+}
+
+func (br *Bridge) resendWithRelation(log zerolog.Logger, portal Portal, roomID id.RoomID, eventID id.EventID, relType PendingRelationType, targetEventID id.EventID) (id.EventID, error) {
+	evt, err := br.FetchEvent(roomID, eventID)
+	if err != nil {
+		return "", err
+	}
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok {
+		return "", fmt.Errorf("unsupported event type %s", evt.Type.Type)
+	} else if !br.Child.IsGhost(evt.Sender) {
+		return "", fmt.Errorf("event wasn't sent by a ghost")
+	}
+	ghost := br.Child.GetIGhost(evt.Sender)
+	if ghost == nil {
+		return "", fmt.Errorf("ghost not found")
+	}
+	intent := ghost.DefaultIntent()
+	newContent := *content
+	switch relType {
+	case PendingRelationThread:
+		newContent.RelatesTo = (&event.RelatesTo{}).SetThread(targetEventID, targetEventID)
+	default:
+		newContent.RelatesTo = (&event.RelatesTo{}).SetReplyTo(targetEventID)
+	}
+	resp, err := br.sendPortalEventWithTS(portal, intent, roomID, event.EventMessage, &newContent, evt.Timestamp)
+	if err != nil {
+		return "", fmt.Errorf("failed to send event with relation: %w", err)
+	}
+	_, err = intent.RedactEvent(roomID, eventID)
+	if err != nil {
+		// The new event was already sent, so the relation is applied even if the old one stays visible.
+		log.Warn().Err(err).Msg("Failed to redact event that was resent with relation")
+	}
+	return resp.EventID, nil
+}
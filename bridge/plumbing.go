@@ -0,0 +1,156 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrRoomBridgedElsewhere      = errors.New("room is already bridged by another bridge")
+	ErrInsufficientPlumbingPower = errors.New("the bridge bot doesn't have enough power to send bridge info and invite users")
+	ErrWontKickPlumbedMember     = errors.New("real Matrix users can't be removed from plumbed rooms")
+)
+
+// RoomBridgingBridge is an optional interface for bridges that can attach an existing Matrix room
+// to a remote chat that doesn't have a portal yet.
+type RoomBridgingBridge interface {
+	ChildOverride
+	// BridgeRoom creates a portal for the given remote chat using the existing Matrix room.
+	// The user is the one who requested bridging and should have access to the remote chat.
+	BridgeRoom(ctx context.Context, user User, roomID id.RoomID, remoteChatID string) (Portal, error)
+}
+
+// PlumbOptions contains options for attaching an existing Matrix room to a remote chat.
+type PlumbOptions struct {
+	// SetRelay makes the user who bridged the room the relay of the portal, so that messages from Matrix users
+	// without a login are bridged through them. The portal must implement RelayPortal.
+	SetRelay bool
+}
+
+// PlumbResult contains the portal created by BridgeExistingRoom, along with non-fatal problems
+// in the room that the user should be told about.
+type PlumbResult struct {
+	Portal   Portal
+	Warnings []string
+}
+
+// BridgeExistingRoom attaches an existing Matrix room to a remote chat using RoomBridgingBridge.
+//
+// The room is validated first: it must not be bridged by another bridge, and the bridge bot must have enough
+// power to send bridge info and invite ghosts. If validation or bridging fails, the bridge bot leaves the room
+// again, unless it was already in the room before. The returned portal should implement PlumbedPortal, so that
+// real Matrix users in the room are never kicked when syncing members.
+func (br *Bridge) BridgeExistingRoom(ctx context.Context, user User, roomID id.RoomID, remoteChatID string, opts PlumbOptions) (*PlumbResult, error) {
+	rbb, ok := br.Child.(RoomBridgingBridge)
+	if !ok {
+		return nil, errors.New("bridging existing rooms is not supported")
+	} else if br.Child.GetIPortal(roomID) != nil {
+		return nil, ErrRoomAlreadyBridged
+	}
+	// The bot has to be in the room to read its state, so it's joined first and leaves again if bridging fails.
+	wasJoined := br.StateStore.IsInRoom(roomID, br.Bot.UserID)
+	err := br.Bot.EnsureJoined(roomID)
+	if err != nil {
+		return nil, fmt.Errorf("bridge bot failed to join room: %w", err)
+	}
+	warnings, err := br.validatePlumbedRoom(roomID)
+	var portal Portal
+	if err == nil {
+		portal, err = rbb.BridgeRoom(ctx, user, roomID, remoteChatID)
+	}
+	if err != nil {
+		if !wasJoined {
+			_, leaveErr := br.Bot.LeaveRoom(roomID)
+			if leaveErr != nil {
+				zerolog.Ctx(ctx).Warn().Err(leaveErr).Str("room_id", roomID.String()).Msg("Failed to leave room after bridging failed")
+			}
+		}
+		return nil, err
+	}
+	if opts.SetRelay {
+		if rp, ok := portal.(RelayPortal); !ok {
+			warnings = append(warnings, "This bridge doesn't support relaying, so only logged-in users' messages will be bridged")
+		} else if err = rp.SetRelayUser(user); err != nil {
+			warnings = append(warnings, fmt.Sprintf("Failed to set relay user: %v", err))
+		}
+	}
+	zerolog.Ctx(ctx).Info().
+		Str("room_id", roomID.String()).
+		Str("remote_chat_id", remoteChatID).
+		Strs("warnings", warnings).
+		Msg("Bridged existing room")
+	return &PlumbResult{Portal: portal, Warnings: warnings}, nil
+}
+
+func (br *Bridge) validatePlumbedRoom(roomID id.RoomID) ([]string, error) {
+	state, err := br.Bot.State(roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get room state: %w", err)
+	}
+	for _, evtType := range []event.Type{event.StateBridge, event.StateHalfShotBridge} {
+		for _, evt := range state[evtType] {
+			content, ok := evt.Content.Parsed.(*event.BridgeEventContent)
+			if ok && content.BridgeBot != "" && content.BridgeBot != br.Bot.UserID {
+				return nil, fmt.Errorf("%w (by %s)", ErrRoomBridgedElsewhere, content.BridgeBot)
+			}
+		}
+	}
+	pls, err := br.Bot.PowerLevels(roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get power levels: %w", err)
+	}
+	botLevel := pls.GetUserLevel(br.Bot.UserID)
+	if botLevel < pls.GetEventLevel(event.StateBridge) || botLevel < pls.Invite() {
+		return nil, ErrInsufficientPlumbingPower
+	}
+	var warnings []string
+	if br.StateStore.IsEncrypted(roomID) && br.Crypto == nil {
+		warnings = append(warnings, "The room is encrypted, but the bridge doesn't have encryption enabled, so messages can't be bridged")
+	}
+	if botLevel < pls.Redact() {
+		warnings = append(warnings, "The bridge bot can't redact messages, so deletes from the remote chat won't be bridged")
+	}
+	humans := 0
+	for userID := range br.StateStore.GetRoomMembers(roomID, event.MembershipJoin) {
+		if userID != br.Bot.UserID && !br.Child.IsGhost(userID) {
+			humans++
+		}
+	}
+	if humans > 0 {
+		warnings = append(warnings, fmt.Sprintf("The room has %d existing Matrix members, who will stay in the room but won't be visible on the remote network unless logged in or relayed", humans))
+	}
+	return warnings, nil
+}
+
+// PlumbedPortal is an optional interface for portals that were attached to a pre-existing Matrix room.
+//
+// The bridge never kicks or bans real Matrix users from plumbed portals when applying membership changes,
+// since they aren't managed by the bridge.
+type PlumbedPortal interface {
+	Portal
+	IsPlumbed() bool
+}
+
+// RelayPortal is an optional interface for portals that can bridge messages from users without a login
+// through a relay user.
+type RelayPortal interface {
+	Portal
+	SetRelayUser(user User) error
+}
+
+func (br *Bridge) isPlumbed(roomID id.RoomID) bool {
+	pp, ok := br.Child.GetIPortal(roomID).(PlumbedPortal)
+	return ok && pp.IsPlumbed()
+}
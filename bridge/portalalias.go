@@ -0,0 +1,93 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+)
+
+var (
+	ErrPortalLookupNotSupported = errors.New("this bridge doesn't support looking up portals by remote ID")
+	ErrPortalAliasConflict      = errors.New("the remote ID is already the primary ID of another portal")
+)
+
+// PortalKeyBridge is an optional interface for bridges that can look up portals by their primary remote ID.
+// It's required for GetPortalByAnyID.
+type PortalKeyBridge interface {
+	ChildOverride
+	// GetPortalByKey returns the portal with the given primary remote ID, or nil if there isn't one.
+	// It must not create new portals.
+	GetPortalByKey(ctx context.Context, portalKey string) (Portal, error)
+}
+
+// ResolvePortalKey returns the primary remote ID of the portal that the given remote ID refers to.
+// IDs that aren't aliases are returned as-is.
+func (br *Bridge) ResolvePortalKey(key string) (string, error) {
+	primary, err := br.BridgeStore.GetPortalAliasTarget(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to get portal alias: %w", err)
+	} else if primary != "" {
+		return primary, nil
+	}
+	return key, nil
+}
+
+// GetPortalByAnyID looks up a portal by its primary remote ID or any of its secondary IDs registered with
+// AddPortalAlias. Bridges should use this instead of looking up portals directly when handling remote events
+// from networks that have multiple IDs for the same chat.
+func (br *Bridge) GetPortalByAnyID(ctx context.Context, key string) (Portal, error) {
+	pkb, ok := br.Child.(PortalKeyBridge)
+	if !ok {
+		return nil, ErrPortalLookupNotSupported
+	}
+	primary, err := br.ResolvePortalKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pkb.GetPortalByKey(ctx, primary)
+}
+
+// AddPortalAlias registers a secondary remote ID for a portal, such as the short form of a chat ID or the new ID
+// of a chat after a network-side ID migration. Adding an alias that already exists moves it to the given portal.
+//
+// If the bridge implements PortalKeyBridge and a portal already exists with the alias as its primary ID,
+// ErrPortalAliasConflict is returned, as the two portals would have to be merged first.
+func (br *Bridge) AddPortalAlias(ctx context.Context, aliasKey, portalKey string) error {
+	// Aliases always point at primary IDs, so lookups never need to follow chains.
+	portalKey, err := br.ResolvePortalKey(portalKey)
+	if err != nil {
+		return err
+	} else if aliasKey == portalKey {
+		return nil
+	}
+	if pkb, ok := br.Child.(PortalKeyBridge); ok {
+		existing, err := pkb.GetPortalByKey(ctx, aliasKey)
+		if err != nil {
+			return fmt.Errorf("failed to check for existing portal: %w", err)
+		} else if existing != nil {
+			return ErrPortalAliasConflict
+		}
+	}
+	err = br.BridgeStore.SetPortalAlias(aliasKey, portalKey)
+	if err != nil {
+		return fmt.Errorf("failed to save portal alias: %w", err)
+	}
+	zerolog.Ctx(ctx).Debug().
+		Str("alias_key", aliasKey).
+		Str("portal_key", portalKey).
+		Msg("Added portal alias")
+	return nil
+}
+
+// RemovePortalAliases deletes all secondary remote IDs of a portal. Bridges should call this when deleting portals.
+func (br *Bridge) RemovePortalAliases(portalKey string) error {
+	return br.BridgeStore.DeletePortalAliases(portalKey)
+}
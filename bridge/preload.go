@@ -0,0 +1,48 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"time"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+)
+
+// CachePreloadingBridge is an optional interface for bridges that can load their hottest portals into
+// memory before the bridge starts receiving events.
+type CachePreloadingBridge interface {
+	ChildOverride
+	// PreloadCaches loads the given number of most recently active portals and their ghosts into the in-memory
+	// caches. It should use a single batched query rather than looking up each row separately.
+	PreloadCaches(ctx context.Context, portalCount int) error
+}
+
+// preloadCaches is called before the appservice is marked as ready, so that the first burst of events after
+// a restart doesn't have to wait for database lookups of each portal one by one.
+func (br *Bridge) preloadCaches() {
+	cpb, ok := br.Child.(CachePreloadingBridge)
+	if !ok {
+		return
+	}
+	cpc, ok := br.Config.Bridge.(bridgeconfig.CachePreloadBridgeConfig)
+	if !ok {
+		return
+	}
+	count := cpc.GetCachePreloadConfig().Portals
+	if count <= 0 {
+		return
+	}
+	log := br.ZLog.With().Str("action", "preload caches").Int("portal_count", count).Logger()
+	start := time.Now()
+	err := cpb.PreloadCaches(log.WithContext(context.Background()), count)
+	if err != nil {
+		log.Err(err).Msg("Failed to preload caches")
+	} else {
+		log.Info().Dur("duration", time.Since(start)).Msg("Preloaded caches")
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func (br *Bridge) getPrivacyConfig() bridgeconfig.PrivacyConfig {
+	pmc, ok := br.Config.Bridge.(bridgeconfig.PrivacyModeBridgeConfig)
+	if !ok {
+		return bridgeconfig.PrivacyConfig{}
+	}
+	return pmc.GetPrivacyConfig()
+}
+
+// IsPrivacyModeEnabled returns true if remote identifiers should be hidden from Matrix.
+func (br *Bridge) IsPrivacyModeEnabled() bool {
+	return br.getPrivacyConfig().HashRemoteIDs
+}
+
+func (br *Bridge) hashRemoteID(remoteID string) string {
+	mac := hmac.New(sha256.New, []byte(br.getPrivacyConfig().Salt))
+	mac.Write([]byte(remoteID))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// OpaqueRemoteID returns the identifier that should be exposed to Matrix for the given remote ID,
+// e.g. in ghost user IDs and the channel ID in bridge info state events.
+//
+// If privacy mode is enabled, the ID is hashed with the salt from the config, so it's stable, but doesn't
+// reveal the remote identifier. The original ID is stored in the database, so it can be looked up later with
+// ResolveOpaqueRemoteID. Otherwise, the remote ID is returned as-is.
+//
+// Bridges that enable privacy mode after ghosts have already been created can use PrivacyGhostMigrations
+// in GhostMigratingBridge to move existing ghosts to the new IDs.
+func (br *Bridge) OpaqueRemoteID(remoteID string) string {
+	if !br.IsPrivacyModeEnabled() {
+		return remoteID
+	}
+	opaqueID := br.hashRemoteID(remoteID)
+	err := br.BridgeStore.PutOpaqueRemoteID(opaqueID, remoteID)
+	if err != nil {
+		br.ZLog.Err(err).Str("opaque_id", opaqueID).Msg("Failed to store opaque remote ID")
+	}
+	return opaqueID
+}
+
+// ResolveOpaqueRemoteID returns the remote ID that the given identifier from Matrix (e.g. parsed from a ghost
+// user ID) refers to. If privacy mode is disabled, the identifier is returned as-is. The boolean is false if
+// the identifier isn't a known hashed ID.
+func (br *Bridge) ResolveOpaqueRemoteID(opaqueID string) (string, bool, error) {
+	if !br.IsPrivacyModeEnabled() {
+		return opaqueID, true, nil
+	}
+	remoteID, err := br.BridgeStore.GetRemoteIDByOpaque(opaqueID)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to look up opaque remote ID: %w", err)
+	}
+	return remoteID, remoteID != "", nil
+}
+
+// PrivacyGhostMigrations returns the ghost migrations needed after privacy mode was enabled or disabled,
+// for use in GhostMigratingBridge.GetGhostMigrations. The ghosts map is keyed by the raw remote ID of each ghost,
+// and formatMXID should return the Matrix user ID for the given ID using the bridge's username template.
+//
+// The ghosts are expected to already have their new user IDs. The hashed IDs of all given ghosts are also
+// stored in the database, so that ResolveOpaqueRemoteID works for ghosts created before privacy mode was enabled.
+func (br *Bridge) PrivacyGhostMigrations(ghosts map[string]Ghost, formatMXID func(string) id.UserID) map[id.UserID]Ghost {
+	migrations := make(map[id.UserID]Ghost)
+	for remoteID, ghost := range ghosts {
+		opaqueID := br.hashRemoteID(remoteID)
+		err := br.BridgeStore.PutOpaqueRemoteID(opaqueID, remoteID)
+		if err != nil {
+			br.ZLog.Err(err).Str("opaque_id", opaqueID).Msg("Failed to store opaque remote ID")
+		}
+		var oldMXID id.UserID
+		if br.IsPrivacyModeEnabled() {
+			oldMXID = formatMXID(remoteID)
+		} else {
+			oldMXID = formatMXID(opaqueID)
+		}
+		if oldMXID != ghost.GetMXID() {
+			migrations[oldMXID] = ghost
+		}
+	}
+	return migrations
+}
+
+// opaqueBridgeInfoID hashes an ID in a bridge info event, unless the portal already hashed it.
+func (br *Bridge) opaqueBridgeInfoID(infoID string) string {
+	if infoID == "" {
+		return ""
+	} else if remoteID, _ := br.BridgeStore.GetRemoteIDByOpaque(infoID); remoteID != "" {
+		return infoID
+	}
+	return br.OpaqueRemoteID(infoID)
+}
+
+// applyPrivacyToBridgeInfo hides remote identifiers in a bridge info event if privacy mode is enabled.
+// The channel and network IDs are hashed, and external URLs and metadata are removed, as they usually
+// contain remote identifiers too.
+func (br *Bridge) applyPrivacyToBridgeInfo(content *event.BridgeEventContent) {
+	if !br.IsPrivacyModeEnabled() {
+		return
+	}
+	content.Channel.ID = br.opaqueBridgeInfoID(content.Channel.ID)
+	content.Channel.ExternalURL = ""
+	if content.Network != nil {
+		content.Network.ID = br.opaqueBridgeInfoID(content.Network.ID)
+		content.Network.ExternalURL = ""
+	}
+	content.Metadata = nil
+}
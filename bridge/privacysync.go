@@ -0,0 +1,90 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ChatPrivacy contains the Matrix room settings derived from the privacy settings of a remote chat,
+// e.g. a public channel would have world readable history, while a private group would only share history
+// with members. Empty fields are not changed.
+type ChatPrivacy struct {
+	HistoryVisibility event.HistoryVisibility
+	JoinRule          event.JoinRule
+	GuestAccess       event.GuestAccess
+}
+
+// RoomDefaults converts the privacy settings into room defaults overrides for creating the portal room.
+func (cp ChatPrivacy) RoomDefaults() *bridgeconfig.RoomDefaults {
+	return &bridgeconfig.RoomDefaults{
+		HistoryVisibility: cp.HistoryVisibility,
+		JoinRule:          cp.JoinRule,
+		GuestAccess:       cp.GuestAccess,
+	}
+}
+
+func (br *Bridge) syncPrivacyState(ctx context.Context, intent *appservice.IntentAPI, roomID id.RoomID, evtType event.Type, current, wanted interface{}, isEqual func() bool) error {
+	err := intent.StateEvent(roomID, evtType, "", current)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return fmt.Errorf("failed to get current %s: %w", evtType.Type, err)
+	} else if err == nil && isEqual() {
+		return nil
+	}
+	_, err = intent.SendStateEvent(roomID, evtType, "", wanted)
+	if err != nil {
+		return fmt.Errorf("failed to update %s: %w", evtType.Type, err)
+	}
+	zerolog.Ctx(ctx).Debug().Str("event_type", evtType.Type).Msg("Updated room privacy setting")
+	return nil
+}
+
+// SyncChatPrivacy updates the history visibility, join rules and guest access of an existing portal room
+// to match the remote chat's privacy settings. Only the state events that differ from the current state are sent.
+func (br *Bridge) SyncChatPrivacy(ctx context.Context, intent *appservice.IntentAPI, roomID id.RoomID, privacy ChatPrivacy) error {
+	if privacy.HistoryVisibility != "" {
+		var current event.HistoryVisibilityEventContent
+		wanted := &event.HistoryVisibilityEventContent{HistoryVisibility: privacy.HistoryVisibility}
+		err := br.syncPrivacyState(ctx, intent, roomID, event.StateHistoryVisibility, &current, wanted, func() bool {
+			return current.HistoryVisibility == wanted.HistoryVisibility
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if privacy.JoinRule != "" {
+		var current event.JoinRulesEventContent
+		wanted := &event.JoinRulesEventContent{JoinRule: privacy.JoinRule}
+		err := br.syncPrivacyState(ctx, intent, roomID, event.StateJoinRules, &current, wanted, func() bool {
+			return current.JoinRule == wanted.JoinRule
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if privacy.GuestAccess != "" {
+		var current event.GuestAccessEventContent
+		wanted := &event.GuestAccessEventContent{GuestAccess: privacy.GuestAccess}
+		err := br.syncPrivacyState(ctx, intent, roomID, event.StateGuestAccess, &current, wanted, func() bool {
+			return current.GuestAccess == wanted.GuestAccess
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
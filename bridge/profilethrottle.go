@@ -0,0 +1,115 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/id"
+)
+
+type profileField int
+
+const (
+	profileFieldName profileField = iota
+	profileFieldAvatar
+)
+
+type profileThrottleKey struct {
+	UserID id.UserID
+	Field  profileField
+}
+
+// ProfileThrottler decides whether changes to ghost profiles are significant enough to be bridged.
+// Every profile update of a ghost creates a new m.room.member event in every room the ghost is in,
+// so skipping insignificant changes reduces state spam in large shared portals.
+//
+// When an update is skipped, the ghost's stored profile info should be left unchanged,
+// so that the change is applied on a later sync if it's still relevant.
+type ProfileThrottler struct {
+	br         *Bridge
+	lastUpdate map[profileThrottleKey]time.Time
+	lock       sync.Mutex
+
+	lastSweep time.Time
+}
+
+func newProfileThrottler(br *Bridge) *ProfileThrottler {
+	return &ProfileThrottler{
+		br:         br,
+		lastUpdate: make(map[profileThrottleKey]time.Time),
+	}
+}
+
+func (pt *ProfileThrottler) getConfig() (cfg bridgeconfig.ProfileThrottleConfig) {
+	if ptc, ok := pt.br.Config.Bridge.(bridgeconfig.ProfileThrottleBridgeConfig); ok {
+		cfg = ptc.GetProfileThrottleConfig()
+	}
+	return
+}
+
+// ShouldUpdateName returns true if the displayname of the ghost should be changed from oldName to newName.
+func (pt *ProfileThrottler) ShouldUpdateName(userID id.UserID, oldName, newName string) bool {
+	if oldName == newName {
+		return false
+	}
+	cfg := pt.getConfig()
+	if cfg.IgnoreNameCaseChanges && oldName != "" && strings.EqualFold(strings.TrimSpace(oldName), strings.TrimSpace(newName)) {
+		return false
+	}
+	return pt.checkInterval(profileThrottleKey{UserID: userID, Field: profileFieldName}, cfg)
+}
+
+// ShouldUpdateAvatar returns true if the avatar of the ghost should be changed.
+// The URLs are the remote avatar URLs, not the Matrix content URIs.
+func (pt *ProfileThrottler) ShouldUpdateAvatar(userID id.UserID, oldURL, newURL string) bool {
+	if oldURL == newURL {
+		return false
+	}
+	cfg := pt.getConfig()
+	if cfg.IgnoreAvatarQueryChanges && oldURL != "" && newURL != "" && stripURLQuery(oldURL) == stripURLQuery(newURL) {
+		return false
+	}
+	return pt.checkInterval(profileThrottleKey{UserID: userID, Field: profileFieldAvatar}, cfg)
+}
+
+func (pt *ProfileThrottler) checkInterval(key profileThrottleKey, cfg bridgeconfig.ProfileThrottleConfig) bool {
+	if cfg.MinInterval <= 0 {
+		return true
+	}
+	minInterval := time.Duration(cfg.MinInterval) * time.Second
+	now := time.Now()
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	if last, ok := pt.lastUpdate[key]; ok && now.Sub(last) < minInterval {
+		return false
+	}
+	pt.lastUpdate[key] = now
+	if now.Sub(pt.lastSweep) >= minInterval {
+		pt.lastSweep = now
+		for otherKey, last := range pt.lastUpdate {
+			if now.Sub(last) >= minInterval {
+				delete(pt.lastUpdate, otherKey)
+			}
+		}
+	}
+	return true
+}
+
+func stripURLQuery(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	parsed.RawQuery = ""
+	parsed.Fragment = ""
+	return parsed.String()
+}
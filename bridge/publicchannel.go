@@ -0,0 +1,63 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrPublicChannelNotFound = errors.New("channel not found")
+	ErrRoomAlreadySubscribed = errors.New("room is already subscribed to a channel")
+	ErrRoomNotSubscribed     = errors.New("room is not subscribed to a channel")
+	ErrPublicChannelReadOnly = errors.New("public channels are read-only")
+)
+
+// PublicChannelBridge is an optional interface for bridges that can bridge public channels or feeds
+// from the remote network without any user being logged in. The bridge is expected to use a shared
+// service credential or anonymous access to receive the channel's messages.
+//
+// Subscribed rooms aren't owned by any user login: the subscriber is only recorded for informational purposes,
+// and the subscription remains active even if the subscriber leaves the room or logs out.
+type PublicChannelBridge interface {
+	ChildOverride
+	// SubscribePublicChannel starts bridging the given public channel into an existing Matrix room.
+	// The returned name is used for the confirmation message.
+	SubscribePublicChannel(ctx context.Context, subscriber User, roomID id.RoomID, channel string) (name string, err error)
+	// UnsubscribePublicChannel stops bridging messages into the given room.
+	UnsubscribePublicChannel(ctx context.Context, roomID id.RoomID) error
+}
+
+// PublicChannelPortal is an optional interface for portals that may be loginless public channel subscriptions.
+// Matrix messages sent to such portals are rejected, as there's no login to send them with.
+type PublicChannelPortal interface {
+	Portal
+	IsPublicChannel() bool
+}
+
+func isPublicChannel(portal Portal) bool {
+	pcp, ok := portal.(PublicChannelPortal)
+	return ok && pcp.IsPublicChannel()
+}
+
+// CanManageSubscription checks whether the given user has sufficient power in the room to change
+// its public channel subscription. Bridge admins are always allowed.
+func (br *Bridge) CanManageSubscription(user User, roomID id.RoomID) (bool, error) {
+	if user.GetPermissionLevel() >= bridgeconfig.PermissionLevelAdmin {
+		return true, nil
+	}
+	levels, err := br.Bot.PowerLevels(roomID)
+	if err != nil {
+		return false, err
+	}
+	return levels.GetUserLevel(user.GetMXID()) >= levels.GetEventLevel(event.StateBridge), nil
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
+)
+
+// UserQueryingBridge is an optional interface for bridges that can resolve arbitrary ghost user IDs.
+//
+// If the child bridge implements it, the homeserver's user queries (which happen e.g. when a client
+// tries to start a DM with a ghost that hasn't been created yet) will be routed to QueryGhost.
+type UserQueryingBridge interface {
+	ChildOverride
+	// QueryGhost should look up the remote user behind the given ghost user ID and create the ghost.
+	// It should return nil if the user doesn't exist on the remote network.
+	QueryGhost(userID id.UserID) Ghost
+}
+
+type queryHandler struct {
+	bridge *Bridge
+	child  UserQueryingBridge
+}
+
+var _ appservice.QueryHandler = (*queryHandler)(nil)
+
+func (qh *queryHandler) QueryAlias(alias string) bool {
+	return false
+}
+
+func (qh *queryHandler) QueryUser(userID id.UserID) bool {
+	if !qh.child.IsGhost(userID) {
+		return false
+	}
+	log := qh.bridge.ZLog.With().Str("action", "query user").Str("user_id", userID.String()).Logger()
+	ghost := qh.child.QueryGhost(userID)
+	if ghost == nil {
+		log.Debug().Msg("Remote user not found, rejecting user query")
+		return false
+	}
+	intent := ghost.DefaultIntent()
+	err := intent.EnsureRegistered()
+	if err != nil {
+		log.Err(err).Msg("Failed to register ghost for user query")
+		return false
+	}
+	if profilefulGhost, ok := ghost.(GhostWithProfile); ok {
+		if displayname := profilefulGhost.GetDisplayname(); displayname != "" {
+			err = intent.SetDisplayName(displayname)
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to set ghost displayname after user query")
+			}
+		}
+		if avatarURL := profilefulGhost.GetAvatarURL(); !avatarURL.IsEmpty() {
+			err = intent.SetAvatarURL(avatarURL)
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to set ghost avatar after user query")
+			}
+		}
+	}
+	log.Debug().Msg("Accepted user query")
+	return true
+}
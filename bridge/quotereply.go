@@ -0,0 +1,143 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"regexp"
+	"strings"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	DefaultQuoteReplyTemplate  = "> {sender}: {excerpt}"
+	DefaultQuoteReplyMaxLength = 100
+)
+
+// ReplylessPortal is an optional interface for portals whose remote chat may not support replies.
+//
+// If SupportsReplies returns false, replies from Matrix are converted into normal messages with a quoted
+// excerpt of the replied-to message prepended, so the context isn't lost. Portals should use
+// Bridge.StripQuoteReply on the echoes of such messages to avoid quoting the message twice.
+type ReplylessPortal interface {
+	Portal
+	SupportsReplies() bool
+}
+
+func (br *Bridge) getQuoteReplyConfig() bridgeconfig.QuoteReplyConfig {
+	var cfg bridgeconfig.QuoteReplyConfig
+	if qrc, ok := br.Config.Bridge.(bridgeconfig.QuoteReplyBridgeConfig); ok {
+		cfg = qrc.GetQuoteReplyConfig()
+	}
+	if cfg.Template == "" {
+		cfg.Template = DefaultQuoteReplyTemplate
+	}
+	if cfg.MaxLength <= 0 {
+		cfg.MaxLength = DefaultQuoteReplyMaxLength
+	}
+	return cfg
+}
+
+func makeExcerpt(text string, maxLength int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	runes := []rune(text)
+	if len(runes) > maxLength {
+		return strings.TrimSpace(string(runes[:maxLength])) + "…"
+	}
+	return text
+}
+
+// MakeQuoteReply renders the quote that is prepended to replies on networks without native replies.
+func (br *Bridge) MakeQuoteReply(sender, targetText string) string {
+	cfg := br.getQuoteReplyConfig()
+	return strings.NewReplacer(
+		"{sender}", makeExcerpt(sender, cfg.MaxLength),
+		"{excerpt}", makeExcerpt(targetText, cfg.MaxLength),
+	).Replace(cfg.Template)
+}
+
+// quotePlaceholderRegex matches the placeholders of the quote template.
+var quotePlaceholderRegex = regexp.MustCompile(`\{(?:sender|excerpt)}`)
+
+// makeQuoteReplyRegex creates a regex that matches a quote rendered from the given template at the
+// beginning of a message, including the blank line that separates it from the message.
+func makeQuoteReplyRegex(template string) *regexp.Regexp {
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	prevEnd := 0
+	for _, loc := range quotePlaceholderRegex.FindAllStringIndex(template, -1) {
+		pattern.WriteString(regexp.QuoteMeta(template[prevEnd:loc[0]]))
+		// Excerpts never contain newlines, as makeExcerpt collapses all whitespace.
+		pattern.WriteString(`[^\n]*`)
+		prevEnd = loc[1]
+	}
+	pattern.WriteString(regexp.QuoteMeta(template[prevEnd:]))
+	pattern.WriteString("\n\n")
+	return regexp.MustCompile(pattern.String())
+}
+
+// StripQuoteReply removes the quote added by MakeQuoteReply from the beginning of a message.
+// The whole quote must match the configured template, so text without a quote is returned unchanged.
+func (br *Bridge) StripQuoteReply(text string) string {
+	cfg := br.getQuoteReplyConfig()
+	if loc := makeQuoteReplyRegex(cfg.Template).FindStringIndex(text); loc != nil {
+		return text[loc[1]:]
+	}
+	return text
+}
+
+func (mx *MatrixHandler) quoteReplyMiddleware(next MatrixEventHandler) MatrixEventHandler {
+	return func(user User, portal Portal, evt *event.Event) {
+		content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+		if ok && content.NewContent == nil && content.RelatesTo.GetNonFallbackReplyTo() != "" {
+			if rp, ok := portal.(ReplylessPortal); ok && !rp.SupportsReplies() && !mx.bridge.getQuoteReplyConfig().Disable {
+				mx.addQuoteReply(evt, content)
+			}
+		}
+		next(user, portal, evt)
+	}
+}
+
+func (mx *MatrixHandler) addQuoteReply(evt *event.Event, content *event.MessageEventContent) {
+	replyTo := content.RelatesTo.GetNonFallbackReplyTo()
+	if content.RelatesTo.Type == "" {
+		content.RelatesTo = nil
+	} else {
+		content.RelatesTo.InReplyTo = nil
+	}
+	target, err := mx.bridge.FetchEvent(evt.RoomID, replyTo)
+	if err != nil {
+		mx.log.Warn().Err(err).
+			Str("event_id", evt.ID.String()).
+			Str("reply_to", replyTo.String()).
+			Msg("Failed to fetch reply target for quote fallback")
+		return
+	}
+	targetContent, ok := target.Content.Parsed.(*event.MessageEventContent)
+	if !ok {
+		return
+	}
+	senderName := target.Sender.String()
+	if member := mx.bridge.StateStore.GetMember(evt.RoomID, target.Sender); member != nil && member.Displayname != "" {
+		senderName = member.Displayname
+	}
+	targetContent.RemoveReplyFallback()
+	quote := mx.bridge.MakeQuoteReply(senderName, targetContent.Body)
+	if isMediaMessage(evt.Type, content) && (content.FileName == "" || content.FileName == content.Body) {
+		// The body of media without a caption is the file name, so move it to the file name field
+		// and send the quote as the caption.
+		content.FileName = content.Body
+		content.Body = quote
+		content.Format = ""
+		content.FormattedBody = ""
+		return
+	} else if content.Format == event.FormatHTML {
+		content.FormattedBody = event.TextToHTML(quote) + "<br/><br/>" + content.FormattedBody
+	}
+	content.Body = quote + "\n\n" + content.Body
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/bridge/bridgestore"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ReactionTotalKey is the key in the content of capped reactions that contains the total number of
+// reactions with the same emoji on the remote network when the reaction was bridged.
+const ReactionTotalKey = "fi.mau.reaction_total"
+
+// RemoteReaction is a single reaction on the remote network.
+type RemoteReaction struct {
+	Sender    Ghost
+	Emoji     string
+	Timestamp time.Time
+}
+
+// ReactionCappingPortal is an optional interface for portals that override the per-emoji reaction cap of the config.
+type ReactionCappingPortal interface {
+	Portal
+	// GetMaxReactionsPerEmoji returns the reaction cap of the portal. Zero means no limit and
+	// a negative value means the default from the bridge config is used.
+	GetMaxReactionsPerEmoji() int
+}
+
+func (br *Bridge) getReactionCap(portal Portal) int {
+	if rcp, ok := portal.(ReactionCappingPortal); ok {
+		if limit := rcp.GetMaxReactionsPerEmoji(); limit >= 0 {
+			return limit
+		}
+	}
+	if rcc, ok := br.Config.Bridge.(bridgeconfig.ReactionCapBridgeConfig); ok {
+		return rcc.GetReactionCapConfig().MaxPerEmoji
+	}
+	return 0
+}
+
+type bridgedReactionKey struct {
+	Emoji  string
+	Sender id.UserID
+}
+
+// SyncCappedReactions makes the reactions bridged to a message match the given full list of remote reactions.
+//
+// If a reaction cap is configured, only the newest reactions of each emoji are bridged as m.reaction events,
+// older ones are redacted, and the full counts are stored using ReactionAggregator.SyncCounts. The bridged
+// reactions are stored in the database, so that later syncs only send and redact the differences.
+func (br *Bridge) SyncCappedReactions(ctx context.Context, portal Portal, roomID id.RoomID, targetID id.EventID, reactions []RemoteReaction) error {
+	log := zerolog.Ctx(ctx).With().Str("target_event_id", targetID.String()).Logger()
+	limit := br.getReactionCap(portal)
+	byEmoji := make(map[string][]RemoteReaction)
+	for _, reaction := range reactions {
+		byEmoji[reaction.Emoji] = append(byEmoji[reaction.Emoji], reaction)
+	}
+	wanted := make(map[bridgedReactionKey]RemoteReaction)
+	counts := make(map[string]int, len(byEmoji))
+	for emoji, emojiReactions := range byEmoji {
+		counts[emoji] = len(emojiReactions)
+		if limit > 0 && len(emojiReactions) > limit {
+			sort.Slice(emojiReactions, func(i, j int) bool {
+				return emojiReactions[i].Timestamp.After(emojiReactions[j].Timestamp)
+			})
+			emojiReactions = emojiReactions[:limit]
+		}
+		for _, reaction := range emojiReactions {
+			wanted[bridgedReactionKey{Emoji: emoji, Sender: reaction.Sender.GetMXID()}] = reaction
+		}
+	}
+	existing, err := br.BridgeStore.GetBridgedReactions(roomID, targetID)
+	if err != nil {
+		return fmt.Errorf("failed to get bridged reactions: %w", err)
+	}
+	for _, reaction := range existing {
+		key := bridgedReactionKey{Emoji: reaction.Emoji, Sender: reaction.Sender}
+		if _, stillWanted := wanted[key]; stillWanted {
+			delete(wanted, key)
+			continue
+		}
+		intent := br.Bot
+		if ghost := br.Child.GetIGhost(reaction.Sender); ghost != nil {
+			intent = ghost.DefaultIntent()
+		}
+		_, err = intent.RedactEvent(roomID, reaction.EventID)
+		if err != nil {
+			log.Err(err).Str("reaction_event_id", reaction.EventID.String()).Msg("Failed to redact capped reaction")
+			continue
+		}
+		err = br.BridgeStore.DeleteBridgedReaction(roomID, targetID, reaction.Emoji, reaction.Sender)
+		if err != nil {
+			log.Err(err).Str("reaction_event_id", reaction.EventID.String()).Msg("Failed to delete bridged reaction from database")
+		}
+	}
+	sent := make([]bridgestore.BridgedReaction, 0, len(wanted))
+	for key, reaction := range wanted {
+		content := &event.Content{
+			Parsed: &event.ReactionEventContent{
+				RelatesTo: *(&event.RelatesTo{}).SetAnnotation(targetID, key.Emoji),
+			},
+			Raw: map[string]interface{}{
+				ReactionTotalKey: counts[key.Emoji],
+			},
+		}
+		resp, err := br.sendPortalEvent(portal, reaction.Sender.DefaultIntent(), roomID, event.EventReaction, content)
+		if err != nil {
+			log.Err(err).Str("sender", key.Sender.String()).Str("emoji", key.Emoji).Msg("Failed to send reaction")
+			continue
+		}
+		sent = append(sent, bridgestore.BridgedReaction{
+			Emoji:     key.Emoji,
+			Sender:    key.Sender,
+			EventID:   resp.EventID,
+			Timestamp: reaction.Timestamp,
+		})
+	}
+	if len(sent) > 0 {
+		err = br.BridgeStore.AddBridgedReactions(ctx, roomID, targetID, sent)
+		if err != nil {
+			log.Err(err).Int("reaction_count", len(sent)).Msg("Failed to save bridged reactions to database")
+		}
+	}
+	if limit > 0 {
+		br.ReactionAggregator.SyncCounts(roomID, targetID, counts)
+	}
+	return nil
+}
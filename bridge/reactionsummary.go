@@ -0,0 +1,232 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// DefaultReactionSummaryWindow is the default value for ReactionAggregator.Window.
+const DefaultReactionSummaryWindow = 5 * time.Second
+
+// maxReactionSummaryAttempts is how many times a summary update is tried before the queued changes are dropped.
+const maxReactionSummaryAttempts = 5
+
+// ReactionAggregatingPortal is an optional interface for portals that can be configured to summarize
+// remote reactions instead of bridging each one as an individual m.reaction event.
+type ReactionAggregatingPortal interface {
+	Portal
+	// ShouldAggregateReactions returns true if remote reactions should be passed to the ReactionAggregator.
+	ShouldAggregateReactions() bool
+}
+
+type reactionSummaryKey struct {
+	RoomID id.RoomID
+	Target id.EventID
+}
+
+type pendingReactionSummary struct {
+	counts   map[string]int
+	deltas   map[string]int
+	timer    *time.Timer
+	attempts int
+}
+
+// roomFlushLock serializes summary updates in a room. It's removed from the map when nobody is using it.
+type roomFlushLock struct {
+	sync.Mutex
+	users int
+}
+
+// ReactionAggregator batches remote reactions within a time window and stores them as
+// com.beeper.reaction_summary state events, which avoids flooding rooms in large channels with reaction events.
+type ReactionAggregator struct {
+	Window time.Duration
+
+	br         *Bridge
+	log        zerolog.Logger
+	pending    map[reactionSummaryKey]*pendingReactionSummary
+	flushLocks map[id.RoomID]*roomFlushLock
+	lock       sync.Mutex
+}
+
+func newReactionAggregator(br *Bridge) *ReactionAggregator {
+	return &ReactionAggregator{
+		Window: DefaultReactionSummaryWindow,
+
+		br:         br,
+		log:        br.ZLog.With().Str("component", "reaction aggregator").Logger(),
+		pending:    make(map[reactionSummaryKey]*pendingReactionSummary),
+		flushLocks: make(map[id.RoomID]*roomFlushLock),
+	}
+}
+
+// Queue adds (or removes, if added is false) a reaction with the given key to the summary of the target event.
+// The summary state event is updated once no new reactions to the target have been queued for the duration of Window.
+func (ra *ReactionAggregator) Queue(roomID id.RoomID, target id.EventID, key string, added bool) {
+	delta := 1
+	if !added {
+		delta = -1
+	}
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+	ra.getPending(roomID, target).deltas[key] += delta
+}
+
+// SyncCounts replaces the summary of the target event with the given reaction counts. It's meant for remote
+// networks that only provide aggregate reaction counts rather than individual reactions.
+//
+// Like Queue, the summary state event is only updated after the window has passed, and it's not updated at all
+// if the counts didn't change. The state event itself is the persistent storage for the counts.
+func (ra *ReactionAggregator) SyncCounts(roomID id.RoomID, target id.EventID, counts map[string]int) {
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+	pending := ra.getPending(roomID, target)
+	pending.counts = counts
+	pending.deltas = make(map[string]int)
+}
+
+func (ra *ReactionAggregator) getPending(roomID id.RoomID, target id.EventID) *pendingReactionSummary {
+	sk := reactionSummaryKey{RoomID: roomID, Target: target}
+	pending, ok := ra.pending[sk]
+	if !ok {
+		pending = &pendingReactionSummary{deltas: make(map[string]int)}
+		pending.timer = time.AfterFunc(ra.Window, func() {
+			ra.flush(sk)
+		})
+		ra.pending[sk] = pending
+	} else {
+		pending.timer.Reset(ra.Window)
+	}
+	return pending
+}
+
+func (ra *ReactionAggregator) lockRoomFlush(roomID id.RoomID) func() {
+	ra.lock.Lock()
+	fl, ok := ra.flushLocks[roomID]
+	if !ok {
+		fl = &roomFlushLock{}
+		ra.flushLocks[roomID] = fl
+	}
+	fl.users++
+	ra.lock.Unlock()
+	fl.Lock()
+	return func() {
+		fl.Unlock()
+		ra.lock.Lock()
+		fl.users--
+		if fl.users == 0 {
+			delete(ra.flushLocks, roomID)
+		}
+		ra.lock.Unlock()
+	}
+}
+
+// requeue puts the changes of a failed flush back into the queue, so that they're retried after the window.
+// Changes queued after the failed flush are applied on top of them.
+func (ra *ReactionAggregator) requeue(sk reactionSummaryKey, failed *pendingReactionSummary) bool {
+	if failed.attempts+1 >= maxReactionSummaryAttempts {
+		return false
+	}
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+	pending := ra.getPending(sk.RoomID, sk.Target)
+	pending.attempts = failed.attempts + 1
+	if pending.counts != nil {
+		// SyncCounts was called after the failed flush, so the failed changes are outdated anyway.
+		return true
+	}
+	pending.counts = failed.counts
+	for key, delta := range failed.deltas {
+		pending.deltas[key] += delta
+	}
+	return true
+}
+
+func (ra *ReactionAggregator) flush(sk reactionSummaryKey) {
+	// Flushes in the same room are serialized, so that a slow flush can't overwrite the result of a newer one.
+	unlock := ra.lockRoomFlush(sk.RoomID)
+	defer unlock()
+	ra.lock.Lock()
+	pending, ok := ra.pending[sk]
+	delete(ra.pending, sk)
+	ra.lock.Unlock()
+	if !ok {
+		return
+	}
+	log := ra.log.With().
+		Str("room_id", sk.RoomID.String()).
+		Str("target_event_id", sk.Target.String()).
+		Logger()
+	err := ra.sendSummary(log, sk, pending)
+	if err != nil {
+		if ra.requeue(sk, pending) {
+			log.Err(err).Int("attempts", pending.attempts+1).Msg("Failed to update reaction summary, retrying later")
+		} else {
+			log.Err(err).Msg("Failed to update reaction summary, dropping queued changes")
+		}
+	}
+}
+
+func (ra *ReactionAggregator) sendSummary(log zerolog.Logger, sk reactionSummaryKey, pending *pendingReactionSummary) error {
+	var summary event.ReactionSummaryEventContent
+	err := ra.br.Bot.StateEvent(sk.RoomID, event.StateBeeperReactionSummary, sk.Target.String(), &summary)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return fmt.Errorf("failed to get existing reaction summary: %w", err)
+	}
+	if summary.Reactions == nil {
+		summary.Reactions = make(map[string]int)
+	}
+	newCounts := make(map[string]int, len(summary.Reactions))
+	baseCounts := summary.Reactions
+	if pending.counts != nil {
+		baseCounts = pending.counts
+	}
+	for key, count := range baseCounts {
+		newCounts[key] = count
+	}
+	for key, delta := range pending.deltas {
+		newCounts[key] += delta
+	}
+	for key, count := range newCounts {
+		if count <= 0 {
+			delete(newCounts, key)
+		}
+	}
+	if reactionCountsEqual(summary.Reactions, newCounts) {
+		log.Debug().Msg("Reaction counts didn't change, not sending summary")
+		return nil
+	}
+	summary.Reactions = newCounts
+	_, err = ra.br.Bot.SendStateEvent(sk.RoomID, event.StateBeeperReactionSummary, sk.Target.String(), &summary)
+	if err != nil {
+		return fmt.Errorf("failed to send reaction summary: %w", err)
+	}
+	log.Debug().Int("reaction_keys", len(summary.Reactions)).Msg("Sent reaction summary")
+	return nil
+}
+
+func reactionCountsEqual(a, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, count := range a {
+		if b[key] != count {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type receiptKey struct {
+	RoomID   id.RoomID
+	UserID   id.UserID
+	ThreadID event.ThreadID
+}
+
+type pendingReceipt struct {
+	portal  ReadReceiptHandlingPortal
+	sender  User
+	eventID id.EventID
+	receipt event.ReadReceipt
+	timer   *time.Timer
+}
+
+// queueReadReceipt coalesces read receipts of a user in a portal, so that only the newest one is passed
+// to the portal once no new receipts have arrived in MatrixHandler.ReceiptDebounceDelay.
+func (mx *MatrixHandler) queueReadReceipt(portal ReadReceiptHandlingPortal, sender User, roomID id.RoomID, eventID id.EventID, receipt event.ReadReceipt) {
+	key := receiptKey{RoomID: roomID, UserID: sender.GetMXID(), ThreadID: receipt.ThreadID}
+	mx.pendingReceiptsLock.Lock()
+	defer mx.pendingReceiptsLock.Unlock()
+	pending, ok := mx.pendingReceipts[key]
+	if !ok {
+		pending = &pendingReceipt{portal: portal, sender: sender}
+		pending.timer = time.AfterFunc(mx.ReceiptDebounceDelay, func() {
+			mx.flushReadReceipt(key, pending)
+		})
+		mx.pendingReceipts[key] = pending
+	} else if receipt.Timestamp.Before(pending.receipt.Timestamp) {
+		// Receipts can arrive out of order, never move the position backwards.
+		return
+	} else {
+		pending.timer.Reset(mx.ReceiptDebounceDelay)
+	}
+	pending.eventID = eventID
+	pending.receipt = receipt
+}
+
+func (mx *MatrixHandler) flushReadReceipt(key receiptKey, pending *pendingReceipt) {
+	mx.pendingReceiptsLock.Lock()
+	if mx.pendingReceipts[key] != pending {
+		mx.pendingReceiptsLock.Unlock()
+		return
+	}
+	delete(mx.pendingReceipts, key)
+	mx.pendingReceiptsLock.Unlock()
+	pending.portal.HandleMatrixReadReceipt(pending.sender, pending.eventID, pending.receipt)
+}
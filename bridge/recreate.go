@@ -0,0 +1,129 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// RecreatablePortal is an optional interface for portals whose Matrix room can be recreated
+// if it's deleted or otherwise becomes unusable.
+type RecreatablePortal interface {
+	Portal
+	// RemoveMXID forgets the Matrix room of the portal without deleting the portal itself.
+	RemoveMXID()
+	// CreateMatrixRoom creates a new Matrix room for the portal and returns its ID. If backfill is true,
+	// recent history should be backfilled into the new room. The user is nil when the room is recreated
+	// automatically, in which case the portal should pick a logged-in user that has access to the chat.
+	CreateMatrixRoom(ctx context.Context, user User, backfill bool) (id.RoomID, error)
+}
+
+// IsRoomGoneError returns true if the error from a Matrix request means that the room may no longer be usable,
+// either because it doesn't exist anymore or because the user isn't allowed in it.
+func IsRoomGoneError(err error) bool {
+	return errors.Is(err, mautrix.MNotFound) || errors.Is(err, mautrix.MForbidden)
+}
+
+// HandlePortalSendError checks whether an error from sending an event to a portal room was caused by the room
+// having been deleted. If it was, the room ID is removed from the portal, and if enabled in the config,
+// a new room is created in the portal's event loop (see MatrixEventQueueingPortal). The return value is true
+// if the room was found to be gone.
+//
+// The room is only considered gone if the bridge bot gets M_NOT_FOUND for it. M_FORBIDDEN means that the room
+// still exists and the bot or ghost just isn't allowed in it, which must be fixed by an admin instead.
+//
+// Bridges should call this whenever sending to a portal room fails, so that broken portals don't fail silently.
+func (br *Bridge) HandlePortalSendError(ctx context.Context, portal Portal, roomID id.RoomID, sendErr error) bool {
+	if !IsRoomGoneError(sendErr) {
+		return false
+	}
+	recreatable, ok := portal.(RecreatablePortal)
+	if !ok {
+		return false
+	}
+	log := zerolog.Ctx(ctx).With().Str("room_id", roomID.String()).Logger()
+	// Double-check using the bridge bot, as the error may have been caused by e.g. the ghost lacking permissions.
+	var createContent event.CreateEventContent
+	err := br.Bot.StateEvent(roomID, event.StateCreate, "", &createContent)
+	if !errors.Is(err, mautrix.MNotFound) {
+		if err != nil {
+			log.Warn().Err(err).AnErr("send_error", sendErr).Msg("Portal room isn't accessible, but doesn't seem to be gone")
+		}
+		return false
+	}
+	if _, alreadyHandling := br.brokenPortalRooms.LoadOrStore(roomID, struct{}{}); alreadyHandling {
+		return true
+	}
+	log.Warn().Err(sendErr).Msg("Portal room seems to be gone, removing room ID from portal")
+	recreatable.RemoveMXID()
+	err = br.BridgeStore.ClearRemoteMembers(roomID)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to clear remote member list of old room")
+	}
+	rrc, ok := br.Config.Bridge.(bridgeconfig.RoomRecreationBridgeConfig)
+	if !ok || !rrc.GetRoomRecreationConfig().Auto {
+		br.brokenPortalRooms.Delete(roomID)
+		return true
+	}
+	backfill := rrc.GetRoomRecreationConfig().Backfill
+	queueInPortal(portal, func() {
+		// The old room stays marked as broken until the new one exists, so that other failed sends
+		// in the meantime don't trigger another recreation.
+		defer br.brokenPortalRooms.Delete(roomID)
+		newRoomID, err := recreatable.CreateMatrixRoom(log.WithContext(br.BackgroundCtx), nil, backfill)
+		if err != nil {
+			log.Err(err).Msg("Failed to recreate portal room")
+		} else {
+			log.Info().Str("new_room_id", newRoomID.String()).Msg("Recreated portal room")
+		}
+	})
+	return true
+}
+
+// RecreatePortalRoom replaces the Matrix room of a portal with a new one. The bridge bot posts a notice
+// pointing to the new room in the old room if possible, and makes the portal's ghosts leave it.
+func (br *Bridge) RecreatePortalRoom(ctx context.Context, portal RecreatablePortal, oldRoomID id.RoomID, user User, backfill bool) (id.RoomID, error) {
+	log := zerolog.Ctx(ctx).With().Str("old_room_id", oldRoomID.String()).Logger()
+	portal.RemoveMXID()
+	newRoomID, err := portal.CreateMatrixRoom(ctx, user, backfill)
+	if err != nil {
+		return "", fmt.Errorf("failed to create new room: %w", err)
+	}
+	_, err = br.Bot.SendMessageEvent(oldRoomID, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    fmt.Sprintf("This portal has been replaced with a new room: https://matrix.to/#/%s", newRoomID),
+	})
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to send notice about new room in old room")
+	}
+	for userID := range br.StateStore.GetRoomMembers(oldRoomID, event.MembershipJoin) {
+		if !br.Child.IsGhost(userID) {
+			continue
+		} else if ghost := br.Child.GetIGhost(userID); ghost != nil {
+			_, _ = ghost.DefaultIntent().LeaveRoom(oldRoomID)
+		}
+	}
+	_, err = br.Bot.LeaveRoom(oldRoomID)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to leave old room")
+	}
+	err = br.BridgeStore.ClearRemoteMembers(oldRoomID)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to clear remote member list of old room")
+	}
+	log.Info().Str("new_room_id", newRoomID.String()).Msg("Recreated portal room")
+	return newRoomID, nil
+}
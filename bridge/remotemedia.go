@@ -0,0 +1,88 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/id"
+)
+
+// MediaReuploader downloads media from the remote network and uploads it to Matrix.
+type MediaReuploader func(ctx context.Context) (id.ContentURIString, error)
+
+func (br *Bridge) canReferenceRemoteURL(remoteURL string) bool {
+	rmc, ok := br.Config.Bridge.(bridgeconfig.RemoteMediaBridgeConfig)
+	if !ok || br.remoteMediaUnsupported.Load() {
+		return false
+	}
+	cfg := rmc.GetRemoteMediaConfig()
+	if !cfg.ReferenceURLs {
+		return false
+	}
+	parsed, err := url.Parse(remoteURL)
+	if err != nil || parsed.Scheme != "https" {
+		return false
+	} else if len(cfg.AllowedHosts) == 0 {
+		return true
+	}
+	for _, host := range cfg.AllowedHosts {
+		if strings.EqualFold(parsed.Hostname(), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDirectMediaPreview checks that a URL preview describes the media file itself. For HTML pages,
+// og:image is just a thumbnail of the page, which must not be used in place of the real media.
+func isDirectMediaPreview(resp *mautrix.RespPreviewURL, mimeType string) bool {
+	if resp.ImageURL == "" || resp.Title != "" || resp.Description != "" {
+		return false
+	}
+	previewType, _, _ := strings.Cut(resp.ImageType, ";")
+	expectedType, _, _ := strings.Cut(mimeType, ";")
+	return strings.EqualFold(strings.TrimSpace(previewType), strings.TrimSpace(expectedType))
+}
+
+// ReferenceRemoteMedia gets a Matrix content URI for media that is available at a stable public URL
+// (e.g. GIFs from Giphy or Tenor) without downloading it through the bridge.
+//
+// If referencing remote URLs is enabled in the config, the homeserver is asked to fetch the URL through the
+// URL preview API. The result is only used if the homeserver fetched the media file itself with the expected
+// MIME type, which in practice means remoteURL must point directly at an image rather than a web page.
+// If that's disabled or fails, the provided reupload function is used instead. If the homeserver doesn't
+// support URL previews at all, referencing is disabled until the bridge is restarted.
+func (br *Bridge) ReferenceRemoteMedia(ctx context.Context, remoteURL, mimeType string, reupload MediaReuploader) (id.ContentURIString, error) {
+	if br.canReferenceRemoteURL(remoteURL) {
+		log := zerolog.Ctx(ctx).With().Str("remote_url", remoteURL).Logger()
+		resp, err := br.Bot.GetURLPreview(remoteURL)
+		if err != nil {
+			if errors.Is(err, mautrix.MUnrecognized) || errors.Is(err, mautrix.MForbidden) {
+				log.Warn().Err(err).Msg("Homeserver can't fetch remote URLs, disabling remote media references")
+				br.remoteMediaUnsupported.Store(true)
+			} else {
+				log.Debug().Err(err).Msg("Failed to reference remote media, falling back to reupload")
+			}
+		} else if isDirectMediaPreview(resp, mimeType) {
+			return resp.ImageURL, nil
+		} else {
+			log.Debug().
+				Str("preview_image_type", resp.ImageType).
+				Str("expected_type", mimeType).
+				Msg("Homeserver didn't return the media itself for remote URL, falling back to reupload")
+		}
+	}
+	return reupload(ctx)
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrDisconnectedQueueFull = errors.New("you're disconnected from the remote network and too many messages are already waiting")
+	ErrQueuedMessageExpired  = errors.New("you weren't reconnected to the remote network in time")
+)
+
+// ConnectionStateUser is an optional interface for users whose connection to the remote network can drop
+// temporarily. If queuing is enabled in the config, Matrix events from disconnected users are held until
+// the bridge calls FlushDisconnectedQueue after reconnecting.
+type ConnectionStateUser interface {
+	User
+	IsConnected() bool
+}
+
+type queuedMatrixEvent struct {
+	portal   Portal
+	evt      *event.Event
+	next     MatrixEventHandler
+	queuedAt time.Time
+}
+
+type disconnectedQueue struct {
+	events   []*queuedMatrixEvent
+	flushing bool
+}
+
+func (br *Bridge) getDisconnectedQueueConfig() (bridgeconfig.DisconnectedQueueConfig, bool) {
+	dqc, ok := br.Config.Bridge.(bridgeconfig.DisconnectedQueueBridgeConfig)
+	if !ok {
+		return bridgeconfig.DisconnectedQueueConfig{}, false
+	}
+	cfg := dqc.GetDisconnectedQueueConfig()
+	return cfg, cfg.Enabled
+}
+
+func (mx *MatrixHandler) disconnectedQueueMiddleware(next MatrixEventHandler) MatrixEventHandler {
+	return func(user User, portal Portal, evt *event.Event) {
+		csUser, ok := user.(ConnectionStateUser)
+		if !ok {
+			next(user, portal, evt)
+			return
+		}
+		cfg, enabled := mx.bridge.getDisconnectedQueueConfig()
+		if !enabled {
+			next(user, portal, evt)
+			return
+		}
+		mx.disconnectedQueuesLock.Lock()
+		queue, queueExists := mx.disconnectedQueues[user.GetMXID()]
+		// Events are also queued while an earlier queue is being flushed to keep them in order.
+		if !queueExists && (!user.IsLoggedIn() || csUser.IsConnected()) {
+			mx.disconnectedQueuesLock.Unlock()
+			next(user, portal, evt)
+			return
+		} else if !queueExists {
+			queue = &disconnectedQueue{}
+			mx.disconnectedQueues[user.GetMXID()] = queue
+		}
+		expired := mx.expireQueuedEvents(queue, cfg)
+		full := cfg.MaxCount > 0 && len(queue.events) >= cfg.MaxCount
+		if !full {
+			queue.events = append(queue.events, &queuedMatrixEvent{
+				portal:   portal,
+				evt:      evt,
+				next:     next,
+				queuedAt: time.Now(),
+			})
+		}
+		mx.disconnectedQueuesLock.Unlock()
+
+		ctx := EventContext(evt)
+		for _, queued := range expired {
+			go mx.sendMessageRejection(ctx, queued.evt, ErrQueuedMessageExpired, event.MessageStatusTooOld)
+		}
+		if full {
+			go mx.sendMessageRejection(ctx, evt, ErrDisconnectedQueueFull, event.MessageStatusNetworkError)
+		} else {
+			zerolog.Ctx(ctx).Debug().Msg("Queued event until the user is reconnected to the remote network")
+			go mx.sendPendingStatus(ctx, evt, "Will retry when reconnected to the remote network")
+		}
+	}
+}
+
+// expireQueuedEvents removes events that have been waiting longer than the configured maximum age.
+// It must be called while holding disconnectedQueuesLock.
+func (mx *MatrixHandler) expireQueuedEvents(queue *disconnectedQueue, cfg bridgeconfig.DisconnectedQueueConfig) []*queuedMatrixEvent {
+	if cfg.MaxAge <= 0 {
+		return nil
+	}
+	maxAge := time.Duration(cfg.MaxAge) * time.Second
+	i := 0
+	for ; i < len(queue.events) && time.Since(queue.events[i].queuedAt) > maxAge; i++ {
+	}
+	expired := queue.events[:i]
+	queue.events = queue.events[i:]
+	return expired
+}
+
+func (mx *MatrixHandler) sendPendingStatus(ctx context.Context, evt *event.Event, message string) {
+	if !mx.bridge.Config.Bridge.EnableMessageStatusEvents() {
+		return
+	}
+	statusEvent := &event.BeeperMessageStatusEventContent{
+		RelatesTo: event.RelatesTo{
+			Type:    event.RelReference,
+			EventID: evt.ID,
+		},
+		Status:  event.MessageStatusPending,
+		Reason:  event.MessageStatusNetworkError,
+		Message: message,
+	}
+	_, err := mx.bridge.Bot.SendMessageEvent(evt.RoomID, event.BeeperMessageStatus, statusEvent)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to send pending message status event")
+	}
+}
+
+// FlushDisconnectedQueue passes the Matrix events that were queued while the user was disconnected to portals
+// in the order they were received. Bridges should call this after the user reconnects to the remote network.
+//
+// Events that waited longer than the configured maximum age are rejected instead. New events from the user
+// are queued until the flush finishes, so they can't overtake older ones.
+func (br *Bridge) FlushDisconnectedQueue(user User) {
+	mx := br.MatrixHandler
+	mx.disconnectedQueuesLock.Lock()
+	queue, ok := mx.disconnectedQueues[user.GetMXID()]
+	if !ok || queue.flushing {
+		mx.disconnectedQueuesLock.Unlock()
+		return
+	}
+	queue.flushing = true
+	mx.disconnectedQueuesLock.Unlock()
+	go mx.flushDisconnectedQueue(user, queue)
+}
+
+func (mx *MatrixHandler) flushDisconnectedQueue(user User, queue *disconnectedQueue) {
+	cfg, _ := mx.bridge.getDisconnectedQueueConfig()
+	log := mx.log.With().Str("action", "flush disconnected queue").Str("user_id", user.GetMXID().String()).Logger()
+	flushed := 0
+	for {
+		mx.disconnectedQueuesLock.Lock()
+		expired := mx.expireQueuedEvents(queue, cfg)
+		if len(queue.events) == 0 && len(expired) == 0 {
+			delete(mx.disconnectedQueues, user.GetMXID())
+			mx.disconnectedQueuesLock.Unlock()
+			break
+		}
+		var queued *queuedMatrixEvent
+		if len(queue.events) > 0 {
+			queued = queue.events[0]
+			queue.events = queue.events[1:]
+		}
+		mx.disconnectedQueuesLock.Unlock()
+
+		for _, expiredEvt := range expired {
+			mx.sendMessageRejection(log.WithContext(mx.bridge.BackgroundCtx), expiredEvt.evt, ErrQueuedMessageExpired, event.MessageStatusTooOld)
+		}
+		if queued == nil {
+			continue
+		}
+		queued.next(user, queued.portal, queued.evt)
+		flushed++
+	}
+	log.Debug().Int("event_count", flushed).Msg("Finished flushing events queued while disconnected")
+}
+
+// DisconnectedQueueLength returns the number of Matrix events waiting for the user to reconnect.
+func (br *Bridge) DisconnectedQueueLength(userID id.UserID) int {
+	br.MatrixHandler.disconnectedQueuesLock.Lock()
+	defer br.MatrixHandler.disconnectedQueuesLock.Unlock()
+	if queue, ok := br.MatrixHandler.disconnectedQueues[userID]; ok {
+		return len(queue.events)
+	}
+	return 0
+}
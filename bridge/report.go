@@ -0,0 +1,35 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"fmt"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// ReportHandlingPortal is an optional interface for portals that can report messages as spam or abuse
+// to the remote network.
+//
+// Homeservers don't send event reports to appservices, so reports are made with the report command
+// by replying to the message.
+type ReportHandlingPortal interface {
+	Portal
+	// HandleMatrixReport reports the remote message corresponding to the given Matrix event.
+	HandleMatrixReport(ctx context.Context, sender User, eventID id.EventID, reason string) error
+}
+
+// SendRemoteReportAck sends a notice to the user's management room when the remote network confirms
+// that it has processed a report made with the report command. The management room is created if necessary.
+func (br *Bridge) SendRemoteReportAck(ctx context.Context, user User, roomID id.RoomID, eventID id.EventID, message string) error {
+	text := fmt.Sprintf("Your report of %s was processed by the remote network", roomID.EventURI(eventID).MatrixToURL())
+	if message != "" {
+		text = fmt.Sprintf("%s: %s", text, message)
+	}
+	return br.SendManagementNotice(ctx, user, text)
+}
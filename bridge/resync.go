@@ -0,0 +1,29 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+)
+
+// ResyncFlags specifies which parts of a portal should be resynced in addition to the basic chat info.
+type ResyncFlags struct {
+	Members     bool
+	Avatar      bool
+	PowerLevels bool
+}
+
+// ResyncFlagsFull resyncs everything.
+var ResyncFlagsFull = ResyncFlags{Members: true, Avatar: true, PowerLevels: true}
+
+// ResyncablePortal is an optional interface for portals whose info can be resynced from the remote network on demand.
+type ResyncablePortal interface {
+	Portal
+	// Resync fetches the chat info from the remote network and updates the Matrix room to match.
+	// It should return human-readable descriptions of what changed.
+	Resync(ctx context.Context, user User, flags ResyncFlags) (changes []string, err error)
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+)
+
+// GetRoomDefaults returns the initial settings for a new portal room of the given type, combining the config
+// with overrides provided by the bridge for the specific chat (which may be nil).
+func (br *Bridge) GetRoomDefaults(roomType bridgeconfig.RoomType, overrides *bridgeconfig.RoomDefaults) bridgeconfig.RoomDefaults {
+	var defaults bridgeconfig.RoomDefaults
+	if rdc, ok := br.Config.Bridge.(bridgeconfig.RoomDefaultsBridgeConfig); ok {
+		defaults = rdc.GetRoomDefaults()[roomType]
+	}
+	return defaults.Merge(overrides)
+}
+
+// ShouldEncryptRoom returns whether a new portal room with the given defaults should be encrypted.
+func (br *Bridge) ShouldEncryptRoom(defaults bridgeconfig.RoomDefaults) bool {
+	if br.Crypto == nil {
+		return false
+	} else if defaults.Encrypt != nil {
+		return *defaults.Encrypt
+	}
+	return br.Config.Bridge.GetEncryptionConfig().Default
+}
+
+// ShouldEncryptRoomType is like ShouldEncryptRoom, but if the room defaults don't specify whether to encrypt,
+// the encryption defaults config (if the bridge config implements EncryptionDefaultsBridgeConfig) is used
+// to decide based on the room type.
+func (br *Bridge) ShouldEncryptRoomType(roomType bridgeconfig.RoomType, defaults bridgeconfig.RoomDefaults) bool {
+	if br.Crypto == nil {
+		return false
+	} else if defaults.Encrypt != nil {
+		return *defaults.Encrypt
+	}
+	fallback := br.Config.Bridge.GetEncryptionConfig().Default
+	if edc, ok := br.Config.Bridge.(bridgeconfig.EncryptionDefaultsBridgeConfig); ok {
+		return edc.GetEncryptionDefaultsConfig().ShouldEncrypt(roomType, fallback)
+	}
+	return fallback
+}
+
+// ApplyRoomDefaults applies room defaults to a room creation request. The power levels are modified in place
+// and must be the levels the bridge is going to send in the request (either as initial state or override).
+func ApplyRoomDefaults(defaults bridgeconfig.RoomDefaults, req *mautrix.ReqCreateRoom, levels *event.PowerLevelsEventContent) {
+	if defaults.Preset != "" {
+		req.Preset = defaults.Preset
+	}
+	if levels != nil {
+		if defaults.EventsDefault != nil {
+			levels.EventsDefault = *defaults.EventsDefault
+		}
+		if defaults.Invite != nil {
+			levels.InvitePtr = defaults.Invite
+		}
+	}
+	if defaults.JoinRule != "" {
+		req.InitialState = append(req.InitialState, &event.Event{
+			Type:    event.StateJoinRules,
+			Content: event.Content{Parsed: &event.JoinRulesEventContent{JoinRule: defaults.JoinRule}},
+		})
+	}
+	if defaults.HistoryVisibility != "" {
+		req.InitialState = append(req.InitialState, &event.Event{
+			Type:    event.StateHistoryVisibility,
+			Content: event.Content{Parsed: &event.HistoryVisibilityEventContent{HistoryVisibility: defaults.HistoryVisibility}},
+		})
+	}
+	if defaults.GuestAccess != "" {
+		req.InitialState = append(req.InitialState, &event.Event{
+			Type:    event.StateGuestAccess,
+			Content: event.Content{Parsed: &event.GuestAccessEventContent{GuestAccess: defaults.GuestAccess}},
+		})
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// SecretChatKey identifies a secret chat portal. Unlike normal portals, secret chats are bound to the
+// device/session of a single login, so the key always includes the owner.
+type SecretChatKey struct {
+	ChatID string
+	Owner  id.UserID
+}
+
+func (sck SecretChatKey) String() string {
+	return fmt.Sprintf("%s:%s", sck.ChatID, sck.Owner)
+}
+
+// SecretChatState is the lifecycle state of a secret chat.
+type SecretChatState string
+
+const (
+	SecretChatActive  SecretChatState = "active"
+	SecretChatRekeyed SecretChatState = "rekeyed"
+	SecretChatExpired SecretChatState = "expired"
+)
+
+var (
+	ErrSecretChatNotOwner = errors.New("only the owner of a secret chat can send messages in it")
+	ErrSecretChatExpired  = errors.New("the secret chat has ended")
+)
+
+const secretChatIntroNotice = "This is a secret chat. It's end-to-end encrypted between the bridge and the other " +
+	"user's device, so it only exists on the account and device that the bridge is logged in as. " +
+	"Messages from other Matrix users in this room won't be bridged, and the chat can't be accessed from your other devices."
+
+// SecretChatPortal is an optional interface for portals that represent "secret chat" style sub-sessions,
+// such as Telegram secret chats, which require a distinct portal per login and device.
+type SecretChatPortal interface {
+	Portal
+	IsSecretChat() bool
+	GetSecretChatKey() SecretChatKey
+	GetSecretChatState() SecretChatState
+	// SetSecretChatState persists the lifecycle state of the secret chat.
+	SetSecretChatState(state SecretChatState) error
+}
+
+func (br *Bridge) sendSecretChatNotice(portal Portal, roomID id.RoomID, text string) error {
+	_, err := br.sendPortalEvent(portal, portal.MainIntent(), roomID, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    text,
+	})
+	return err
+}
+
+// SendSecretChatIntro sends a notice explaining the limitations of secret chats.
+// It should be called after the portal room is created.
+func (br *Bridge) SendSecretChatIntro(portal SecretChatPortal, roomID id.RoomID) error {
+	return br.sendSecretChatNotice(portal, roomID, secretChatIntroNotice)
+}
+
+// HandleSecretChatRekeyed should be called when the encryption keys of a secret chat are renegotiated.
+func (br *Bridge) HandleSecretChatRekeyed(ctx context.Context, portal SecretChatPortal, roomID id.RoomID) error {
+	zerolog.Ctx(ctx).Info().Str("secret_chat_key", portal.GetSecretChatKey().String()).Msg("Secret chat was re-keyed")
+	if err := portal.SetSecretChatState(SecretChatRekeyed); err != nil {
+		return err
+	}
+	return br.sendSecretChatNotice(portal, roomID, "The encryption keys of this secret chat were changed.")
+}
+
+// HandleSecretChatExpired should be called when a secret chat session ends, e.g. because the other user
+// deleted it or the bridge's device was logged out. Further Matrix messages in the room are rejected.
+func (br *Bridge) HandleSecretChatExpired(ctx context.Context, portal SecretChatPortal, roomID id.RoomID, reason string) error {
+	zerolog.Ctx(ctx).Info().
+		Str("secret_chat_key", portal.GetSecretChatKey().String()).
+		Str("reason", reason).
+		Msg("Secret chat expired")
+	if err := portal.SetSecretChatState(SecretChatExpired); err != nil {
+		return err
+	}
+	text := "This secret chat has ended, messages sent here won't be bridged anymore."
+	if reason != "" {
+		text = fmt.Sprintf("This secret chat has ended (%s), messages sent here won't be bridged anymore.", reason)
+	}
+	return br.sendSecretChatNotice(portal, roomID, text)
+}
+
+func checkSecretChat(user User, portal Portal) error {
+	scp, ok := portal.(SecretChatPortal)
+	if !ok || !scp.IsSecretChat() {
+		return nil
+	} else if scp.GetSecretChatState() == SecretChatExpired {
+		return ErrSecretChatExpired
+	} else if scp.GetSecretChatKey().Owner != user.GetMXID() {
+		return ErrSecretChatNotOwner
+	}
+	return nil
+}
+
+func (mx *MatrixHandler) secretChatMiddleware(next MatrixEventHandler) MatrixEventHandler {
+	return func(user User, portal Portal, evt *event.Event) {
+		if err := checkSecretChat(user, portal); err != nil {
+			log := mx.log.With().Str("event_id", evt.ID.String()).Logger()
+			log.Debug().Err(err).Msg("Rejecting event in secret chat")
+			go mx.sendMessageRejection(log.WithContext(EventContext(evt)), evt, err, event.MessageStatusNoPermission)
+			return
+		}
+		next(user, portal, evt)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// SlowModePortal is an optional interface for portals whose remote chat limits how often users can send messages.
+type SlowModePortal interface {
+	Portal
+	// GetSlowModeCooldown returns how long users have to wait between messages, or zero if slow mode is disabled.
+	GetSlowModeCooldown() time.Duration
+}
+
+type SlowModeError struct {
+	Remaining time.Duration
+}
+
+func (sme SlowModeError) Error() string {
+	return fmt.Sprintf("slow mode is enabled in this chat, you can send another message in %s", sme.Remaining.Round(time.Second))
+}
+
+// slowModePruneInterval is how often expired slow mode entries of all rooms are removed.
+const slowModePruneInterval = time.Minute
+
+// checkSlowMode returns a SlowModeError if the user has sent a message in the portal too recently.
+// Otherwise, the user's cooldown is started. Edits and non-message events don't count.
+func (mx *MatrixHandler) checkSlowMode(user User, portal Portal, evt *event.Event) error {
+	if evt.Type != event.EventMessage && evt.Type != event.EventSticker {
+		return nil
+	} else if content, ok := evt.Content.Parsed.(*event.MessageEventContent); ok && content.RelatesTo.GetReplaceID() != "" {
+		return nil
+	}
+	smPortal, ok := portal.(SlowModePortal)
+	if !ok {
+		return nil
+	}
+	cooldown := smPortal.GetSlowModeCooldown()
+	if cooldown <= 0 {
+		return nil
+	}
+	now := time.Now()
+	mx.slowModeLock.Lock()
+	defer mx.slowModeLock.Unlock()
+	mx.pruneSlowMode(now)
+	roomSends, ok := mx.slowModeUntil[evt.RoomID]
+	if !ok {
+		roomSends = make(map[id.UserID]time.Time)
+		mx.slowModeUntil[evt.RoomID] = roomSends
+	}
+	if until, ok := roomSends[user.GetMXID()]; ok && until.After(now) {
+		return SlowModeError{Remaining: until.Sub(now)}
+	}
+	roomSends[user.GetMXID()] = now.Add(cooldown)
+	return nil
+}
+
+func (mx *MatrixHandler) pruneSlowMode(now time.Time) {
+	if now.Sub(mx.slowModePruned) < slowModePruneInterval {
+		return
+	}
+	mx.slowModePruned = now
+	for roomID, roomSends := range mx.slowModeUntil {
+		for userID, until := range roomSends {
+			if !until.After(now) {
+				delete(roomSends, userID)
+			}
+		}
+		if len(roomSends) == 0 {
+			delete(mx.slowModeUntil, roomID)
+		}
+	}
+}
+
+// SendRoomFeatures updates the com.beeper.room_features state event in the given room,
+// which lets clients show restrictions like slow mode countdowns.
+func (br *Bridge) SendRoomFeatures(roomID id.RoomID, features *event.RoomFeaturesEventContent) error {
+	_, err := br.Bot.SendStateEvent(roomID, event.StateBeeperRoomFeatures, "", features)
+	return err
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// MaxPendingRelationAge is how old pending relations can get before the startup check considers them orphaned.
+const MaxPendingRelationAge = 7 * 24 * time.Hour
+
+// StateProblem is a broken invariant found by the startup check.
+type StateProblem struct {
+	// Kind is a short machine-readable identifier for the type of problem, e.g. portal_room_missing.
+	Kind        string
+	Description string
+	// Repair fixes the problem. It may be nil if the problem can only be reported.
+	Repair func(ctx context.Context) error
+}
+
+// StateCheckingBridge is an optional interface for bridges that validate their own database at startup,
+// e.g. to find user-portal rows pointing at deleted logins, ghosts without a profile or orphaned messages.
+type StateCheckingBridge interface {
+	ChildOverride
+	CheckState(ctx context.Context) []StateProblem
+}
+
+// RoomIDPortal is an optional interface for portals that expose their Matrix room ID,
+// which allows the startup check to detect portals whose room has been deleted.
+type RoomIDPortal interface {
+	Portal
+	GetMXID() id.RoomID
+}
+
+func (br *Bridge) runStartupCheck() {
+	scc, ok := br.Config.Bridge.(bridgeconfig.StartupCheckBridgeConfig)
+	if !ok {
+		return
+	}
+	cfg := scc.GetStartupCheckConfig()
+	if !cfg.Enabled {
+		return
+	}
+	log := br.ZLog.With().Str("component", "startup check").Logger()
+	ctx := log.WithContext(context.Background())
+	problems := br.checkBuiltinState(ctx)
+	if scb, ok := br.Child.(StateCheckingBridge); ok {
+		problems = append(problems, scb.CheckState(ctx)...)
+	}
+	repaired := 0
+	for _, problem := range problems {
+		evt := log.Warn().Str("problem_kind", problem.Kind)
+		if !cfg.Repair || problem.Repair == nil {
+			evt.Msg(problem.Description)
+			continue
+		}
+		err := problem.Repair(ctx)
+		if err != nil {
+			log.Err(err).Str("problem_kind", problem.Kind).Str("problem", problem.Description).Msg("Failed to repair problem")
+		} else {
+			evt.Msg(problem.Description + " (repaired)")
+			repaired++
+		}
+	}
+	log.Info().Int("problems", len(problems)).Int("repaired", repaired).Msg("Startup check finished")
+}
+
+func (br *Bridge) checkBuiltinState(ctx context.Context) []StateProblem {
+	var problems []StateProblem
+	for _, portal := range br.Child.GetAllIPortals() {
+		ridPortal, ok := portal.(RoomIDPortal)
+		if !ok {
+			continue
+		}
+		roomID := ridPortal.GetMXID()
+		if roomID == "" {
+			continue
+		}
+		var createContent event.CreateEventContent
+		err := br.Bot.StateEvent(roomID, event.StateCreate, "", &createContent)
+		if !IsRoomGoneError(err) {
+			continue
+		}
+		problem := StateProblem{
+			Kind:        "portal_room_missing",
+			Description: fmt.Sprintf("Portal room %s doesn't exist or the bridge bot isn't in it", roomID),
+		}
+		if recreatable, ok := portal.(RecreatablePortal); ok {
+			problem.Repair = func(ctx context.Context) error {
+				recreatable.RemoveMXID()
+				return nil
+			}
+		}
+		problems = append(problems, problem)
+	}
+	cutoff := time.Now().Add(-MaxPendingRelationAge)
+	count, err := br.BridgeStore.CountOldPendingRelations(cutoff)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to count old pending relations")
+	} else if count > 0 {
+		problems = append(problems, StateProblem{
+			Kind:        "orphaned_pending_relations",
+			Description: fmt.Sprintf("%d pending relations are older than %s and are likely orphaned", count, MaxPendingRelationAge),
+			Repair: func(ctx context.Context) error {
+				_, err := br.BridgeStore.DeleteOldPendingRelations(cutoff)
+				return err
+			},
+		})
+	}
+	return problems
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// SystemMessageKey is the key in the content of bridged system messages that contains the SystemMessageType.
+const SystemMessageKey = "fi.mau.system_message"
+
+// SystemMessageType classifies service messages from the remote network, which don't have a sender of their own.
+type SystemMessageType string
+
+const (
+	SystemMessageJoinedViaLink       SystemMessageType = "joined_via_link"
+	SystemMessageChatCreated         SystemMessageType = "chat_created"
+	SystemMessageSecurityCodeChanged SystemMessageType = "security_code_changed"
+	SystemMessageMissedCall          SystemMessageType = "missed_call"
+	SystemMessageCall                SystemMessageType = "call"
+	SystemMessageOther               SystemMessageType = "other"
+)
+
+var systemMessageIcons = map[SystemMessageType]string{
+	SystemMessageJoinedViaLink:       "🔗",
+	SystemMessageChatCreated:         "✨",
+	SystemMessageSecurityCodeChanged: "🔒",
+	SystemMessageMissedCall:          "📵",
+	SystemMessageCall:                "📞",
+}
+
+// Icon returns the standard icon that is prepended to system messages of this type.
+func (smt SystemMessageType) Icon() string {
+	return systemMessageIcons[smt]
+}
+
+// SystemMessageFilteringPortal is an optional interface for portals that suppress some system messages
+// in addition to the ones suppressed in the bridge config.
+type SystemMessageFilteringPortal interface {
+	Portal
+	GetSuppressedSystemMessages() []SystemMessageType
+}
+
+func (br *Bridge) isSystemMessageSuppressed(portal Portal, msgType SystemMessageType) bool {
+	if smc, ok := br.Config.Bridge.(bridgeconfig.SystemMessageBridgeConfig); ok {
+		for _, suppressed := range smc.GetSystemMessageConfig().Suppress {
+			if SystemMessageType(suppressed) == msgType {
+				return true
+			}
+		}
+	}
+	if fp, ok := portal.(SystemMessageFilteringPortal); ok {
+		for _, suppressed := range fp.GetSuppressedSystemMessages() {
+			if suppressed == msgType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SendSystemMessage sends a remote system message to the portal room as a notice with the standard icon
+// of the message type. If the intent is nil, the portal's main intent is used. If a ghost intent is given,
+// the message is about that user and is sent as an emote instead.
+//
+// Suppressed system messages are not sent, in which case the returned response and error are both nil.
+func (br *Bridge) SendSystemMessage(ctx context.Context, portal Portal, intent *appservice.IntentAPI, roomID id.RoomID, msgType SystemMessageType, text string) (*mautrix.RespSendEvent, error) {
+	if br.isSystemMessageSuppressed(portal, msgType) {
+		zerolog.Ctx(ctx).Debug().Str("system_message_type", string(msgType)).Msg("Not sending suppressed system message")
+		return nil, nil
+	}
+	content := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    text,
+	}
+	if intent == nil {
+		intent = portal.MainIntent()
+	} else if br.Child.IsGhost(intent.UserID) {
+		content.MsgType = event.MsgEmote
+	}
+	if icon := msgType.Icon(); icon != "" {
+		content.Body = icon + " " + content.Body
+	}
+	wrapped := &event.Content{
+		Parsed: content,
+		Raw: map[string]interface{}{
+			SystemMessageKey: msgType,
+		},
+	}
+	return br.sendPortalEvent(portal, intent, roomID, event.EventMessage, wrapped)
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// CreatedThread contains info about a thread that was created on the remote network for a Matrix message.
+type CreatedThread struct {
+	// RemoteID is the ID of the thread on the remote network.
+	RemoteID string
+	// Title is the name of the thread. If set, the bridge will post it inside the new thread.
+	Title string
+}
+
+// ThreadFirstPortal is an optional interface for portals on networks where every message must be in a thread.
+//
+// Matrix messages that aren't in a thread are passed to HandleMatrixNewThread instead of ReceiveMatrixEvent.
+// If the portal creates a new thread for the message, the Matrix event becomes the root of the thread,
+// and SetThreadRoot is called so that further messages in the remote thread can be grouped under it.
+type ThreadFirstPortal interface {
+	Portal
+	// HandleMatrixNewThread sends a non-threaded Matrix message to the remote network. It should return nil
+	// if the message was sent into an existing thread.
+	HandleMatrixNewThread(sender User, evt *event.Event) (*CreatedThread, error)
+	// SetThreadRoot stores the Matrix event ID to use as the root of the given remote thread.
+	SetThreadRoot(remoteThreadID string, rootEventID id.EventID) error
+}
+
+func isThreadless(evt *event.Event) bool {
+	if evt.Type != event.EventMessage && evt.Type != event.EventSticker {
+		return false
+	}
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	return ok && content.NewContent == nil && content.RelatesTo.GetThreadParent() == ""
+}
+
+func (mx *MatrixHandler) handleNewThread(ctx context.Context, user User, portal ThreadFirstPortal, evt *event.Event) {
+	log := zerolog.Ctx(ctx)
+	thread, err := portal.HandleMatrixNewThread(user, evt)
+	if err != nil {
+		log.Err(err).Msg("Failed to send message in new thread")
+		mx.sendMessageRejection(ctx, evt, err, event.MessageStatusGenericError)
+		return
+	} else if thread == nil {
+		return
+	}
+	err = portal.SetThreadRoot(thread.RemoteID, evt.ID)
+	if err != nil {
+		log.Err(err).Str("remote_thread_id", thread.RemoteID).Msg("Failed to save thread root")
+	}
+	if thread.Title != "" {
+		content := &event.MessageEventContent{
+			MsgType:   event.MsgNotice,
+			Body:      fmt.Sprintf("Created thread %s", thread.Title),
+			RelatesTo: (&event.RelatesTo{}).SetThread(evt.ID, evt.ID),
+		}
+		_, err = mx.bridge.sendPortalEvent(portal, portal.MainIntent(), evt.RoomID, event.EventMessage, content)
+		if err != nil {
+			log.Err(err).Msg("Failed to send thread title notice")
+		}
+	}
+}
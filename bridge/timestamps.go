@@ -0,0 +1,57 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/id"
+)
+
+// GuardTimestamp validates the timestamp of a live remote event before it's used for timestamp massaging.
+// Remote clocks can be wrong, which would cause events to show up out of order in the Matrix timeline.
+//
+// Future timestamps beyond the allowed skew are replaced with the current time, as are timestamps that are
+// backdated more than allowed. If monotonicity is enabled, timestamps are also never allowed to go backwards
+// within a room. Events sent with batch sending during backfill shouldn't be passed through this.
+func (br *Bridge) GuardTimestamp(ctx context.Context, roomID id.RoomID, ts time.Time) time.Time {
+	tc, ok := br.Config.Bridge.(bridgeconfig.TimestampBridgeConfig)
+	if !ok {
+		return ts
+	}
+	cfg := tc.GetTimestampConfig()
+	log := zerolog.Ctx(ctx)
+	now := time.Now()
+	origTS := ts
+	if ts.After(now.Add(time.Duration(cfg.MaxFutureSkew) * time.Second)) {
+		ts = now
+	} else if cfg.MaxBackdate > 0 && ts.Before(now.Add(-time.Duration(cfg.MaxBackdate)*time.Second)) {
+		ts = now
+	}
+	if cfg.Monotonic {
+		br.lastTimestampsLock.Lock()
+		if br.lastTimestamps == nil {
+			br.lastTimestamps = make(map[id.RoomID]time.Time)
+		}
+		if last, ok := br.lastTimestamps[roomID]; ok && ts.Before(last) {
+			ts = last
+		}
+		br.lastTimestamps[roomID] = ts
+		br.lastTimestampsLock.Unlock()
+	}
+	if !ts.Equal(origTS) {
+		log.Debug().
+			Time("original_ts", origTS).
+			Time("new_ts", ts).
+			Msg("Adjusted remote event timestamp")
+	}
+	return ts
+}
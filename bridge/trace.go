@@ -0,0 +1,46 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// TracedReaction is a reaction to a traced message.
+type TracedReaction struct {
+	Sender string
+	Key    string
+	MXID   id.EventID
+}
+
+// MessageTrace contains everything the bridge knows about a single part of a bridged message.
+type MessageTrace struct {
+	RoomID    id.RoomID
+	MXID      id.EventID
+	RemoteID  string
+	PartID    string
+	Sender    string
+	Timestamp time.Time
+	EditCount int
+	Reactions []TracedReaction
+
+	// MatrixStatus is the last known status of the Matrix->remote direction, if the message was sent from Matrix.
+	MatrixStatus string
+	// RemoteStatus is the last known status of the remote->Matrix direction, if the message was sent from the remote network.
+	RemoteStatus string
+}
+
+// MessageTracingBridge is an optional interface for bridges that can look up the database rows of a message
+// for debugging purposes.
+type MessageTracingBridge interface {
+	ChildOverride
+	// TraceMessage finds all message parts whose Matrix event ID or remote message ID matches the given query.
+	TraceMessage(ctx context.Context, query string) ([]*MessageTrace, error)
+}
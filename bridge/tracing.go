@@ -0,0 +1,101 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/event"
+)
+
+// TracerName is the name of the OpenTelemetry tracer used for spans created by the bridge module.
+//
+// Spans are sent to the global tracer provider, so bridges can export them (e.g. via OTLP)
+// by calling otel.SetTracerProvider with a configured provider at startup.
+const TracerName = "maunium.net/go/mautrix/bridge"
+
+// StartSpan starts a tracing span with the bridge module's tracer.
+// Bridges can use this to add their own spans to the bridging path, e.g. when handling a message in a portal.
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(TracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// detachedContext keeps the values of the parent context, but not its deadline or cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// EventContext returns the context of the given Matrix event. It starts from the appservice transaction the event
+// was received in and carries the logger and tracing span of the event.
+//
+// The context never has a deadline and is never canceled, so portals can use it as the parent context even if
+// they handle the event in their own event loop after dispatching has finished. The handler deadline is applied
+// by RunMatrixEventHandler.
+func EventContext(evt *event.Event) context.Context {
+	switch ctx := evt.Mautrix.Context.(type) {
+	case nil:
+		return context.Background()
+	case detachedContext:
+		return ctx
+	default:
+		return detachedContext{ctx}
+	}
+}
+
+// addTraceID adds the ID of the trace in the context to the log context, so that log lines can be matched with traces.
+func addTraceID(ctx context.Context, with zerolog.Context) zerolog.Context {
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		return with.Str("trace_id", sc.TraceID().String())
+	}
+	return with
+}
+
+func (mx *MatrixHandler) startEventSpan(evt *event.Event, name string) trace.Span {
+	parent := EventContext(evt)
+	opts := []trace.SpanStartOption{
+		trace.WithAttributes(
+			attribute.String("matrix.event_id", evt.ID.String()),
+			attribute.String("matrix.room_id", evt.RoomID.String()),
+			attribute.String("matrix.event_type", evt.Type.Type),
+		),
+	}
+	// The first span of an event starts when the appservice received it, so that time spent
+	// in the event processor queue is included.
+	if !trace.SpanFromContext(parent).SpanContext().IsValid() && !evt.Mautrix.ReceivedAt.IsZero() {
+		opts = append(opts, trace.WithTimestamp(evt.Mautrix.ReceivedAt))
+	}
+	ctx, span := otel.Tracer(TracerName).Start(parent, name, opts...)
+	evt.Mautrix.Context = ctx
+	return span
+}
+
+func traceCheckpoint(evt *event.Event, step status.MessageCheckpointStep, s status.MessageCheckpointStatus, err error) {
+	if evt.Mautrix.Context == nil {
+		return
+	}
+	_, span := StartSpan(evt.Mautrix.Context, "bridge.message_checkpoint",
+		attribute.String("checkpoint.step", string(step)),
+		attribute.String("checkpoint.status", string(s)),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"html"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Translator is a pluggable translation backend.
+type Translator interface {
+	// Translate translates the given text to the target language. It should return the detected source language
+	// (or an empty string if unknown). If the text is already in the target language, the translation
+	// should be returned as an empty string.
+	Translate(ctx context.Context, text, targetLanguage string) (translation, sourceLanguage string, err error)
+}
+
+// TranslatingPortal is an optional interface for portals where translation of incoming messages can be toggled.
+type TranslatingPortal interface {
+	Portal
+	// GetTranslationLanguage returns the language that incoming messages should be translated to,
+	// or an empty string if translation is disabled.
+	GetTranslationLanguage() string
+	SetTranslationLanguage(lang string) error
+}
+
+// TranslationLanguageUser is an optional interface for users who have a preferred language,
+// which is used by default when enabling translation in a portal.
+type TranslationLanguageUser interface {
+	User
+	GetPreferredLanguage() string
+}
+
+func (br *Bridge) getTranslationMode() bridgeconfig.TranslationMode {
+	if tbc, ok := br.Config.Bridge.(bridgeconfig.TranslationBridgeConfig); ok {
+		if mode := tbc.GetTranslationConfig().Mode; mode != "" {
+			return mode
+		}
+	}
+	return bridgeconfig.TranslationModeAppend
+}
+
+func (br *Bridge) translate(ctx context.Context, portal Portal, content *event.MessageEventContent) (translation, sourceLang string, ok bool) {
+	tp, isTranslating := portal.(TranslatingPortal)
+	if br.Translator == nil || !isTranslating || (content.MsgType != event.MsgText && content.MsgType != event.MsgNotice && content.MsgType != event.MsgEmote) {
+		return
+	}
+	targetLang := tp.GetTranslationLanguage()
+	if targetLang == "" {
+		return
+	}
+	translation, sourceLang, err := br.Translator.Translate(ctx, content.Body, targetLang)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("target_language", targetLang).Msg("Failed to translate message")
+		return
+	}
+	return translation, sourceLang, translation != ""
+}
+
+func appendTranslation(content *event.MessageEventContent, translation, sourceLang string) {
+	label := "Translated"
+	if sourceLang != "" {
+		label = fmt.Sprintf("Translated from %s", sourceLang)
+	}
+	content.EnsureHasHTML()
+	content.Body = fmt.Sprintf("%s\n\n%s: %s", content.Body, label, translation)
+	content.FormattedBody = fmt.Sprintf(
+		"%s<blockquote data-mautrix-translation><em>%s:</em> %s</blockquote>",
+		content.FormattedBody, html.EscapeString(label), event.TextToHTML(translation),
+	)
+}
+
+// TranslateRemoteMessage appends a translation to a remote message that is about to be sent to Matrix,
+// if translation is enabled in the portal and the translation mode is "append".
+//
+// Bridges using translation should call this before sending each converted text message, and call
+// SendTranslationEdit after sending it. Only one of the two will do anything depending on the configured mode.
+func (br *Bridge) TranslateRemoteMessage(ctx context.Context, portal Portal, content *event.MessageEventContent) {
+	if br.getTranslationMode() != bridgeconfig.TranslationModeAppend {
+		return
+	}
+	translation, sourceLang, ok := br.translate(ctx, portal, content)
+	if ok {
+		appendTranslation(content, translation, sourceLang)
+	}
+}
+
+// SendTranslationEdit edits a bridged remote message to add a translation, if translation is enabled in the portal
+// and the translation mode is "edit". The content must be the original content that was sent as eventID.
+// The translation is done synchronously, so this should be called in a goroutine if that would block the portal.
+func (br *Bridge) SendTranslationEdit(ctx context.Context, portal Portal, intent *appservice.IntentAPI, roomID id.RoomID, eventID id.EventID, content *event.MessageEventContent) {
+	if br.getTranslationMode() != bridgeconfig.TranslationModeEdit {
+		return
+	}
+	translation, sourceLang, ok := br.translate(ctx, portal, content)
+	if !ok {
+		return
+	}
+	edit := &event.MessageEventContent{
+		MsgType:       content.MsgType,
+		Body:          content.Body,
+		Format:        content.Format,
+		FormattedBody: content.FormattedBody,
+	}
+	appendTranslation(edit, translation, sourceLang)
+	edit.SetEdit(eventID)
+	_, err := br.sendPortalEvent(portal, intent, roomID, event.EventMessage, edit)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("event_id", eventID.String()).Msg("Failed to send translation edit")
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var ErrRoomAlreadyBridged = errors.New("room is already a portal")
+
+// UnbridgeablePortal is an optional interface for portals that can be detached from their Matrix room
+// without deleting the room.
+type UnbridgeablePortal interface {
+	Portal
+	// Unbridge deletes the database rows of the portal, but must not touch the Matrix room.
+	Unbridge(ctx context.Context) error
+}
+
+// UnbridgeRoom detaches a portal from its Matrix room. The portal's database rows are deleted, all ghosts and
+// the bridge bot leave the room, and bridge info and bridge-managed widgets are removed, but the room itself
+// and its history are left intact.
+func (br *Bridge) UnbridgeRoom(ctx context.Context, portal UnbridgeablePortal, roomID id.RoomID) error {
+	log := zerolog.Ctx(ctx).With().Str("room_id", roomID.String()).Logger()
+	err := portal.Unbridge(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to delete portal: %w", err)
+	}
+	err = br.RemovePortalWidgets(ctx, portal, roomID)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to remove portal widgets")
+	}
+	state, err := br.Bot.State(roomID)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get room state to remove bridge info")
+	} else {
+		for _, evtType := range []event.Type{event.StateBridge, event.StateHalfShotBridge} {
+			for stateKey, evt := range state[evtType] {
+				if len(evt.Content.Raw) == 0 {
+					continue
+				}
+				_, err = br.Bot.SendStateEvent(roomID, evtType, stateKey, struct{}{})
+				if err != nil {
+					log.Warn().Err(err).Str("event_type", evtType.Type).Msg("Failed to remove bridge info")
+				}
+			}
+		}
+	}
+	for userID := range br.StateStore.GetRoomMembers(roomID, event.MembershipJoin) {
+		if !br.Child.IsGhost(userID) {
+			continue
+		} else if ghost := br.Child.GetIGhost(userID); ghost != nil {
+			_, err = ghost.DefaultIntent().LeaveRoom(roomID)
+			if err != nil {
+				log.Debug().Err(err).Str("ghost_user_id", userID.String()).Msg("Failed to make ghost leave room")
+			}
+		}
+	}
+	err = br.BridgeStore.ClearRemoteMembers(roomID)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to clear remote member list of unbridged room")
+	}
+	_, err = br.Bot.LeaveRoom(roomID)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to leave unbridged room")
+	}
+	log.Info().Msg("Unbridged room")
+	return nil
+}
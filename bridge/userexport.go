@@ -0,0 +1,78 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/jsontime"
+)
+
+// UserDataExportVersion is the current version of the UserDataExport format.
+const UserDataExportVersion = 1
+
+var ErrUnsupportedExportVersion = errors.New("unsupported export version")
+
+// UserDataExport contains the data of a single bridge user in a portable format,
+// which can be imported on another bridge instance to move users between homeservers.
+type UserDataExport struct {
+	Version    int                `json:"version"`
+	Bridge     string             `json:"bridge"`
+	UserID     id.UserID          `json:"user_id"`
+	ExportedAt jsontime.UnixMilli `json:"exported_at"`
+
+	// Login contains network-specific login info. Secrets (like access tokens) are only included
+	// if they were explicitly requested when exporting.
+	Login          json.RawMessage `json:"login,omitempty"`
+	IncludeSecrets bool            `json:"include_secrets"`
+
+	Portals []*ExportedPortal `json:"portals"`
+}
+
+// ExportedPortal contains the data of a single portal in a UserDataExport.
+type ExportedPortal struct {
+	RemoteID    string                 `json:"remote_id"`
+	RoomID      id.RoomID              `json:"room_id,omitempty"`
+	Preferences map[string]interface{} `json:"preferences,omitempty"`
+
+	Messages []*ExportedMessage `json:"messages,omitempty"`
+}
+
+// ExportedMessage is a mapping between a remote message ID and a Matrix event ID.
+type ExportedMessage struct {
+	RemoteID string     `json:"remote_id"`
+	PartID   string     `json:"part_id,omitempty"`
+	EventID  id.EventID `json:"event_id"`
+}
+
+// DataExportingUser is an optional interface for users whose bridge data can be exported and
+// imported on another bridge instance.
+type DataExportingUser interface {
+	User
+	// ExportData collects the logins, portals, portal preferences and message ID mappings of the user.
+	ExportData(includeSecrets bool) (*UserDataExport, error)
+	// ImportData restores data exported from another bridge instance.
+	// Implementations should not overwrite an existing login.
+	ImportData(data *UserDataExport) error
+}
+
+// ParseUserDataExport parses and validates a UserDataExport.
+func ParseUserDataExport(data []byte, bridgeName string) (*UserDataExport, error) {
+	var export UserDataExport
+	err := json.Unmarshal(data, &export)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse export: %w", err)
+	} else if export.Version != UserDataExportVersion {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedExportVersion, export.Version)
+	} else if export.Bridge != bridgeName {
+		return nil, fmt.Errorf("export was made with %s, not %s", export.Bridge, bridgeName)
+	}
+	return &export, nil
+}
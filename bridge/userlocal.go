@@ -0,0 +1,137 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"errors"
+	"math"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+)
+
+const (
+	RoomTagFavourite   = "m.favourite"
+	RoomTagLowPriority = "m.lowpriority"
+)
+
+// NoTagOrder can be passed to SetPortalTag to add a tag without an order.
+var NoTagOrder = math.NaN()
+
+// ErrNoDoublePuppet is returned by methods that change user-local room settings
+// (like tags and push rules) when the user doesn't have double puppeting enabled.
+var ErrNoDoublePuppet = errors.New("double puppeting is not enabled")
+
+func getCustomClient(user User) (*mautrix.Client, error) {
+	puppet := user.GetIDoublePuppet()
+	if puppet == nil || puppet.CustomIntent() == nil {
+		return nil, ErrNoDoublePuppet
+	}
+	return puppet.CustomIntent().Client, nil
+}
+
+// SetPortalTag adds or removes a room tag (e.g. RoomTagFavourite) for the given user using their double puppet.
+// If order is NoTagOrder, the tag is added without an order.
+func (br *Bridge) SetPortalTag(user User, roomID id.RoomID, tag string, active bool, order float64) error {
+	client, err := getCustomClient(user)
+	if err != nil {
+		return err
+	}
+	if active {
+		return client.AddTag(roomID, tag, order)
+	}
+	return client.RemoveTag(roomID, tag)
+}
+
+// NotificationLevel is the notification setting of a single room.
+type NotificationLevel int
+
+const (
+	NotificationLevelAll NotificationLevel = iota
+	NotificationLevelMentionsOnly
+	NotificationLevelMuted
+)
+
+// SetPortalMuted mutes or unmutes the given room for the user through their double puppet.
+func (br *Bridge) SetPortalMuted(user User, roomID id.RoomID, muted bool) error {
+	level := NotificationLevelAll
+	if muted {
+		level = NotificationLevelMuted
+	}
+	return br.SetPortalNotificationLevel(user, roomID, level)
+}
+
+func deletePushRuleIfExists(client *mautrix.Client, kind pushrules.PushRuleType, ruleID string) error {
+	err := client.DeletePushRule("global", kind, ruleID)
+	if errors.Is(err, mautrix.MNotFound) {
+		err = nil
+	}
+	return err
+}
+
+// SetPortalNotificationLevel changes the notification level of the given room for the user through their
+// double puppet. The push rules are the same as what Element uses: mentions-only is a room rule that doesn't
+// notify (which mention override rules take precedence over), while muting is an override rule for the room.
+func (br *Bridge) SetPortalNotificationLevel(user User, roomID id.RoomID, level NotificationLevel) error {
+	client, err := getCustomClient(user)
+	if err != nil {
+		return err
+	}
+	ruleID := string(roomID)
+	if level != NotificationLevelMuted {
+		err = deletePushRuleIfExists(client, pushrules.OverrideRule, ruleID)
+	} else {
+		err = client.PutPushRule("global", pushrules.OverrideRule, ruleID, &mautrix.ReqPutPushRule{
+			Actions: []pushrules.PushActionType{pushrules.ActionDontNotify},
+			Conditions: []pushrules.PushCondition{{
+				Kind:    pushrules.KindEventMatch,
+				Key:     "room_id",
+				Pattern: ruleID,
+			}},
+		})
+	}
+	if err != nil {
+		return err
+	}
+	if level != NotificationLevelMentionsOnly {
+		return deletePushRuleIfExists(client, pushrules.RoomRule, ruleID)
+	}
+	return client.PutPushRule("global", pushrules.RoomRule, ruleID, &mautrix.ReqPutPushRule{
+		Actions: []pushrules.PushActionType{pushrules.ActionDontNotify},
+	})
+}
+
+// NotificationLevelFromPushRules finds the notification level of the given room in a push ruleset.
+func NotificationLevelFromPushRules(ruleset *pushrules.PushRuleset, roomID id.RoomID) NotificationLevel {
+	for _, rule := range ruleset.Override {
+		if rule.RuleID == string(roomID) && rule.Enabled && !rule.Actions.Should().Notify {
+			return NotificationLevelMuted
+		}
+	}
+	if rule, ok := ruleset.Room.Map[string(roomID)]; ok && rule.Enabled && !rule.Actions.Should().Notify {
+		return NotificationLevelMentionsOnly
+	}
+	return NotificationLevelAll
+}
+
+// NotificationLevelSyncingPortal is an optional interface for portals that can bridge notification
+// settings changed on Matrix to the remote network.
+type NotificationLevelSyncingPortal interface {
+	Portal
+	HandleMatrixNotificationLevel(user User, level NotificationLevel)
+}
+
+// HandleMatrixPushRules bridges the notification level of a room to the portal. Bridges that sync the account data
+// of double puppets should call this for rooms whose push rules changed.
+func (br *Bridge) HandleMatrixPushRules(user User, roomID id.RoomID, ruleset *pushrules.PushRuleset) {
+	portal, ok := br.Child.GetIPortal(roomID).(NotificationLevelSyncingPortal)
+	if !ok {
+		return
+	}
+	portal.HandleMatrixNotificationLevel(user, NotificationLevelFromPushRules(ruleset, roomID))
+}
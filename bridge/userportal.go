@@ -0,0 +1,136 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/bridge/bridgestore"
+	"maunium.net/go/mautrix/id"
+)
+
+// NotificationOverride is a per-user notification setting for a portal.
+type NotificationOverride string
+
+const (
+	NotificationsDefault  NotificationOverride = ""
+	NotificationsAll      NotificationOverride = "all"
+	NotificationsMentions NotificationOverride = "mentions"
+	NotificationsMuted    NotificationOverride = "muted"
+)
+
+// userPortalActivityInterval is the minimum time between saving the last activity time of a user in a portal,
+// so that busy rooms don't cause a database write for every message.
+const userPortalActivityInterval = 5 * time.Minute
+
+type userPortalKey struct {
+	UserID id.UserID
+	RoomID id.RoomID
+}
+
+type userPortalActivity struct {
+	lock  sync.Mutex
+	saved map[userPortalKey]time.Time
+}
+
+// GetUserPortal returns the preferences of a user in a portal.
+func (br *Bridge) GetUserPortal(userID id.UserID, roomID id.RoomID) (*bridgestore.UserPortal, error) {
+	return br.BridgeStore.GetUserPortal(userID, roomID)
+}
+
+func (br *Bridge) updateUserPortal(userID id.UserID, roomID id.RoomID, update func(up *bridgestore.UserPortal)) error {
+	up, err := br.BridgeStore.GetUserPortal(userID, roomID)
+	if err != nil {
+		return fmt.Errorf("failed to get user portal: %w", err)
+	}
+	update(up)
+	err = br.BridgeStore.PutUserPortal(up)
+	if err != nil {
+		return fmt.Errorf("failed to save user portal: %w", err)
+	}
+	return nil
+}
+
+// GetNotificationOverride returns the notification override of a user in a portal.
+func (br *Bridge) GetNotificationOverride(userID id.UserID, roomID id.RoomID) (NotificationOverride, error) {
+	up, err := br.BridgeStore.GetUserPortal(userID, roomID)
+	if err != nil {
+		return NotificationsDefault, err
+	}
+	return NotificationOverride(up.Notifications), nil
+}
+
+// SetNotificationOverride changes the notification override of a user in a portal.
+func (br *Bridge) SetNotificationOverride(userID id.UserID, roomID id.RoomID, override NotificationOverride) error {
+	return br.updateUserPortal(userID, roomID, func(up *bridgestore.UserPortal) {
+		up.Notifications = string(override)
+	})
+}
+
+// GetPreferredLogin returns the remote login a user prefers to use in a portal,
+// or an empty string if the user hasn't chosen one.
+func (br *Bridge) GetPreferredLogin(userID id.UserID, roomID id.RoomID) (string, error) {
+	up, err := br.BridgeStore.GetUserPortal(userID, roomID)
+	if err != nil {
+		return "", err
+	}
+	return up.LoginID, nil
+}
+
+// SetPreferredLogin changes the remote login a user prefers to use in a portal.
+// Bridges with multiple logins per user should use it when choosing which login sends a message.
+func (br *Bridge) SetPreferredLogin(userID id.UserID, roomID id.RoomID, loginID string) error {
+	return br.updateUserPortal(userID, roomID, func(up *bridgestore.UserPortal) {
+		up.LoginID = loginID
+	})
+}
+
+// IsRelayOptedOut checks if a user has opted out of having their messages sent through the relay bot in a portal.
+// Database errors are treated as opting out, so that messages are never relayed against the user's wishes.
+func (br *Bridge) IsRelayOptedOut(userID id.UserID, roomID id.RoomID) bool {
+	up, err := br.BridgeStore.GetUserPortal(userID, roomID)
+	if err != nil {
+		br.ZLog.Err(err).
+			Str("user_id", userID.String()).
+			Str("room_id", roomID.String()).
+			Msg("Failed to get user portal to check relay opt-out")
+		return true
+	}
+	return up.RelayOptOut
+}
+
+// SetRelayOptOut changes whether a user's messages can be sent through the relay bot in a portal.
+func (br *Bridge) SetRelayOptOut(userID id.UserID, roomID id.RoomID, optOut bool) error {
+	return br.updateUserPortal(userID, roomID, func(up *bridgestore.UserPortal) {
+		up.RelayOptOut = optOut
+	})
+}
+
+// markUserPortalActive is called for every Matrix event dispatched to a portal to keep track of when users
+// were last active in each portal.
+func (br *Bridge) markUserPortalActive(userID id.UserID, roomID id.RoomID) {
+	key := userPortalKey{UserID: userID, RoomID: roomID}
+	now := time.Now()
+	br.userPortalActivity.lock.Lock()
+	if now.Sub(br.userPortalActivity.saved[key]) < userPortalActivityInterval {
+		br.userPortalActivity.lock.Unlock()
+		return
+	}
+	br.userPortalActivity.saved[key] = now
+	br.userPortalActivity.lock.Unlock()
+	go func() {
+		err := br.BridgeStore.SetUserPortalLastActive(userID, roomID, now)
+		if err != nil {
+			br.ZLog.Err(err).
+				Str("user_id", userID.String()).
+				Str("room_id", roomID.String()).
+				Msg("Failed to save last activity time in portal")
+		}
+	}()
+}
@@ -0,0 +1,36 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// WarmUpEncryptedRoom prepares encryption for a newly created portal room by fetching the device lists of the
+// current members, claiming one-time keys and sharing the initial Megolm session. Without this, all of that would
+// happen when the first message is bridged, which makes that message noticeably slow.
+//
+// Bridges should call this in a goroutine right after creating an encrypted portal room. It does nothing if
+// encryption isn't enabled.
+func (br *Bridge) WarmUpEncryptedRoom(ctx context.Context, roomID id.RoomID) {
+	if br.Crypto == nil {
+		return
+	}
+	log := zerolog.Ctx(ctx).With().Str("room_id", roomID.String()).Logger()
+	start := time.Now()
+	err := br.Crypto.ShareSession(roomID)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to warm up encryption in new room")
+	} else {
+		log.Debug().Dur("duration", time.Since(start)).Msg("Warmed up encryption in new room")
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"runtime"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+)
+
+// maxWatchdogStackSize is the maximum size of the goroutine dump logged when a handler exceeds its deadline.
+const maxWatchdogStackSize = 256 * 1024
+
+func (br *Bridge) getHandlerTimeout(eventType string) (time.Duration, bool) {
+	htc, ok := br.Config.Bridge.(bridgeconfig.HandlerTimeoutBridgeConfig)
+	if !ok {
+		return 0, false
+	}
+	cfg := htc.GetHandlerTimeoutConfig()
+	timeout := cfg.Default
+	if override, ok := cfg.EventTypes[eventType]; ok {
+		timeout = override
+	}
+	return time.Duration(timeout) * time.Second, cfg.Skip
+}
+
+// withBackgroundCancel returns a copy of the context that is also canceled when the bridge is stopping.
+func (br *Bridge) withBackgroundCancel(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	go func() {
+		select {
+		case <-br.BackgroundCtx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// RunMatrixEventHandler runs the actual handling of a Matrix event in a portal. The handler deadline configured
+// for the event type is applied (see HandlerTimeoutConfig) and the timing stats of the event are recorded.
+// If the user is not nil, the handler holds one of the user's connector slots (see AcquireConnectorSlot).
+//
+// ReceiveMatrixEvent may only queue the event for the portal's own event loop, so portals should call this
+// wherever the event is actually handled, e.g. in the event loop. Waiting for a connector slot blocks the caller,
+// so this must not be called directly in ReceiveMatrixEvent with a user. The context passed to the handler is
+// derived from EventContext and is canceled when the deadline is reached or the handler returns, so it must
+// not be stored.
+func (br *Bridge) RunMatrixEventHandler(user User, portal Portal, evt *event.Event, handler func(ctx context.Context)) {
+	ctx, timing := startEventTiming(EventContext(evt))
+	log := zerolog.Ctx(ctx)
+	start := time.Now()
+	eventType := matrixEventTypeName(evt)
+	if user != nil {
+		waitCtx, cancel := br.withBackgroundCancel(ctx, 0)
+		release, err := br.AcquireConnectorSlot(waitCtx, user.GetMXID(), evt.RoomID)
+		cancel()
+		if err != nil {
+			br.MatrixHandler.sendMessageRejection(ctx, evt, err, event.MessageStatusGenericError)
+			return
+		}
+		defer release()
+	}
+	br.runWithWatchdog(ctx, log, eventType, handler)
+	br.finishEventTiming(log, portal, eventType, start, timing)
+}
+
+// runWithWatchdog runs an event handler with the deadline configured for the event type. The context passed
+// to the handler is canceled when the deadline is reached or when the bridge is stopping.
+//
+// Handlers that ignore the cancellation are logged along with a goroutine dump. If skipping is enabled in the
+// config, the portal moves on to the next event and the stuck handler is left running in the background.
+func (br *Bridge) runWithWatchdog(ctx context.Context, log *zerolog.Logger, eventType string, handler func(ctx context.Context)) {
+	timeout, skip := br.getHandlerTimeout(eventType)
+	ctx, cancel := br.withBackgroundCancel(ctx, timeout)
+	defer cancel()
+	if timeout <= 0 {
+		handler(ctx)
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler(ctx)
+	}()
+	start := time.Now()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+	stack := make([]byte, maxWatchdogStackSize)
+	stack = stack[:runtime.Stack(stack, true)]
+	log.Warn().
+		Str("event_type", eventType).
+		Dur("timeout", timeout).
+		Bool("skipping", skip).
+		Bytes("goroutines", stack).
+		Msg("Event handler exceeded its deadline")
+	if skip {
+		return
+	}
+	<-done
+	log.Warn().
+		Str("event_type", eventType).
+		Dur("duration", time.Since(start)).
+		Msg("Event handler that exceeded its deadline finished")
+}
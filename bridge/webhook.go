@@ -0,0 +1,196 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// webhookQueueSize is the number of events that are buffered for each webhook target.
+const webhookQueueSize = 1024
+
+// WebhookPayload is the normalized JSON body that is sent to webhooks for bridged events.
+type WebhookPayload struct {
+	Type      BusEventType `json:"type"`
+	Bridge    string       `json:"bridge"`
+	Timestamp int64        `json:"timestamp"`
+
+	RoomID     id.RoomID           `json:"room_id,omitempty"`
+	EventID    id.EventID          `json:"event_id,omitempty"`
+	RemoteID   string              `json:"remote_id,omitempty"`
+	Direction  string              `json:"direction,omitempty"`
+	UserID     id.UserID           `json:"user_id,omitempty"`
+	Membership event.Membership    `json:"membership,omitempty"`
+	State      *status.BridgeState `json:"state,omitempty"`
+	Count      int                 `json:"count,omitempty"`
+}
+
+type webhookDelivery struct {
+	body    []byte
+	evtType BusEventType
+}
+
+// webhookSink delivers events to a single webhook target. Each target has its own queue and worker,
+// so a slow or failing target can't delay or cause dropped events for the other targets.
+type webhookSink struct {
+	log        zerolog.Logger
+	client     *http.Client
+	target     bridgeconfig.WebhookTarget
+	maxRetries int
+	queue      chan *webhookDelivery
+}
+
+func (br *Bridge) initWebhooks() {
+	whc, ok := br.Config.Bridge.(bridgeconfig.WebhookBridgeConfig)
+	if !ok {
+		return
+	}
+	cfg := whc.GetWebhookConfig()
+	if len(cfg.Targets) == 0 {
+		return
+	}
+	log := br.ZLog.With().Str("component", "webhooks").Logger()
+	client := &http.Client{Timeout: 30 * time.Second}
+	sinks := make([]*webhookSink, len(cfg.Targets))
+	for i, target := range cfg.Targets {
+		sinks[i] = &webhookSink{
+			log:        log.With().Str("url", target.URL).Logger(),
+			client:     client,
+			target:     target,
+			maxRetries: cfg.MaxRetries,
+			queue:      make(chan *webhookDelivery, webhookQueueSize),
+		}
+		go sinks[i].loop()
+	}
+	handler := func(ctx context.Context, evt BusEvent) {
+		payload := br.makeWebhookPayload(evt)
+		body, err := json.Marshal(payload)
+		if err != nil {
+			log.Err(err).Str("bus_event_type", string(payload.Type)).Msg("Failed to marshal webhook payload")
+			return
+		}
+		for _, sink := range sinks {
+			if !webhookWantsEvent(sink.target, payload.Type) {
+				continue
+			}
+			select {
+			case sink.queue <- &webhookDelivery{body: body, evtType: payload.Type}:
+			default:
+				sink.log.Warn().Str("bus_event_type", string(payload.Type)).Msg("Webhook queue is full, dropping event")
+			}
+		}
+	}
+	for _, evtType := range []BusEventType{
+		BusEventPortalCreated, BusEventMessageBridged, BusEventLoginStateChanged,
+		BusEventBackfillFinished, BusEventMembershipChanged,
+	} {
+		br.EventBus.Subscribe(evtType, handler)
+	}
+}
+
+func webhookWantsEvent(target bridgeconfig.WebhookTarget, evtType BusEventType) bool {
+	if len(target.Events) == 0 {
+		return true
+	}
+	for _, wanted := range target.Events {
+		if BusEventType(wanted) == evtType {
+			return true
+		}
+	}
+	return false
+}
+
+func (br *Bridge) makeWebhookPayload(evt BusEvent) *WebhookPayload {
+	payload := &WebhookPayload{
+		Type:      evt.GetBusEventType(),
+		Bridge:    br.Name,
+		Timestamp: time.Now().UnixMilli(),
+	}
+	switch typedEvt := evt.(type) {
+	case *PortalCreatedEvent:
+		payload.RoomID = typedEvt.RoomID
+	case *MessageBridgedEvent:
+		payload.RoomID = typedEvt.RoomID
+		payload.EventID = typedEvt.EventID
+		payload.RemoteID = typedEvt.RemoteID
+		payload.Direction = "received"
+		if typedEvt.FromMatrix {
+			payload.Direction = "sent"
+		}
+	case *LoginStateChangedEvent:
+		payload.State = &typedEvt.State
+	case *BackfillFinishedEvent:
+		payload.RoomID = typedEvt.RoomID
+		payload.Count = typedEvt.MessageCount
+	case *MembershipChangedEvent:
+		payload.RoomID = typedEvt.RoomID
+		payload.UserID = typedEvt.UserID
+		payload.Membership = typedEvt.Membership
+	}
+	return payload
+}
+
+func (sink *webhookSink) loop() {
+	for delivery := range sink.queue {
+		sink.deliver(delivery)
+	}
+}
+
+func (sink *webhookSink) deliver(delivery *webhookDelivery) {
+	log := sink.log.With().Str("bus_event_type", string(delivery.evtType)).Logger()
+	backoff := 1 * time.Second
+	for attempt := 0; ; attempt++ {
+		err := sink.send(delivery)
+		if err == nil {
+			return
+		} else if attempt >= sink.maxRetries {
+			log.Err(err).Int("attempts", attempt+1).Msg("Failed to deliver webhook, giving up")
+			return
+		}
+		log.Warn().Err(err).Dur("retry_in", backoff).Msg("Failed to deliver webhook, retrying")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (sink *webhookSink) send(delivery *webhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, sink.target.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return fmt.Errorf("failed to prepare request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Mautrix-Event", string(delivery.evtType))
+	if sink.target.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(sink.target.Secret))
+		mac.Write(delivery.body)
+		req.Header.Set("X-Mautrix-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := sink.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
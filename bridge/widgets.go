@@ -0,0 +1,144 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// PortalWidget is a network-native feature of a remote chat, like a poll dashboard, an about page
+// or a payment request, that is published as a widget in the portal room.
+type PortalWidget struct {
+	// ID identifies the widget within the portal. It must be stable for the widget to be updated instead of recreated.
+	ID   string
+	Type string
+	Name string
+	URL  string
+	Data map[string]interface{}
+}
+
+// WidgetPublishingPortal is an optional interface for portals that publish network-native features as widgets.
+//
+// The bridge only manages widgets it created itself, i.e. ones whose state key starts with the bridge name.
+// Widgets added by users are never touched.
+type WidgetPublishingPortal interface {
+	Portal
+	GetPortalWidgets(ctx context.Context) ([]PortalWidget, error)
+}
+
+// WidgetLifecyclePortal is an optional extension of WidgetPublishingPortal for portals that want to know
+// when their widgets are added to or removed from the room, e.g. to start or stop serving them.
+type WidgetLifecyclePortal interface {
+	WidgetPublishingPortal
+	OnWidgetAdded(ctx context.Context, widget PortalWidget)
+	OnWidgetRemoved(ctx context.Context, widgetID string)
+}
+
+func (br *Bridge) widgetStateKeyPrefix() string {
+	return br.Name + "_"
+}
+
+func (br *Bridge) getManagedWidgets(roomID id.RoomID) (map[string]*event.WidgetEventContent, error) {
+	state, err := br.Bot.State(roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get room state: %w", err)
+	}
+	prefix := br.widgetStateKeyPrefix()
+	widgets := make(map[string]*event.WidgetEventContent)
+	for stateKey, evt := range state[event.StateWidget] {
+		if !strings.HasPrefix(stateKey, prefix) {
+			continue
+		}
+		content := evt.Content.AsWidget()
+		if content.URL != "" {
+			widgets[strings.TrimPrefix(stateKey, prefix)] = content
+		}
+	}
+	return widgets, nil
+}
+
+// SyncPortalWidgets makes the bridge-managed widgets in the portal room match the portal's current widgets.
+// New and changed widgets are sent as state events, while widgets the portal doesn't have anymore are removed.
+func (br *Bridge) SyncPortalWidgets(ctx context.Context, portal WidgetPublishingPortal, roomID id.RoomID) error {
+	log := zerolog.Ctx(ctx).With().Str("action", "sync portal widgets").Logger()
+	wanted, err := portal.GetPortalWidgets(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get portal widgets: %w", err)
+	}
+	existing, err := br.getManagedWidgets(roomID)
+	if err != nil {
+		return err
+	}
+	lifecycle, _ := portal.(WidgetLifecyclePortal)
+	for _, widget := range wanted {
+		content := &event.WidgetEventContent{
+			ID:            br.widgetStateKeyPrefix() + widget.ID,
+			Type:          widget.Type,
+			URL:           widget.URL,
+			Name:          widget.Name,
+			Data:          widget.Data,
+			CreatorUserID: br.Bot.UserID,
+		}
+		old, alreadyExists := existing[widget.ID]
+		delete(existing, widget.ID)
+		if alreadyExists && reflect.DeepEqual(old, content) {
+			continue
+		}
+		_, err = br.Bot.SendStateEvent(roomID, event.StateWidget, content.ID, content)
+		if err != nil {
+			return fmt.Errorf("failed to send widget %s: %w", widget.ID, err)
+		}
+		log.Debug().Str("widget_id", widget.ID).Bool("updated", alreadyExists).Msg("Sent portal widget")
+		if lifecycle != nil && !alreadyExists {
+			lifecycle.OnWidgetAdded(ctx, widget)
+		}
+	}
+	for widgetID := range existing {
+		err = br.removeWidget(ctx, lifecycle, roomID, widgetID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemovePortalWidgets removes all bridge-managed widgets from the portal room.
+// Bridges should call this before deleting a portal if they don't delete the room itself.
+func (br *Bridge) RemovePortalWidgets(ctx context.Context, portal Portal, roomID id.RoomID) error {
+	existing, err := br.getManagedWidgets(roomID)
+	if err != nil {
+		return err
+	}
+	lifecycle, _ := portal.(WidgetLifecyclePortal)
+	for widgetID := range existing {
+		err = br.removeWidget(ctx, lifecycle, roomID, widgetID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (br *Bridge) removeWidget(ctx context.Context, lifecycle WidgetLifecyclePortal, roomID id.RoomID, widgetID string) error {
+	_, err := br.Bot.SendStateEvent(roomID, event.StateWidget, br.widgetStateKeyPrefix()+widgetID, &event.WidgetEventContent{})
+	if err != nil {
+		return fmt.Errorf("failed to remove widget %s: %w", widgetID, err)
+	}
+	zerolog.Ctx(ctx).Debug().Str("widget_id", widgetID).Msg("Removed portal widget")
+	if lifecycle != nil {
+		lifecycle.OnWidgetRemoved(ctx, widgetID)
+	}
+	return nil
+}
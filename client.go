@@ -1200,7 +1200,13 @@ func (cli *Client) UnbanUser(roomID id.RoomID, req *ReqUnbanUser) (resp *RespUnb
 
 // UserTyping sets the typing status of the user. See https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3roomsroomidtypinguserid
 func (cli *Client) UserTyping(roomID id.RoomID, typing bool, timeout time.Duration) (resp *RespTyping, err error) {
-	req := ReqTyping{Typing: typing, Timeout: timeout.Milliseconds()}
+	return cli.UserTypingWithType(roomID, typing, timeout, event.TypingTypeText)
+}
+
+// UserTypingWithType sets the typing status of the user with an extended typing type (Beeper extension).
+// Homeservers that don't support extended typing types will treat it as normal typing.
+func (cli *Client) UserTypingWithType(roomID id.RoomID, typing bool, timeout time.Duration, typingType event.TypingType) (resp *RespTyping, err error) {
+	req := ReqTyping{Typing: typing, Timeout: timeout.Milliseconds(), Type: typingType}
 	u := cli.BuildClientURL("v3", "rooms", roomID, "typing", cli.UserID)
 	_, err = cli.MakeRequest("PUT", u, req, &resp)
 	return
@@ -1804,6 +1810,22 @@ func (cli *Client) GetAliases(roomID id.RoomID) (resp *RespAliasList, err error)
 	return
 }
 
+// GetRoomDirectoryVisibility gets whether the room is published in the server's room directory.
+// See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3directorylistroomroomid
+func (cli *Client) GetRoomDirectoryVisibility(roomID id.RoomID) (resp *RespRoomDirectoryVisibility, err error) {
+	urlPath := cli.BuildClientURL("v3", "directory", "list", "room", roomID)
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
+// SetRoomDirectoryVisibility publishes or unpublishes the room in the server's room directory.
+// See https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3directorylistroomroomid
+func (cli *Client) SetRoomDirectoryVisibility(roomID id.RoomID, visibility RoomDirectoryVisibility) (err error) {
+	urlPath := cli.BuildClientURL("v3", "directory", "list", "room", roomID)
+	_, err = cli.MakeRequest("PUT", urlPath, &ReqRoomDirectoryVisibility{Visibility: visibility}, nil)
+	return
+}
+
 func (cli *Client) UploadKeys(req *ReqUploadKeys) (resp *RespUploadKeys, err error) {
 	urlPath := cli.BuildClientURL("v3", "keys", "upload")
 	_, err = cli.MakeRequest("POST", urlPath, req, &resp)
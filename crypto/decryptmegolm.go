@@ -59,6 +59,7 @@ func (mach *OlmMachine) DecryptMegolmEvent(ctx context.Context, evt *event.Event
 	if err != nil {
 		return nil, fmt.Errorf("failed to get group session: %w", err)
 	} else if sess == nil {
+		mach.trackMissingGroupSession(encryptionRoomID, content.SenderKey, content.SessionID)
 		return nil, fmt.Errorf("%w (ID %s)", NoSessionFound, content.SessionID)
 	} else if content.SenderKey != "" && content.SenderKey != sess.SenderKey {
 		return nil, SenderKeyMismatch
@@ -80,6 +80,7 @@ func (mach *OlmMachine) decryptAndParseOlmCiphertext(ctx context.Context, sender
 	if err != nil {
 		return nil, err
 	}
+	mach.markOlmSessionHealthy(senderKey)
 
 	defer mach.timeTrace(ctx, "parsing decrypted olm event", time.Second)()
 
@@ -223,40 +224,3 @@ func (mach *OlmMachine) createInboundSession(ctx context.Context, senderKey id.S
 	}
 	return session, nil
 }
-
-const MinUnwedgeInterval = 1 * time.Hour
-
-func (mach *OlmMachine) unwedgeDevice(log zerolog.Logger, sender id.UserID, senderKey id.SenderKey) {
-	log = log.With().Str("action", "unwedge olm session").Logger()
-	ctx := log.WithContext(context.Background())
-	mach.recentlyUnwedgedLock.Lock()
-	prevUnwedge, ok := mach.recentlyUnwedged[senderKey]
-	delta := time.Now().Sub(prevUnwedge)
-	if ok && delta < MinUnwedgeInterval {
-		log.Debug().
-			Str("previous_recreation", delta.String()).
-			Msg("Not creating new Olm session as it was already recreated recently")
-		mach.recentlyUnwedgedLock.Unlock()
-		return
-	}
-	mach.recentlyUnwedged[senderKey] = time.Now()
-	mach.recentlyUnwedgedLock.Unlock()
-
-	deviceIdentity, err := mach.GetOrFetchDeviceByKey(ctx, sender, senderKey)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to find device info by identity key")
-		return
-	} else if deviceIdentity == nil {
-		log.Warn().Msg("Didn't find identity for device")
-		return
-	}
-
-	log.Debug().Str("device_id", deviceIdentity.DeviceID.String()).Msg("Creating new Olm session")
-	mach.devicesToUnwedgeLock.Lock()
-	mach.devicesToUnwedge[senderKey] = true
-	mach.devicesToUnwedgeLock.Unlock()
-	err = mach.SendEncryptedToDevice(ctx, deviceIdentity, event.ToDeviceDummy, event.Content{})
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to send dummy event to unwedge session")
-	}
-}
@@ -86,6 +86,66 @@ func (mach *OlmMachine) storeDeviceSelfSignatures(ctx context.Context, userID id
 	}
 }
 
+// DeviceListUntrackingStore is an optional interface for crypto stores that can stop tracking the device lists
+// of users. Untracked users are treated like users whose devices were never fetched in GetDevices and
+// FilterTrackedUsers, i.e. their devices are fetched again when sending a message to a room they're in.
+// The stored devices must still be returned by GetDevice, so that their signing keys stay pinned.
+type DeviceListUntrackingStore interface {
+	Store
+	UntrackUsers(users []id.UserID) error
+}
+
+// deviceListQueryBatchSize is the maximum number of users whose keys are queried with one request
+// when handling device list changes.
+const deviceListQueryBatchSize = 100
+
+// filterDeviceListChanges returns the tracked users out of the given ones. Tracked users who don't share
+// any encrypted rooms with us anymore are untracked instead of being returned.
+func (mach *OlmMachine) filterDeviceListChanges(ctx context.Context, users []id.UserID) []id.UserID {
+	log := mach.machOrContextLog(ctx)
+	tracked, err := mach.CryptoStore.FilterTrackedUsers(append([]id.UserID{}, users...))
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to filter tracked user list")
+		return nil
+	}
+	stillShared := tracked[:0]
+	var noLongerShared []id.UserID
+	for _, userID := range tracked {
+		if userID == mach.Client.UserID || len(mach.StateStore.FindSharedRooms(userID)) > 0 {
+			stillShared = append(stillShared, userID)
+		} else {
+			noLongerShared = append(noLongerShared, userID)
+		}
+	}
+	if len(noLongerShared) > 0 {
+		mach.untrackUsers(ctx, noLongerShared)
+	}
+	return stillShared
+}
+
+func (mach *OlmMachine) untrackUsers(ctx context.Context, users []id.UserID) {
+	untracker, ok := mach.CryptoStore.(DeviceListUntrackingStore)
+	if !ok {
+		return
+	}
+	filtered := make([]id.UserID, 0, len(users))
+	for _, userID := range users {
+		if userID != mach.Client.UserID {
+			filtered = append(filtered, userID)
+		}
+	}
+	if len(filtered) == 0 {
+		return
+	}
+	log := mach.machOrContextLog(ctx)
+	err := untracker.UntrackUsers(filtered)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to untrack device lists of users")
+	} else {
+		log.Debug().Strs("users", strishArray(filtered)).Msg("Stopped tracking device lists of users who don't share encrypted rooms")
+	}
+}
+
 func (mach *OlmMachine) fetchKeys(ctx context.Context, users []id.UserID, sinceToken string, includeUntracked bool) (data map[id.UserID]map[id.DeviceID]*id.Device) {
 	// TODO this function should probably return errors
 	req := &mautrix.ReqQueryKeys{
@@ -127,6 +187,10 @@ func (mach *OlmMachine) fetchKeys(ctx context.Context, users []id.UserID, sinceT
 		if err != nil {
 			log.Warn().Err(err).Msg("Failed to get existing devices for user")
 			existingDevices = make(map[id.DeviceID]*id.Device)
+		} else if existingDevices == nil {
+			// The user isn't tracked, but devices may still be stored if the user was untracked earlier,
+			// so look them up one by one to make sure signing keys can't change.
+			existingDevices = mach.getUntrackedDevices(userID, devices)
 		}
 		log.Debug().
 			Int("new_device_count", len(devices)).
@@ -172,6 +236,22 @@ func (mach *OlmMachine) fetchKeys(ctx context.Context, users []id.UserID, sinceT
 	return data
 }
 
+func (mach *OlmMachine) getUntrackedDevices(userID id.UserID, devices map[id.DeviceID]mautrix.DeviceKeys) map[id.DeviceID]*id.Device {
+	existingDevices := make(map[id.DeviceID]*id.Device)
+	for deviceID := range devices {
+		device, err := mach.CryptoStore.GetDevice(userID, deviceID)
+		if err != nil {
+			mach.Log.Warn().Err(err).
+				Str("user_id", userID.String()).
+				Str("device_id", deviceID.String()).
+				Msg("Failed to get stored device of untracked user")
+		} else if device != nil && !device.Deleted {
+			existingDevices[deviceID] = device
+		}
+	}
+	return existingDevices
+}
+
 // OnDevicesChanged finds all shared rooms with the given user and invalidates outbound sessions in those rooms.
 //
 // This is called automatically whenever a device list change is noticed in ProcessSyncResponse and usually does
@@ -13,6 +13,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/rs/zerolog"
 
@@ -273,11 +274,11 @@ func (mach *OlmMachine) ShareGroupSession(ctx context.Context, roomID id.RoomID,
 			Int("user_count", len(toDeviceWithheld.Messages)).
 			Msg("Sending to-device messages to report withheld key")
 		// TODO remove the next 4 lines once clients support m.room_key.withheld
-		_, err = mach.Client.SendToDevice(event.ToDeviceOrgMatrixRoomKeyWithheld, toDeviceWithheld)
+		err = mach.sendToDeviceBatched(ctx, event.ToDeviceOrgMatrixRoomKeyWithheld, toDeviceWithheld)
 		if err != nil {
 			log.Warn().Err(err).Msg("Failed to report withheld keys (legacy event type)")
 		}
-		_, err = mach.Client.SendToDevice(event.ToDeviceRoomKeyWithheld, toDeviceWithheld)
+		err = mach.sendToDeviceBatched(ctx, event.ToDeviceRoomKeyWithheld, toDeviceWithheld)
 		if err != nil {
 			log.Warn().Err(err).Msg("Failed to report withheld keys")
 		}
@@ -288,40 +289,74 @@ func (mach *OlmMachine) ShareGroupSession(ctx context.Context, roomID id.RoomID,
 	return mach.CryptoStore.AddOutboundGroupSession(session)
 }
 
+type groupSessionShareTarget struct {
+	userID   id.UserID
+	deviceID id.DeviceID
+	device   deviceSessionWrapper
+}
+
 func (mach *OlmMachine) encryptAndSendGroupSession(ctx context.Context, session *OutboundGroupSession, olmSessions map[id.UserID]map[id.DeviceID]deviceSessionWrapper) error {
 	mach.olmLock.Lock()
 	defer mach.olmLock.Unlock()
 	log := zerolog.Ctx(ctx)
 	log.Trace().Msg("Encrypting group session for all found devices")
-	deviceCount := 0
-	toDevice := &mautrix.ReqSendToDevice{Messages: make(map[id.UserID]map[id.DeviceID]*event.Content)}
+	// Targets are grouped by identity key, so that each olm session is only used by one worker.
+	targets := make(map[id.IdentityKey][]groupSessionShareTarget)
 	for userID, sessions := range olmSessions {
-		if len(sessions) == 0 {
-			continue
-		}
-		output := make(map[id.DeviceID]*event.Content)
-		toDevice.Messages[userID] = output
 		for deviceID, device := range sessions {
-			log.Trace().
-				Str("target_user_id", userID.String()).
-				Str("target_device_id", deviceID.String()).
-				Msg("Encrypting group session for device")
-			content := mach.encryptOlmEvent(ctx, device.session, device.identity, event.ToDeviceRoomKey, session.ShareContent())
-			output[deviceID] = &event.Content{Parsed: content}
-			deviceCount++
-			log.Debug().
-				Str("target_user_id", userID.String()).
-				Str("target_device_id", deviceID.String()).
-				Msg("Encrypted group session for device")
+			identityKey := device.identity.IdentityKey
+			targets[identityKey] = append(targets[identityKey], groupSessionShareTarget{userID, deviceID, device})
 		}
 	}
+	shareContent := session.ShareContent()
+	toDevice := &mautrix.ReqSendToDevice{Messages: make(map[id.UserID]map[id.DeviceID]*event.Content)}
+	var outputLock sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan []groupSessionShareTarget)
+	workers := mach.OlmEncryptionWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers && i < len(targets); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range queue {
+				for _, target := range group {
+					log.Trace().
+						Str("target_user_id", target.userID.String()).
+						Str("target_device_id", target.deviceID.String()).
+						Msg("Encrypting group session for device")
+					content := mach.encryptOlmEvent(ctx, target.device.session, target.device.identity, event.ToDeviceRoomKey, shareContent)
+					outputLock.Lock()
+					output, ok := toDevice.Messages[target.userID]
+					if !ok {
+						output = make(map[id.DeviceID]*event.Content)
+						toDevice.Messages[target.userID] = output
+					}
+					output[target.deviceID] = &event.Content{Parsed: content}
+					outputLock.Unlock()
+					log.Debug().
+						Str("target_user_id", target.userID.String()).
+						Str("target_device_id", target.deviceID.String()).
+						Msg("Encrypted group session for device")
+				}
+			}
+		}()
+	}
+	deviceCount := 0
+	for _, group := range targets {
+		queue <- group
+		deviceCount += len(group)
+	}
+	close(queue)
+	wg.Wait()
 
 	log.Debug().
 		Int("device_count", deviceCount).
 		Int("user_count", len(toDevice.Messages)).
 		Msg("Sending to-device messages to share group session")
-	_, err := mach.Client.SendToDevice(event.ToDeviceEncrypted, toDevice)
-	return err
+	return mach.sendToDeviceBatched(ctx, event.ToDeviceEncrypted, toDevice)
 }
 
 func (mach *OlmMachine) findOlmSessionsForUser(ctx context.Context, session *OutboundGroupSession, userID id.UserID, devices map[id.DeviceID]*id.Device, output map[id.DeviceID]deviceSessionWrapper, withheld map[id.DeviceID]*event.Content, missingOutput map[id.DeviceID]*id.Device) {
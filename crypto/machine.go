@@ -10,6 +10,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"runtime"
 	"sync"
 	"time"
 
@@ -36,6 +37,12 @@ type OlmMachine struct {
 	SendKeysMinTrust  id.TrustState
 	ShareKeysMinTrust id.TrustState
 
+	// ToDeviceBatchSize is the maximum number of devices in a single to-device request when sharing
+	// group sessions. Zero means all messages are sent in one request.
+	ToDeviceBatchSize int
+	// OlmEncryptionWorkers is the number of goroutines used to encrypt a group session for devices in parallel.
+	OlmEncryptionWorkers int
+
 	AllowKeyShare func(context.Context, *id.Device, event.RequestedKeyInfo) *KeyShareRejection
 
 	DefaultSASTimeout time.Duration
@@ -53,7 +60,12 @@ type OlmMachine struct {
 	devicesToUnwedge     map[id.IdentityKey]bool
 	devicesToUnwedgeLock sync.Mutex
 	recentlyUnwedged     map[id.IdentityKey]time.Time
+	unwedgeAttempts      map[id.IdentityKey]int
 	recentlyUnwedgedLock sync.Mutex
+	unwedgeCounters      unwedgeCounters
+
+	missingGroupSessions     map[id.SessionID]missingGroupSession
+	missingGroupSessionsLock sync.Mutex
 
 	olmLock sync.Mutex
 
@@ -92,6 +104,9 @@ func NewOlmMachine(client *mautrix.Client, log *zerolog.Logger, cryptoStore Stor
 		SendKeysMinTrust:  id.TrustStateUnset,
 		ShareKeysMinTrust: id.TrustStateCrossSignedTOFU,
 
+		ToDeviceBatchSize:    DefaultToDeviceBatchSize,
+		OlmEncryptionWorkers: runtime.NumCPU(),
+
 		DefaultSASTimeout: 10 * time.Minute,
 		AcceptVerificationFrom: func(string, *id.Device, id.RoomID) (VerificationRequestResponse, VerificationHooks) {
 			// Reject requests by default. Users need to override this to return appropriate verification hooks.
@@ -105,6 +120,9 @@ func NewOlmMachine(client *mautrix.Client, log *zerolog.Logger, cryptoStore Stor
 
 		devicesToUnwedge: make(map[id.IdentityKey]bool),
 		recentlyUnwedged: make(map[id.IdentityKey]time.Time),
+		unwedgeAttempts:  make(map[id.IdentityKey]int),
+
+		missingGroupSessions: make(map[id.SessionID]missingGroupSession),
 	}
 	mach.AllowKeyShare = mach.defaultAllowKeyShare
 	return mach
@@ -205,16 +223,44 @@ func (mach *OlmMachine) AddAppserviceListener(ep asEventProcessor) {
 	mach.Log.Debug().Msg("Added listeners for encryption data coming from appservice transactions")
 }
 
+// HandleDeviceLists handles device list changes from /sync or appservice transactions.
+//
+// Only users whose device lists are already tracked are queried. Users who don't share any encrypted rooms
+// with the bridge anymore are untracked instead, and their devices are fetched again when they're needed.
 func (mach *OlmMachine) HandleDeviceLists(dl *mautrix.DeviceLists, since string) {
+	if len(dl.Left) > 0 {
+		mach.untrackUsers(context.TODO(), dl.Left)
+	}
 	if len(dl.Changed) > 0 {
 		traceID := time.Now().Format("15:04:05.000000")
-		mach.Log.Debug().
-			Str("trace_id", traceID).
+		log := mach.Log.With().Str("trace_id", traceID).Logger()
+		ctx := log.WithContext(context.TODO())
+		log.Debug().
 			Interface("changes", dl.Changed).
 			Msg("Device list changes in /sync")
-		mach.fetchKeys(context.TODO(), dl.Changed, since, false)
-		mach.Log.Debug().Str("trace_id", traceID).Msg("Finished handling device list changes")
+		users := mach.filterDeviceListChanges(ctx, dl.Changed)
+		for len(users) > 0 {
+			batch := users
+			if len(batch) > deviceListQueryBatchSize {
+				batch = batch[:deviceListQueryBatchSize]
+			}
+			users = users[len(batch):]
+			mach.fetchKeys(ctx, batch, since, true)
+		}
+		log.Debug().Msg("Finished handling device list changes")
+	}
+}
+
+// CatchUpDeviceLists gets the users whose device lists changed between the given sync tokens from /keys/changes
+// and handles them like device list changes in /sync. This can be used after being offline for a while instead
+// of querying the keys of every tracked user.
+func (mach *OlmMachine) CatchUpDeviceLists(from, to string) error {
+	resp, err := mach.Client.GetKeyChanges(from, to)
+	if err != nil {
+		return fmt.Errorf("failed to get key changes: %w", err)
 	}
+	mach.HandleDeviceLists(&mautrix.DeviceLists{Changed: resp.Changed, Left: resp.Left}, to)
+	return nil
 }
 
 func (mach *OlmMachine) HandleOTKCounts(otkCount *mautrix.OTKCount) {
@@ -502,6 +548,7 @@ func (mach *OlmMachine) markSessionReceived(id id.SessionID) {
 		delete(mach.keyWaiters, id)
 	}
 	mach.keyWaitersLock.Unlock()
+	mach.forgetMissingGroupSession(id)
 }
 
 // WaitForSession waits for the given Megolm session to arrive.
@@ -43,9 +43,13 @@ type SQLCryptoStore struct {
 
 	olmSessionCache     map[id.SenderKey]map[id.SessionID]*OlmSession
 	olmSessionCacheLock sync.Mutex
+
+	groupSessionUsage     map[id.SessionID]time.Time
+	groupSessionUsageLock sync.Mutex
 }
 
 var _ Store = (*SQLCryptoStore)(nil)
+var _ DeviceListUntrackingStore = (*SQLCryptoStore)(nil)
 
 // NewSQLCryptoStore initializes a new crypto Store using the given database, for a device's crypto material.
 // The stored material will be encrypted with the given key.
@@ -56,7 +60,8 @@ func NewSQLCryptoStore(db *dbutil.Database, log dbutil.DatabaseLogger, accountID
 		AccountID: accountID,
 		DeviceID:  deviceID,
 
-		olmSessionCache: make(map[id.SenderKey]map[id.SessionID]*OlmSession),
+		olmSessionCache:   make(map[id.SenderKey]map[id.SessionID]*OlmSession),
+		groupSessionUsage: make(map[id.SessionID]time.Time),
 	}
 }
 
@@ -260,12 +265,13 @@ func (store *SQLCryptoStore) PutGroupSession(roomID id.RoomID, senderKey id.Send
 	forwardingChains := strings.Join(session.ForwardingChains, ",")
 	_, err := store.DB.Exec(`
 		INSERT INTO crypto_megolm_inbound_session
-			(session_id, sender_key, signing_key, room_id, session, forwarding_chains, account_id)
-			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			(session_id, sender_key, signing_key, room_id, session, forwarding_chains, account_id, last_used)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 		ON CONFLICT (session_id, account_id) DO UPDATE
 		    SET withheld_code=NULL, withheld_reason=NULL, sender_key=excluded.sender_key, signing_key=excluded.signing_key,
-		        room_id=excluded.room_id, session=excluded.session, forwarding_chains=excluded.forwarding_chains
-	`, sessionID, senderKey, session.SigningKey, roomID, sessionBytes, forwardingChains, store.AccountID)
+		        room_id=excluded.room_id, session=excluded.session, forwarding_chains=excluded.forwarding_chains,
+		        last_used=excluded.last_used
+	`, sessionID, senderKey, session.SigningKey, roomID, sessionBytes, forwardingChains, store.AccountID, time.Now().UnixMilli())
 	return err
 }
 
@@ -291,6 +297,7 @@ func (store *SQLCryptoStore) GetGroupSession(roomID id.RoomID, senderKey id.Send
 	if err != nil {
 		return nil, err
 	}
+	store.markGroupSessionUsed(sessionID)
 	var chains []string
 	if forwardingChains.String != "" {
 		chains = strings.Split(forwardingChains.String, ",")
@@ -476,7 +483,7 @@ func (store *SQLCryptoStore) ValidateMessageIndex(ctx context.Context, senderKey
 // GetDevices returns a map of device IDs to device identities, including the identity and signing keys, for a given user ID.
 func (store *SQLCryptoStore) GetDevices(userID id.UserID) (map[id.DeviceID]*id.Device, error) {
 	var ignore id.UserID
-	err := store.DB.QueryRow("SELECT user_id FROM crypto_tracked_user WHERE user_id=$1", userID).Scan(&ignore)
+	err := store.DB.QueryRow("SELECT user_id FROM crypto_tracked_user WHERE user_id=$1 AND outdated=false", userID).Scan(&ignore)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
@@ -542,7 +549,7 @@ const deviceInsertQuery = `
 INSERT INTO crypto_device (user_id, device_id, identity_key, signing_key, trust, deleted, name)
 VALUES ($1, $2, $3, $4, $5, $6, $7)
 ON CONFLICT (user_id, device_id) DO UPDATE
-    SET identity_key=excluded.identity_key, deleted=excluded.deleted, trust=excluded.trust, name=excluded.name
+    SET identity_key=excluded.identity_key, signing_key=excluded.signing_key, deleted=excluded.deleted, trust=excluded.trust, name=excluded.name
 `
 
 var deviceMassInsertTemplate = strings.ReplaceAll(deviceInsertQuery, "($1, $2, $3, $4, $5, $6, $7)", "%s")
@@ -561,7 +568,7 @@ func (store *SQLCryptoStore) PutDevices(userID id.UserID, devices map[id.DeviceI
 		return err
 	}
 
-	_, err = tx.Exec("INSERT INTO crypto_tracked_user (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING", userID)
+	_, err = tx.Exec("INSERT INTO crypto_tracked_user (user_id, outdated) VALUES ($1, false) ON CONFLICT (user_id) DO UPDATE SET outdated=false", userID)
 	if err != nil {
 		return fmt.Errorf("failed to add user to tracked users list: %w", err)
 	}
@@ -620,7 +627,7 @@ func (store *SQLCryptoStore) FilterTrackedUsers(users []id.UserID) ([]id.UserID,
 	var rows dbutil.Rows
 	var err error
 	if store.DB.Dialect == dbutil.Postgres && PostgresArrayWrapper != nil {
-		rows, err = store.DB.Query("SELECT user_id FROM crypto_tracked_user WHERE user_id = ANY($1)", PostgresArrayWrapper(users))
+		rows, err = store.DB.Query("SELECT user_id FROM crypto_tracked_user WHERE user_id = ANY($1) AND outdated=false", PostgresArrayWrapper(users))
 	} else {
 		queryString := make([]string, len(users))
 		params := make([]interface{}, len(users))
@@ -628,7 +635,7 @@ func (store *SQLCryptoStore) FilterTrackedUsers(users []id.UserID) ([]id.UserID,
 			queryString[i] = fmt.Sprintf("$%d", i+1)
 			params[i] = user
 		}
-		rows, err = store.DB.Query("SELECT user_id FROM crypto_tracked_user WHERE user_id IN ("+strings.Join(queryString, ",")+")", params...)
+		rows, err = store.DB.Query("SELECT user_id FROM crypto_tracked_user WHERE user_id IN ("+strings.Join(queryString, ",")+") AND outdated=false", params...)
 	}
 	if err != nil {
 		return users, err
@@ -645,6 +652,24 @@ func (store *SQLCryptoStore) FilterTrackedUsers(users []id.UserID) ([]id.UserID,
 	return users[:ptr], nil
 }
 
+// UntrackUsers marks the device lists of the given users as outdated. GetDevices returns nil for them until
+// PutDevices is called again, but their devices are kept and can still be found with GetDevice, so that
+// trust states and signing keys aren't lost.
+func (store *SQLCryptoStore) UntrackUsers(users []id.UserID) error {
+	tx, err := store.DB.Begin()
+	if err != nil {
+		return err
+	}
+	for _, userID := range users {
+		_, err = tx.Exec("UPDATE crypto_tracked_user SET outdated=true WHERE user_id=$1", userID)
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to untrack %s: %w", userID, err)
+		}
+	}
+	return tx.Commit()
+}
+
 // PutCrossSigningKey stores a cross-signing key of some user along with its usage.
 func (store *SQLCryptoStore) PutCrossSigningKey(userID id.UserID, usage id.CrossSigningUsage, key id.Ed25519) error {
 	_, err := store.DB.Exec(`
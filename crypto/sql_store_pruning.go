@@ -0,0 +1,199 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+// groupSessionUsageInterval is how often the last used timestamp of an inbound megolm session is updated
+// in the database. Updating it on every decryption would make each decryption a database write.
+const groupSessionUsageInterval = 24 * time.Hour
+
+// maxTrackedGroupSessionUsage is the number of sessions whose last update is remembered in memory.
+const maxTrackedGroupSessionUsage = 10000
+
+func (store *SQLCryptoStore) markGroupSessionUsed(sessionID id.SessionID) {
+	now := time.Now()
+	store.groupSessionUsageLock.Lock()
+	if lastMarked, ok := store.groupSessionUsage[sessionID]; ok && now.Sub(lastMarked) < groupSessionUsageInterval {
+		store.groupSessionUsageLock.Unlock()
+		return
+	} else if len(store.groupSessionUsage) >= maxTrackedGroupSessionUsage {
+		store.groupSessionUsage = make(map[id.SessionID]time.Time)
+	}
+	store.groupSessionUsage[sessionID] = now
+	store.groupSessionUsageLock.Unlock()
+	_, err := store.DB.Exec("UPDATE crypto_megolm_inbound_session SET last_used=$1 WHERE session_id=$2 AND account_id=$3",
+		now.UnixMilli(), sessionID, store.AccountID)
+	if err != nil {
+		store.groupSessionUsageLock.Lock()
+		delete(store.groupSessionUsage, sessionID)
+		store.groupSessionUsageLock.Unlock()
+	}
+}
+
+// SessionPruneOptions contains the retention policy for PruneSessions. Zero values disable the corresponding rule.
+type SessionPruneOptions struct {
+	// OlmMaxAge is how long an olm session can go without being used for encrypting or decrypting before
+	// it's deleted. The most recently used session with each device is always kept.
+	OlmMaxAge time.Duration
+	// OlmMaxPerDevice is the maximum number of olm sessions kept with each device.
+	// The least recently used sessions are deleted first.
+	OlmMaxPerDevice int
+	// MegolmMaxAge is how long an inbound megolm session can go without being used before it's deleted.
+	// Messages encrypted with deleted sessions can't be decrypted anymore.
+	MegolmMaxAge time.Duration
+	// Vacuum makes the database file shrink after pruning on SQLite. It locks the whole database while running.
+	Vacuum bool
+}
+
+// SessionPruneResult contains the number of rows deleted by PruneSessions.
+type SessionPruneResult struct {
+	OlmSessions    int64
+	MegolmSessions int64
+	MessageIndexes int64
+}
+
+// CryptoStoreStats contains the number of rows in the crypto store tables.
+type CryptoStoreStats struct {
+	OlmSessions            int
+	OlmDevices             int
+	MegolmInboundSessions  int
+	MegolmWithheldSessions int
+	MegolmOutboundSessions int
+	MessageIndexes         int
+	Devices                int
+	TrackedUsers           int
+}
+
+const pruneOlmSessionsQuery = `
+	DELETE FROM crypto_olm_session WHERE account_id=$1 AND session_id IN (
+		SELECT session_id FROM (
+			SELECT session_id, last_decrypted, last_encrypted,
+				ROW_NUMBER() OVER (PARTITION BY sender_key ORDER BY last_decrypted DESC) AS recency
+			FROM crypto_olm_session WHERE account_id=$1
+		) ranked
+		WHERE recency > 1 AND ((last_decrypted < $2 AND last_encrypted < $2) OR recency > $3)
+	)
+	RETURNING sender_key, session_id
+`
+
+// PruneSessions deletes old olm and megolm sessions according to the given retention policy,
+// as well as the message indexes of deleted megolm sessions.
+//
+// Inbound megolm sessions that were stored before last used timestamps were tracked are considered used
+// at the time of the first prune. Inbound sessions matching the current outbound sessions are never deleted.
+func (store *SQLCryptoStore) PruneSessions(ctx context.Context, opts SessionPruneOptions) (*SessionPruneResult, error) {
+	var result SessionPruneResult
+	if opts.OlmMaxAge > 0 || opts.OlmMaxPerDevice > 0 {
+		var cutoff time.Time
+		if opts.OlmMaxAge > 0 {
+			cutoff = time.Now().Add(-opts.OlmMaxAge)
+		}
+		maxPerDevice := opts.OlmMaxPerDevice
+		if maxPerDevice <= 0 {
+			maxPerDevice = math.MaxInt32
+		}
+		rows, err := store.DB.QueryContext(ctx, pruneOlmSessionsQuery, store.AccountID, cutoff, maxPerDevice)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prune olm sessions: %w", err)
+		}
+		store.olmSessionCacheLock.Lock()
+		for rows.Next() {
+			var senderKey id.SenderKey
+			var sessionID id.SessionID
+			if err = rows.Scan(&senderKey, &sessionID); err != nil {
+				break
+			}
+			delete(store.olmSessionCache[senderKey], sessionID)
+			result.OlmSessions++
+		}
+		store.olmSessionCacheLock.Unlock()
+		if err == nil {
+			err = rows.Err()
+		}
+		_ = rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pruned olm sessions: %w", err)
+		}
+	}
+	if opts.MegolmMaxAge > 0 {
+		now := time.Now()
+		_, err := store.DB.ExecContext(ctx, "UPDATE crypto_megolm_inbound_session SET last_used=$1 WHERE account_id=$2 AND last_used IS NULL",
+			now.UnixMilli(), store.AccountID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize megolm session last used timestamps: %w", err)
+		}
+		res, err := store.DB.ExecContext(ctx, `
+			DELETE FROM crypto_megolm_inbound_session
+			WHERE account_id=$1 AND last_used<$2 AND session_id NOT IN (
+				SELECT session_id FROM crypto_megolm_outbound_session WHERE account_id=$1
+			)
+		`, store.AccountID, now.Add(-opts.MegolmMaxAge).UnixMilli())
+		if err != nil {
+			return nil, fmt.Errorf("failed to prune megolm sessions: %w", err)
+		}
+		result.MegolmSessions, _ = res.RowsAffected()
+		res, err = store.DB.ExecContext(ctx, `
+			DELETE FROM crypto_message_index WHERE NOT EXISTS (
+				SELECT 1 FROM crypto_megolm_inbound_session mis WHERE mis.session_id=crypto_message_index.session_id
+			)
+		`)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prune message indexes: %w", err)
+		}
+		result.MessageIndexes, _ = res.RowsAffected()
+	}
+	if opts.Vacuum && store.DB.Dialect == dbutil.SQLite {
+		_, err := store.DB.ExecContext(ctx, "VACUUM")
+		if err != nil {
+			return &result, fmt.Errorf("failed to vacuum database: %w", err)
+		}
+	}
+	return &result, nil
+}
+
+// GetStats counts the rows in the crypto store tables, which can be used to monitor the size of the store.
+func (store *SQLCryptoStore) GetStats(ctx context.Context) (*CryptoStoreStats, error) {
+	var stats CryptoStoreStats
+	err := store.DB.QueryRowContext(ctx,
+		"SELECT COUNT(*), COUNT(DISTINCT sender_key) FROM crypto_olm_session WHERE account_id=$1", store.AccountID,
+	).Scan(&stats.OlmSessions, &stats.OlmDevices)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count olm sessions: %w", err)
+	}
+	err = store.DB.QueryRowContext(ctx,
+		"SELECT COUNT(session), COUNT(withheld_code) FROM crypto_megolm_inbound_session WHERE account_id=$1", store.AccountID,
+	).Scan(&stats.MegolmInboundSessions, &stats.MegolmWithheldSessions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count inbound megolm sessions: %w", err)
+	}
+	counts := []struct {
+		target *int
+		query  string
+		args   []interface{}
+	}{
+		{&stats.MegolmOutboundSessions, "SELECT COUNT(*) FROM crypto_megolm_outbound_session WHERE account_id=$1", []interface{}{store.AccountID}},
+		{&stats.MessageIndexes, "SELECT COUNT(*) FROM crypto_message_index", nil},
+		{&stats.Devices, "SELECT COUNT(*) FROM crypto_device", nil},
+		{&stats.TrackedUsers, "SELECT COUNT(*) FROM crypto_tracked_user WHERE outdated=false", nil},
+	}
+	for _, count := range counts {
+		err = store.DB.QueryRowContext(ctx, count.query, count.args...).Scan(count.target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count rows: %w", err)
+		}
+	}
+	return &stats, nil
+}
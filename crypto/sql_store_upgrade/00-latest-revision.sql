@@ -1,4 +1,4 @@
--- v0 -> v8: Latest revision
+-- v0 -> v11: Latest revision
 CREATE TABLE IF NOT EXISTS crypto_account (
 	account_id TEXT    PRIMARY KEY,
 	device_id  TEXT    NOT NULL,
@@ -17,7 +17,8 @@ CREATE TABLE IF NOT EXISTS crypto_message_index (
 );
 
 CREATE TABLE IF NOT EXISTS crypto_tracked_user (
-	user_id TEXT PRIMARY KEY
+	user_id  TEXT    PRIMARY KEY,
+	outdated BOOLEAN NOT NULL DEFAULT false
 );
 
 CREATE TABLE IF NOT EXISTS crypto_device (
@@ -52,6 +53,7 @@ CREATE TABLE IF NOT EXISTS crypto_megolm_inbound_session (
 	forwarding_chains bytea,
 	withheld_code     TEXT,
 	withheld_reason   TEXT,
+	last_used         BIGINT,
 	PRIMARY KEY (account_id, session_id)
 );
 
@@ -0,0 +1,2 @@
+-- v10: Add last used timestamp to inbound megolm sessions
+ALTER TABLE crypto_megolm_inbound_session ADD COLUMN last_used BIGINT;
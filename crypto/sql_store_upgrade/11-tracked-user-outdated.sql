@@ -0,0 +1,2 @@
+-- v11: Mark users as outdated instead of deleting them when untracking device lists
+ALTER TABLE crypto_tracked_user ADD COLUMN outdated BOOLEAN NOT NULL DEFAULT false;
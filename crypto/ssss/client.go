@@ -7,6 +7,7 @@
 package ssss
 
 import (
+	"errors"
 	"fmt"
 
 	"maunium.net/go/mautrix"
@@ -14,6 +15,9 @@ import (
 )
 
 // Machine contains utility methods for interacting with SSSS data on the server.
+//
+// The machine can be used with any client, e.g. the client of a double puppet to read or store
+// the user's cross-signing or key backup secrets.
 type Machine struct {
 	Client *mautrix.Client
 }
@@ -71,6 +75,16 @@ func (mach *Machine) GetDefaultKeyData() (keyID string, keyData *KeyMetadata, er
 	return
 }
 
+// GetDefaultKey gets the default key metadata from the server and verifies the given recovery key
+// or passphrase against it (see KeyMetadata.VerifyRecoveryKeyOrPassphrase).
+func (mach *Machine) GetDefaultKey(recoveryKeyOrPassphrase string) (*Key, error) {
+	_, keyData, err := mach.GetDefaultKeyData()
+	if err != nil {
+		return nil, err
+	}
+	return keyData.VerifyRecoveryKeyOrPassphrase(recoveryKeyOrPassphrase)
+}
+
 // GetDecryptedAccountData gets the account data event with the given event type and decrypts it using the given key.
 func (mach *Machine) GetDecryptedAccountData(eventType event.Type, key *Key) ([]byte, error) {
 	var encData EncryptedAccountDataEventContent
@@ -81,6 +95,19 @@ func (mach *Machine) GetDecryptedAccountData(eventType event.Type, key *Key) ([]
 	return encData.Decrypt(eventType.Type, key)
 }
 
+// GetSecret is like GetDecryptedAccountData, but returns ErrSecretNotFound if the secret doesn't exist
+// in account data at all, and ErrNotEncryptedForKey if it exists but isn't encrypted with the given key.
+func (mach *Machine) GetSecret(eventType event.Type, key *Key) ([]byte, error) {
+	var encData EncryptedAccountDataEventContent
+	err := mach.Client.GetAccountData(eventType.Type, &encData)
+	if errors.Is(err, mautrix.MNotFound) || (err == nil && len(encData.Encrypted) == 0) {
+		return nil, fmt.Errorf("%w: %s", ErrSecretNotFound, eventType.Type)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get %s from account data: %w", eventType.Type, err)
+	}
+	return encData.Decrypt(eventType.Type, key)
+}
+
 // SetEncryptedAccountData encrypts the given data with the given keys and stores it on the server.
 func (mach *Machine) SetEncryptedAccountData(eventType event.Type, data []byte, keys ...*Key) error {
 	if len(keys) == 0 {
@@ -106,3 +133,17 @@ func (mach *Machine) GenerateAndUploadKey(passphrase string) (key *Key, err erro
 	}
 	return key, err
 }
+
+// SetupDefaultKey generates a new SSSS key, stores the metadata on the server and marks it as the default key.
+// Existing secrets are not re-encrypted with the new key.
+func (mach *Machine) SetupDefaultKey(passphrase string) (*Key, error) {
+	key, err := mach.GenerateAndUploadKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	err = mach.SetDefaultKeyID(key.ID)
+	if err != nil {
+		return key, fmt.Errorf("failed to set default key ID: %w", err)
+	}
+	return key, nil
+}
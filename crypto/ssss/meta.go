@@ -57,6 +57,15 @@ func (kd *KeyMetadata) VerifyRecoveryKey(recoverKey string) (*Key, error) {
 	}, nil
 }
 
+// VerifyRecoveryKeyOrPassphrase verifies the given user input and returns the SSSS key. The input is treated
+// as a recovery key if it's formatted like one and as a passphrase otherwise.
+func (kd *KeyMetadata) VerifyRecoveryKeyOrPassphrase(input string) (*Key, error) {
+	if utils.DecodeBase58RecoveryKey(input) != nil {
+		return kd.VerifyRecoveryKey(input)
+	}
+	return kd.VerifyPassphrase(input)
+}
+
 // VerifyKey verifies the SSSS key is valid by calculating and comparing its MAC.
 func (kd *KeyMetadata) VerifyKey(key []byte) bool {
 	return strings.ReplaceAll(kd.MAC, "=", "") == strings.ReplaceAll(kd.calculateHash(key), "=", "")
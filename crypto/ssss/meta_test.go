@@ -133,3 +133,24 @@ func TestKeyMetadata_VerifyPassphrase_NotSet(t *testing.T) {
 	assert.True(t, errors.Is(err, ssss.ErrNoPassphrase), "unexpected error %v", err)
 	assert.Nil(t, key)
 }
+
+func TestKeyMetadata_VerifyRecoveryKeyOrPassphrase_RecoveryKey(t *testing.T) {
+	km := getKey1Meta()
+	key, err := km.VerifyRecoveryKeyOrPassphrase(key1RecoveryKey)
+	assert.NoError(t, err)
+	assert.Equal(t, key1RecoveryKey, key.RecoveryKey())
+}
+
+func TestKeyMetadata_VerifyRecoveryKeyOrPassphrase_Passphrase(t *testing.T) {
+	km := getKey1Meta()
+	key, err := km.VerifyRecoveryKeyOrPassphrase(key1Passphrase)
+	assert.NoError(t, err)
+	assert.Equal(t, key1RecoveryKey, key.RecoveryKey())
+}
+
+func TestKeyMetadata_VerifyRecoveryKeyOrPassphrase_NoPassphrase(t *testing.T) {
+	km := getKey2Meta()
+	key, err := km.VerifyRecoveryKeyOrPassphrase("not a recovery key")
+	assert.True(t, errors.Is(err, ssss.ErrNoPassphrase), "unexpected error %v", err)
+	assert.Nil(t, key)
+}
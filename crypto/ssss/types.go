@@ -26,6 +26,7 @@ var (
 	ErrUnsupportedPassphraseAlgorithm = errors.New("unsupported passphrase KDF algorithm")
 	ErrIncorrectSSSSKey               = errors.New("incorrect SSSS key")
 	ErrInvalidRecoveryKey             = errors.New("invalid recovery key")
+	ErrSecretNotFound                 = errors.New("secret not found in account data")
 )
 
 // Algorithm is the identifier for an SSSS encryption algorithm.
@@ -56,6 +57,12 @@ type EncryptedAccountDataEventContent struct {
 	Encrypted map[string]EncryptedKeyData `json:"encrypted"`
 }
 
+// IsEncryptedFor returns whether the data has been encrypted with the given key ID.
+func (ed *EncryptedAccountDataEventContent) IsEncryptedFor(keyID string) bool {
+	_, ok := ed.Encrypted[keyID]
+	return ok
+}
+
 func (ed *EncryptedAccountDataEventContent) Decrypt(eventType string, key *Key) ([]byte, error) {
 	keyEncData, ok := ed.Encrypted[key.ID]
 	if !ok {
@@ -70,6 +77,7 @@ func init() {
 	event.TypeMap[event.AccountDataCrossSigningMaster] = encryptedContent
 	event.TypeMap[event.AccountDataCrossSigningSelf] = encryptedContent
 	event.TypeMap[event.AccountDataCrossSigningUser] = encryptedContent
+	event.TypeMap[event.AccountDataMegolmBackupKey] = encryptedContent
 	event.TypeMap[event.AccountDataSecretStorageDefaultKey] = reflect.TypeOf(&DefaultSecretStorageKeyContent{})
 	event.TypeMap[event.AccountDataSecretStorageKey] = reflect.TypeOf(&KeyMetadata{})
 }
@@ -139,11 +139,13 @@ type MemoryStore struct {
 	OutGroupSessions      map[id.RoomID]*OutboundGroupSession
 	MessageIndices        map[messageIndexKey]messageIndexValue
 	Devices               map[id.UserID]map[id.DeviceID]*id.Device
+	OutdatedUsers         map[id.UserID]bool
 	CrossSigningKeys      map[id.UserID]map[id.CrossSigningUsage]id.CrossSigningKey
 	KeySignatures         map[id.UserID]map[id.Ed25519]map[id.UserID]map[id.Ed25519]string
 }
 
 var _ Store = (*MemoryStore)(nil)
+var _ DeviceListUntrackingStore = (*MemoryStore)(nil)
 
 func NewMemoryStore(saveCallback func() error) *MemoryStore {
 	if saveCallback == nil {
@@ -158,6 +160,7 @@ func NewMemoryStore(saveCallback func() error) *MemoryStore {
 		OutGroupSessions:      make(map[id.RoomID]*OutboundGroupSession),
 		MessageIndices:        make(map[messageIndexKey]messageIndexValue),
 		Devices:               make(map[id.UserID]map[id.DeviceID]*id.Device),
+		OutdatedUsers:         make(map[id.UserID]bool),
 		CrossSigningKeys:      make(map[id.UserID]map[id.CrossSigningUsage]id.CrossSigningKey),
 		KeySignatures:         make(map[id.UserID]map[id.Ed25519]map[id.UserID]map[id.Ed25519]string),
 	}
@@ -385,7 +388,7 @@ func (gs *MemoryStore) ValidateMessageIndex(_ context.Context, senderKey id.Send
 func (gs *MemoryStore) GetDevices(userID id.UserID) (map[id.DeviceID]*id.Device, error) {
 	gs.lock.RLock()
 	devices, ok := gs.Devices[userID]
-	if !ok {
+	if !ok || gs.OutdatedUsers[userID] {
 		devices = nil
 	}
 	gs.lock.RUnlock()
@@ -437,6 +440,7 @@ func (gs *MemoryStore) PutDevice(userID id.UserID, device *id.Device) error {
 func (gs *MemoryStore) PutDevices(userID id.UserID, devices map[id.DeviceID]*id.Device) error {
 	gs.lock.Lock()
 	gs.Devices[userID] = devices
+	delete(gs.OutdatedUsers, userID)
 	err := gs.save()
 	gs.lock.Unlock()
 	return err
@@ -447,7 +451,7 @@ func (gs *MemoryStore) FilterTrackedUsers(users []id.UserID) ([]id.UserID, error
 	var ptr int
 	for _, userID := range users {
 		_, ok := gs.Devices[userID]
-		if ok {
+		if ok && !gs.OutdatedUsers[userID] {
 			users[ptr] = userID
 			ptr++
 		}
@@ -456,6 +460,21 @@ func (gs *MemoryStore) FilterTrackedUsers(users []id.UserID) ([]id.UserID, error
 	return users[:ptr], nil
 }
 
+func (gs *MemoryStore) UntrackUsers(users []id.UserID) error {
+	gs.lock.Lock()
+	if gs.OutdatedUsers == nil {
+		gs.OutdatedUsers = make(map[id.UserID]bool)
+	}
+	for _, userID := range users {
+		if _, ok := gs.Devices[userID]; ok {
+			gs.OutdatedUsers[userID] = true
+		}
+	}
+	err := gs.save()
+	gs.lock.Unlock()
+	return err
+}
+
 func (gs *MemoryStore) PutCrossSigningKey(userID id.UserID, usage id.CrossSigningUsage, key id.Ed25519) error {
 	gs.lock.RLock()
 	userKeys, ok := gs.CrossSigningKeys[userID]
@@ -11,8 +11,10 @@ import (
 	"database/sql"
 	"strconv"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
 
 	"maunium.net/go/mautrix/crypto/olm"
 	"maunium.net/go/mautrix/id"
@@ -26,7 +28,7 @@ const olmPickled = "L6cdv3JYO9OzhXbcjNSwl7ldN5bDvwmGyin+hISePETE6bO71DIlhqTC9YIh
 	"qcCwp6sZrgLbmfBUBb0zJCogCmYw8m2"
 const groupSession = "9ZbsRqJuETbjnxPpKv29n3dubP/m5PSLbr9I9CIWS2O86F/Og1JZXhqT+4fA5tovoPfdpk5QLh7PfDyjmgOcO9sSA37maJyzCy6Ap+uBZLAXp6VLJ0mjSvxi+PAbzGKDMqpn+pa+oeEIH6SFPG/2GGDSRoXVi5fttAClCIoav5RflWiMypKqnQRfkZR2Gx8glOaBiTzAd7m0X6XGfYIPol41JUIHfBLuJBfXQ0Uu5GScV4eKUWdJP2J6zzC2Hx8cZAhiBBzAza0CbGcnUK+YJXMYaJg92HiIo++l317LlsYUJ/P+gKOLafYR9/l8bAzxH7j5s31PnRs7mD1Bl6G1LFM+dPsGXUOLx6PlvlTlYYM/opai0uKKzT0Wk6zPoq9fN/smlXEPBtKlw2fqcytL4gOF0MrBPEca"
 
-func getCryptoStores(t *testing.T) map[string]Store {
+func newSQLStoreForTest(t *testing.T) *SQLCryptoStore {
 	rawDB, err := sql.Open("sqlite3", ":memory:?_busy_timeout=5000")
 	if err != nil {
 		t.Fatalf("Error opening db: %v", err)
@@ -39,15 +41,26 @@ func getCryptoStores(t *testing.T) map[string]Store {
 	if err = sqlStore.DB.Upgrade(); err != nil {
 		t.Fatalf("Error creating tables: %v", err)
 	}
+	return sqlStore
+}
+
+func getCryptoStores(t *testing.T) map[string]Store {
+	sqlStore := newSQLStoreForTest(t)
+	writeBehindStore := NewWriteBehindStore(newSQLStoreForTest(t), zerolog.Nop(), WriteBehindStoreOptions{})
+	t.Cleanup(func() {
+		_ = writeBehindStore.Close()
+	})
 
+	var err error
 	gobStore := NewMemoryStore(nil)
 	if err != nil {
 		t.Fatalf("Error creating Gob store: %v", err)
 	}
 
 	return map[string]Store{
-		"sql": sqlStore,
-		"gob": gobStore,
+		"sql":         sqlStore,
+		"gob":         gobStore,
+		"writebehind": writeBehindStore,
 	}
 }
 
@@ -259,3 +272,161 @@ func TestStoreDevices(t *testing.T) {
 		})
 	}
 }
+
+func TestUntrackUsers(t *testing.T) {
+	stores := getCryptoStores(t)
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			device := &id.Device{
+				UserID:      "user1",
+				DeviceID:    "DEVICE1",
+				IdentityKey: "identitykey",
+				SigningKey:  "signingkey",
+			}
+			err := store.PutDevices("user1", map[id.DeviceID]*id.Device{device.DeviceID: device})
+			if err != nil {
+				t.Fatalf("Error storing devices: %v", err)
+			}
+			err = store.(DeviceListUntrackingStore).UntrackUsers([]id.UserID{"user1"})
+			if err != nil {
+				t.Fatalf("Error untracking user: %v", err)
+			}
+			filtered, err := store.FilterTrackedUsers([]id.UserID{"user1"})
+			if err != nil {
+				t.Errorf("Error filtering tracked users: %v", err)
+			} else if len(filtered) != 0 {
+				t.Errorf("Expected untracked user to be filtered out, got %v", filtered)
+			}
+			devices, err := store.GetDevices("user1")
+			if err != nil {
+				t.Errorf("Error getting devices: %v", err)
+			} else if devices != nil {
+				t.Errorf("Expected no device list for untracked user, got %v", devices)
+			}
+			stored, err := store.GetDevice("user1", device.DeviceID)
+			if err != nil {
+				t.Errorf("Error getting device: %v", err)
+			} else if stored == nil || stored.SigningKey != device.SigningKey {
+				t.Errorf("Expected device of untracked user to be kept, got %v", stored)
+			}
+			err = store.PutDevices("user1", map[id.DeviceID]*id.Device{device.DeviceID: device})
+			if err != nil {
+				t.Fatalf("Error storing devices: %v", err)
+			}
+			filtered, err = store.FilterTrackedUsers([]id.UserID{"user1"})
+			if err != nil {
+				t.Errorf("Error filtering tracked users: %v", err)
+			} else if len(filtered) != 1 {
+				t.Errorf("Expected user to be tracked again, got %v", filtered)
+			}
+		})
+	}
+}
+
+func TestPruneSessions(t *testing.T) {
+	store := getCryptoStores(t)["sql"].(*SQLCryptoStore)
+	now := time.Now()
+	addOlmSession := func(sessionID string, senderKey id.SenderKey, age time.Duration) {
+		ts := now.Add(-age)
+		_, err := store.DB.Exec(`
+			INSERT INTO crypto_olm_session (session_id, sender_key, session, created_at, last_encrypted, last_decrypted, account_id)
+			VALUES ($1, $2, '', $3, $3, $3, $4)
+		`, sessionID, senderKey, ts, store.AccountID)
+		if err != nil {
+			t.Fatalf("Error adding olm session: %v", err)
+		}
+	}
+	addOlmSession("recent", "device1", 0)
+	addOlmSession("old", "device1", 100*24*time.Hour)
+	addOlmSession("only", "device2", 100*24*time.Hour)
+	_, err := store.DB.Exec(`
+		INSERT INTO crypto_megolm_inbound_session (session_id, sender_key, room_id, account_id, last_used)
+		VALUES ('fresh', 'device1', '!room', $1, $2), ('stale', 'device1', '!room', $1, $3)
+	`, store.AccountID, now.UnixMilli(), now.Add(-100*24*time.Hour).UnixMilli())
+	if err != nil {
+		t.Fatalf("Error adding megolm sessions: %v", err)
+	}
+
+	result, err := store.PruneSessions(context.Background(), SessionPruneOptions{
+		OlmMaxAge:    30 * 24 * time.Hour,
+		MegolmMaxAge: 30 * 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Error pruning sessions: %v", err)
+	} else if result.OlmSessions != 1 || result.MegolmSessions != 1 {
+		t.Errorf("Expected to prune 1 olm and 1 megolm session, got %+v", result)
+	}
+	stats, err := store.GetStats(context.Background())
+	if err != nil {
+		t.Fatalf("Error getting stats: %v", err)
+	} else if stats.OlmSessions != 2 || stats.OlmDevices != 2 {
+		t.Errorf("Expected 2 olm sessions with 2 devices left, got %+v", stats)
+	}
+}
+
+func TestWriteBehindStoreFlush(t *testing.T) {
+	backing := newSQLStoreForTest(t)
+	store := NewWriteBehindStore(backing, zerolog.Nop(), WriteBehindStoreOptions{FlushInterval: time.Hour})
+	defer store.Close()
+
+	acc := NewOlmAccount()
+	internal, err := olm.InboundGroupSessionFromPickled([]byte(groupSession), []byte("test"))
+	if err != nil {
+		t.Fatalf("Error creating internal inbound group session: %v", err)
+	}
+	igs := &InboundGroupSession{
+		Internal:   *internal,
+		SigningKey: acc.SigningKey(),
+		SenderKey:  acc.IdentityKey(),
+		RoomID:     "room1",
+	}
+	err = store.PutGroupSession("room1", acc.IdentityKey(), igs.ID(), igs)
+	if err != nil {
+		t.Fatalf("Error storing inbound group session: %v", err)
+	}
+	if retrieved, _ := backing.GetGroupSession("room1", acc.IdentityKey(), igs.ID()); retrieved != nil {
+		t.Error("Inbound group session was written to backing store before flushing")
+	}
+	if retrieved, _ := store.GetGroupSession("room1", acc.IdentityKey(), igs.ID()); retrieved == nil {
+		t.Error("Inbound group session wasn't returned from memory")
+	}
+	if err = store.Flush(); err != nil {
+		t.Fatalf("Error flushing store: %v", err)
+	}
+	retrieved, err := backing.GetGroupSession("room1", acc.IdentityKey(), igs.ID())
+	if err != nil {
+		t.Fatalf("Error retrieving inbound group session from backing store: %v", err)
+	} else if retrieved == nil {
+		t.Fatal("Inbound group session wasn't written to backing store after flushing")
+	} else if pickled := string(retrieved.Internal.Pickle([]byte("test"))); pickled != groupSession {
+		t.Error("Pickled inbound group session does not match original")
+	}
+}
+
+func TestWriteBehindStoreValidateMessageIndex(t *testing.T) {
+	backing := newSQLStoreForTest(t)
+	ctx := context.Background()
+	senderKey := id.SenderKey("senderkey")
+	valid, err := backing.ValidateMessageIndex(ctx, senderKey, "session", "$event1", 0, 1000)
+	if err != nil || !valid {
+		t.Fatalf("Failed to validate message index in backing store: %v", err)
+	}
+	store := NewWriteBehindStore(backing, zerolog.Nop(), WriteBehindStoreOptions{FlushInterval: time.Hour})
+	defer store.Close()
+	valid, err = store.ValidateMessageIndex(ctx, senderKey, "session", "$event2", 0, 2000)
+	if err != nil {
+		t.Fatalf("Error validating message index: %v", err)
+	} else if valid {
+		t.Error("Replayed message index was accepted")
+	}
+	valid, err = store.ValidateMessageIndex(ctx, senderKey, "session", "$event3", 1, 3000)
+	if err != nil || !valid {
+		t.Fatalf("New message index wasn't accepted: %v", err)
+	}
+	valid, err = backing.ValidateMessageIndex(ctx, senderKey, "session", "$event4", 1, 4000)
+	if err != nil {
+		t.Fatalf("Error validating message index in backing store: %v", err)
+	} else if valid {
+		t.Error("Message index wasn't saved to backing store before flushing")
+	}
+}
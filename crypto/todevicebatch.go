@@ -0,0 +1,102 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// DefaultToDeviceBatchSize is the default value for OlmMachine.ToDeviceBatchSize.
+const DefaultToDeviceBatchSize = 250
+
+const maxParallelToDeviceRequests = 4
+
+func splitToDeviceRequest(req *mautrix.ReqSendToDevice, batchSize int) []*mautrix.ReqSendToDevice {
+	if batchSize <= 0 {
+		return []*mautrix.ReqSendToDevice{req}
+	}
+	var batches []*mautrix.ReqSendToDevice
+	current := &mautrix.ReqSendToDevice{Messages: make(map[id.UserID]map[id.DeviceID]*event.Content)}
+	count := 0
+	for userID, devices := range req.Messages {
+		for deviceID, content := range devices {
+			if count >= batchSize {
+				batches = append(batches, current)
+				current = &mautrix.ReqSendToDevice{Messages: make(map[id.UserID]map[id.DeviceID]*event.Content)}
+				count = 0
+			}
+			userMessages, ok := current.Messages[userID]
+			if !ok {
+				userMessages = make(map[id.DeviceID]*event.Content)
+				current.Messages[userID] = userMessages
+			}
+			userMessages[deviceID] = content
+			count++
+		}
+	}
+	if count > 0 {
+		batches = append(batches, current)
+	}
+	return batches
+}
+
+// sendToDeviceBatched sends the given to-device messages split into requests of at most ToDeviceBatchSize devices.
+// A few requests are sent in parallel. All batches are attempted even if some of them fail.
+func (mach *OlmMachine) sendToDeviceBatched(ctx context.Context, eventType event.Type, req *mautrix.ReqSendToDevice) error {
+	batches := splitToDeviceRequest(req, mach.ToDeviceBatchSize)
+	if len(batches) == 0 {
+		return nil
+	} else if len(batches) == 1 {
+		_, err := mach.Client.SendToDevice(eventType, batches[0])
+		return err
+	}
+	log := zerolog.Ctx(ctx)
+	log.Debug().
+		Int("batch_count", len(batches)).
+		Str("event_type", eventType.Type).
+		Msg("Sending to-device messages in batches")
+	var wg sync.WaitGroup
+	var errLock sync.Mutex
+	var firstErr error
+	failed := 0
+	queue := make(chan *mautrix.ReqSendToDevice)
+	for i := 0; i < maxParallelToDeviceRequests && i < len(batches); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range queue {
+				_, err := mach.Client.SendToDevice(eventType, batch)
+				if err != nil {
+					log.Warn().Err(err).Int("user_count", len(batch.Messages)).Msg("Failed to send batch of to-device messages")
+					errLock.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					failed++
+					errLock.Unlock()
+				}
+			}
+		}()
+	}
+	for _, batch := range batches {
+		queue <- batch
+	}
+	close(queue)
+	wg.Wait()
+	if firstErr != nil {
+		return fmt.Errorf("%d/%d to-device batches failed: %w", failed, len(batches), firstErr)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"fmt"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestSplitToDeviceRequest(t *testing.T) {
+	req := &mautrix.ReqSendToDevice{Messages: make(map[id.UserID]map[id.DeviceID]*event.Content)}
+	for i := 0; i < 5; i++ {
+		userID := id.UserID(fmt.Sprintf("@user%d:example.com", i))
+		req.Messages[userID] = make(map[id.DeviceID]*event.Content)
+		for j := 0; j < 3; j++ {
+			req.Messages[userID][id.DeviceID(fmt.Sprintf("DEVICE%d", j))] = &event.Content{}
+		}
+	}
+	batches := splitToDeviceRequest(req, 4)
+	if len(batches) != 4 {
+		t.Fatalf("Expected 4 batches, got %d", len(batches))
+	}
+	seen := make(map[id.UserID]map[id.DeviceID]bool)
+	for i, batch := range batches {
+		count := 0
+		for userID, devices := range batch.Messages {
+			if seen[userID] == nil {
+				seen[userID] = make(map[id.DeviceID]bool)
+			}
+			for deviceID := range devices {
+				if seen[userID][deviceID] {
+					t.Errorf("Device %s of %s is in multiple batches", deviceID, userID)
+				}
+				seen[userID][deviceID] = true
+				count++
+			}
+		}
+		if count > 4 {
+			t.Errorf("Batch %d has %d messages", i, count)
+		}
+	}
+	for userID, devices := range seen {
+		if len(devices) != 3 {
+			t.Errorf("Expected 3 devices for %s, got %d", userID, len(devices))
+		}
+	}
+	if batches = splitToDeviceRequest(req, 0); len(batches) != 1 || batches[0] != req {
+		t.Errorf("Expected unsplit request when batch size is zero")
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// MinUnwedgeInterval is the minimum time between two attempts to unwedge the Olm session with the same device.
+const MinUnwedgeInterval = 1 * time.Hour
+
+// MaxUnwedgeAttempts is how many times the Olm session with a device is recreated before giving up.
+// The counter is reset when an Olm message from the device is decrypted successfully.
+const MaxUnwedgeAttempts = 3
+
+const (
+	maxMissingGroupSessions   = 1000
+	missingGroupSessionMaxAge = 24 * time.Hour
+)
+
+// UnwedgeStats contains counters about automatic recovery of broken Olm sessions.
+type UnwedgeStats struct {
+	// Attempts is the number of times a new Olm session was created because decrypting a message failed.
+	Attempts uint64
+	// Succeeded is the number of attempts where a dummy event was sent over the new session.
+	Succeeded uint64
+	// Failed is the number of attempts where a new session couldn't be established or the dummy event couldn't be sent.
+	Failed uint64
+	// RateLimited is the number of decryption failures that were ignored because of MinUnwedgeInterval.
+	RateLimited uint64
+	// GaveUp is the number of decryption failures that were ignored because of MaxUnwedgeAttempts.
+	GaveUp uint64
+	// KeysRerequested is the number of Megolm sessions that were requested again after unwedging.
+	KeysRerequested uint64
+}
+
+type unwedgeCounters struct {
+	attempts        atomic.Uint64
+	succeeded       atomic.Uint64
+	failed          atomic.Uint64
+	rateLimited     atomic.Uint64
+	gaveUp          atomic.Uint64
+	keysRerequested atomic.Uint64
+}
+
+type missingGroupSession struct {
+	RoomID    id.RoomID
+	SenderKey id.SenderKey
+	Since     time.Time
+}
+
+// GetUnwedgeStats returns counters about automatic Olm session recovery since the machine was created.
+func (mach *OlmMachine) GetUnwedgeStats() UnwedgeStats {
+	return UnwedgeStats{
+		Attempts:        mach.unwedgeCounters.attempts.Load(),
+		Succeeded:       mach.unwedgeCounters.succeeded.Load(),
+		Failed:          mach.unwedgeCounters.failed.Load(),
+		RateLimited:     mach.unwedgeCounters.rateLimited.Load(),
+		GaveUp:          mach.unwedgeCounters.gaveUp.Load(),
+		KeysRerequested: mach.unwedgeCounters.keysRerequested.Load(),
+	}
+}
+
+func (mach *OlmMachine) shouldUnwedge(log zerolog.Logger, senderKey id.SenderKey) bool {
+	mach.recentlyUnwedgedLock.Lock()
+	defer mach.recentlyUnwedgedLock.Unlock()
+	prevUnwedge, ok := mach.recentlyUnwedged[senderKey]
+	delta := time.Now().Sub(prevUnwedge)
+	if ok && delta < MinUnwedgeInterval {
+		log.Debug().
+			Str("previous_recreation", delta.String()).
+			Msg("Not creating new Olm session as it was already recreated recently")
+		mach.unwedgeCounters.rateLimited.Add(1)
+		return false
+	} else if attempts := mach.unwedgeAttempts[senderKey]; attempts >= MaxUnwedgeAttempts {
+		log.Debug().
+			Int("attempts", attempts).
+			Msg("Not creating new Olm session as previous attempts didn't fix decryption")
+		mach.unwedgeCounters.gaveUp.Add(1)
+		return false
+	}
+	mach.recentlyUnwedged[senderKey] = time.Now()
+	mach.unwedgeAttempts[senderKey]++
+	return true
+}
+
+// markOlmSessionHealthy resets the unwedge attempt counter of a device after a message from it was decrypted.
+func (mach *OlmMachine) markOlmSessionHealthy(senderKey id.SenderKey) {
+	mach.recentlyUnwedgedLock.Lock()
+	delete(mach.unwedgeAttempts, senderKey)
+	mach.recentlyUnwedgedLock.Unlock()
+}
+
+// unwedgeDevice treats the current Olm session with the given device as corrupted, establishes a new one by
+// claiming a one-time key, sends a dummy event over the new session so that the other side switches to it too,
+// and finally requests the Megolm sessions from that device that we haven't received yet.
+func (mach *OlmMachine) unwedgeDevice(log zerolog.Logger, sender id.UserID, senderKey id.SenderKey) {
+	log = log.With().Str("action", "unwedge olm session").Logger()
+	ctx := log.WithContext(context.Background())
+	if !mach.shouldUnwedge(log, senderKey) {
+		return
+	}
+	mach.unwedgeCounters.attempts.Add(1)
+
+	deviceIdentity, err := mach.GetOrFetchDeviceByKey(ctx, sender, senderKey)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to find device info by identity key")
+		mach.unwedgeCounters.failed.Add(1)
+		return
+	} else if deviceIdentity == nil {
+		log.Warn().Msg("Didn't find identity for device")
+		mach.unwedgeCounters.failed.Add(1)
+		return
+	}
+	log = log.With().Str("device_id", deviceIdentity.DeviceID.String()).Logger()
+	ctx = log.WithContext(ctx)
+
+	corruptedSession, err := mach.CryptoStore.GetLatestSession(senderKey)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get current Olm session")
+		mach.unwedgeCounters.failed.Add(1)
+		return
+	} else if corruptedSession != nil {
+		log = log.With().Str("corrupted_session_id", corruptedSession.ID().String()).Logger()
+		ctx = log.WithContext(ctx)
+	}
+
+	log.Debug().Msg("Creating new Olm session")
+	mach.devicesToUnwedgeLock.Lock()
+	mach.devicesToUnwedge[senderKey] = true
+	mach.devicesToUnwedgeLock.Unlock()
+	err = mach.createOutboundSessions(ctx, map[id.UserID]map[id.DeviceID]*id.Device{
+		deviceIdentity.UserID: {deviceIdentity.DeviceID: deviceIdentity},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create new Olm session")
+		mach.unwedgeCounters.failed.Add(1)
+		return
+	}
+	newSession, err := mach.CryptoStore.GetLatestSession(senderKey)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get new Olm session")
+		mach.unwedgeCounters.failed.Add(1)
+		return
+	} else if newSession == nil || (corruptedSession != nil && newSession.ID() == corruptedSession.ID()) {
+		// Don't send anything over the corrupted session, the next attempt will try to claim a key again.
+		log.Warn().Msg("Didn't get new Olm session, device may be out of one-time keys")
+		mach.unwedgeCounters.failed.Add(1)
+		return
+	}
+	log = log.With().Str("new_session_id", newSession.ID().String()).Logger()
+	ctx = log.WithContext(ctx)
+
+	err = mach.SendEncryptedToDevice(ctx, deviceIdentity, event.ToDeviceDummy, event.Content{})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to send dummy event to unwedge session")
+		mach.unwedgeCounters.failed.Add(1)
+		return
+	}
+	mach.unwedgeCounters.succeeded.Add(1)
+	log.Info().Msg("Sent dummy event over new Olm session")
+	mach.rerequestMissingGroupSessions(ctx, deviceIdentity)
+}
+
+// trackMissingGroupSession remembers a Megolm session that was needed to decrypt an event but wasn't found,
+// so that it can be requested again if the Olm session with the sender turns out to be wedged.
+func (mach *OlmMachine) trackMissingGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) {
+	if senderKey == "" {
+		return
+	}
+	mach.missingGroupSessionsLock.Lock()
+	defer mach.missingGroupSessionsLock.Unlock()
+	if _, alreadyTracked := mach.missingGroupSessions[sessionID]; alreadyTracked {
+		return
+	}
+	if len(mach.missingGroupSessions) >= maxMissingGroupSessions {
+		for trackedID, missing := range mach.missingGroupSessions {
+			if time.Since(missing.Since) > missingGroupSessionMaxAge {
+				delete(mach.missingGroupSessions, trackedID)
+			}
+		}
+		if len(mach.missingGroupSessions) >= maxMissingGroupSessions {
+			return
+		}
+	}
+	mach.missingGroupSessions[sessionID] = missingGroupSession{
+		RoomID:    roomID,
+		SenderKey: senderKey,
+		Since:     time.Now(),
+	}
+}
+
+func (mach *OlmMachine) forgetMissingGroupSession(sessionID id.SessionID) {
+	mach.missingGroupSessionsLock.Lock()
+	delete(mach.missingGroupSessions, sessionID)
+	mach.missingGroupSessionsLock.Unlock()
+}
+
+func (mach *OlmMachine) rerequestMissingGroupSessions(ctx context.Context, device *id.Device) {
+	log := zerolog.Ctx(ctx)
+	mach.missingGroupSessionsLock.Lock()
+	missing := make(map[id.SessionID]missingGroupSession)
+	for sessionID, info := range mach.missingGroupSessions {
+		if info.SenderKey != device.IdentityKey {
+			continue
+		} else if time.Since(info.Since) > missingGroupSessionMaxAge {
+			delete(mach.missingGroupSessions, sessionID)
+		} else {
+			missing[sessionID] = info
+		}
+	}
+	mach.missingGroupSessionsLock.Unlock()
+	for sessionID, info := range missing {
+		sess, err := mach.CryptoStore.GetGroupSession(info.RoomID, info.SenderKey, sessionID)
+		if sess != nil || errors.Is(err, ErrGroupSessionWithheld) {
+			mach.forgetMissingGroupSession(sessionID)
+			continue
+		}
+		err = mach.SendRoomKeyRequest(info.RoomID, info.SenderKey, sessionID, "", map[id.UserID][]id.DeviceID{
+			device.UserID: {device.DeviceID},
+		})
+		if err != nil {
+			log.Warn().Err(err).Str("megolm_session_id", sessionID.String()).Msg("Failed to request missing Megolm session")
+		} else {
+			mach.unwedgeCounters.keysRerequested.Add(1)
+			log.Debug().Str("megolm_session_id", sessionID.String()).Msg("Requested missing Megolm session after unwedging")
+		}
+	}
+}
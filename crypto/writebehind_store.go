@@ -0,0 +1,615 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// StoreConsistency determines when writes made to a WriteBehindStore reach the backing store.
+type StoreConsistency string
+
+const (
+	// ConsistencyWriteThrough writes everything to the backing store before returning, only reads are served from memory.
+	ConsistencyWriteThrough StoreConsistency = "write_through"
+	// ConsistencyWriteBehind queues writes in memory and flushes them to the backing store periodically.
+	// Writes that haven't been flushed are lost if the process crashes, which may wedge Olm sessions.
+	ConsistencyWriteBehind StoreConsistency = "write_behind"
+)
+
+// WriteBehindStoreOptions contains the settings for NewWriteBehindStore.
+type WriteBehindStoreOptions struct {
+	Consistency StoreConsistency
+	// FlushInterval is how often queued writes are flushed in write-behind mode. Defaults to one second.
+	FlushInterval time.Duration
+	// MaxPending is the number of queued writes that triggers an immediate flush. Defaults to 500.
+	MaxPending int
+	// MaxGroupSessions is the maximum number of inbound Megolm sessions kept in memory. Defaults to 10000.
+	MaxGroupSessions int
+}
+
+const maxCachedMessageIndexes = 100000
+
+type pendingWrite struct {
+	insert bool
+	write  func(Store) error
+}
+
+type cachedGroupSession struct {
+	pickle           []byte
+	signingKey       id.Ed25519
+	senderKey        id.SenderKey
+	roomID           id.RoomID
+	forwardingChains []string
+}
+
+type cachedOutboundSession struct {
+	pickle       []byte
+	sessionID    id.SessionID
+	maxAge       time.Duration
+	timestamps   TimeMixin
+	maxMessages  int
+	messageCount int
+	shared       bool
+}
+
+// WriteBehindStore is a Store decorator that serves Olm and Megolm sessions and message indexes from memory.
+//
+// Writes are snapshotted when they're made and either written to the backing store immediately or queued
+// and written in batches, depending on the consistency mode. Everything else is passed through to the
+// backing store. Flush (or Close on shutdown) must be called to persist queued writes.
+type WriteBehindStore struct {
+	Store
+
+	log       zerolog.Logger
+	opts      WriteBehindStoreOptions
+	pickleKey []byte
+
+	lock          sync.Mutex
+	account       *OlmAccount
+	olmSessions   map[id.SenderKey]OlmSessionList
+	groupSessions map[id.SessionID]*cachedGroupSession
+	outbound      map[id.RoomID]*cachedOutboundSession
+	messageIndex  map[messageIndexKey]messageIndexValue
+
+	pending      map[string]*pendingWrite
+	pendingOrder []string
+
+	flushLock   sync.Mutex
+	flushNow    chan struct{}
+	stop        chan struct{}
+	stopped     chan struct{}
+	stopOnce    sync.Once
+	loopStarted bool
+}
+
+var _ Store = (*WriteBehindStore)(nil)
+var _ DeviceListUntrackingStore = (*WriteBehindStore)(nil)
+
+// NewWriteBehindStore wraps the given store. In write-behind mode, a background goroutine is started
+// for flushing queued writes, which is stopped by Close.
+func NewWriteBehindStore(backing Store, log zerolog.Logger, opts WriteBehindStoreOptions) *WriteBehindStore {
+	if opts.Consistency == "" {
+		opts.Consistency = ConsistencyWriteBehind
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 1 * time.Second
+	}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = 500
+	}
+	if opts.MaxGroupSessions <= 0 {
+		opts.MaxGroupSessions = 10000
+	}
+	pickleKey := make([]byte, 32)
+	_, err := rand.Read(pickleKey)
+	if err != nil {
+		panic(err)
+	}
+	store := &WriteBehindStore{
+		Store:     backing,
+		log:       log,
+		opts:      opts,
+		pickleKey: pickleKey,
+
+		olmSessions:   make(map[id.SenderKey]OlmSessionList),
+		groupSessions: make(map[id.SessionID]*cachedGroupSession),
+		outbound:      make(map[id.RoomID]*cachedOutboundSession),
+		messageIndex:  make(map[messageIndexKey]messageIndexValue),
+		pending:       make(map[string]*pendingWrite),
+
+		flushNow: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if opts.Consistency == ConsistencyWriteBehind {
+		store.loopStarted = true
+		go store.flushLoop()
+	}
+	return store
+}
+
+func (store *WriteBehindStore) flushLoop() {
+	defer close(store.stopped)
+	ticker := time.NewTicker(store.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-store.flushNow:
+		case <-store.stop:
+			return
+		}
+		err := store.Flush()
+		if err != nil {
+			store.log.Err(err).Msg("Failed to flush crypto store writes")
+		}
+	}
+}
+
+// Close stops the background flush loop and flushes all queued writes.
+func (store *WriteBehindStore) Close() error {
+	store.stopOnce.Do(func() {
+		close(store.stop)
+		if store.loopStarted {
+			<-store.stopped
+		}
+	})
+	return store.Flush()
+}
+
+// Flush writes all queued writes to the backing store and then flushes the backing store.
+// Writes that fail are kept in the queue to be retried on the next flush.
+func (store *WriteBehindStore) Flush() error {
+	store.flushLock.Lock()
+	defer store.flushLock.Unlock()
+	store.lock.Lock()
+	pending, order := store.pending, store.pendingOrder
+	store.pending = make(map[string]*pendingWrite)
+	store.pendingOrder = nil
+	store.lock.Unlock()
+
+	var firstErr error
+	failed := 0
+	for _, key := range order {
+		err := pending[key].write(store.Store)
+		if err != nil {
+			store.log.Warn().Err(err).Str("write_key", key).Msg("Failed to write to crypto store")
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+			store.lock.Lock()
+			if _, hasNewer := store.pending[key]; !hasNewer {
+				store.pending[key] = pending[key]
+				store.pendingOrder = append(store.pendingOrder, key)
+			}
+			store.lock.Unlock()
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf("%d/%d crypto store writes failed: %w", failed, len(order), firstErr)
+	}
+	return store.Store.Flush()
+}
+
+// Invalidate flushes queued writes and drops everything cached in memory. This must be called after the
+// backing store is modified directly, e.g. after pruning sessions.
+func (store *WriteBehindStore) Invalidate() error {
+	err := store.Flush()
+	store.lock.Lock()
+	store.account = nil
+	store.olmSessions = make(map[id.SenderKey]OlmSessionList)
+	store.groupSessions = make(map[id.SessionID]*cachedGroupSession)
+	store.outbound = make(map[id.RoomID]*cachedOutboundSession)
+	store.messageIndex = make(map[messageIndexKey]messageIndexValue)
+	store.lock.Unlock()
+	return err
+}
+
+// queue must be called with the lock held. In write-through mode, the write is done immediately.
+func (store *WriteBehindStore) queue(key string, write *pendingWrite) error {
+	if store.opts.Consistency == ConsistencyWriteThrough {
+		return write.write(store.Store)
+	}
+	if existing, ok := store.pending[key]; ok {
+		write.insert = write.insert || existing.insert
+	} else {
+		store.pendingOrder = append(store.pendingOrder, key)
+	}
+	store.pending[key] = write
+	if len(store.pending) >= store.opts.MaxPending {
+		select {
+		case store.flushNow <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (store *WriteBehindStore) flushIfPending() {
+	store.lock.Lock()
+	hasPending := len(store.pending) > 0
+	store.lock.Unlock()
+	if hasPending {
+		err := store.Flush()
+		if err != nil {
+			store.log.Warn().Err(err).Msg("Failed to flush crypto store writes before reading from backing store")
+		}
+	}
+}
+
+func (store *WriteBehindStore) unpickle(pickle []byte, into interface{ Unpickle([]byte, []byte) error }) error {
+	// Unpickling modifies the input, so make a copy to keep the cached pickle intact.
+	return into.Unpickle(append([]byte{}, pickle...), store.pickleKey)
+}
+
+func (store *WriteBehindStore) copyOlmSession(session *OlmSession) (*OlmSession, error) {
+	internal := olm.NewBlankSession()
+	err := store.unpickle(session.Internal.Pickle(store.pickleKey), internal)
+	if err != nil {
+		return nil, err
+	}
+	return &OlmSession{Internal: *internal, ExpirationMixin: session.ExpirationMixin}, nil
+}
+
+func (store *WriteBehindStore) PutAccount(account *OlmAccount) error {
+	internal := olm.NewBlankAccount()
+	err := store.unpickle(account.Internal.Pickle(store.pickleKey), internal)
+	if err != nil {
+		return fmt.Errorf("failed to copy account: %w", err)
+	}
+	snapshot := &OlmAccount{Internal: *internal, Shared: account.Shared}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.account = account
+	return store.queue("account", &pendingWrite{write: func(backing Store) error {
+		return backing.PutAccount(snapshot)
+	}})
+}
+
+func (store *WriteBehindStore) GetAccount() (*OlmAccount, error) {
+	store.lock.Lock()
+	account := store.account
+	store.lock.Unlock()
+	if account != nil {
+		return account, nil
+	}
+	account, err := store.Store.GetAccount()
+	if err == nil && account != nil {
+		store.lock.Lock()
+		if store.account == nil {
+			store.account = account
+		} else {
+			account = store.account
+		}
+		store.lock.Unlock()
+	}
+	return account, err
+}
+
+func (store *WriteBehindStore) getOlmSessions(key id.SenderKey) (OlmSessionList, error) {
+	store.lock.Lock()
+	sessions, ok := store.olmSessions[key]
+	store.lock.Unlock()
+	if ok {
+		return sessions, nil
+	}
+	sessions, err := store.Store.GetSessions(key)
+	if err != nil {
+		return nil, err
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if existing, ok := store.olmSessions[key]; ok {
+		return existing, nil
+	}
+	store.olmSessions[key] = sessions
+	return sessions, nil
+}
+
+func (store *WriteBehindStore) AddSession(key id.SenderKey, session *OlmSession) error {
+	_, err := store.getOlmSessions(key)
+	if err != nil {
+		return err
+	}
+	snapshot, err := store.copyOlmSession(session)
+	if err != nil {
+		return fmt.Errorf("failed to copy olm session: %w", err)
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.olmSessions[key] = append(store.olmSessions[key], session)
+	return store.queue("olm:"+session.ID().String(), &pendingWrite{insert: true, write: func(backing Store) error {
+		return backing.AddSession(key, snapshot)
+	}})
+}
+
+func (store *WriteBehindStore) HasSession(key id.SenderKey) bool {
+	sessions, err := store.getOlmSessions(key)
+	return err == nil && len(sessions) > 0
+}
+
+func (store *WriteBehindStore) GetSessions(key id.SenderKey) (OlmSessionList, error) {
+	sessions, err := store.getOlmSessions(key)
+	if err != nil {
+		return nil, err
+	}
+	store.lock.Lock()
+	sorted := make(OlmSessionList, len(sessions))
+	copy(sorted, sessions)
+	store.lock.Unlock()
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].LastDecryptedTime.After(sorted[j].LastDecryptedTime)
+	})
+	return sorted, nil
+}
+
+func (store *WriteBehindStore) GetLatestSession(key id.SenderKey) (*OlmSession, error) {
+	sessions, err := store.GetSessions(key)
+	if err != nil || len(sessions) == 0 {
+		return nil, err
+	}
+	return sessions[0], nil
+}
+
+func (store *WriteBehindStore) UpdateSession(key id.SenderKey, session *OlmSession) error {
+	snapshot, err := store.copyOlmSession(session)
+	if err != nil {
+		return fmt.Errorf("failed to copy olm session: %w", err)
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	write := &pendingWrite{}
+	write.write = func(backing Store) error {
+		// If the session hasn't been inserted yet, the latest snapshot is inserted instead of updating.
+		if write.insert {
+			return backing.AddSession(key, snapshot)
+		}
+		return backing.UpdateSession(key, snapshot)
+	}
+	return store.queue("olm:"+session.ID().String(), write)
+}
+
+func (store *WriteBehindStore) evictGroupSessions() {
+	for sessionID := range store.groupSessions {
+		if len(store.groupSessions) < store.opts.MaxGroupSessions {
+			return
+		} else if _, isPending := store.pending["igs:"+sessionID.String()]; !isPending {
+			delete(store.groupSessions, sessionID)
+		}
+	}
+}
+
+func (store *WriteBehindStore) cacheGroupSession(sessionID id.SessionID, session *InboundGroupSession) *cachedGroupSession {
+	cached := &cachedGroupSession{
+		pickle:           session.Internal.Pickle(store.pickleKey),
+		signingKey:       session.SigningKey,
+		senderKey:        session.SenderKey,
+		roomID:           session.RoomID,
+		forwardingChains: session.ForwardingChains,
+	}
+	store.lock.Lock()
+	store.evictGroupSessions()
+	store.groupSessions[sessionID] = cached
+	store.lock.Unlock()
+	return cached
+}
+
+func (store *WriteBehindStore) PutGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, session *InboundGroupSession) error {
+	cached := store.cacheGroupSession(sessionID, session)
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.queue("igs:"+sessionID.String(), &pendingWrite{write: func(backing Store) error {
+		internal := olm.NewBlankInboundGroupSession()
+		err := store.unpickle(cached.pickle, internal)
+		if err != nil {
+			return err
+		}
+		return backing.PutGroupSession(roomID, senderKey, sessionID, &InboundGroupSession{
+			Internal:         *internal,
+			SigningKey:       cached.signingKey,
+			SenderKey:        cached.senderKey,
+			RoomID:           cached.roomID,
+			ForwardingChains: cached.forwardingChains,
+		})
+	}})
+}
+
+func (store *WriteBehindStore) GetGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) (*InboundGroupSession, error) {
+	store.lock.Lock()
+	cached, ok := store.groupSessions[sessionID]
+	store.lock.Unlock()
+	if !ok {
+		session, err := store.Store.GetGroupSession(roomID, senderKey, sessionID)
+		if err == nil && session != nil {
+			store.cacheGroupSession(sessionID, session)
+		}
+		return session, err
+	} else if cached.roomID != roomID || cached.senderKey != senderKey {
+		return nil, nil
+	}
+	if marker, ok := store.Store.(interface{ markGroupSessionUsed(id.SessionID) }); ok {
+		marker.markGroupSessionUsed(sessionID)
+	}
+	internal := olm.NewBlankInboundGroupSession()
+	err := store.unpickle(cached.pickle, internal)
+	if err != nil {
+		return nil, err
+	}
+	return &InboundGroupSession{
+		Internal:         *internal,
+		SigningKey:       cached.signingKey,
+		SenderKey:        cached.senderKey,
+		RoomID:           cached.roomID,
+		ForwardingChains: cached.forwardingChains,
+	}, nil
+}
+
+func (store *WriteBehindStore) PutWithheldGroupSession(content event.RoomKeyWithheldEventContent) error {
+	store.flushIfPending()
+	return store.Store.PutWithheldGroupSession(content)
+}
+
+func (store *WriteBehindStore) GetWithheldGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) (*event.RoomKeyWithheldEventContent, error) {
+	store.flushIfPending()
+	return store.Store.GetWithheldGroupSession(roomID, senderKey, sessionID)
+}
+
+func (store *WriteBehindStore) GetGroupSessionsForRoom(roomID id.RoomID) ([]*InboundGroupSession, error) {
+	store.flushIfPending()
+	return store.Store.GetGroupSessionsForRoom(roomID)
+}
+
+func (store *WriteBehindStore) GetAllGroupSessions() ([]*InboundGroupSession, error) {
+	store.flushIfPending()
+	return store.Store.GetAllGroupSessions()
+}
+
+func (store *WriteBehindStore) snapshotOutbound(session *OutboundGroupSession) *cachedOutboundSession {
+	return &cachedOutboundSession{
+		pickle:       session.Internal.Pickle(store.pickleKey),
+		sessionID:    session.ID(),
+		maxAge:       session.MaxAge,
+		timestamps:   session.TimeMixin,
+		maxMessages:  session.MaxMessages,
+		messageCount: session.MessageCount,
+		shared:       session.Shared,
+	}
+}
+
+func (store *WriteBehindStore) restoreOutbound(roomID id.RoomID, cached *cachedOutboundSession) (*OutboundGroupSession, error) {
+	internal := olm.NewBlankOutboundGroupSession()
+	err := store.unpickle(cached.pickle, internal)
+	if err != nil {
+		return nil, err
+	}
+	session := &OutboundGroupSession{
+		Internal:     *internal,
+		MaxMessages:  cached.maxMessages,
+		MessageCount: cached.messageCount,
+		RoomID:       roomID,
+		Shared:       cached.shared,
+	}
+	session.TimeMixin = cached.timestamps
+	session.MaxAge = cached.maxAge
+	return session, nil
+}
+
+func (store *WriteBehindStore) writeOutbound(roomID id.RoomID, cached *cachedOutboundSession, insert bool) error {
+	write := &pendingWrite{insert: insert}
+	write.write = func(backing Store) error {
+		session, err := store.restoreOutbound(roomID, cached)
+		if err != nil {
+			return err
+		} else if write.insert {
+			return backing.AddOutboundGroupSession(session)
+		}
+		return backing.UpdateOutboundGroupSession(session)
+	}
+	store.outbound[roomID] = cached
+	return store.queue("ogs:"+roomID.String(), write)
+}
+
+func (store *WriteBehindStore) AddOutboundGroupSession(session *OutboundGroupSession) error {
+	cached := store.snapshotOutbound(session)
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.writeOutbound(session.RoomID, cached, true)
+}
+
+func (store *WriteBehindStore) UpdateOutboundGroupSession(session *OutboundGroupSession) error {
+	cached := store.snapshotOutbound(session)
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if existing, ok := store.outbound[session.RoomID]; ok && (existing == nil || existing.sessionID != cached.sessionID) {
+		// The session was removed or replaced, so the update would be a no-op in the backing store too.
+		return nil
+	}
+	return store.writeOutbound(session.RoomID, cached, false)
+}
+
+func (store *WriteBehindStore) GetOutboundGroupSession(roomID id.RoomID) (*OutboundGroupSession, error) {
+	store.lock.Lock()
+	cached, ok := store.outbound[roomID]
+	store.lock.Unlock()
+	if ok {
+		if cached == nil {
+			return nil, nil
+		}
+		return store.restoreOutbound(roomID, cached)
+	}
+	session, err := store.Store.GetOutboundGroupSession(roomID)
+	if err != nil {
+		return nil, err
+	}
+	store.lock.Lock()
+	if _, ok = store.outbound[roomID]; !ok {
+		if session != nil {
+			store.outbound[roomID] = store.snapshotOutbound(session)
+		} else {
+			store.outbound[roomID] = nil
+		}
+	}
+	store.lock.Unlock()
+	return session, nil
+}
+
+func (store *WriteBehindStore) RemoveOutboundGroupSession(roomID id.RoomID) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.outbound[roomID] = nil
+	return store.queue("ogs:"+roomID.String(), &pendingWrite{write: func(backing Store) error {
+		return backing.RemoveOutboundGroupSession(roomID)
+	}})
+}
+
+// ValidateMessageIndex checks the message index against the ones seen by this process. Indexes that aren't in
+// memory are always checked against (and saved in) the backing store before returning, regardless of the
+// consistency mode, so that replay protection isn't weakened by the cache.
+func (store *WriteBehindStore) ValidateMessageIndex(ctx context.Context, senderKey id.SenderKey, sessionID id.SessionID, eventID id.EventID, index uint, timestamp int64) (bool, error) {
+	key := messageIndexKey{SenderKey: senderKey, SessionID: sessionID, Index: index}
+	value := messageIndexValue{EventID: eventID, Timestamp: timestamp}
+	store.lock.Lock()
+	existing, ok := store.messageIndex[key]
+	store.lock.Unlock()
+	if ok {
+		return existing == value, nil
+	}
+	valid, err := store.Store.ValidateMessageIndex(ctx, senderKey, sessionID, eventID, index, timestamp)
+	if err == nil && valid {
+		store.lock.Lock()
+		if len(store.messageIndex) >= maxCachedMessageIndexes {
+			// Everything in the map is already in the backing store, so it's safe to forget it.
+			store.messageIndex = make(map[messageIndexKey]messageIndexValue)
+		}
+		store.messageIndex[key] = value
+		store.lock.Unlock()
+	}
+	return valid, err
+}
+
+// UntrackUsers passes the call through to the backing store if it supports untracking users.
+func (store *WriteBehindStore) UntrackUsers(users []id.UserID) error {
+	untracker, ok := store.Store.(DeviceListUntrackingStore)
+	if !ok {
+		return errors.New("backing crypto store doesn't support untracking users")
+	}
+	return untracker.UntrackUsers(users)
+}
@@ -41,9 +41,46 @@ type BeeperMessageStatusEventContent struct {
 
 	LastRetry id.EventID `json:"last_retry,omitempty"`
 
+	// DeliveredToUsers is the list of users the message was delivered to, used for messages that are sent
+	// to multiple recipients separately, such as broadcast lists.
+	DeliveredToUsers *[]id.UserID `json:"delivered_to_users,omitempty"`
+
 	MutateEventKey string `json:"mutate_event_key,omitempty"`
 }
 
+// RoomFeaturesEventContent represents the content of a com.beeper.room_features state event,
+// which bridges use to tell clients about restrictions of the remote chat.
+type RoomFeaturesEventContent struct {
+	// SlowMode is the number of seconds users have to wait between sending messages.
+	SlowMode int `json:"slow_mode,omitempty"`
+	// MessageEffects is true if the remote chat supports sending messages with effects (see BeeperMessageEffect).
+	MessageEffects bool `json:"message_effects,omitempty"`
+	// CaptionEdits is true if the caption of media messages can be edited.
+	CaptionEdits bool `json:"caption_edits,omitempty"`
+	// MediaEdits is true if edits can replace the media of a message.
+	MediaEdits bool `json:"media_edits,omitempty"`
+}
+
+// ReactionSummaryEventContent represents the content of a com.beeper.reaction_summary state event.
+// The state key is the ID of the event the reactions are for.
+//
+// Bridges use it instead of individual m.reaction events in chats with a very large number of reactions.
+type ReactionSummaryEventContent struct {
+	// Reactions maps reaction keys to the number of users who reacted with that key.
+	Reactions map[string]int `json:"reactions"`
+}
+
+// BeeperMessageEffect contains metadata about an effect or animation that should be shown with a message,
+// such as iMessage screen effects or Telegram animated emoji effects.
+type BeeperMessageEffect struct {
+	// ID is the network-specific identifier of the effect, e.g. com.apple.messages.effect.CKConfettiEffect.
+	ID string `json:"id"`
+	// Name is a human-readable name for the effect, which clients can show if they can't render the effect.
+	Name string `json:"name,omitempty"`
+	// Fallback is an optional image or animation of the effect.
+	Fallback id.ContentURIString `json:"fallback_url,omitempty"`
+}
+
 type BeeperRetryMetadata struct {
 	OriginalEventID id.EventID `json:"original_event_id"`
 	RetryCount      int        `json:"retry_count"`
@@ -39,6 +39,10 @@ var TypeMap = map[Type]reflect.Type{
 	StateSpaceParent:       reflect.TypeOf(SpaceParentEventContent{}),
 	StateSpaceChild:        reflect.TypeOf(SpaceChildEventContent{}),
 	StateInsertionMarker:   reflect.TypeOf(InsertionMarkerContent{}),
+	StateWidget:            reflect.TypeOf(WidgetEventContent{}),
+
+	StateBeeperRoomFeatures:    reflect.TypeOf(RoomFeaturesEventContent{}),
+	StateBeeperReactionSummary: reflect.TypeOf(ReactionSummaryEventContent{}),
 
 	EventMessage:   reflect.TypeOf(MessageEventContent{}),
 	EventSticker:   reflect.TypeOf(MessageEventContent{}),
@@ -200,6 +204,9 @@ func init() {
 	gob.Register(&CanonicalAliasEventContent{})
 	gob.Register(&EncryptionEventContent{})
 	gob.Register(&BridgeEventContent{})
+	gob.Register(&RoomFeaturesEventContent{})
+	gob.Register(&ReactionSummaryEventContent{})
+	gob.Register(&WidgetEventContent{})
 	gob.Register(&SpaceChildEventContent{})
 	gob.Register(&SpaceParentEventContent{})
 	gob.Register(&RoomNameEventContent{})
@@ -329,6 +336,27 @@ func (content *Content) AsBridge() *BridgeEventContent {
 	}
 	return casted
 }
+func (content *Content) AsRoomFeatures() *RoomFeaturesEventContent {
+	casted, ok := content.Parsed.(*RoomFeaturesEventContent)
+	if !ok {
+		return &RoomFeaturesEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsReactionSummary() *ReactionSummaryEventContent {
+	casted, ok := content.Parsed.(*ReactionSummaryEventContent)
+	if !ok {
+		return &ReactionSummaryEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsWidget() *WidgetEventContent {
+	casted, ok := content.Parsed.(*WidgetEventContent)
+	if !ok {
+		return &WidgetEventContent{}
+	}
+	return casted
+}
 func (content *Content) AsSpaceChild() *SpaceChildEventContent {
 	casted, ok := content.Parsed.(*SpaceChildEventContent)
 	if !ok {
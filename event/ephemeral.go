@@ -17,6 +17,24 @@ import (
 // https://spec.matrix.org/v1.2/client-server-api/#mtyping
 type TypingEventContent struct {
 	UserIDs []id.UserID `json:"user_ids"`
+	// Types contains the extended typing types of users (Beeper extension).
+	// Users who aren't in the map are doing normal text typing.
+	Types map[id.UserID]TypingType `json:"com.beeper.typing_types,omitempty"`
+}
+
+// TypingType is the type of activity a typing notification represents (Beeper extension).
+type TypingType string
+
+const (
+	TypingTypeText           TypingType = ""
+	TypingTypeRecordingAudio TypingType = "recording_audio"
+	TypingTypeRecordingVideo TypingType = "recording_video"
+	TypingTypeUploadingMedia TypingType = "uploading_media"
+)
+
+// GetType returns the typing type of the given user.
+func (content *TypingEventContent) GetType(userID id.UserID) TypingType {
+	return content.Types[userID]
 }
 
 // ReceiptEventContent represents the content of a m.receipt ephemeral event.
@@ -7,6 +7,7 @@
 package event
 
 import (
+	"context"
 	"encoding/json"
 	"time"
 
@@ -115,6 +116,10 @@ type MautrixInfo struct {
 	DecryptionDuration time.Duration
 
 	CheckpointSent bool
+
+	// Context carries request-scoped values like loggers and tracing spans along with the event as it's being bridged.
+	// The appservice sets it to the context of the transaction the event was received in.
+	Context context.Context
 }
 
 func (evt *Event) GetStateKey() string {
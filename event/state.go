@@ -149,6 +149,9 @@ type BridgeEventContent struct {
 	Protocol  BridgeInfoSection  `json:"protocol"`
 	Network   *BridgeInfoSection `json:"network,omitempty"`
 	Channel   BridgeInfoSection  `json:"channel"`
+
+	// Metadata contains arbitrary network-specific info about the chat. Keys should be namespaced.
+	Metadata map[string]interface{} `json:"fi.mau.metadata,omitempty"`
 }
 
 type SpaceChildEventContent struct {
@@ -174,3 +177,15 @@ type InsertionMarkerContent struct {
 	InsertionID id.EventID `json:"org.matrix.msc2716.marker.insertion"`
 	Timestamp   int64      `json:"com.beeper.timestamp,omitempty"`
 }
+
+// WidgetEventContent represents the content of a im.vector.modular.widgets state event.
+// An empty content (i.e. no type or URL) means the widget has been removed.
+type WidgetEventContent struct {
+	ID                string                 `json:"id,omitempty"`
+	Type              string                 `json:"type,omitempty"`
+	URL               string                 `json:"url,omitempty"`
+	Name              string                 `json:"name,omitempty"`
+	Data              map[string]interface{} `json:"data,omitempty"`
+	CreatorUserID     id.UserID              `json:"creatorUserId,omitempty"`
+	WaitForIframeLoad bool                   `json:"waitForIframeLoad,omitempty"`
+}
@@ -110,13 +110,14 @@ func (et *Type) GuessClass() TypeClass {
 		StatePowerLevels.Type, StateRoomName.Type, StateRoomAvatar.Type, StateServerACL.Type, StateTopic.Type,
 		StatePinnedEvents.Type, StateTombstone.Type, StateEncryption.Type, StateBridge.Type, StateHalfShotBridge.Type,
 		StateSpaceParent.Type, StateSpaceChild.Type, StatePolicyRoom.Type, StatePolicyServer.Type, StatePolicyUser.Type,
-		StateInsertionMarker.Type:
+		StateInsertionMarker.Type, StateWidget.Type, StateBeeperRoomFeatures.Type, StateBeeperReactionSummary.Type:
 		return StateEventType
 	case EphemeralEventReceipt.Type, EphemeralEventTyping.Type, EphemeralEventPresence.Type:
 		return EphemeralEventType
 	case AccountDataDirectChats.Type, AccountDataPushRules.Type, AccountDataRoomTags.Type,
 		AccountDataSecretStorageKey.Type, AccountDataSecretStorageDefaultKey.Type,
-		AccountDataCrossSigningMaster.Type, AccountDataCrossSigningSelf.Type, AccountDataCrossSigningUser.Type:
+		AccountDataCrossSigningMaster.Type, AccountDataCrossSigningSelf.Type, AccountDataCrossSigningUser.Type,
+		AccountDataMegolmBackupKey.Type:
 		return AccountDataEventType
 	case EventRedaction.Type, EventMessage.Type, EventEncrypted.Type, EventReaction.Type, EventSticker.Type,
 		InRoomVerificationStart.Type, InRoomVerificationReady.Type, InRoomVerificationAccept.Type,
@@ -187,6 +188,10 @@ var (
 	StateSpaceChild        = Type{"m.space.child", StateEventType}
 	StateSpaceParent       = Type{"m.space.parent", StateEventType}
 	StateInsertionMarker   = Type{"org.matrix.msc2716.marker", StateEventType}
+	StateWidget            = Type{"im.vector.modular.widgets", StateEventType}
+
+	StateBeeperRoomFeatures    = Type{"com.beeper.room_features", StateEventType}
+	StateBeeperReactionSummary = Type{"com.beeper.reaction_summary", StateEventType}
 )
 
 // Message events
@@ -235,6 +240,7 @@ var (
 	AccountDataCrossSigningMaster      = Type{"m.cross_signing.master", AccountDataEventType}
 	AccountDataCrossSigningUser        = Type{"m.cross_signing.user_signing", AccountDataEventType}
 	AccountDataCrossSigningSelf        = Type{"m.cross_signing.self_signing", AccountDataEventType}
+	AccountDataMegolmBackupKey         = Type{"m.megolm_backup.v1", AccountDataEventType}
 )
 
 // Device-to-device events
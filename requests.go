@@ -169,6 +169,8 @@ type ReqUnbanUser struct {
 type ReqTyping struct {
 	Typing  bool  `json:"typing"`
 	Timeout int64 `json:"timeout,omitempty"`
+
+	Type event.TypingType `json:"com.beeper.typing_type,omitempty"`
 }
 
 type ReqPresence struct {
@@ -179,6 +181,17 @@ type ReqAliasCreate struct {
 	RoomID id.RoomID `json:"room_id"`
 }
 
+type RoomDirectoryVisibility string
+
+const (
+	RoomDirectoryVisibilityPublic  RoomDirectoryVisibility = "public"
+	RoomDirectoryVisibilityPrivate RoomDirectoryVisibility = "private"
+)
+
+type ReqRoomDirectoryVisibility struct {
+	Visibility RoomDirectoryVisibility `json:"visibility"`
+}
+
 type OneTimeKey struct {
 	Key        id.Curve25519  `json:"key"`
 	Fallback   bool           `json:"fallback,omitempty"`
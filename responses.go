@@ -360,6 +360,10 @@ type RespAliasList struct {
 	Aliases []id.RoomAlias `json:"aliases"`
 }
 
+type RespRoomDirectoryVisibility struct {
+	Visibility RoomDirectoryVisibility `json:"visibility"`
+}
+
 type RespUploadKeys struct {
 	OneTimeKeyCounts OTKCount `json:"one_time_key_counts"`
 }
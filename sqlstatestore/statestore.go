@@ -161,6 +161,25 @@ func (store *SQLStateStore) FindSharedRooms(userID id.UserID) (rooms []id.RoomID
 	return
 }
 
+// FindJoinedRooms returns all rooms where the given user is joined according to the state store.
+func (store *SQLStateStore) FindJoinedRooms(userID id.UserID) (rooms []id.RoomID) {
+	rows, err := store.Query("SELECT room_id FROM mx_user_profile WHERE user_id=$1 AND membership='join'", userID)
+	if err != nil {
+		store.Log.Warn("Failed to query joined rooms of %s: %v", userID, err)
+		return
+	}
+	for rows.Next() {
+		var roomID id.RoomID
+		err = rows.Scan(&roomID)
+		if err != nil {
+			store.Log.Warn("Failed to scan room ID: %v", err)
+		} else {
+			rooms = append(rooms, roomID)
+		}
+	}
+	return
+}
+
 func (store *SQLStateStore) IsInRoom(roomID id.RoomID, userID id.UserID) bool {
 	return store.IsMembership(roomID, userID, "join")
 }
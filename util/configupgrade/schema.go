@@ -0,0 +1,189 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package configupgrade
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SchemaField describes a single field in a config Schema.
+type SchemaField struct {
+	// Path is the location of the field in the config.
+	Path []string
+	// Type contains the allowed types of the field.
+	Type YAMLType
+	// Default is the default value of the field, which is encoded into the base config.
+	Default interface{}
+	// Comment is placed above the field in the base config.
+	Comment string
+	// Required makes validation fail if the field is missing from the config.
+	Required bool
+	// DeprecatedPaths are old locations of the field. When upgrading, values at deprecated paths are
+	// moved to Path if the config doesn't have a value at Path already.
+	DeprecatedPaths [][]string
+	// Validate is an optional function to check the value of the field.
+	Validate func(node *yaml.Node) error
+}
+
+// Schema is a programmatic definition of a config file. It can generate the base config with defaults and
+// comments, upgrade existing configs while preserving comments, and validate configs with precise error paths.
+//
+// Schema implements BaseUpgrader, so it can be used instead of an example config file and a separate upgrader.
+type Schema struct {
+	Fields []SchemaField
+	// Blocks contains paths that should have an empty line before them in the generated config.
+	Blocks [][]string
+}
+
+var _ SpacedUpgrader = (*Schema)(nil)
+var _ BaseUpgrader = (*Schema)(nil)
+
+func (s *Schema) SpacedBlocks() [][]string {
+	return s.Blocks
+}
+
+// GetBase generates the base config from the schema.
+func (s *Schema) GetBase() string {
+	root := &yaml.Node{Kind: yaml.MappingNode, Tag: MapTag}
+	for _, field := range s.Fields {
+		parent := root
+		for _, item := range field.Path[:len(field.Path)-1] {
+			parent = findOrAddMapping(parent, item)
+		}
+		value := yaml.Node{Kind: yaml.ScalarNode, Tag: NullTag, Value: "null"}
+		if field.Default != nil {
+			err := value.Encode(field.Default)
+			if err != nil {
+				panic(fmt.Errorf("failed to encode default value of %s: %w", formatPath(field.Path), err))
+			}
+		}
+		key := &yaml.Node{
+			Kind:        yaml.ScalarNode,
+			Tag:         StrTag,
+			Value:       field.Path[len(field.Path)-1],
+			HeadComment: field.Comment,
+		}
+		parent.Content = append(parent.Content, key, &value)
+	}
+	output, err := yaml.Marshal(root)
+	if err != nil {
+		panic(fmt.Errorf("failed to marshal base config: %w", err))
+	}
+	return string(output)
+}
+
+func findOrAddMapping(parent *yaml.Node, key string) *yaml.Node {
+	for i := 0; i < len(parent.Content); i += 2 {
+		if parent.Content[i].Value == key {
+			return parent.Content[i+1]
+		}
+	}
+	keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: StrTag, Value: key}
+	valueNode := &yaml.Node{Kind: yaml.MappingNode, Tag: MapTag}
+	parent.Content = append(parent.Content, keyNode, valueNode)
+	return valueNode
+}
+
+// DoUpgrade copies values from the user's config into the base config, moving values from deprecated paths.
+func (s *Schema) DoUpgrade(helper *Helper) {
+	for _, field := range s.Fields {
+		if helper.GetNode(field.Path...) == nil {
+			for _, oldPath := range field.DeprecatedPaths {
+				if helper.GetNode(oldPath...) != nil {
+					_, _ = fmt.Fprintf(os.Stderr, "Moving deprecated config field %s to %s\n", formatPath(oldPath), formatPath(field.Path))
+					helper.copyFrom(field.Type, oldPath, field.Path)
+					break
+				}
+			}
+		}
+		helper.Copy(field.Type, field.Path...)
+	}
+}
+
+func (helper *Helper) copyFrom(allowedTypes YAMLType, from, to []string) {
+	cfg := helper.GetNode(from...)
+	base := helper.GetBaseNode(to...)
+	if cfg == nil || base == nil {
+		return
+	} else if allowedTypes&tagToType(cfg.Tag) == 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "Ignoring incorrect config field type %s at %s\n", cfg.Tag, formatPath(from))
+		return
+	}
+	base.Tag = cfg.Tag
+	base.Style = cfg.Style
+	base.Kind = cfg.Kind
+	base.Value = cfg.Value
+	base.Content = cfg.Content
+}
+
+// ValidationError is an error in a single config field.
+type ValidationError struct {
+	Path []string
+	Err  error
+}
+
+func (ve *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %v", formatPath(ve.Path), ve.Err)
+}
+
+func (ve *ValidationError) Unwrap() error {
+	return ve.Err
+}
+
+// ValidationErrors is a list of errors returned by Schema.Validate.
+type ValidationErrors []*ValidationError
+
+func (ves ValidationErrors) Error() string {
+	msgs := make([]string, len(ves))
+	for i, ve := range ves {
+		msgs[i] = ve.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Validate checks the given config data against the schema. If there are any errors,
+// the returned error is a ValidationErrors containing every invalid field.
+func (s *Schema) Validate(configData []byte) error {
+	var doc yaml.Node
+	err := yaml.Unmarshal(configData, &doc)
+	if err != nil {
+		return fmt.Errorf("failed to parse config: %w", err)
+	}
+	var root YAMLNode
+	if len(doc.Content) > 0 {
+		root = fromNode(&doc, nil)
+	}
+	var errs ValidationErrors
+	for _, field := range s.Fields {
+		node := getNode(root, field.Path)
+		if node == nil || node.Node == nil {
+			if field.Required {
+				errs = append(errs, &ValidationError{Path: field.Path, Err: fmt.Errorf("required field is missing")})
+			}
+			continue
+		}
+		if field.Type&tagToType(node.Tag) == 0 {
+			errs = append(errs, &ValidationError{Path: field.Path, Err: fmt.Errorf("unexpected type %s", node.Tag)})
+		} else if field.Validate != nil {
+			if err = field.Validate(node.Node); err != nil {
+				errs = append(errs, &ValidationError{Path: field.Path, Err: err})
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func formatPath(path []string) string {
+	return strings.Join(path, "->")
+}
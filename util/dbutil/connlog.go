@@ -17,13 +17,21 @@ import (
 type LoggingExecable struct {
 	UnderlyingExecable UnderlyingExecable
 	db                 *Database
+	txn                *LoggingTxn
 }
 
 func (le *LoggingExecable) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
 	start := time.Now()
-	query = le.db.mutateQuery(query)
-	res, err := le.UnderlyingExecable.ExecContext(ctx, query, args...)
-	le.db.Log.QueryTiming(ctx, "Exec", query, args, -1, time.Since(start), err)
+	mutatedQuery := le.db.mutateQuery(query)
+	res, err := le.UnderlyingExecable.ExecContext(ctx, mutatedQuery, args...)
+	le.db.Log.QueryTiming(ctx, "Exec", mutatedQuery, args, -1, time.Since(start), err)
+	if dw := le.db.doubleWrite.Load(); dw != nil && err == nil {
+		if le.txn != nil {
+			le.txn.doubleWrites = append(le.txn.doubleWrites, doubleWrittenQuery{query: query, args: args})
+		} else {
+			dw.exec(ctx, []doubleWrittenQuery{{query: query, args: args}})
+		}
+	}
 	return res, err
 }
 
@@ -77,11 +85,13 @@ func (ld *loggingDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Logging
 	if err != nil {
 		return nil, err
 	}
-	return &LoggingTxn{
+	txn := &LoggingTxn{
 		LoggingExecable: LoggingExecable{UnderlyingExecable: tx, db: ld.db},
 		UnderlyingTx:    tx,
 		ctx:             ctx,
-	}, nil
+	}
+	txn.txn = txn
+	return txn, nil
 }
 
 func (ld *loggingDB) Begin() (*LoggingTxn, error) {
@@ -92,12 +102,18 @@ type LoggingTxn struct {
 	LoggingExecable
 	UnderlyingTx *sql.Tx
 	ctx          context.Context
+
+	doubleWrites []doubleWrittenQuery
 }
 
 func (lt *LoggingTxn) Commit() error {
 	start := time.Now()
 	err := lt.UnderlyingTx.Commit()
 	lt.db.Log.QueryTiming(lt.ctx, "Commit", "", nil, -1, time.Since(start), err)
+	if dw := lt.db.doubleWrite.Load(); dw != nil && err == nil && len(lt.doubleWrites) > 0 {
+		dw.exec(lt.ctx, lt.doubleWrites)
+	}
+	lt.doubleWrites = nil
 	return err
 }
 
@@ -0,0 +1,433 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dbutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+var ErrCopyVerificationFailed = errors.New("copied rows don't match")
+
+// CopyOptions contains options for CopyDatabase.
+type CopyOptions struct {
+	// Tables is the list of tables to copy. If empty, all tables in the source database are copied.
+	Tables []string
+	// KeepExisting makes the copy skip rows that conflict with existing rows in the target database instead of
+	// clearing the target tables first. This is meant for copying while double-writing is active.
+	KeepExisting bool
+	// Verify makes the copy compare the row counts and a checksum of the row contents of each table after copying.
+	Verify bool
+}
+
+// TableCopyResult contains the number of rows copied from a single table.
+type TableCopyResult struct {
+	Table string
+	Rows  int
+}
+
+// CopyDatabase copies the rows of all tables from one database to another, which may use a different dialect.
+//
+// The schema must already exist in the target database, which is normally done by running the same upgrades
+// on it as on the source. Rows are streamed table by table in foreign key order, and values are converted
+// to the target column types where SQLite and Postgres differ (e.g. booleans and text stored as bytes).
+// Sequences of auto-incrementing Postgres columns are updated after copying.
+func CopyDatabase(ctx context.Context, src, dst *Database, opts CopyOptions) ([]TableCopyResult, error) {
+	log := zerolog.Ctx(ctx)
+	tables := opts.Tables
+	if len(tables) == 0 {
+		var err error
+		tables, err = src.getTableNames(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tables: %w", err)
+		}
+	}
+	tables, err := src.sortTablesByForeignKeys(ctx, tables)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sort tables: %w", err)
+	}
+	if !opts.KeepExisting {
+		for i := len(tables) - 1; i >= 0; i-- {
+			_, err = dst.ExecContext(ctx, fmt.Sprintf(`DELETE FROM "%s"`, tables[i]))
+			if err != nil {
+				return nil, fmt.Errorf("failed to clear %s in target database: %w", tables[i], err)
+			}
+		}
+	}
+	results := make([]TableCopyResult, 0, len(tables))
+	for _, table := range tables {
+		rows, err := copyTable(ctx, src, dst, table, opts.KeepExisting)
+		if err != nil {
+			return results, fmt.Errorf("failed to copy %s: %w", table, err)
+		}
+		log.Debug().Str("table", table).Int("rows", rows).Msg("Copied table")
+		results = append(results, TableCopyResult{Table: table, Rows: rows})
+		if opts.Verify {
+			err = verifyTable(ctx, src, dst, table)
+			if err != nil {
+				return results, err
+			}
+		}
+	}
+	return results, nil
+}
+
+// PrepareCopyTarget creates the schema of this database and all its children (e.g. state and crypto stores)
+// in the target database by running the same upgrades on it. It should be called before CopyDatabase.
+func (db *Database) PrepareCopyTarget(target *Database) error {
+	target.VersionTable = db.VersionTable
+	target.UpgradeTable = db.UpgradeTable
+	err := target.Upgrade()
+	if err != nil {
+		return fmt.Errorf("failed to upgrade %s in target database: %w", db.VersionTable, err)
+	}
+	db.childrenLock.Lock()
+	children := db.children
+	db.childrenLock.Unlock()
+	for _, child := range children {
+		err = child.PrepareCopyTarget(target.Child(child.VersionTable, child.UpgradeTable, nil))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verifyTable(ctx context.Context, src, dst *Database, table string) error {
+	columnTypes, err := src.getColumnTypes(ctx, table)
+	if err != nil {
+		return fmt.Errorf("failed to get column types of %s in source database: %w", table, err)
+	}
+	columns := make([]string, 0, len(columnTypes))
+	for column := range columnTypes {
+		columns = append(columns, fmt.Sprintf(`"%s"`, column))
+	}
+	sort.Strings(columns)
+	query := fmt.Sprintf(`SELECT %s FROM "%s"`, strings.Join(columns, ", "), table)
+	srcCount, srcSum, err := checksumRows(ctx, src, query, len(columns))
+	if err != nil {
+		return fmt.Errorf("failed to checksum rows of %s in source database: %w", table, err)
+	}
+	dstCount, dstSum, err := checksumRows(ctx, dst, query, len(columns))
+	if err != nil {
+		return fmt.Errorf("failed to checksum rows of %s in target database: %w", table, err)
+	}
+	if srcCount != dstCount {
+		return fmt.Errorf("%w: %s has %d rows in source and %d in target", ErrCopyVerificationFailed, table, srcCount, dstCount)
+	} else if srcSum != dstSum {
+		return fmt.Errorf("%w: contents of %s differ between source and target", ErrCopyVerificationFailed, table)
+	}
+	return nil
+}
+
+// checksumRows returns the number of rows and an order-independent checksum of their contents.
+// Values are normalized so that the same row has the same checksum in SQLite and Postgres.
+func checksumRows(ctx context.Context, db *Database, query string, columnCount int) (count int, sum uint64, err error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	row := make([]interface{}, columnCount)
+	scanTargets := make([]interface{}, columnCount)
+	for i := range row {
+		scanTargets[i] = &row[i]
+	}
+	hash := fnv.New64a()
+	for rows.Next() {
+		if err = rows.Scan(scanTargets...); err != nil {
+			return
+		}
+		hash.Reset()
+		for _, val := range row {
+			_, _ = hash.Write([]byte(normalizeValue(val)))
+			_, _ = hash.Write([]byte{0})
+		}
+		sum += hash.Sum64()
+		count++
+	}
+	err = rows.Err()
+	return
+}
+
+func normalizeValue(val interface{}) string {
+	switch typedVal := val.(type) {
+	case nil:
+		return "\x00null"
+	case bool:
+		if typedVal {
+			return "1"
+		}
+		return "0"
+	case []byte:
+		return string(typedVal)
+	case string:
+		return typedVal
+	case time.Time:
+		return typedVal.UTC().Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(typedVal)
+	}
+}
+
+func copyTable(ctx context.Context, src, dst *Database, table string, keepExisting bool) (int, error) {
+	columnTypes, err := dst.getColumnTypes(ctx, table)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get column types in target database: %w", err)
+	}
+	rows, err := src.QueryContext(ctx, fmt.Sprintf(`SELECT * FROM "%s"`, table))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	targetTypes := make([]string, len(columns))
+	quotedColumns := make([]string, len(columns))
+	for i, column := range columns {
+		targetTypes[i] = columnTypes[column]
+		quotedColumns[i] = fmt.Sprintf(`"%s"`, column)
+	}
+	var suffix string
+	if keepExisting {
+		suffix = "ON CONFLICT DO NOTHING"
+	}
+	inserter := NewMassInsertBuilder(
+		fmt.Sprintf(`INSERT INTO "%s" (%s)`, table, strings.Join(quotedColumns, ", ")),
+		suffix, len(columns), func(row []interface{}) []interface{} { return row },
+	)
+	txn, err := dst.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if txn != nil {
+			_ = txn.Rollback()
+		}
+	}()
+	batch := make([][]interface{}, 0, inserter.BatchSize())
+	count := 0
+	for rows.Next() {
+		row := make([]interface{}, len(columns))
+		scanTargets := make([]interface{}, len(columns))
+		for i := range row {
+			scanTargets[i] = &row[i]
+		}
+		err = rows.Scan(scanTargets...)
+		if err != nil {
+			return count, err
+		}
+		for i, val := range row {
+			row[i] = convertValue(val, targetTypes[i])
+		}
+		batch = append(batch, row)
+		if len(batch) == cap(batch) {
+			err = inserter.Exec(ctx, txn, batch)
+			if err != nil {
+				return count, err
+			}
+			count += len(batch)
+			batch = batch[:0]
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return count, err
+	}
+	err = inserter.Exec(ctx, txn, batch)
+	if err != nil {
+		return count, err
+	}
+	count += len(batch)
+	if dst.Dialect == Postgres {
+		err = resetSequences(ctx, txn, table)
+		if err != nil {
+			return count, fmt.Errorf("failed to reset sequences: %w", err)
+		}
+	}
+	err = txn.Commit()
+	txn = nil
+	return count, err
+}
+
+func convertValue(val interface{}, targetType string) interface{} {
+	switch typedVal := val.(type) {
+	case int64:
+		if targetType == "boolean" {
+			return typedVal != 0
+		}
+	case []byte:
+		if targetType != "bytea" && targetType != "blob" {
+			return string(typedVal)
+		}
+	case string:
+		if targetType == "bytea" || targetType == "blob" {
+			return []byte(typedVal)
+		}
+	}
+	return val
+}
+
+func resetSequences(ctx context.Context, txn *LoggingTxn, table string) error {
+	rows, err := txn.QueryContext(ctx, `
+		SELECT column_name FROM information_schema.columns
+		WHERE table_schema=current_schema() AND table_name=$1 AND (column_default LIKE 'nextval(%' OR is_identity='YES')
+	`, table)
+	if err != nil {
+		return err
+	}
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err = rows.Scan(&column); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		columns = append(columns, column)
+	}
+	_ = rows.Close()
+	for _, column := range columns {
+		_, err = txn.ExecContext(ctx, fmt.Sprintf(
+			`SELECT setval(pg_get_serial_sequence('"%[1]s"', '%[2]s'), COALESCE((SELECT MAX("%[2]s") FROM "%[1]s"), 0) + 1, false)`,
+			table, column,
+		))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *Database) queryStrings(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err = rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+func (db *Database) getTableNames(ctx context.Context) ([]string, error) {
+	switch db.Dialect {
+	case SQLite:
+		return db.queryStrings(ctx, "SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%'")
+	case Postgres:
+		return db.queryStrings(ctx, "SELECT tablename FROM pg_tables WHERE schemaname=current_schema()")
+	default:
+		return nil, fmt.Errorf("unsupported dialect %s", db.Dialect)
+	}
+}
+
+func (db *Database) getForeignKeyTargets(ctx context.Context, table string) ([]string, error) {
+	switch db.Dialect {
+	case SQLite:
+		return db.queryStrings(ctx, `SELECT DISTINCT "table" FROM pragma_foreign_key_list($1)`, table)
+	case Postgres:
+		return db.queryStrings(ctx, `
+			SELECT DISTINCT ccu.table_name FROM information_schema.table_constraints tc
+			JOIN information_schema.constraint_column_usage ccu
+				ON tc.constraint_name=ccu.constraint_name AND tc.table_schema=ccu.table_schema
+			WHERE tc.constraint_type='FOREIGN KEY' AND tc.table_schema=current_schema() AND tc.table_name=$1
+		`, table)
+	default:
+		return nil, fmt.Errorf("unsupported dialect %s", db.Dialect)
+	}
+}
+
+// getColumnTypes returns the lowercased types of the columns in the given table.
+func (db *Database) getColumnTypes(ctx context.Context, table string) (map[string]string, error) {
+	var query string
+	switch db.Dialect {
+	case SQLite:
+		query = "SELECT name, type FROM pragma_table_info($1)"
+	case Postgres:
+		query = "SELECT column_name, data_type FROM information_schema.columns WHERE table_schema=current_schema() AND table_name=$1"
+	default:
+		return nil, fmt.Errorf("unsupported dialect %s", db.Dialect)
+	}
+	rows, err := db.QueryContext(ctx, query, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	types := make(map[string]string)
+	for rows.Next() {
+		var name, colType string
+		if err = rows.Scan(&name, &colType); err != nil {
+			return nil, err
+		}
+		types[name] = strings.ToLower(colType)
+	}
+	return types, rows.Err()
+}
+
+// sortTablesByForeignKeys orders the tables so that tables referenced by foreign keys come before the tables
+// referencing them. Tables in reference cycles are left in alphabetical order at the end.
+func (db *Database) sortTablesByForeignKeys(ctx context.Context, tables []string) ([]string, error) {
+	deps := make(map[string]map[string]struct{}, len(tables))
+	for _, table := range tables {
+		targets, err := db.getForeignKeyTargets(ctx, table)
+		if err != nil {
+			return nil, err
+		}
+		deps[table] = make(map[string]struct{}, len(targets))
+		for _, target := range targets {
+			if target != table {
+				deps[table][target] = struct{}{}
+			}
+		}
+	}
+	remaining := make([]string, len(tables))
+	copy(remaining, tables)
+	sort.Strings(remaining)
+	sorted := make([]string, 0, len(tables))
+	done := make(map[string]struct{}, len(tables))
+	for len(remaining) > 0 {
+		progress := false
+		next := remaining[:0]
+		for _, table := range remaining {
+			ready := true
+			for dep := range deps[table] {
+				_, depDone := done[dep]
+				_, depIncluded := deps[dep]
+				if !depDone && depIncluded {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				sorted = append(sorted, table)
+				done[table] = struct{}{}
+				progress = true
+			} else {
+				next = append(next, table)
+			}
+		}
+		remaining = next
+		if !progress {
+			sorted = append(sorted, remaining...)
+			break
+		}
+	}
+	return sorted, nil
+}
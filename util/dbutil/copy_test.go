@@ -0,0 +1,112 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dbutil_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+const copyTestSchema = `
+	CREATE TABLE child (id INTEGER PRIMARY KEY, parent_id INTEGER NOT NULL REFERENCES parent(id), data BLOB);
+	CREATE TABLE parent (id INTEGER PRIMARY KEY, name TEXT NOT NULL, active BOOLEAN NOT NULL);
+`
+
+func makeCopyTestDB(t *testing.T) *dbutil.Database {
+	db, err := dbutil.NewWithDialect(":memory:", "sqlite3")
+	require.NoError(t, err)
+	db.RawDB.SetMaxOpenConns(1)
+	_, err = db.Exec("PRAGMA foreign_keys = ON")
+	require.NoError(t, err)
+	_, err = db.Exec(copyTestSchema)
+	require.NoError(t, err)
+	return db
+}
+
+func TestCopyDatabase(t *testing.T) {
+	ctx := context.Background()
+	src := makeCopyTestDB(t)
+	dst := makeCopyTestDB(t)
+	for i := 1; i <= 300; i++ {
+		_, err := src.Exec("INSERT INTO parent (id, name, active) VALUES ($1, $2, $3)", i, fmt.Sprintf("parent %d", i), i%2 == 0)
+		require.NoError(t, err)
+		_, err = src.Exec("INSERT INTO child (id, parent_id, data) VALUES ($1, $2, $3)", i, i, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, err := dst.Exec("INSERT INTO parent (id, name, active) VALUES (1000, 'stale', false)")
+	require.NoError(t, err)
+
+	results, err := dbutil.CopyDatabase(ctx, src, dst, dbutil.CopyOptions{Verify: true})
+	require.NoError(t, err)
+	assert.Equal(t, []dbutil.TableCopyResult{{Table: "parent", Rows: 300}, {Table: "child", Rows: 300}}, results)
+
+	var name string
+	var active bool
+	var data []byte
+	err = dst.QueryRow("SELECT name, active, data FROM parent JOIN child ON child.parent_id=parent.id WHERE parent.id=42").Scan(&name, &active, &data)
+	require.NoError(t, err)
+	assert.Equal(t, "parent 42", name)
+	assert.True(t, active)
+	assert.Equal(t, []byte{42}, data)
+}
+
+func TestDoubleWrite(t *testing.T) {
+	ctx := context.Background()
+	src := makeCopyTestDB(t)
+	dst := makeCopyTestDB(t)
+	_, err := src.Exec("INSERT INTO parent (id, name, active) VALUES (1, 'before', true)")
+	require.NoError(t, err)
+
+	src.StartDoubleWrite(dst)
+	_, err = src.Exec("INSERT INTO parent (id, name, active) VALUES (2, 'during', true)")
+	require.NoError(t, err)
+	txn, err := src.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	_, err = txn.Exec("INSERT INTO parent (id, name, active) VALUES (3, 'committed', true)")
+	require.NoError(t, err)
+	require.NoError(t, txn.Commit())
+	txn, err = src.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	_, err = txn.Exec("INSERT INTO parent (id, name, active) VALUES (4, 'rolled back', true)")
+	require.NoError(t, err)
+	require.NoError(t, txn.Rollback())
+
+	_, err = dbutil.CopyDatabase(ctx, src, dst, dbutil.CopyOptions{KeepExisting: true, Verify: true})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), src.StopDoubleWrite())
+
+	_, err = src.Exec("INSERT INTO parent (id, name, active) VALUES (5, 'after', true)")
+	require.NoError(t, err)
+	var count int
+	require.NoError(t, dst.QueryRow("SELECT COUNT(*) FROM parent").Scan(&count))
+	assert.Equal(t, 3, count)
+}
+
+func TestCopyDatabase_VerifyDetectsLostUpdate(t *testing.T) {
+	ctx := context.Background()
+	src := makeCopyTestDB(t)
+	dst := makeCopyTestDB(t)
+	_, err := src.Exec("INSERT INTO parent (id, name, active) VALUES (1, 'original', true)")
+	require.NoError(t, err)
+	_, err = dbutil.CopyDatabase(ctx, src, dst, dbutil.CopyOptions{Verify: true})
+	require.NoError(t, err)
+
+	// Simulate an update that was made on the source while the row was being copied and never reached the target.
+	_, err = src.Exec("UPDATE parent SET name='updated' WHERE id=1")
+	require.NoError(t, err)
+	_, err = dbutil.CopyDatabase(ctx, src, dst, dbutil.CopyOptions{KeepExisting: true, Verify: true})
+	assert.ErrorIs(t, err, dbutil.ErrCopyVerificationFailed)
+
+	_, err = dbutil.CopyDatabase(ctx, src, dst, dbutil.CopyOptions{Verify: true})
+	assert.NoError(t, err)
+}
@@ -12,6 +12,8 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -117,6 +119,10 @@ type Database struct {
 
 	IgnoreForeignTables       bool
 	IgnoreUnsupportedDatabase bool
+
+	doubleWrite  atomic.Pointer[doubleWriter]
+	children     []*Database
+	childrenLock sync.Mutex
 }
 
 var positionalParamPattern = regexp.MustCompile(`\$(\d+)`)
@@ -134,7 +140,7 @@ func (db *Database) Child(versionTable string, upgradeTable UpgradeTable, log Da
 	if log == nil {
 		log = db.Log
 	}
-	return &Database{
+	child := &Database{
 		RawDB:        db.RawDB,
 		loggingDB:    db.loggingDB,
 		Owner:        "",
@@ -146,6 +152,10 @@ func (db *Database) Child(versionTable string, upgradeTable UpgradeTable, log Da
 		IgnoreForeignTables:       true,
 		IgnoreUnsupportedDatabase: db.IgnoreUnsupportedDatabase,
 	}
+	db.childrenLock.Lock()
+	db.children = append(db.children, child)
+	db.childrenLock.Unlock()
+	return child
 }
 
 func NewWithDB(db *sql.DB, rawDialect string) (*Database, error) {
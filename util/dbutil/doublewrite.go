@@ -0,0 +1,79 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dbutil
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+)
+
+type doubleWriter struct {
+	target *Database
+	errors atomic.Int64
+}
+
+type doubleWrittenQuery struct {
+	query string
+	args  []interface{}
+}
+
+// StartDoubleWrite makes every successful Exec call on this database (and its children) also run on the target
+// database. Writes made in transactions are replayed on the target in a single transaction after committing.
+//
+// This is meant for a brief window while switching database backends: start double-writing, copy the existing
+// rows with CopyDatabase using KeepExisting, then restart with the target database. Errors on the target don't
+// affect the primary database and are only logged and counted, so CopyDatabase should be run with Verify.
+//
+// Updates and deletes of rows that haven't been copied yet only affect the primary database, which is fine
+// if the copy reads the changed row later. However, an update made after the copy of a table has started
+// reading but before it's committed on the target is lost, as it matches no rows on the target. Verify compares
+// the row contents to detect this, in which case the copy must be run again, ideally with writes paused.
+//
+// Queries are run as-is on the target, so queries that differ by dialect may fail if the databases use
+// different dialects.
+func (db *Database) StartDoubleWrite(target *Database) {
+	db.doubleWrite.Store(&doubleWriter{target: target})
+}
+
+// StopDoubleWrite stops double-writing and returns the number of writes that failed on the target database.
+func (db *Database) StopDoubleWrite() int64 {
+	dw := db.doubleWrite.Swap(nil)
+	if dw == nil {
+		return 0
+	}
+	return dw.errors.Load()
+}
+
+func (dw *doubleWriter) exec(ctx context.Context, queries []doubleWrittenQuery) {
+	var execable ContextExecable = dw.target
+	var txn *LoggingTxn
+	if len(queries) > 1 {
+		var err error
+		txn, err = dw.target.BeginTx(ctx, nil)
+		if err != nil {
+			dw.errors.Add(1)
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to begin transaction in double-write target")
+			return
+		}
+		execable = txn
+	}
+	for _, query := range queries {
+		_, err := execable.ExecContext(ctx, query.query, query.args...)
+		if err != nil {
+			dw.errors.Add(1)
+			zerolog.Ctx(ctx).Warn().Err(err).Str("query", query.query).Msg("Failed to execute query in double-write target")
+		}
+	}
+	if txn != nil {
+		if err := txn.Commit(); err != nil {
+			dw.errors.Add(1)
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to commit transaction in double-write target")
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dbutil
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// MaxMassInsertParams is the maximum number of parameters used in a single mass insert query. Both SQLite and
+// Postgres allow much more, but binding parameters gets slower per row with bigger queries on SQLite, and most
+// of the gain comes from avoiding round trips, which a few hundred parameters per query already does.
+const MaxMassInsertParams = 500
+
+// MassInsertBuilder builds multi-row INSERT queries, which are much faster than inserting rows one by one
+// when e.g. backfilling messages or syncing reactions, as each query is a separate database round trip.
+//
+// Multi-row VALUES are used instead of COPY on Postgres, as COPY doesn't support ON CONFLICT clauses.
+type MassInsertBuilder[Item any] struct {
+	prefix     string
+	suffix     string
+	columns    int
+	itemToArgs func(Item) []interface{}
+}
+
+// NewMassInsertBuilder creates a builder for multi-row inserts.
+//
+// The prefix is the part of the query before the values, e.g. `INSERT INTO table (a, b)`, and the suffix is
+// the part after them, e.g. an ON CONFLICT clause. The itemToArgs function must return exactly one value per column.
+func NewMassInsertBuilder[Item any](prefix, suffix string, columns int, itemToArgs func(Item) []interface{}) *MassInsertBuilder[Item] {
+	if columns <= 0 || columns > MaxMassInsertParams {
+		panic(fmt.Errorf("invalid column count %d for mass insert", columns))
+	}
+	return &MassInsertBuilder[Item]{
+		prefix:     prefix,
+		suffix:     suffix,
+		columns:    columns,
+		itemToArgs: itemToArgs,
+	}
+}
+
+// BatchSize returns the maximum number of rows inserted with one query.
+func (mib *MassInsertBuilder[Item]) BatchSize() int {
+	return MaxMassInsertParams / mib.columns
+}
+
+// Build builds the query and parameters for inserting the given items. It doesn't split the items into batches,
+// so callers must make sure there are at most BatchSize items.
+func (mib *MassInsertBuilder[Item]) Build(items []Item) (string, []interface{}) {
+	args := make([]interface{}, 0, len(items)*mib.columns)
+	var query strings.Builder
+	query.Grow(len(mib.prefix) + len(mib.suffix) + len(items)*mib.columns*6 + 8)
+	query.WriteString(mib.prefix)
+	query.WriteString(" VALUES ")
+	for i, item := range items {
+		itemArgs := mib.itemToArgs(item)
+		if len(itemArgs) != mib.columns {
+			panic(fmt.Errorf("mass insert item returned %d values, expected %d", len(itemArgs), mib.columns))
+		}
+		if i > 0 {
+			query.WriteByte(',')
+		}
+		query.WriteByte('(')
+		for j := range itemArgs {
+			if j > 0 {
+				query.WriteByte(',')
+			}
+			_, _ = fmt.Fprintf(&query, "$%d", len(args)+j+1)
+		}
+		query.WriteByte(')')
+		args = append(args, itemArgs...)
+	}
+	if mib.suffix != "" {
+		query.WriteByte(' ')
+		query.WriteString(mib.suffix)
+	}
+	return query.String(), args
+}
+
+// Exec inserts all the given items, splitting them into as few queries as possible.
+//
+// The queries aren't wrapped in a transaction, so callers that need all rows to be inserted atomically
+// should pass a transaction as the Execable.
+func (mib *MassInsertBuilder[Item]) Exec(ctx context.Context, db ContextExecable, items []Item) error {
+	batchSize := mib.BatchSize()
+	for len(items) > 0 {
+		batch := items
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		items = items[len(batch):]
+		query, args := mib.Build(batch)
+		_, err := db.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
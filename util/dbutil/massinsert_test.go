@@ -0,0 +1,89 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dbutil_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+type testRow struct {
+	Key   string
+	Value int
+}
+
+var testRowInserter = dbutil.NewMassInsertBuilder(
+	"INSERT INTO test_row (key, value)",
+	"ON CONFLICT (key) DO UPDATE SET value=excluded.value",
+	2, func(row testRow) []interface{} {
+		return []interface{}{row.Key, row.Value}
+	},
+)
+
+func makeTestDB(t testing.TB) *dbutil.Database {
+	db, err := dbutil.NewWithDialect(":memory:", "sqlite3")
+	require.NoError(t, err)
+	db.RawDB.SetMaxOpenConns(1)
+	_, err = db.Exec("CREATE TABLE test_row (key TEXT PRIMARY KEY, value INTEGER NOT NULL)")
+	require.NoError(t, err)
+	return db
+}
+
+func makeTestRows(count int) []testRow {
+	rows := make([]testRow, count)
+	for i := range rows {
+		rows[i] = testRow{Key: fmt.Sprintf("row%d", i), Value: i}
+	}
+	return rows
+}
+
+func TestMassInsertBuilder_Build(t *testing.T) {
+	query, args := testRowInserter.Build([]testRow{{"a", 1}, {"b", 2}})
+	assert.Equal(t, "INSERT INTO test_row (key, value) VALUES ($1,$2),($3,$4) ON CONFLICT (key) DO UPDATE SET value=excluded.value", query)
+	assert.Equal(t, []interface{}{"a", 1, "b", 2}, args)
+}
+
+func TestMassInsertBuilder_Exec(t *testing.T) {
+	db := makeTestDB(t)
+	rows := makeTestRows(testRowInserter.BatchSize()*2 + 5)
+	require.NoError(t, testRowInserter.Exec(context.Background(), db, rows))
+	require.NoError(t, testRowInserter.Exec(context.Background(), db, []testRow{{"row0", -1}}))
+	var count, value int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM test_row").Scan(&count))
+	assert.Equal(t, len(rows), count)
+	require.NoError(t, db.QueryRow("SELECT value FROM test_row WHERE key='row0'").Scan(&value))
+	assert.Equal(t, -1, value)
+}
+
+func BenchmarkInsert_Individual(b *testing.B) {
+	db := makeTestDB(b)
+	rows := makeTestRows(b.N)
+	b.ResetTimer()
+	for _, row := range rows {
+		_, err := db.Exec("INSERT INTO test_row (key, value) VALUES ($1, $2)", row.Key, row.Value)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInsert_Mass(b *testing.B) {
+	db := makeTestDB(b)
+	rows := makeTestRows(b.N)
+	b.ResetTimer()
+	err := testRowInserter.Exec(context.Background(), db, rows)
+	if err != nil {
+		b.Fatal(err)
+	}
+}
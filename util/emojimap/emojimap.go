@@ -0,0 +1,163 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package emojimap provides a two-way mapping between remote network reaction IDs and Matrix reaction keys.
+package emojimap
+
+import (
+	"sort"
+	"strings"
+
+	"maunium.net/go/mautrix/util/variationselector"
+)
+
+// VariationSelectorPolicy defines what to do with emoji variation selectors in Matrix reaction keys.
+type VariationSelectorPolicy string
+
+const (
+	// VariationSelectorsKeep leaves variation selectors as-is.
+	VariationSelectorsKeep VariationSelectorPolicy = "keep"
+	// VariationSelectorsAdd adds variation selectors like the Matrix spec recommends.
+	VariationSelectorsAdd VariationSelectorPolicy = "add"
+	// VariationSelectorsRemove removes all variation selectors.
+	VariationSelectorsRemove VariationSelectorPolicy = "remove"
+	// VariationSelectorsFullyQualify only adds variation selectors that are required for fully-qualified emojis.
+	VariationSelectorsFullyQualify VariationSelectorPolicy = "fully-qualify"
+)
+
+var skinToneRemover = strings.NewReplacer(
+	"\U0001F3FB", "",
+	"\U0001F3FC", "",
+	"\U0001F3FD", "",
+	"\U0001F3FE", "",
+	"\U0001F3FF", "",
+)
+
+// Config contains the operator-configurable parts of an EmojiMap.
+type Config struct {
+	// Overrides maps remote reaction IDs to Matrix reaction keys. They take precedence over the defaults.
+	Overrides map[string]string `yaml:"overrides"`
+	// NormalizeSkinTones removes skin tone modifiers from reactions sent to the remote network.
+	NormalizeSkinTones bool `yaml:"normalize_skin_tones"`
+	// VariationSelectors is the policy for variation selectors in reactions sent to Matrix.
+	VariationSelectors VariationSelectorPolicy `yaml:"variation_selectors"`
+}
+
+// EmojiMap translates reactions between a remote network and Matrix.
+//
+// Reactions that aren't in the map are passed through unchanged (other than the variation selector policy
+// and skin tone normalization).
+type EmojiMap struct {
+	toMatrix map[string]string
+	toRemote map[string]string
+
+	NormalizeSkinTones bool
+	VariationSelectors VariationSelectorPolicy
+}
+
+// New creates an EmojiMap with the given default mapping from remote reaction IDs to Matrix reaction keys.
+// If multiple remote IDs map to the same Matrix key, the alphabetically first one is used when converting
+// from Matrix to the remote network.
+func New(defaults map[string]string) *EmojiMap {
+	em := &EmojiMap{
+		toMatrix: make(map[string]string, len(defaults)),
+		toRemote: make(map[string]string, len(defaults)),
+
+		VariationSelectors: VariationSelectorsAdd,
+	}
+	em.setAll(defaults)
+	return em
+}
+
+// Set adds a mapping between a remote reaction ID and a Matrix reaction key.
+//
+// Multiple remote IDs may map to the same Matrix key, in which case the one set last is used when
+// converting from Matrix to the remote network.
+func (em *EmojiMap) Set(remote, matrix string) {
+	oldMatrix, hadOld := em.toMatrix[remote]
+	em.toMatrix[remote] = matrix
+	if hadOld {
+		oldMatrixKey := variationselector.Remove(oldMatrix)
+		if em.toRemote[oldMatrixKey] == remote {
+			delete(em.toRemote, oldMatrixKey)
+			em.restoreReverse(oldMatrixKey)
+		}
+	}
+	em.toRemote[variationselector.Remove(matrix)] = remote
+}
+
+// restoreReverse points the given Matrix key back to the alphabetically first remote ID that still maps to it,
+// after the remote ID it pointed to was remapped.
+func (em *EmojiMap) restoreReverse(matrixKey string) {
+	var best string
+	found := false
+	for remote, matrix := range em.toMatrix {
+		if variationselector.Remove(matrix) == matrixKey && (!found || remote < best) {
+			best = remote
+			found = true
+		}
+	}
+	if found {
+		em.toRemote[matrixKey] = best
+	}
+}
+
+// setAll adds all the given mappings in a deterministic order. If multiple remote IDs in the map have the same
+// Matrix key, the alphabetically first one is used when converting from Matrix to the remote network.
+func (em *EmojiMap) setAll(mapping map[string]string) {
+	remotes := make([]string, 0, len(mapping))
+	for remote := range mapping {
+		remotes = append(remotes, remote)
+	}
+	// Later calls to Set win, so go through the IDs in reverse order.
+	sort.Sort(sort.Reverse(sort.StringSlice(remotes)))
+	for _, remote := range remotes {
+		em.Set(remote, mapping[remote])
+	}
+}
+
+// ApplyConfig applies the overrides and policies from the given config. Overrides take precedence over
+// the defaults, and ties between overrides are resolved like in New.
+func (em *EmojiMap) ApplyConfig(cfg Config) {
+	em.setAll(cfg.Overrides)
+	em.NormalizeSkinTones = cfg.NormalizeSkinTones
+	if cfg.VariationSelectors != "" {
+		em.VariationSelectors = cfg.VariationSelectors
+	}
+}
+
+// ToMatrix converts a remote reaction ID into a Matrix reaction key.
+func (em *EmojiMap) ToMatrix(remote string) string {
+	matrix, ok := em.toMatrix[remote]
+	if !ok {
+		matrix = remote
+	}
+	switch em.VariationSelectors {
+	case VariationSelectorsAdd:
+		return variationselector.Add(matrix)
+	case VariationSelectorsRemove:
+		return variationselector.Remove(matrix)
+	case VariationSelectorsFullyQualify:
+		return variationselector.FullyQualify(matrix)
+	default:
+		return matrix
+	}
+}
+
+// ToRemote converts a Matrix reaction key into a remote reaction ID.
+//
+// Variation selectors are ignored when looking up the mapping, but reactions that aren't in the map
+// are passed through with their variation selectors intact.
+func (em *EmojiMap) ToRemote(matrix string) string {
+	if em.NormalizeSkinTones {
+		matrix = skinToneRemover.Replace(matrix)
+	}
+	remote, ok := em.toRemote[variationselector.Remove(matrix)]
+	if !ok {
+		return matrix
+	}
+	return remote
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package emojimap_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/util/emojimap"
+)
+
+func TestEmojiMap_ToMatrix(t *testing.T) {
+	em := emojimap.New(map[string]string{"thumbsup": "\U0001f44d"})
+	assert.Equal(t, "\U0001f44d️", em.ToMatrix("thumbsup"))
+	assert.Equal(t, "\U0001f914", em.ToMatrix("\U0001f914"))
+	em.VariationSelectors = emojimap.VariationSelectorsRemove
+	assert.Equal(t, "\U0001f44d", em.ToMatrix("thumbsup"))
+}
+
+func TestEmojiMap_ToRemote(t *testing.T) {
+	em := emojimap.New(map[string]string{"thumbsup": "\U0001f44d"})
+	assert.Equal(t, "thumbsup", em.ToRemote("\U0001f44d️"))
+	assert.Equal(t, "\U0001f44d\U0001f3fd", em.ToRemote("\U0001f44d\U0001f3fd"))
+	em.NormalizeSkinTones = true
+	assert.Equal(t, "thumbsup", em.ToRemote("\U0001f44d\U0001f3fd"))
+	assert.Equal(t, "❤️", em.ToRemote("❤️"), "unmapped reactions should keep variation selectors")
+}
+
+func TestEmojiMap_DuplicateKeys(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		em := emojimap.New(map[string]string{"thumbsup": "\U0001f44d", "+1": "\U0001f44d", "like": "\U0001f44d"})
+		assert.Equal(t, "+1", em.ToRemote("\U0001f44d"))
+	}
+	em := emojimap.New(map[string]string{"thumbsup": "\U0001f44d", "+1": "\U0001f44d"})
+	em.Set("+1", "\U0001f44e")
+	assert.Equal(t, "thumbsup", em.ToRemote("\U0001f44d"), "remapping the winner should fall back to the other mapping")
+	assert.Equal(t, "+1", em.ToRemote("\U0001f44e"))
+}
+
+func TestEmojiMap_ApplyConfig(t *testing.T) {
+	em := emojimap.New(map[string]string{"thumbsup": "\U0001f44d", "heart": "❤"})
+	em.ApplyConfig(emojimap.Config{
+		Overrides:          map[string]string{"like": "\U0001f44d"},
+		VariationSelectors: emojimap.VariationSelectorsKeep,
+	})
+	assert.Equal(t, "like", em.ToRemote("\U0001f44d"))
+	assert.Equal(t, "\U0001f44d", em.ToMatrix("like"))
+	assert.Equal(t, "\U0001f44d", em.ToMatrix("thumbsup"))
+	assert.Equal(t, "heart", em.ToRemote("❤️"))
+}
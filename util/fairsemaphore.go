@@ -0,0 +1,134 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package util
+
+import (
+	"context"
+	"sync"
+)
+
+type fairWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// FairSemaphore limits the number of concurrent holders, and hands out free slots to waiters round-robin
+// by key, so that a single key with lots of waiters can't starve the others. Waiters with the same key are
+// served in the order they started waiting.
+type FairSemaphore[Key comparable] struct {
+	lock    sync.Mutex
+	limit   int
+	active  int
+	waiters map[Key][]*fairWaiter
+	order   []Key
+}
+
+// NewFairSemaphore creates a new semaphore that allows up to the given number of concurrent holders.
+func NewFairSemaphore[Key comparable](limit int) *FairSemaphore[Key] {
+	if limit <= 0 {
+		panic("semaphore limit must be positive")
+	}
+	return &FairSemaphore[Key]{
+		limit:   limit,
+		waiters: make(map[Key][]*fairWaiter),
+	}
+}
+
+// Acquire waits until a slot is free and takes it. Every successful call must be followed by a call to Release.
+//
+// If the context is canceled before a slot is free, the context's error is returned and no slot is taken.
+func (fs *FairSemaphore[Key]) Acquire(ctx context.Context, key Key) error {
+	fs.lock.Lock()
+	if fs.active < fs.limit && len(fs.order) == 0 {
+		fs.active++
+		fs.lock.Unlock()
+		return nil
+	}
+	waiter := &fairWaiter{ready: make(chan struct{})}
+	if len(fs.waiters[key]) == 0 {
+		fs.order = append(fs.order, key)
+	}
+	fs.waiters[key] = append(fs.waiters[key], waiter)
+	fs.lock.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		if waiter.granted {
+			// The slot was handed over at the same time as the context was canceled, pass it on.
+			fs.active--
+			fs.grantNext()
+		} else {
+			fs.removeWaiter(key, waiter)
+		}
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot taken with Acquire and hands it to the next waiter, if there is one.
+func (fs *FairSemaphore[Key]) Release() {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.active <= 0 {
+		panic("semaphore released more times than acquired")
+	}
+	fs.active--
+	fs.grantNext()
+}
+
+// Waiting returns the number of callers waiting for a slot.
+func (fs *FairSemaphore[Key]) Waiting() (count int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for _, waiters := range fs.waiters {
+		count += len(waiters)
+	}
+	return
+}
+
+func (fs *FairSemaphore[Key]) grantNext() {
+	if fs.active >= fs.limit || len(fs.order) == 0 {
+		return
+	}
+	key := fs.order[0]
+	fs.order = fs.order[1:]
+	waiters := fs.waiters[key]
+	waiter := waiters[0]
+	if len(waiters) > 1 {
+		fs.waiters[key] = waiters[1:]
+		fs.order = append(fs.order, key)
+	} else {
+		delete(fs.waiters, key)
+	}
+	fs.active++
+	waiter.granted = true
+	close(waiter.ready)
+}
+
+func (fs *FairSemaphore[Key]) removeWaiter(key Key, waiter *fairWaiter) {
+	waiters := fs.waiters[key]
+	for i, w := range waiters {
+		if w == waiter {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) > 0 {
+		fs.waiters[key] = waiters
+		return
+	}
+	delete(fs.waiters, key)
+	for i, k := range fs.order {
+		if k == key {
+			fs.order = append(fs.order[:i], fs.order[i+1:]...)
+			break
+		}
+	}
+}
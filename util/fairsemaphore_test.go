@@ -0,0 +1,57 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package util_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/util"
+)
+
+func addWaiter(t *testing.T, sem *util.FairSemaphore[string], key, name string, acquired chan<- string) {
+	waiting := sem.Waiting()
+	go func() {
+		require.NoError(t, sem.Acquire(context.Background(), key))
+		acquired <- name
+	}()
+	require.Eventually(t, func() bool { return sem.Waiting() == waiting+1 }, time.Second, time.Millisecond)
+}
+
+func TestFairSemaphore_RoundRobin(t *testing.T) {
+	sem := util.NewFairSemaphore[string](1)
+	require.NoError(t, sem.Acquire(context.Background(), "a"))
+	acquired := make(chan string, 4)
+	addWaiter(t, sem, "a", "a1", acquired)
+	addWaiter(t, sem, "a", "a2", acquired)
+	addWaiter(t, sem, "a", "a3", acquired)
+	addWaiter(t, sem, "b", "b1", acquired)
+	var order []string
+	for i := 0; i < 4; i++ {
+		sem.Release()
+		order = append(order, <-acquired)
+	}
+	assert.Equal(t, []string{"a1", "b1", "a2", "a3"}, order)
+	sem.Release()
+	assert.Equal(t, 0, sem.Waiting())
+}
+
+func TestFairSemaphore_Cancel(t *testing.T) {
+	sem := util.NewFairSemaphore[string](1)
+	require.NoError(t, sem.Acquire(context.Background(), "a"))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, sem.Acquire(ctx, "b"), context.DeadlineExceeded)
+	assert.Equal(t, 0, sem.Waiting())
+	sem.Release()
+	require.NoError(t, sem.Acquire(context.Background(), "b"))
+	sem.Release()
+}
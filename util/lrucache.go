@@ -0,0 +1,95 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package util
+
+import (
+	"container/list"
+	"sync"
+)
+
+type lruEntry[Key comparable, Value any] struct {
+	key   Key
+	value Value
+}
+
+// LRUCache is a fixed-size cache that evicts the least recently used value when it's full.
+type LRUCache[Key comparable, Value any] struct {
+	lock    sync.Mutex
+	size    int
+	order   *list.List
+	data    map[Key]*list.Element
+	onEvict func(Key, Value)
+}
+
+// NewLRUCache creates a new LRU cache that holds up to the given number of values.
+//
+// The onEvict function is optional. If set, it's called when a value is evicted to make room for a new one,
+// but not when values are removed explicitly. It's called while the cache is locked, so it must not use the cache.
+func NewLRUCache[Key comparable, Value any](size int, onEvict func(Key, Value)) *LRUCache[Key, Value] {
+	if size <= 0 {
+		panic("LRU cache size must be positive")
+	}
+	return &LRUCache[Key, Value]{
+		size:    size,
+		order:   list.New(),
+		data:    make(map[Key]*list.Element, size),
+		onEvict: onEvict,
+	}
+}
+
+// Get gets a value from the cache and marks it as recently used.
+func (lru *LRUCache[Key, Value]) Get(key Key) (value Value, ok bool) {
+	lru.lock.Lock()
+	defer lru.lock.Unlock()
+	elem, ok := lru.data[key]
+	if !ok {
+		return
+	}
+	lru.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry[Key, Value]).value, true
+}
+
+// Put stores a value in the cache, evicting the least recently used value if the cache is full.
+func (lru *LRUCache[Key, Value]) Put(key Key, value Value) {
+	lru.lock.Lock()
+	defer lru.lock.Unlock()
+	if elem, ok := lru.data[key]; ok {
+		elem.Value.(*lruEntry[Key, Value]).value = value
+		lru.order.MoveToFront(elem)
+		return
+	}
+	lru.data[key] = lru.order.PushFront(&lruEntry[Key, Value]{key: key, value: value})
+	if lru.order.Len() > lru.size {
+		oldest := lru.order.Back()
+		lru.order.Remove(oldest)
+		entry := oldest.Value.(*lruEntry[Key, Value])
+		delete(lru.data, entry.key)
+		if lru.onEvict != nil {
+			lru.onEvict(entry.key, entry.value)
+		}
+	}
+}
+
+// Remove removes a value from the cache and returns it.
+func (lru *LRUCache[Key, Value]) Remove(key Key) (value Value, ok bool) {
+	lru.lock.Lock()
+	defer lru.lock.Unlock()
+	elem, ok := lru.data[key]
+	if !ok {
+		return
+	}
+	lru.order.Remove(elem)
+	delete(lru.data, key)
+	return elem.Value.(*lruEntry[Key, Value]).value, true
+}
+
+// Len returns the number of values in the cache.
+func (lru *LRUCache[Key, Value]) Len() int {
+	lru.lock.Lock()
+	defer lru.lock.Unlock()
+	return lru.order.Len()
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package util_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/util"
+)
+
+func TestLRUCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	var evicted []string
+	cache := util.NewLRUCache[string, int](2, func(key string, _ int) {
+		evicted = append(evicted, key)
+	})
+	cache.Put("a", 1)
+	cache.Put("b", 2)
+	_, ok := cache.Get("a")
+	assert.True(t, ok)
+	cache.Put("c", 3)
+	assert.Equal(t, []string{"b"}, evicted)
+	_, ok = cache.Get("b")
+	assert.False(t, ok)
+	val, ok := cache.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, val)
+	assert.Equal(t, 2, cache.Len())
+}
+
+func TestLRUCache_Remove(t *testing.T) {
+	cache := util.NewLRUCache[string, int](2, func(key string, _ int) {
+		t.Errorf("unexpected eviction of %s", key)
+	})
+	cache.Put("a", 1)
+	val, ok := cache.Remove("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, val)
+	_, ok = cache.Remove("a")
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.Len())
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package util
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+// DefaultCacheShards is the number of shards used by NewShardedCache if the given count is zero or negative.
+const DefaultCacheShards = 32
+
+type cacheEntry[Value any] struct {
+	ready chan struct{}
+	value Value
+	ok    bool
+}
+
+type cacheShard[Key comparable, Value any] struct {
+	data map[Key]*cacheEntry[Value]
+	lock sync.Mutex
+}
+
+// ShardedCache is a concurrent map split into shards that each have their own lock, meant for caches of
+// portals, ghosts and users in bridges. Unlike a map guarded by a single mutex, lookups of different keys
+// rarely wait for each other, and a slow database load of one key only blocks other lookups of the same key.
+type ShardedCache[Key comparable, Value any] struct {
+	shards []*cacheShard[Key, Value]
+	hash   func(Key) uint64
+}
+
+// NewShardedCache creates a new cache with the given number of shards, using the given function to pick
+// the shard for each key. StringHash can be used for string keys.
+func NewShardedCache[Key comparable, Value any](shardCount int, hash func(Key) uint64) *ShardedCache[Key, Value] {
+	if shardCount <= 0 {
+		shardCount = DefaultCacheShards
+	}
+	sc := &ShardedCache[Key, Value]{
+		shards: make([]*cacheShard[Key, Value], shardCount),
+		hash:   hash,
+	}
+	for i := range sc.shards {
+		sc.shards[i] = &cacheShard[Key, Value]{data: make(map[Key]*cacheEntry[Value])}
+	}
+	return sc
+}
+
+var stringHashSeed = maphash.MakeSeed()
+
+// StringHash is a hash function for string-based keys like user and room IDs to use with NewShardedCache.
+func StringHash[Key ~string](key Key) uint64 {
+	return maphash.String(stringHashSeed, string(key))
+}
+
+func (sc *ShardedCache[Key, Value]) shard(key Key) *cacheShard[Key, Value] {
+	return sc.shards[sc.hash(key)%uint64(len(sc.shards))]
+}
+
+// GetOrLoad gets a value from the cache, or loads it using the given function if it's not cached yet.
+//
+// If multiple goroutines request the same missing key at the same time, the load function is only called once
+// and the others wait for its result. If the load function returns false or panics, nothing is cached
+// and the waiting goroutines get a false result.
+func (sc *ShardedCache[Key, Value]) GetOrLoad(key Key, load func(Key) (Value, bool)) (Value, bool) {
+	shard := sc.shard(key)
+	shard.lock.Lock()
+	entry, exists := shard.data[key]
+	if exists {
+		shard.lock.Unlock()
+		<-entry.ready
+		return entry.value, entry.ok
+	}
+	entry = &cacheEntry[Value]{ready: make(chan struct{})}
+	shard.data[key] = entry
+	shard.lock.Unlock()
+	defer func() {
+		// This is deferred so that waiters are released and the key isn't left loading forever if load panics.
+		if !entry.ok {
+			shard.lock.Lock()
+			if shard.data[key] == entry {
+				delete(shard.data, key)
+			}
+			shard.lock.Unlock()
+		}
+		close(entry.ready)
+	}()
+	entry.value, entry.ok = load(key)
+	return entry.value, entry.ok
+}
+
+// Get gets a value from the cache. If the value is currently being loaded, this waits for the load to finish.
+func (sc *ShardedCache[Key, Value]) Get(key Key) (value Value, ok bool) {
+	shard := sc.shard(key)
+	shard.lock.Lock()
+	entry, exists := shard.data[key]
+	shard.lock.Unlock()
+	if !exists {
+		return
+	}
+	<-entry.ready
+	return entry.value, entry.ok
+}
+
+// Set stores a value in the cache, replacing any existing or loading value.
+func (sc *ShardedCache[Key, Value]) Set(key Key, value Value) {
+	entry := &cacheEntry[Value]{ready: make(chan struct{}), value: value, ok: true}
+	close(entry.ready)
+	shard := sc.shard(key)
+	shard.lock.Lock()
+	shard.data[key] = entry
+	shard.lock.Unlock()
+}
+
+// Delete removes a value from the cache.
+func (sc *ShardedCache[Key, Value]) Delete(key Key) {
+	shard := sc.shard(key)
+	shard.lock.Lock()
+	delete(shard.data, key)
+	shard.lock.Unlock()
+}
+
+// Values returns all loaded values in the cache. Values that are still being loaded are skipped.
+func (sc *ShardedCache[Key, Value]) Values() []Value {
+	var values []Value
+	for _, shard := range sc.shards {
+		shard.lock.Lock()
+		for _, entry := range shard.data {
+			select {
+			case <-entry.ready:
+				if entry.ok {
+					values = append(values, entry.value)
+				}
+			default:
+			}
+		}
+		shard.lock.Unlock()
+	}
+	return values
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package util_test
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/util"
+)
+
+func TestShardedCache_GetOrLoadOnce(t *testing.T) {
+	cache := util.NewShardedCache[string, int](4, util.StringHash[string])
+	var loads atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, ok := cache.GetOrLoad("meow", func(key string) (int, bool) {
+				loads.Add(1)
+				time.Sleep(10 * time.Millisecond)
+				return 5, true
+			})
+			assert.True(t, ok)
+			assert.Equal(t, 5, val)
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 1, loads.Load())
+}
+
+func TestShardedCache_FailedLoadNotCached(t *testing.T) {
+	cache := util.NewShardedCache[string, int](0, util.StringHash[string])
+	_, ok := cache.GetOrLoad("meow", func(key string) (int, bool) {
+		return 0, false
+	})
+	assert.False(t, ok)
+	_, ok = cache.Get("meow")
+	assert.False(t, ok)
+	cache.Set("meow", 3)
+	val, ok := cache.Get("meow")
+	assert.True(t, ok)
+	assert.Equal(t, 3, val)
+	assert.Equal(t, []int{3}, cache.Values())
+	cache.Delete("meow")
+	assert.Empty(t, cache.Values())
+}
+
+func TestShardedCache_PanickingLoad(t *testing.T) {
+	cache := util.NewShardedCache[string, int](0, util.StringHash[string])
+	started := make(chan struct{})
+	waiterDone := make(chan bool)
+	go func() {
+		<-started
+		_, ok := cache.Get("meow")
+		waiterDone <- ok
+	}()
+	assert.Panics(t, func() {
+		cache.GetOrLoad("meow", func(key string) (int, bool) {
+			close(started)
+			time.Sleep(10 * time.Millisecond)
+			panic("meow")
+		})
+	})
+	select {
+	case ok := <-waiterDone:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("Waiter wasn't released after load panicked")
+	}
+	val, ok := cache.GetOrLoad("meow", func(key string) (int, bool) {
+		return 7, true
+	})
+	assert.True(t, ok)
+	assert.Equal(t, 7, val)
+}
+
+func benchmarkKeys() []string {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "!room" + strconv.Itoa(i) + ":example.com"
+	}
+	return keys
+}
+
+func BenchmarkShardedCache_Parallel(b *testing.B) {
+	cache := util.NewShardedCache[string, int](0, util.StringHash[string])
+	keys := benchmarkKeys()
+	for i, key := range keys {
+		cache.Set(key, i)
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			cache.Get(keys[i%len(keys)])
+			i++
+		}
+	})
+}
+
+func BenchmarkSingleLockMap_Parallel(b *testing.B) {
+	var lock sync.Mutex
+	data := make(map[string]int)
+	keys := benchmarkKeys()
+	for i, key := range keys {
+		data[key] = i
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			lock.Lock()
+			_ = data[keys[i%len(keys)]]
+			lock.Unlock()
+			i++
+		}
+	})
+}